@@ -0,0 +1,150 @@
+package wireproxy
+
+import (
+	"strconv"
+
+	"github.com/go-ini/ini"
+)
+
+// ASecConfig is the exported form of ASecConfigType for APIs that exchange AWG
+// parameters as JSON. A nil field is a parameter that is not set. Magic headers
+// are a single value or a min-max range, as in the [Interface] section
+type ASecConfig struct {
+	Mode *int    `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Jc   *int    `json:"jc,omitempty" yaml:"jc,omitempty"`
+	Jmin *int    `json:"jmin,omitempty" yaml:"jmin,omitempty"`
+	Jmax *int    `json:"jmax,omitempty" yaml:"jmax,omitempty"`
+	S1   *int    `json:"s1,omitempty" yaml:"s1,omitempty"`
+	S2   *int    `json:"s2,omitempty" yaml:"s2,omitempty"`
+	S3   *int    `json:"s3,omitempty" yaml:"s3,omitempty"`
+	S4   *int    `json:"s4,omitempty" yaml:"s4,omitempty"`
+	H1   *string `json:"h1,omitempty" yaml:"h1,omitempty"`
+	H2   *string `json:"h2,omitempty" yaml:"h2,omitempty"`
+	H3   *string `json:"h3,omitempty" yaml:"h3,omitempty"`
+	H4   *string `json:"h4,omitempty" yaml:"h4,omitempty"`
+	I1   *string `json:"i1,omitempty" yaml:"i1,omitempty"`
+	I2   *string `json:"i2,omitempty" yaml:"i2,omitempty"`
+	I3   *string `json:"i3,omitempty" yaml:"i3,omitempty"`
+	I4   *string `json:"i4,omitempty" yaml:"i4,omitempty"`
+	I5   *string `json:"i5,omitempty" yaml:"i5,omitempty"`
+}
+
+// Export returns the parameters that are set, a nil configuration has none
+func (c *ASecConfigType) Export() ASecConfig {
+	var e ASecConfig
+	if c == nil {
+		return e
+	}
+
+	n := c.Normalize()
+	exportInt := func(isSet bool, value int) *int {
+		if !isSet {
+			return nil
+		}
+		return &value
+	}
+	exportHeader := func(isSet bool, minValue uint32, maxValue uint32) *string {
+		if !isSet {
+			return nil
+		}
+		value := formatMagicHeaderInterval(minValue, maxValue)
+		return &value
+	}
+
+	e.Mode = clonePtr(n.mode)
+	e.Jc = exportInt(n.hasJunkPacketCount, n.junkPacketCount)
+	e.Jmin = exportInt(n.hasJunkPacketMinSize, n.junkPacketMinSize)
+	e.Jmax = exportInt(n.hasJunkPacketMaxSize, n.junkPacketMaxSize)
+	e.S1 = exportInt(n.hasInitPacketJunkSize, n.initPacketJunkSize)
+	e.S2 = exportInt(n.hasResponsePacketJunkSize, n.responsePacketJunkSize)
+	e.S3 = exportInt(n.hasCookieReplyPacketJunkSize, n.cookieReplyPacketJunkSize)
+	e.S4 = exportInt(n.hasTransportPacketJunkSize, n.transportPacketJunkSize)
+	e.H1 = exportHeader(n.hasInitPacketMagicHeader, n.initPacketMagicHeader, n.initPacketMagicHeaderMax)
+	e.H2 = exportHeader(n.hasResponsePacketMagicHeader, n.responsePacketMagicHeader, n.responsePacketMagicHeaderMax)
+	e.H3 = exportHeader(n.hasUnderloadPacketMagicHeader, n.underloadPacketMagicHeader, n.underloadPacketMagicHeaderMax)
+	e.H4 = exportHeader(n.hasTransportPacketMagicHeader, n.transportPacketMagicHeader, n.transportPacketMagicHeaderMax)
+	e.I1 = clonePtr(n.i1)
+	e.I2 = clonePtr(n.i2)
+	e.I3 = clonePtr(n.i3)
+	e.I4 = clonePtr(n.i4)
+	e.I5 = clonePtr(n.i5)
+	return e
+}
+
+// ToInternal parses and validates the parameters like the [Interface] section,
+// it returns nil when none is set
+func (e ASecConfig) ToInternal() (*ASecConfigType, error) {
+	section, err := ini.Empty(configLoadOptions).NewSection("Interface")
+	if err != nil {
+		return nil, err
+	}
+
+	var keyErr error
+	addInt := func(key string, value *int) {
+		if value != nil && keyErr == nil {
+			_, keyErr = section.NewKey(key, strconv.Itoa(*value))
+		}
+	}
+	addString := func(key string, value *string) {
+		if value != nil && keyErr == nil {
+			_, keyErr = section.NewKey(key, *value)
+		}
+	}
+
+	addInt("Mode", e.Mode)
+	addInt("Jc", e.Jc)
+	addInt("Jmin", e.Jmin)
+	addInt("Jmax", e.Jmax)
+	addInt("S1", e.S1)
+	addInt("S2", e.S2)
+	addInt("S3", e.S3)
+	addInt("S4", e.S4)
+	addString("H1", e.H1)
+	addString("H2", e.H2)
+	addString("H3", e.H3)
+	addString("H4", e.H4)
+	addString("I1", e.I1)
+	addString("I2", e.I2)
+	addString("I3", e.I3)
+	addString("I4", e.I4)
+	addString("I5", e.I5)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	return ParseASecConfig(section)
+}
+
+// fields returns the parameters that are set in the order of ASecConfigType.fields
+func (e ASecConfig) fields() []awgField {
+	var fields []awgField
+	addInt := func(key string, value *int) {
+		if value != nil {
+			fields = append(fields, awgField{key: key, value: strconv.Itoa(*value)})
+		}
+	}
+	addString := func(key string, value *string) {
+		if value != nil {
+			fields = append(fields, awgField{key: key, value: *value})
+		}
+	}
+
+	addInt("Mode", e.Mode)
+	addInt("Jc", e.Jc)
+	addInt("Jmin", e.Jmin)
+	addInt("Jmax", e.Jmax)
+	addInt("S1", e.S1)
+	addInt("S2", e.S2)
+	addInt("S3", e.S3)
+	addInt("S4", e.S4)
+	addString("H1", e.H1)
+	addString("H2", e.H2)
+	addString("H3", e.H3)
+	addString("H4", e.H4)
+	addString("I1", e.I1)
+	addString("I2", e.I2)
+	addString("I3", e.I3)
+	addString("I4", e.I4)
+	addString("I5", e.I5)
+	return fields
+}
@@ -2,8 +2,11 @@ package wireproxy
 
 import (
 	"errors"
+	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/go-ini/ini"
 )
@@ -40,8 +43,16 @@ type ASecConfigType struct {
 	i3                            *string
 	i4                            *string
 	i5                            *string
+	mode                          *int // obfuscation mode, validated and kept by wireproxy but not sent to the device
+
+	// UseHexFormatInOutput writes magic header values above 0xFFFF in hex when the
+	// configuration is serialized. The IPC request always uses decimal values
+	UseHexFormatInOutput bool
 }
 
+// SupportedModes lists the values accepted by the Mode field
+var SupportedModes = []int{1, 2}
+
 func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 	var aSecConfig *ASecConfigType
 
@@ -130,7 +141,7 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 	}
 
 	if sectionKey, err := section.GetKey("H1"); err == nil {
-		minValue, maxValue, err := parseMagicHeaderInterval(sectionKey.String())
+		minValue, maxValue, err := ParseMagicHeaderIntervalString(sectionKey.String())
 		if err != nil {
 			return nil, err
 		}
@@ -143,7 +154,7 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 	}
 
 	if sectionKey, err := section.GetKey("H2"); err == nil {
-		minValue, maxValue, err := parseMagicHeaderInterval(sectionKey.String())
+		minValue, maxValue, err := ParseMagicHeaderIntervalString(sectionKey.String())
 		if err != nil {
 			return nil, err
 		}
@@ -156,7 +167,7 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 	}
 
 	if sectionKey, err := section.GetKey("H3"); err == nil {
-		minValue, maxValue, err := parseMagicHeaderInterval(sectionKey.String())
+		minValue, maxValue, err := ParseMagicHeaderIntervalString(sectionKey.String())
 		if err != nil {
 			return nil, err
 		}
@@ -169,7 +180,7 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 	}
 
 	if sectionKey, err := section.GetKey("H4"); err == nil {
-		minValue, maxValue, err := parseMagicHeaderInterval(sectionKey.String())
+		minValue, maxValue, err := ParseMagicHeaderIntervalString(sectionKey.String())
 		if err != nil {
 			return nil, err
 		}
@@ -181,8 +192,22 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 		aSecConfig.hasTransportPacketMagicHeader = true
 	}
 
+	if sectionKey, err := section.GetKey("Mode"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return nil, err
+		}
+		if aSecConfig == nil {
+			aSecConfig = &ASecConfigType{}
+		}
+		aSecConfig.mode = &value
+	}
+
 	if sectionKey, err := section.GetKey("I1"); err == nil {
 		value := sectionKey.String()
+		if !utf8.ValidString(value) {
+			return nil, errors.New("I1 contains invalid UTF-8 encoding")
+		}
 		if aSecConfig == nil {
 			aSecConfig = &ASecConfigType{}
 		}
@@ -191,6 +216,9 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 
 	if sectionKey, err := section.GetKey("I2"); err == nil {
 		value := sectionKey.String()
+		if !utf8.ValidString(value) {
+			return nil, errors.New("I2 contains invalid UTF-8 encoding")
+		}
 		if aSecConfig == nil {
 			aSecConfig = &ASecConfigType{}
 		}
@@ -199,6 +227,9 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 
 	if sectionKey, err := section.GetKey("I3"); err == nil {
 		value := sectionKey.String()
+		if !utf8.ValidString(value) {
+			return nil, errors.New("I3 contains invalid UTF-8 encoding")
+		}
 		if aSecConfig == nil {
 			aSecConfig = &ASecConfigType{}
 		}
@@ -207,6 +238,9 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 
 	if sectionKey, err := section.GetKey("I4"); err == nil {
 		value := sectionKey.String()
+		if !utf8.ValidString(value) {
+			return nil, errors.New("I4 contains invalid UTF-8 encoding")
+		}
 		if aSecConfig == nil {
 			aSecConfig = &ASecConfigType{}
 		}
@@ -215,6 +249,9 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 
 	if sectionKey, err := section.GetKey("I5"); err == nil {
 		value := sectionKey.String()
+		if !utf8.ValidString(value) {
+			return nil, errors.New("I5 contains invalid UTF-8 encoding")
+		}
 		if aSecConfig == nil {
 			aSecConfig = &ASecConfigType{}
 		}
@@ -224,23 +261,100 @@ func ParseASecConfig(section *ini.Section) (*ASecConfigType, error) {
 	if err := ValidateASecConfig(aSecConfig); err != nil {
 		return nil, err
 	}
+	for _, warning := range ASecConfigWarnings(aSecConfig) {
+		errorLogger.Printf("Warning: %s\n", warning)
+	}
 
 	return aSecConfig, nil
 }
 
+// maxIFieldLength is the longest I1-I5 value passed to the driver
+const maxIFieldLength = 4096
+
+// InvalidIFieldError is returned by ValidateASecConfig for an I1-I5 value longer than maxIFieldLength
+type InvalidIFieldError struct {
+	Field string
+	Len   int
+}
+
+func (e *InvalidIFieldError) Error() string {
+	return e.Field + " is " + strconv.Itoa(e.Len) + " bytes long, the limit is " + strconv.Itoa(maxIFieldLength)
+}
+
+// maxJunkSize is the largest S1-S4 value, the padding has to fit a UDP datagram
+const maxJunkSize = 65535
+
+// minJunkPacketCount and maxJunkPacketCount bound Jc, maxJunkPacketSize bounds Jmin and Jmax
+const (
+	minJunkPacketCount = 1
+	maxJunkPacketCount = 128
+	maxJunkPacketSize  = 1280
+)
+
+// InvalidSFieldError is returned by ValidateASecConfig for an S1-S4 value outside of 0 to maxJunkSize
+type InvalidSFieldError struct {
+	Field string
+	Value int
+}
+
+func (e *InvalidSFieldError) Error() string {
+	return "value of the " + e.Field + " field must be within the range of 0 to " + strconv.Itoa(maxJunkSize) + ", got " + strconv.Itoa(e.Value)
+}
+
 func ValidateASecConfig(config *ASecConfigType) error {
 	if config == nil {
 		return nil
 	}
-	if config.hasJunkPacketCount && (config.junkPacketCount < 1 || config.junkPacketCount > 128) {
-		return errors.New("value of the Jc field must be within the range of 1 to 128")
+	if config.mode != nil && !slices.Contains(SupportedModes, *config.mode) {
+		return errors.New("value of the Mode field is not supported")
+	}
+	for i, value := range []*string{config.i1, config.i2, config.i3, config.i4, config.i5} {
+		if value == nil {
+			continue
+		}
+		field := "I" + strconv.Itoa(i+1)
+		if len(*value) > maxIFieldLength {
+			return &InvalidIFieldError{Field: field, Len: len(*value)}
+		}
+		// the tags of the signature packets are plain text, anything else is a pasted binary blob
+		for j := 0; j < len(*value); j++ {
+			if c := (*value)[j]; c < 0x20 || c > 0x7e {
+				return errors.New(field + " contains a non-printable character at offset " + strconv.Itoa(j))
+			}
+		}
+	}
+	if config.hasJunkPacketCount && (config.junkPacketCount < minJunkPacketCount || config.junkPacketCount > maxJunkPacketCount) {
+		return errors.New("value of the Jc field must be within the range of " + strconv.Itoa(minJunkPacketCount) + " to " + strconv.Itoa(maxJunkPacketCount))
 	}
 	if config.hasJunkPacketMinSize && config.hasJunkPacketMaxSize &&
 		config.junkPacketMinSize > config.junkPacketMaxSize {
 		return errors.New("value of the Jmin field must be less than or equal to Jmax field value")
 	}
-	if config.hasJunkPacketMaxSize && config.junkPacketMaxSize > 1280 {
-		return errors.New("value of the Jmax field must be less than or equal 1280")
+	// the driver keeps 0 for the unset one of Jmin and Jmax, Jmin above it breaks junk packet sizing
+	if config.hasJunkPacketMinSize && !config.hasJunkPacketMaxSize && config.junkPacketMinSize > 0 {
+		return errors.New("value of the Jmin field must be less than or equal to Jmax field value, which is 0 when not set")
+	}
+	if config.hasJunkPacketMaxSize && !config.hasJunkPacketMinSize && config.junkPacketMaxSize < 0 {
+		return errors.New("value of the Jmax field must be greater than or equal to Jmin field value, which is 0 when not set")
+	}
+	if config.hasJunkPacketMaxSize && config.junkPacketMaxSize > maxJunkPacketSize {
+		return errors.New("value of the Jmax field must be less than or equal " + strconv.Itoa(maxJunkPacketSize))
+	}
+
+	junkSizes := []struct {
+		field string
+		isSet bool
+		value int
+	}{
+		{field: "S1", isSet: config.hasInitPacketJunkSize, value: config.initPacketJunkSize},
+		{field: "S2", isSet: config.hasResponsePacketJunkSize, value: config.responsePacketJunkSize},
+		{field: "S3", isSet: config.hasCookieReplyPacketJunkSize, value: config.cookieReplyPacketJunkSize},
+		{field: "S4", isSet: config.hasTransportPacketJunkSize, value: config.transportPacketJunkSize},
+	}
+	for _, junk := range junkSizes {
+		if junk.isSet && (junk.value < 0 || junk.value > maxJunkSize) {
+			return &InvalidSFieldError{Field: junk.field, Value: junk.value}
+		}
 	}
 
 	const messageInitiationSize = 148
@@ -289,10 +403,119 @@ func ValidateASecConfig(config *ASecConfigType) error {
 	if hasOverlappingHeaderIntervals(intervals) {
 		return errors.New("values of the H1-H4 fields must be unique")
 	}
+	// message types 0 and 5 are reserved by the protocol, the driver misclassifies packets using them
+	for _, interval := range intervals {
+		for _, reserved := range []uint32{0, 5} {
+			if interval.min <= reserved && reserved <= interval.max {
+				return errors.New(strings.ToUpper(interval.key) + " range " + formatMagicHeaderInterval(interval.min, interval.max) +
+					" includes reserved value " + strconv.FormatUint(uint64(reserved), 10))
+			}
+		}
+	}
 
 	return nil
 }
 
+// ValidationOptions controls the checks of ValidateASecConfigStrict
+type ValidationOptions struct {
+	// StrictMode rejects partial parameter sets: H1-H4 must be set together, and so must S1 and S2
+	StrictMode bool
+}
+
+// ValidateASecConfigStrict runs ValidateASecConfig and, in strict mode, also rejects
+// partial parameter sets that the driver would otherwise accept with confusing results
+func ValidateASecConfigStrict(config *ASecConfigType, opts ValidationOptions) error {
+	if err := ValidateASecConfig(config); err != nil {
+		return err
+	}
+	if config == nil || !opts.StrictMode {
+		return nil
+	}
+
+	headers := []bool{
+		config.hasInitPacketMagicHeader,
+		config.hasResponsePacketMagicHeader,
+		config.hasUnderloadPacketMagicHeader,
+		config.hasTransportPacketMagicHeader,
+	}
+	if slices.Contains(headers, true) && slices.Contains(headers, false) {
+		return errors.New("all of the H1-H4 fields must be set together")
+	}
+	if config.hasInitPacketJunkSize != config.hasResponsePacketJunkSize {
+		return errors.New("the S1 and S2 fields must be set together")
+	}
+	return nil
+}
+
+// ASecConfigWarnings reports settings that are valid but likely mistakes.
+// Unlike ValidateASecConfig, these never prevent the configuration from loading
+func ASecConfigWarnings(config *ASecConfigType) []string {
+	if config == nil {
+		return nil
+	}
+
+	var warnings []string
+	if config.hasInitPacketJunkSize && config.hasResponsePacketJunkSize &&
+		config.initPacketJunkSize != 0 && config.initPacketJunkSize == config.responsePacketJunkSize {
+		warnings = append(warnings, "S1 and S2 have the same value, consider choosing distinct junk sizes for init and response packets")
+	}
+
+	// the standard WireGuard message types are 1 to 4, such headers are not obfuscated
+	headers := []struct {
+		isSet    bool
+		key      string
+		min, max uint32
+	}{
+		{config.hasInitPacketMagicHeader, "H1", config.initPacketMagicHeader, config.initPacketMagicHeaderMax},
+		{config.hasResponsePacketMagicHeader, "H2", config.responsePacketMagicHeader, config.responsePacketMagicHeaderMax},
+		{config.hasUnderloadPacketMagicHeader, "H3", config.underloadPacketMagicHeader, config.underloadPacketMagicHeaderMax},
+		{config.hasTransportPacketMagicHeader, "H4", config.transportPacketMagicHeader, config.transportPacketMagicHeaderMax},
+	}
+	for _, header := range headers {
+		if header.isSet && header.min <= defaultTransportPacketMagicHeader && max(header.min, header.max) >= defaultInitPacketMagicHeader {
+			warnings = append(warnings, header.key+" matches a standard WireGuard message type, choose values outside of 1-4 for meaningful obfuscation")
+		}
+	}
+
+	return warnings
+}
+
+// ASecPeerWarnings reports AWG settings that are likely unnecessary for the given peers:
+// junk packets only help against inspection on an internet path, not towards
+// loopback or private network endpoints
+func ASecPeerWarnings(config *ASecConfigType, peers []PeerConfig) []string {
+	if config == nil || !config.hasJunkParameters() {
+		return nil
+	}
+
+	local := 0
+	for _, peer := range peers {
+		if peer.Endpoint == nil {
+			continue
+		}
+		addrPort, err := netip.ParseAddrPort(*peer.Endpoint)
+		if err != nil {
+			return nil
+		}
+		addr := addrPort.Addr().Unmap()
+		if !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsLinkLocalUnicast() {
+			return nil
+		}
+		local++
+	}
+	if local == 0 {
+		return nil
+	}
+	return []string{"AWG junk parameters are set but all peer endpoints are loopback or private network addresses, obfuscation may be unnecessary"}
+}
+
+// hasJunkParameters reports whether any of the Jc, Jmin, Jmax and S1-S4 fields is set
+func (c *ASecConfigType) hasJunkParameters() bool {
+	return c.hasJunkPacketCount || c.hasJunkPacketMinSize || c.hasJunkPacketMaxSize ||
+		c.hasInitPacketJunkSize || c.hasResponsePacketJunkSize ||
+		c.hasCookieReplyPacketJunkSize || c.hasTransportPacketJunkSize
+}
+
 type headerInterval struct {
 	key string
 	min uint32
@@ -306,22 +529,28 @@ const (
 	defaultTransportPacketMagicHeader uint32 = 4
 )
 
-func parseMagicHeaderInterval(value string) (uint32, uint32, error) {
+// ParseMagicHeaderIntervalString parses an H1-H4 value, a single number or a range N-M,
+// with decimal or 0x prefixed hex bounds. It is the inverse of formatMagicHeaderInterval
+func ParseMagicHeaderIntervalString(value string) (minValue, maxValue uint32, err error) {
 	trimmed := strings.TrimSpace(value)
 	if trimmed == "" {
 		return 0, 0, errors.New("empty magic header value")
 	}
+	if trimmed == "*" {
+		// amneziawg-go only accepts N or N-M and rejects overlapping header ranges,
+		// so a header drawn from the whole uint32 range cannot be configured
+		return 0, 0, errors.New("wildcard magic header is not supported, use a range such as 100000-200000")
+	}
 
 	parts := strings.Split(trimmed, "-")
 	if len(parts) == 0 || len(parts) > 2 || parts[0] == "" {
 		return 0, 0, errors.New("invalid magic header range format")
 	}
 
-	minRaw, err := strconv.ParseUint(parts[0], 10, 32)
+	minValue, err = parseMagicHeaderValue(parts[0])
 	if err != nil {
 		return 0, 0, err
 	}
-	minValue := uint32(minRaw)
 
 	if len(parts) == 1 {
 		return minValue, minValue, nil
@@ -330,11 +559,10 @@ func parseMagicHeaderInterval(value string) (uint32, uint32, error) {
 		return 0, 0, errors.New("invalid magic header range format")
 	}
 
-	maxRaw, err := strconv.ParseUint(parts[1], 10, 32)
+	maxValue, err = parseMagicHeaderValue(parts[1])
 	if err != nil {
 		return 0, 0, err
 	}
-	maxValue := uint32(maxRaw)
 	if minValue > maxValue {
 		return 0, 0, errors.New("invalid magic header range: lower bound cannot exceed upper bound")
 	}
@@ -342,6 +570,40 @@ func parseMagicHeaderInterval(value string) (uint32, uint32, error) {
 	return minValue, maxValue, nil
 }
 
+// maxMagicHeaderDigits is the number of digits of math.MaxUint32
+const maxMagicHeaderDigits = 10
+
+var errMagicHeaderOutOfRange = errors.New("magic header value out of uint32 range")
+
+// maxMagicHeaderHexDigits is the number of hex digits of math.MaxUint32
+const maxMagicHeaderHexDigits = 8
+
+func parseMagicHeaderValue(value string) (uint32, error) {
+	if digits, ok := strings.CutPrefix(strings.ToLower(value), "0x"); ok {
+		if len(digits) > maxMagicHeaderHexDigits {
+			return 0, errMagicHeaderOutOfRange
+		}
+		raw, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(raw), nil
+	}
+
+	if len(value) > maxMagicHeaderDigits {
+		return 0, errMagicHeaderOutOfRange
+	}
+
+	raw, err := strconv.ParseUint(value, 10, 32)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, errMagicHeaderOutOfRange
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint32(raw), nil
+}
+
 func collectEffectiveHeaderIntervals(config *ASecConfigType) []headerInterval {
 	intervals := make([]headerInterval, 0, 4)
 
@@ -391,3 +653,163 @@ func formatMagicHeaderInterval(minValue uint32, maxValue uint32) string {
 	}
 	return strconv.FormatUint(uint64(minValue), 10) + "-" + strconv.FormatUint(uint64(maxValue), 10)
 }
+
+// formatMagicHeaderIntervalHex is like formatMagicHeaderInterval but writes values
+// above 0xFFFF in hex with a 0x prefix, e.g. 0xdeadbeef-0xdeadbef0
+func formatMagicHeaderIntervalHex(minValue uint32, maxValue uint32) string {
+	format := func(value uint32) string {
+		if value > 0xFFFF {
+			return "0x" + strconv.FormatUint(uint64(value), 16)
+		}
+		return strconv.FormatUint(uint64(value), 10)
+	}
+	if minValue == maxValue {
+		return format(minValue)
+	}
+	return format(minValue) + "-" + format(maxValue)
+}
+
+// Normalize returns a copy of the configuration in canonical form, so configurations
+// with the same effective values compare equal and serialize identically.
+// Values of unset fields are zeroed and a header range whose upper bound is below
+// its lower bound is collapsed to the single lower value
+func (c *ASecConfigType) Normalize() *ASecConfigType {
+	if c == nil {
+		return nil
+	}
+
+	n := *c.Clone()
+	normalizeInt := func(isSet bool, value *int) {
+		if !isSet {
+			*value = 0
+		}
+	}
+	normalizeHeader := func(isSet bool, minValue *uint32, maxValue *uint32) {
+		if !isSet {
+			*minValue, *maxValue = 0, 0
+		} else if *maxValue < *minValue {
+			*maxValue = *minValue
+		}
+	}
+	normalizeInt(n.hasJunkPacketCount, &n.junkPacketCount)
+	normalizeInt(n.hasJunkPacketMinSize, &n.junkPacketMinSize)
+	normalizeInt(n.hasJunkPacketMaxSize, &n.junkPacketMaxSize)
+	normalizeInt(n.hasInitPacketJunkSize, &n.initPacketJunkSize)
+	normalizeInt(n.hasResponsePacketJunkSize, &n.responsePacketJunkSize)
+	normalizeInt(n.hasCookieReplyPacketJunkSize, &n.cookieReplyPacketJunkSize)
+	normalizeInt(n.hasTransportPacketJunkSize, &n.transportPacketJunkSize)
+	normalizeHeader(n.hasInitPacketMagicHeader, &n.initPacketMagicHeader, &n.initPacketMagicHeaderMax)
+	normalizeHeader(n.hasResponsePacketMagicHeader, &n.responsePacketMagicHeader, &n.responsePacketMagicHeaderMax)
+	normalizeHeader(n.hasUnderloadPacketMagicHeader, &n.underloadPacketMagicHeader, &n.underloadPacketMagicHeaderMax)
+	normalizeHeader(n.hasTransportPacketMagicHeader, &n.transportPacketMagicHeader, &n.transportPacketMagicHeaderMax)
+
+	return &n
+}
+
+// Clone returns a deep copy of the configuration, nil for a nil configuration
+func (c *ASecConfigType) Clone() *ASecConfigType {
+	if c == nil {
+		return nil
+	}
+
+	n := *c
+	n.i1 = clonePtr(c.i1)
+	n.i2 = clonePtr(c.i2)
+	n.i3 = clonePtr(c.i3)
+	n.i4 = clonePtr(c.i4)
+	n.i5 = clonePtr(c.i5)
+	n.mode = clonePtr(c.mode)
+	return &n
+}
+
+// clonePtr returns a pointer to a copy of *value, nil for nil
+func clonePtr[T any](value *T) *T {
+	if value == nil {
+		return nil
+	}
+	v := *value
+	return &v
+}
+
+// awgField is a single AWG parameter named as in the [Interface] section
+type awgField struct {
+	key   string
+	value string
+}
+
+// uapi reports whether the parameter is sent to the device through the IPC protocol.
+// Mode is only validated and kept by wireproxy, amneziawg-go rejects it as an unknown key
+func (f awgField) uapi() bool {
+	return f.key != "Mode"
+}
+
+// awgDeviceDefaults are the values amneziawg-go starts with for the parameters that can be
+// reset through the IPC protocol. Jc, Jmin and Jmax only accept positive values and an
+// empty I1-I5 is not the same as none, so these cannot be reset on a running device
+var awgDeviceDefaults = map[string]string{
+	"S1": "0", "S2": "0", "S3": "0", "S4": "0",
+	"H1": "1", "H2": "2", "H3": "3", "H4": "4",
+}
+
+// setFields returns the normalized fields of the configuration, nil for a nil configuration
+func (c *ASecConfigType) setFields() []awgField {
+	if c == nil {
+		return nil
+	}
+	return c.Normalize().fields()
+}
+
+// fields returns the AWG parameters that are set, in IPC order
+func (c *ASecConfigType) fields() []awgField {
+	return c.formatFields(formatMagicHeaderInterval)
+}
+
+// outputFields returns the fields as written to a configuration file,
+// honouring UseHexFormatInOutput
+func (c *ASecConfigType) outputFields() []awgField {
+	if c.UseHexFormatInOutput {
+		return c.formatFields(formatMagicHeaderIntervalHex)
+	}
+	return c.fields()
+}
+
+func (c *ASecConfigType) formatFields(formatHeader func(uint32, uint32) string) []awgField {
+	var fields []awgField
+	addInt := func(isSet bool, key string, value int) {
+		if isSet {
+			fields = append(fields, awgField{key: key, value: strconv.Itoa(value)})
+		}
+	}
+	addHeader := func(isSet bool, key string, minValue uint32, maxValue uint32) {
+		if isSet {
+			fields = append(fields, awgField{key: key, value: formatHeader(minValue, maxValue)})
+		}
+	}
+	addString := func(key string, value *string) {
+		if value != nil {
+			fields = append(fields, awgField{key: key, value: *value})
+		}
+	}
+
+	if c.mode != nil {
+		addInt(true, "Mode", *c.mode)
+	}
+	addInt(c.hasJunkPacketCount, "Jc", c.junkPacketCount)
+	addInt(c.hasJunkPacketMinSize, "Jmin", c.junkPacketMinSize)
+	addInt(c.hasJunkPacketMaxSize, "Jmax", c.junkPacketMaxSize)
+	addInt(c.hasInitPacketJunkSize, "S1", c.initPacketJunkSize)
+	addInt(c.hasResponsePacketJunkSize, "S2", c.responsePacketJunkSize)
+	addInt(c.hasCookieReplyPacketJunkSize, "S3", c.cookieReplyPacketJunkSize)
+	addInt(c.hasTransportPacketJunkSize, "S4", c.transportPacketJunkSize)
+	addHeader(c.hasInitPacketMagicHeader, "H1", c.initPacketMagicHeader, c.initPacketMagicHeaderMax)
+	addHeader(c.hasResponsePacketMagicHeader, "H2", c.responsePacketMagicHeader, c.responsePacketMagicHeaderMax)
+	addHeader(c.hasUnderloadPacketMagicHeader, "H3", c.underloadPacketMagicHeader, c.underloadPacketMagicHeaderMax)
+	addHeader(c.hasTransportPacketMagicHeader, "H4", c.transportPacketMagicHeader, c.transportPacketMagicHeaderMax)
+	addString("I1", c.i1)
+	addString("I2", c.i2)
+	addString("I3", c.i3)
+	addString("I4", c.i4)
+	addString("I5", c.i5)
+
+	return fields
+}
@@ -0,0 +1,76 @@
+package wireproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// amneziaFlagKeys are the keys accepted in the --amnezia-config format, the lower case AWG field names
+var amneziaFlagKeys = []string{"mode", "jc", "jmin", "jmax", "s1", "s2", "s3", "s4", "h1", "h2", "h3", "h4", "i1", "i2", "i3", "i4", "i5"}
+
+// ToAmneziaFlagString returns the AWG parameters that are set as the JSON object accepted
+// by the --amnezia-config flag, e.g. {"jc":5,"jmin":10,"jmax":50,"h1":1}.
+// Magic header ranges and signature packets are written as strings, other values as numbers
+func (c *ASecConfigType) ToAmneziaFlagString() string {
+	var buf bytes.Buffer
+	// signature packets use <tag> syntax, which must not be escaped
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	writeString := func(value string) {
+		_ = encoder.Encode(value)
+		buf.Truncate(buf.Len() - 1) // Encode appends a newline
+	}
+
+	buf.WriteByte('{')
+	for i, field := range c.setFields() {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeString(strings.ToLower(field.key))
+		buf.WriteByte(':')
+		if field.key[0] == 'I' || strings.Contains(field.value, "-") {
+			writeString(field.value)
+		} else {
+			buf.WriteString(field.value)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// ParseAmneziaFlagString parses the --amnezia-config format written by ToAmneziaFlagString.
+// The values go through the same parsing and validation as the [Interface] section
+func ParseAmneziaFlagString(value string) (*ASecConfigType, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return nil, err
+	}
+
+	section, err := ini.Empty(configLoadOptions).NewSection("Interface")
+	if err != nil {
+		return nil, err
+	}
+	for key, raw := range fields {
+		key = strings.ToLower(key)
+		if !slices.Contains(amneziaFlagKeys, key) {
+			return nil, errors.New("unknown AWG parameter " + key)
+		}
+
+		fieldValue := string(raw)
+		if strings.HasPrefix(fieldValue, `"`) {
+			if err := json.Unmarshal(raw, &fieldValue); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := section.NewKey(key, fieldValue); err != nil {
+			return nil, err
+		}
+	}
+
+	return ParseASecConfig(section)
+}
@@ -0,0 +1,105 @@
+package wireproxy
+
+import (
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"strconv"
+
+	"github.com/invopop/jsonschema"
+)
+
+//go:generate go run ./cmd/schema-gen -o schema/device_config.json
+
+// schemaVersion is the JSON Schema draft of the generated schemas, draft-07 is the one
+// most config editors and validators support
+const schemaVersion = "http://json-schema.org/draft-07/schema#"
+
+// magicHeaderPattern matches a magic header value or range, in decimal or 0x prefixed hex
+const magicHeaderPattern = `^([0-9]+|0[xX][0-9a-fA-F]+)(-([0-9]+|0[xX][0-9a-fA-F]+))?$`
+
+// JSONSchema describes the AWG parameters of the [Interface] section and the
+// constraints ValidateASecConfig enforces on them, for config editors and validators.
+// Properties are named like the JSON of ASecConfig, the exported form of the parameters.
+// Jmin must not exceed Jmax, which a plain JSON schema cannot express
+func (ASecConfigType) JSONSchema() *jsonschema.Schema {
+	integer := func(description string, minValue, maxValue int) *jsonschema.Schema {
+		schema := &jsonschema.Schema{
+			Type:        "integer",
+			Description: description,
+			Minimum:     json.Number(strconv.Itoa(minValue)),
+		}
+		if maxValue > 0 {
+			schema.Maximum = json.Number(strconv.Itoa(maxValue))
+		}
+		return schema
+	}
+	header := func(description string) *jsonschema.Schema {
+		return &jsonschema.Schema{Type: "string", Description: description, Pattern: magicHeaderPattern}
+	}
+	signature := func(description string) *jsonschema.Schema {
+		return &jsonschema.Schema{Type: "string", Description: description}
+	}
+
+	modes := make([]any, 0, len(SupportedModes))
+	for _, mode := range SupportedModes {
+		modes = append(modes, mode)
+	}
+
+	properties := jsonschema.NewProperties()
+	properties.Set("mode", &jsonschema.Schema{Type: "integer", Description: "Obfuscation mode", Enum: modes})
+	properties.Set("jc", integer("Junk packet count", minJunkPacketCount, maxJunkPacketCount))
+	properties.Set("jmin", integer("Minimum junk packet size, at most Jmax", 0, maxJunkPacketSize))
+	properties.Set("jmax", integer("Maximum junk packet size", 0, maxJunkPacketSize))
+	properties.Set("s1", integer("Init packet junk size", 0, maxJunkSize))
+	properties.Set("s2", integer("Response packet junk size", 0, maxJunkSize))
+	properties.Set("s3", integer("Cookie reply packet junk size", 0, maxJunkSize))
+	properties.Set("s4", integer("Transport packet junk size", 0, maxJunkSize))
+	properties.Set("h1", header("Init packet magic header"))
+	properties.Set("h2", header("Response packet magic header"))
+	properties.Set("h3", header("Underload packet magic header"))
+	properties.Set("h4", header("Transport packet magic header"))
+	properties.Set("i1", signature("Signature packet 1"))
+	properties.Set("i2", signature("Signature packet 2"))
+	properties.Set("i3", signature("Signature packet 3"))
+	properties.Set("i4", signature("Signature packet 4"))
+	properties.Set("i5", signature("Signature packet 5"))
+
+	return &jsonschema.Schema{
+		Version:              schemaVersion,
+		Title:                "AmneziaWG parameters",
+		Type:                 "object",
+		Properties:           properties,
+		AdditionalProperties: jsonschema.FalseSchema,
+	}
+}
+
+// DeviceConfigJSONSchema describes DeviceConfig, with the AWG parameters of JSONSchema
+// as a definition. Constraints come from the jsonschema tags of the fields,
+// schema/device_config.json is generated from it with go generate
+func DeviceConfigJSONSchema() *jsonschema.Schema {
+	reflector := &jsonschema.Reflector{
+		Anonymous:                  true,
+		RequiredFromJSONSchemaTags: true,
+		Mapper: func(t reflect.Type) *jsonschema.Schema {
+			switch t {
+			case reflect.TypeOf(netip.Addr{}):
+				return &jsonschema.Schema{
+					Type:  "string",
+					AnyOf: []*jsonschema.Schema{{Format: "ipv4"}, {Format: "ipv6"}},
+				}
+			case reflect.TypeOf(netip.Prefix{}):
+				return &jsonschema.Schema{Type: "string", Description: "Address prefix in CIDR notation"}
+			}
+			return nil
+		},
+	}
+	schema := reflector.Reflect(&DeviceConfig{})
+	// The AWG schema is a definition here, only the root declares the version
+	if aSec, ok := schema.Definitions["ASecConfigType"]; ok {
+		aSec.Version = ""
+	}
+	schema.Version = schemaVersion
+	schema.Title = "wireproxy device configuration"
+	return schema
+}
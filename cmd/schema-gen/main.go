@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/akamensky/argparse"
+	wireproxyawg "github.com/artem-russkikh/wireproxy-awg"
+)
+
+// schema-gen writes the JSON schema of the device configuration, see go:generate in awg_schema.go
+func main() {
+	parser := argparse.NewParser("schema-gen", "Generate the JSON schema of the wireproxy device configuration")
+	output := parser.String("o", "output", &argparse.Options{Help: "Path of the schema file", Default: "schema/device_config.json"})
+	if err := parser.Parse(os.Args); err != nil {
+		log.Fatal(parser.Usage(err))
+	}
+
+	data, err := json.MarshalIndent(wireproxyawg.DeviceConfigJSONSchema(), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*output), 0o755); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*output, append(data, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -245,6 +245,13 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// PostUp and PostDown would run once wireproxy is locked down, without exec rights.
+	// Exported configurations often carry them, so they are skipped rather than refused
+	if len(conf.Device.PostUp) > 0 || len(conf.Device.PostDown) > 0 {
+		log.Println("Warning: PostUp and PostDown are skipped, wireproxy is sandboxed and cannot run commands")
+		conf.Device.PostUp, conf.Device.PostDown = nil, nil
+	}
+
 	if *configTest {
 		fmt.Println("Config OK")
 		return
@@ -300,7 +307,7 @@ func main() {
 
 	lock("ready")
 
-	tun, err := wireproxyawg.StartWireguard(conf.Device, logLevel)
+	tun, err := wireproxyawg.StartWireguard(ctx, conf.Device, logLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -321,4 +328,7 @@ func main() {
 	}
 
 	<-ctx.Done()
+	if err := tun.Wait(); err != nil {
+		log.Printf("failed to bring the wireguard device down: %s\n", err)
+	}
 }
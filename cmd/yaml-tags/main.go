@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/akamensky/argparse"
+)
+
+// yamlStructs are the structs whose fields get a yaml tag
+var yamlStructs = map[string]bool{"DeviceConfig": true, "PeerConfig": true, "ASecConfig": true}
+
+// iniKeys maps the fields whose INI key is not the field name
+var iniKeys = map[string]string{
+	"DeviceConfig.SecretKey":  "PrivateKey",
+	"PeerConfig.KeepAlive":    "PersistentKeepalive",
+	"DeviceConfig.RouteTable": "Table",
+}
+
+// skipped are the fields without a key of their own: values derived from other keys,
+// INI comments, and the fields DeviceConfig.UnmarshalYAML reads with the INI parsers
+var skipped = map[string]bool{
+	"DeviceConfig.Endpoint":         true,
+	"DeviceConfig.DynamicAddress":   true,
+	"DeviceConfig.DNS":              true,
+	"DeviceConfig.DNSSearchDomains": true,
+	"DeviceConfig.ASecConfig":       true,
+	"DeviceConfig.Comments":         true,
+	"PeerConfig.EndpointHost":       true,
+	"PeerConfig.Comments":           true,
+}
+
+// yaml-tags sets the yaml tags of the configuration structs, see go:generate in config_yaml.go.
+// A field is named after its INI key in lower case, or its json tag when it has one, and
+// is omitempty unless jsonschema marks it required. Fields hidden from the JSON schema
+// and the ones of skipped are left out
+func main() {
+	parser := argparse.NewParser("yaml-tags", "Set the yaml tags of the wireproxy configuration structs")
+	files := parser.StringList("f", "file", &argparse.Options{Required: true, Help: "Go file to rewrite, may be repeated"})
+	if err := parser.Parse(os.Args); err != nil {
+		log.Fatal(parser.Usage(err))
+	}
+
+	for _, path := range *files {
+		if err := rewrite(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func rewrite(path string) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, nil, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+
+	ast.Inspect(file, func(node ast.Node) bool {
+		spec, ok := node.(*ast.TypeSpec)
+		if !ok || !yamlStructs[spec.Name.Name] {
+			return true
+		}
+		structType, ok := spec.Type.(*ast.StructType)
+		if !ok {
+			return false
+		}
+		for _, field := range structType.Fields.List {
+			for _, name := range field.Names {
+				if !name.IsExported() {
+					continue
+				}
+				tag := yamlTag(field.Tag, spec.Name.Name+"."+name.Name, name.Name)
+				if field.Tag == nil {
+					field.Tag = &ast.BasicLit{ValuePos: field.Type.End(), Kind: token.STRING}
+				}
+				field.Tag.Value = tag
+			}
+		}
+		return false
+	})
+
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, file); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0o644)
+}
+
+// yamlTag returns the literal of tag with its yaml key replaced by the one of field
+func yamlTag(tag *ast.BasicLit, field string, name string) string {
+	var value string
+	if tag != nil {
+		value, _ = strconv.Unquote(tag.Value)
+	}
+	structTag := reflect.StructTag(value)
+
+	yamlValue := strings.ToLower(name)
+	if key, ok := iniKeys[field]; ok {
+		yamlValue = strings.ToLower(key)
+	}
+	if jsonName, _, _ := strings.Cut(structTag.Get("json"), ","); jsonName != "" {
+		yamlValue = jsonName
+	}
+	if !strings.Contains(structTag.Get("jsonschema"), "required") {
+		yamlValue += ",omitempty"
+	}
+	if skipped[field] || structTag.Get("jsonschema") == "-" {
+		yamlValue = "-"
+	}
+
+	var parts []string
+	for _, part := range splitTag(value) {
+		if !strings.HasPrefix(part, "yaml:") {
+			parts = append(parts, part)
+		}
+	}
+	parts = append(parts, "yaml:"+strconv.Quote(yamlValue))
+	return "`" + strings.Join(parts, " ") + "`"
+}
+
+// splitTag splits a struct tag into its key:"value" pairs
+func splitTag(tag string) []string {
+	var parts []string
+	for tag = strings.TrimSpace(tag); tag != ""; tag = strings.TrimSpace(tag) {
+		colon := strings.Index(tag, ":\"")
+		if colon < 0 {
+			break
+		}
+		end := colon + 2
+		for end < len(tag) && tag[end] != '"' {
+			if tag[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(tag) {
+			break
+		}
+		parts = append(parts, tag[:end+1])
+		tag = tag[end+1:]
+	}
+	return parts
+}
@@ -1,12 +1,18 @@
 package wireproxy
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"io"
 	"net"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-ini/ini"
 
@@ -14,24 +20,53 @@ import (
 )
 
 type PeerConfig struct {
-	PublicKey    string
-	PreSharedKey string
-	Endpoint     *string
-	KeepAlive    int
-	AllowedIPs   []netip.Prefix
+	PublicKey    string              `jsonschema:"required" yaml:"publickey"`
+	PreSharedKey string              `yaml:"presharedkey,omitempty"`
+	Endpoint     *string             `yaml:"endpoint,omitempty"`
+	EndpointHost string              `yaml:"-"` // host:port as configured when the endpoint is a hostname, Endpoint is its resolved address
+	KeepAlive    int                 `jsonschema:"minimum=0,maximum=65535" yaml:"persistentkeepalive,omitempty"`
+	AllowedIPs   []netip.Prefix      `yaml:"allowedips,omitempty"`
+	Comments     map[string][]string `yaml:"-"` // comment lines of the [Peer] section by "peer" or "peer.<key>", lower case
+}
+
+// zeroKey is the hex encoded all-zero key WireGuard uses for an unset preshared key
+const zeroKey = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// hasPresharedKey reports whether a preshared key other than the all-zero key is set
+func (p PeerConfig) hasPresharedKey() bool {
+	return p.PreSharedKey != "" && p.PreSharedKey != zeroKey
 }
 
 // DeviceConfig contains the information to initiate a wireguard connection
 type DeviceConfig struct {
-	SecretKey          string
-	Endpoint           []netip.Addr
-	Peers              []PeerConfig
-	DNS                []netip.Addr
-	MTU                int
-	ListenPort         *int
-	CheckAlive         []netip.Addr
-	CheckAliveInterval int
-	ASecConfig         *ASecConfigType
+	SecretKey          string              `jsonschema:"required" yaml:"privatekey"`
+	Endpoint           []netip.Addr        `yaml:"-"`
+	DynamicAddress     bool                `yaml:"-"` // Address lists 0.0.0.0/0, see dynamic_address.go
+	Peers              []PeerConfig        `yaml:"peers,omitempty"`
+	DNS                []netip.Addr        `yaml:"-"`
+	DNSSearchDomains   []string            `yaml:"-"` // non-IP entries of DNS, see wg-quick(8)
+	MTU                int                 `jsonschema:"minimum=0" yaml:"mtu,omitempty"`
+	ListenPort         *int                `jsonschema:"minimum=0,maximum=65535" yaml:"listenport,omitempty"`
+	RouteTable         *RouteTableMode     `yaml:"table,omitempty"` // Table of wg-quick, or RoutingTable, only kept for compatibility
+	CheckAlive         []netip.Addr        `yaml:"checkalive,omitempty"`
+	CheckAliveInterval int                 `yaml:"checkaliveinterval,omitempty"`
+	ASecConfig         *ASecConfigType     `yaml:"-"`
+	Comments           map[string][]string `yaml:"-"`                  // comment lines of the [Interface] section by "interface" or "interface.<key>", lower case
+	PostUp             []string            `yaml:"postup,omitempty"`   // commands run after the device is up, see RunHooks
+	PostDown           []string            `yaml:"postdown,omitempty"` // commands run after the device is brought down on shutdown
+	// UpstreamSOCKS5 is the host:port of a SOCKS5 proxy the packets to the peers are relayed
+	// through with UDP ASSOCIATE, they are sent directly when it is empty
+	UpstreamSOCKS5     string       `yaml:"upstreamsocks5,omitempty"`
+	UpstreamSOCKS5Auth *Credentials `yaml:"upstreamsocks5auth,omitempty"` // user name and password of UpstreamSOCKS5, nil when it needs none
+	// PeerEndpointResolver resolves the hostname endpoints of the peers, e.g. with a split-DNS server.
+	// When nil, endpoints are resolved with net.DefaultResolver
+	PeerEndpointResolver *net.Resolver `jsonschema:"-" yaml:"-"`
+	// EnableHooks runs PostUp and PostDown, off by default as they are arbitrary commands
+	// coming from the configuration. Never set from the configuration itself
+	EnableHooks bool `jsonschema:"-" yaml:"-"`
+	// InterfaceName replaces %i in the hooks, "wireproxy" when empty. wireproxy has no OS
+	// interface, wg-quick(8) uses the name of the configuration file
+	InterfaceName string `jsonschema:"-" yaml:"-"`
 }
 
 type UDPProxyTunnelConfig struct {
@@ -57,9 +92,23 @@ type TCPServerTunnelConfig struct {
 }
 
 type Socks5Config struct {
-	BindAddress string
-	Username    string
-	Password    string
+	BindAddress  string
+	Username     string
+	Password     string
+	BindTimeout  time.Duration // how long BIND waits for the inbound connection, 0 waits 30 seconds
+	DialTimeout  time.Duration // how long CONNECT waits for the connection to the target, 0 waits 30 seconds
+	ReadTimeout  time.Duration // how long a relayed connection may stay idle in both directions, 0 waits forever
+	WriteTimeout time.Duration // how long a relayed write may block, 0 waits forever
+	// UDPMaxConnections is the number of UDP ASSOCIATE relay connections open at once, 0 allows 1000
+	UDPMaxConnections int
+	// UDPIdleTimeout is how long a UDP relay connection may stay idle, 0 waits 40 seconds
+	UDPIdleTimeout time.Duration
+	// UDPKeyFunc picks the relay connection of a UDP packet, nil shares one connection per client
+	// as UDPKeyByClient. UDPConnectionPerTarget = true sets it to UDPKeyByClientAndTarget
+	UDPKeyFunc UDPKeyFunc
+	// UDPDNSCacheSize is the number of hostnames the UDP relay keeps resolved, nil keeps 1000
+	// and 0 removes the limit
+	UDPDNSCacheSize *int
 }
 
 type HTTPConfig struct {
@@ -150,6 +199,14 @@ func encodeBase64ToHex(key string) (string, error) {
 	return hex.EncodeToString(decoded), nil
 }
 
+func encodeHexToBase64(key string) string {
+	decoded, err := hex.DecodeString(key)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(decoded)
+}
+
 func parseNetIP(section *ini.Section, keyName string) ([]netip.Addr, error) {
 	key, err := parseString(section, keyName)
 	if err != nil {
@@ -175,6 +232,68 @@ func parseNetIP(section *ini.Section, keyName string) ([]netip.Addr, error) {
 	return ips, nil
 }
 
+// parseDNS splits the DNS key into resolver addresses and, like wg-quick,
+// search domains for the entries that are not IP addresses
+func parseDNS(section *ini.Section) ([]netip.Addr, []string, error) {
+	key, err := parseString(section, "DNS")
+	if err != nil {
+		if strings.Contains(err.Error(), "should not be empty") {
+			return []netip.Addr{}, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	var ips []netip.Addr
+	var domains []string
+	for _, str := range strings.Split(key, ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		if ip, err := netip.ParseAddr(str); err == nil {
+			ips = append(ips, ip)
+			continue
+		}
+		domain := strings.TrimSuffix(str, ".")
+		if !isSearchDomain(domain) {
+			return nil, nil, errors.New("invalid DNS entry: " + str)
+		}
+		domains = append(domains, domain)
+	}
+	if ips == nil {
+		ips = []netip.Addr{}
+	}
+	return ips, domains, nil
+}
+
+// isSearchDomain reports whether name is a domain name made of labels of letters, digits
+// and hyphens. The first label must have a letter, so a mistyped address like 1.1.1.l
+// is rejected instead of being taken for a search domain
+func isSearchDomain(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for i, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		hasLetter := false
+		for _, c := range label {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+				hasLetter = true
+			case c >= '0' && c <= '9', c == '-':
+			default:
+				return false
+			}
+		}
+		if i == 0 && !hasLetter {
+			return false
+		}
+	}
+	return true
+}
+
 func parseCIDRNetIP(section *ini.Section, keyName string) ([]netip.Addr, error) {
 	key, err := parseString(section, keyName)
 	if err != nil {
@@ -227,12 +346,37 @@ func parseAllowedIPs(section *ini.Section) ([]netip.Prefix, error) {
 		if err != nil {
 			return nil, err
 		}
-
-		ips = append(ips, prefix)
+		ips = append(ips, unmapPrefix(prefix))
 	}
 	return ips, nil
 }
 
+// unmapPrefix returns the IPv4 form of an IPv4-mapped IPv6 prefix, which is not
+// accepted by every implementation
+func unmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix
+}
+
+// dedupPrefixes removes repeated prefixes, keeping the order of first occurrences.
+// It returns the deduplicated list and the removed duplicates
+func dedupPrefixes(prefixes []netip.Prefix) ([]netip.Prefix, []netip.Prefix) {
+	seen := make(map[netip.Prefix]struct{}, len(prefixes))
+	unique := prefixes[:0:0]
+	var duplicates []netip.Prefix
+	for _, prefix := range prefixes {
+		if _, ok := seen[prefix]; ok {
+			duplicates = append(duplicates, prefix)
+			continue
+		}
+		seen[prefix] = struct{}{}
+		unique = append(unique, prefix)
+	}
+	return unique, duplicates
+}
+
 func resolveIP(ip string) (*net.IPAddr, error) {
 	return net.ResolveIPAddr("ip", ip)
 }
@@ -250,6 +394,27 @@ func resolveIPPAndPort(addr string) (string, error) {
 	return net.JoinHostPort(ip.String(), port), nil
 }
 
+// parseComments collects the comments of section and of its keys, nil if there are none.
+// An inline comment is kept after the comments above its key
+func parseComments(section *ini.Section) map[string][]string {
+	var comments map[string][]string
+	add := func(key string, comment string) {
+		if comment == "" {
+			return
+		}
+		if comments == nil {
+			comments = make(map[string][]string)
+		}
+		comments[strings.ToLower(key)] = strings.Split(comment, "\n")
+	}
+
+	add(section.Name(), section.Comment)
+	for _, key := range section.Keys() {
+		add(section.Name()+"."+key.Name(), key.Comment)
+	}
+	return comments
+}
+
 // ParseInterface parses the [Interface] section and extract the information into `device`
 func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 	sections, err := cfg.SectionsByName("Interface")
@@ -257,13 +422,14 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 		return errors.New("one and only one [Interface] is expected")
 	}
 	section := sections[0]
+	device.Comments = parseComments(section)
 
 	address, err := parseCIDRNetIP(section, "Address")
 	if err != nil {
 		return err
 	}
 
-	device.Endpoint = address
+	device.Endpoint, device.DynamicAddress = parseDynamicAddress(section, address)
 
 	privKey, err := parseBase64KeyToHex(section, "PrivateKey")
 	if err != nil {
@@ -271,11 +437,12 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 	}
 	device.SecretKey = privKey
 
-	dns, err := parseNetIP(section, "DNS")
+	dns, searchDomains, err := parseDNS(section)
 	if err != nil {
 		return err
 	}
 	device.DNS = dns
+	device.DNSSearchDomains = searchDomains
 
 	if sectionKey, err := section.GetKey("MTU"); err == nil {
 		value, err := sectionKey.Int()
@@ -293,6 +460,42 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 		device.ListenPort = &value
 	}
 
+	routingTableKey := "RoutingTable"
+	if section.HasKey("Table") {
+		if section.HasKey("RoutingTable") {
+			return errors.New("RoutingTable and Table are the same setting, only one of them may be set")
+		}
+		routingTableKey = "Table"
+	}
+	if sectionKey, err := section.GetKey(routingTableKey); err == nil {
+		value, err := parseRouteTable(sectionKey.String())
+		if err != nil {
+			return err
+		}
+		if value != RouteTableOff {
+			errorLogger.Printf("Warning: %s = %s has no effect, wireproxy runs in userspace and does not manage routes\n", routingTableKey, value)
+		}
+		device.RouteTable = &value
+	}
+
+	device.PostUp = parseHooks(section, "PostUp")
+	device.PostDown = parseHooks(section, "PostDown")
+
+	if sectionKey, err := section.GetKey("UpstreamSOCKS5"); err == nil {
+		if _, _, err := net.SplitHostPort(sectionKey.String()); err != nil {
+			return errors.New("invalid UpstreamSOCKS5: " + err.Error())
+		}
+		device.UpstreamSOCKS5 = sectionKey.String()
+	}
+	username, _ := parseString(section, "UpstreamSOCKS5Username")
+	password, _ := parseString(section, "UpstreamSOCKS5Password")
+	if username != "" || password != "" {
+		if device.UpstreamSOCKS5 == "" {
+			return errors.New("UpstreamSOCKS5Username and UpstreamSOCKS5Password are only valid when UpstreamSOCKS5 is set")
+		}
+		device.UpstreamSOCKS5Auth = &Credentials{Username: username, Password: password}
+	}
+
 	checkAlive, err := parseNetIP(section, "CheckAlive")
 	if err != nil {
 		return err
@@ -316,11 +519,83 @@ func ParseInterface(cfg *ini.File, device *DeviceConfig) error {
 	if err != nil {
 		return err
 	}
+
+	peerASecConfig, err := parsePeerASecConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if peerASecConfig != nil {
+		if aSecConfig != nil {
+			return errors.New("AWG parameters are set in both [Interface] and [Peer] sections")
+		}
+		errorLogger.Printf("Warning: AWG parameters found in a [Peer] section, they belong to [Interface]")
+		aSecConfig = peerASecConfig
+	}
+
+	if sectionKey, err := section.GetKey("StrictAWG"); err == nil {
+		strict, err := sectionKey.Bool()
+		if err != nil {
+			return err
+		}
+		if err := ValidateASecConfigStrict(aSecConfig, ValidationOptions{StrictMode: strict}); err != nil {
+			return err
+		}
+	}
 	device.ASecConfig = aSecConfig
 
 	return nil
 }
 
+// parsePeerASecConfig parses AWG parameters that some clients put in [Peer] sections
+// instead of [Interface]. Peers setting different values are ambiguous
+func parsePeerASecConfig(cfg *ini.File) (*ASecConfigType, error) {
+	sections, err := cfg.SectionsByName("Peer")
+	if err != nil {
+		return nil, nil
+	}
+
+	var aSecConfig *ASecConfigType
+	for _, section := range sections {
+		peerConfig, err := ParseASecConfig(section)
+		if err != nil {
+			return nil, err
+		}
+		if peerConfig == nil {
+			continue
+		}
+		if aSecConfig != nil && !slices.Equal(aSecConfig.setFields(), peerConfig.setFields()) {
+			return nil, errors.New("[Peer] sections set different AWG parameters")
+		}
+		aSecConfig = peerConfig
+	}
+	return aSecConfig, nil
+}
+
+// RouteTableMode is the routing table wg-quick adds the routes of the peers to
+type RouteTableMode string
+
+const (
+	RouteTableOff  RouteTableMode = "off"  // no routes are added
+	RouteTableAuto RouteTableMode = "auto" // routes go to the main table, or a new one for default routes
+)
+
+// RouteTableCustom returns the mode adding the routes to the routing table with ID n
+func RouteTableCustom(n int) RouteTableMode {
+	return RouteTableMode(strconv.Itoa(n))
+}
+
+// parseRouteTable accepts the Table values of wg-quick: off, auto or a decimal table ID
+func parseRouteTable(value string) (RouteTableMode, error) {
+	mode := RouteTableMode(strings.ToLower(strings.TrimSpace(value)))
+	if mode == RouteTableOff || mode == RouteTableAuto {
+		return mode, nil
+	}
+	if _, err := strconv.ParseUint(string(mode), 10, 32); err != nil {
+		return "", errors.New("RoutingTable must be off, auto or a routing table ID")
+	}
+	return mode, nil
+}
+
 // ParsePeers parses the [Peer] section and extract the information into `peers`
 func ParsePeers(cfg *ini.File, peers *[]PeerConfig) error {
 	sections, err := cfg.SectionsByName("Peer")
@@ -330,8 +605,9 @@ func ParsePeers(cfg *ini.File, peers *[]PeerConfig) error {
 
 	for _, section := range sections {
 		peer := PeerConfig{
-			PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
+			PreSharedKey: zeroKey,
 			KeepAlive:    0,
+			Comments:     parseComments(section),
 		}
 
 		decoded, err := parseBase64KeyToHex(section, "PublicKey")
@@ -349,12 +625,9 @@ func ParsePeers(cfg *ini.File, peers *[]PeerConfig) error {
 		}
 
 		if sectionKey, err := section.GetKey("Endpoint"); err == nil {
-			value := sectionKey.String()
-			decoded, err = resolveIPPAndPort(strings.ToLower(value))
-			if err != nil {
+			if err := peer.parseEndpoint(sectionKey.String()); err != nil {
 				return err
 			}
-			peer.Endpoint = &decoded
 		}
 
 		if sectionKey, err := section.GetKey("PersistentKeepalive"); err == nil {
@@ -369,12 +642,40 @@ func ParsePeers(cfg *ini.File, peers *[]PeerConfig) error {
 		if err != nil {
 			return err
 		}
+		var duplicates []netip.Prefix
+		peer.AllowedIPs, duplicates = dedupPrefixes(peer.AllowedIPs)
+		if len(duplicates) > 0 {
+			errorLogger.Printf("Warning: removed duplicate AllowedIPs of peer %s: %s\n", section.Key("PublicKey").String(), joinPrefixes(duplicates))
+		}
 
 		*peers = append(*peers, peer)
 	}
 	return nil
 }
 
+// parseEndpoint sets the endpoint of the peer from its host:port value
+func (peer *PeerConfig) parseEndpoint(value string) error {
+	value = strings.ToLower(value)
+	host, _, err := net.SplitHostPort(value)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		peer.EndpointHost = value
+	}
+	// a hostname may only resolve with DeviceConfig.PeerEndpointResolver, e.g. with
+	// split DNS, its resolution is then retried when the tunnel starts
+	decoded, err := resolveIPPAndPort(value)
+	if err == nil {
+		peer.Endpoint = &decoded
+	} else if peer.EndpointHost != "" {
+		errorLogger.Printf("Warning: endpoint %s is not resolved yet: %s\n", value, err)
+	} else {
+		return err
+	}
+	return nil
+}
+
 func parseTCPClientTunnelConfig(section *ini.Section) (RoutineSpawner, error) {
 	config := &TCPClientTunnelConfig{}
 	tcpAddr, err := parseTCPAddr(section, "BindAddress")
@@ -438,9 +739,70 @@ func parseSocks5Config(section *ini.Section) (RoutineSpawner, error) {
 	password, _ := parseString(section, "Password")
 	config.Password = password
 
+	if config.BindTimeout, err = parseTimeout(section, "BindTimeout"); err != nil {
+		return nil, err
+	}
+	if config.DialTimeout, err = parseTimeout(section, "DialTimeout"); err != nil {
+		return nil, err
+	}
+	if config.ReadTimeout, err = parseTimeout(section, "ReadTimeout"); err != nil {
+		return nil, err
+	}
+	if config.WriteTimeout, err = parseTimeout(section, "WriteTimeout"); err != nil {
+		return nil, err
+	}
+	if config.UDPIdleTimeout, err = parseTimeout(section, "UDPIdleTimeout"); err != nil {
+		return nil, err
+	}
+	if sectionKey, err := section.GetKey("UDPMaxConnections"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return nil, err
+		}
+		if value < 0 {
+			return nil, errors.New("UDPMaxConnections must not be negative")
+		}
+		config.UDPMaxConnections = value
+	}
+	if sectionKey, err := section.GetKey("UDPDNSCacheSize"); err == nil {
+		value, err := sectionKey.Int()
+		if err != nil {
+			return nil, err
+		}
+		if value < 0 {
+			return nil, errors.New("UDPDNSCacheSize must not be negative")
+		}
+		config.UDPDNSCacheSize = &value
+	}
+	if sectionKey, err := section.GetKey("UDPConnectionPerTarget"); err == nil {
+		perTarget, err := sectionKey.Bool()
+		if err != nil {
+			return nil, err
+		}
+		if perTarget {
+			config.UDPKeyFunc = UDPKeyByClientAndTarget
+		}
+	}
+
 	return config, nil
 }
 
+// parseTimeout parses a timeout given in seconds, 0 if the key is not set
+func parseTimeout(section *ini.Section, keyName string) (time.Duration, error) {
+	sectionKey, err := section.GetKey(keyName)
+	if err != nil {
+		return 0, nil
+	}
+	value, err := sectionKey.Int()
+	if err != nil {
+		return 0, err
+	}
+	if value < 0 {
+		return 0, errors.New(keyName + " must not be negative")
+	}
+	return time.Duration(value) * time.Second, nil
+}
+
 func parseHTTPConfig(section *ini.Section) (RoutineSpawner, error) {
 	config := &HTTPConfig{}
 
@@ -465,12 +827,30 @@ func parseHTTPConfig(section *ini.Section) (RoutineSpawner, error) {
 	return config, nil
 }
 
+// parseProxyConfig parses a generic [Proxy] section, its Type key selects the
+// kind of proxy and the remaining keys are the ones of [Socks5] or [http]
+func parseProxyConfig(section *ini.Section) (RoutineSpawner, error) {
+	proxyType, err := parseString(section, "Type")
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(proxyType) {
+	case "socks5":
+		return parseSocks5Config(section)
+	case "http":
+		return parseHTTPConfig(section)
+	default:
+		return nil, errors.New("unknown proxy type " + proxyType + ", expected socks5 or http")
+	}
+}
+
 func parseResolveConfig(section *ini.Section) (*ResolveConfig, error) {
 	config := &ResolveConfig{}
 
 	resolvStrategy, _ := parseString(section, "ResolveStrategy")
 	config.ResolveStrategy = resolvStrategy
-  
+
 	return config, nil
 }
 
@@ -527,23 +907,217 @@ func parseRoutinesConfig(
 	return nil
 }
 
+const includeDirective = "@include"
+
+// loadConfigSource reads the configuration file at path, expanding any
+// `@include <path>` lines with the content of the referenced file
+func loadConfigSource(path string) ([]byte, error) {
+	return expandIncludes(path, map[string]bool{})
+}
+
+func expandIncludes(path string, visiting map[string]bool) ([]byte, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if visiting[absPath] {
+		return nil, errors.New("include cycle detected at " + path)
+	}
+	visiting[absPath] = true
+	defer delete(visiting, absPath)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// relative paths are resolved from the directory of the including file
+	return expandIncludeLines(content, filepath.Dir(path), visiting)
+}
+
+// expandIncludeLines replaces the `@include <path>` lines of content, relative paths
+// are resolved from dir
+func expandIncludeLines(content []byte, dir string, visiting map[string]bool) ([]byte, error) {
+	var result strings.Builder
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		includePath, ok := parseIncludeDirective(line)
+		if !ok {
+			result.WriteString(line)
+			continue
+		}
+
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(dir, includePath)
+		}
+
+		included, err := expandIncludes(includePath, visiting)
+		if err != nil {
+			return nil, err
+		}
+		result.Write(included)
+		if len(included) > 0 && included[len(included)-1] != '\n' {
+			result.WriteString("\n")
+		}
+	}
+
+	return []byte(result.String()), nil
+}
+
+func parseIncludeDirective(line string) (string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, includeDirective) {
+		return "", false
+	}
+
+	rest := strings.TrimPrefix(trimmed, includeDirective)
+	if rest == "" || (rest[0] != ' ' && rest[0] != '\t') {
+		return "", false
+	}
+
+	includePath := strings.TrimSpace(rest)
+	return includePath, includePath != ""
+}
+
 // ParseConfig takes the path of a configuration file and parses it into Configuration
 func ParseConfig(path string) (*Configuration, error) {
-	iniOpt := ini.LoadOptions{
-		Insensitive:            true,
-		AllowShadows:           true,
-		AllowNonUniqueSections: true,
+	source, err := loadConfigSource(path)
+	if err != nil {
+		return nil, err
 	}
 
-	cfg, err := ini.LoadSources(iniOpt, path)
+	return parseConfigSource(source)
+}
+
+var configLoadOptions = ini.LoadOptions{
+	Insensitive:            true,
+	AllowShadows:           true,
+	AllowNonUniqueSections: true,
+}
+
+// ConfigFileError is returned by ParseConfigFromFile when the file cannot be read or parsed
+type ConfigFileError struct {
+	Path string
+	Err  error
+}
+
+func (e *ConfigFileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *ConfigFileError) Unwrap() error {
+	return e.Err
+}
+
+// ParseConfigFromReader parses a WireGuard configuration with [Interface] and [Peer] sections from r.
+// Includes are expanded, r has no directory so relative paths are resolved from the working directory
+func ParseConfigFromReader(r io.Reader) (*DeviceConfig, error) {
+	source, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	source, err = expandIncludeLines(source, ".", map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDeviceConfigSource(source)
+}
+
+// parseDeviceConfigSource parses a WireGuard configuration with its includes already expanded
+func parseDeviceConfigSource(source []byte) (*DeviceConfig, error) {
+	cfg, err := ini.LoadSources(configLoadOptions, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseDeviceConfig(cfg)
+}
+
+// ParseConfigFromFile parses the WireGuard configuration file at path, includes are expanded.
+// Errors are returned as *ConfigFileError
+func ParseConfigFromFile(path string) (*DeviceConfig, error) {
+	source, err := loadConfigSource(path)
+	if err != nil {
+		return nil, &ConfigFileError{Path: path, Err: err}
+	}
+
+	device, err := parseDeviceConfigSource(source)
+	if err != nil {
+		return nil, &ConfigFileError{Path: path, Err: err}
+	}
+	return device, nil
+}
+
+// ParseMultipleConfigs parses every file of dir matching the glob pattern, e.g. "*.conf",
+// in lexical order. Each file is a complete WireGuard configuration, see MergeMultipleConfigs
+func ParseMultipleConfigs(dir string, glob string) ([]*DeviceConfig, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, glob))
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]*DeviceConfig, 0, len(paths))
+	for _, path := range paths {
+		device, err := ParseConfigFromFile(path)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, device)
+	}
+	return configs, nil
+}
+
+// ErrEnvVarNotSet is returned by ParseConfigFromEnvironment when the environment variable is absent
+var ErrEnvVarNotSet = errors.New("environment variable is not set")
+
+// ParseConfigFromEnvironment parses the WireGuard configuration stored in the environment variable envKey.
+// A value without newlines is base64 decoded first, as injected from Docker secrets
+func ParseConfigFromEnvironment(envKey string) (*DeviceConfig, error) {
+	value, ok := os.LookupEnv(envKey)
+	if !ok {
+		return nil, ErrEnvVarNotSet
+	}
+
+	source := []byte(value)
+	if !strings.ContainsAny(value, "\r\n") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errors.New(envKey + " is not a valid base64 configuration: " + err.Error())
+		}
+		source = decoded
+	}
 
+	return ParseConfigFromReader(bytes.NewReader(source))
+}
+
+// parseDeviceConfig parses the [Interface] and [Peer] sections of cfg
+func parseDeviceConfig(cfg *ini.File) (*DeviceConfig, error) {
 	device := &DeviceConfig{
 		MTU: 1420,
 	}
 
+	err := ParseInterface(cfg, device)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ParsePeers(cfg, &device.Peers)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range ASecPeerWarnings(device.ASecConfig, device.Peers) {
+		errorLogger.Printf("Warning: %s\n", warning)
+	}
+
+	return device, nil
+}
+
+// parseConfigSource parses the content of a configuration file with its includes already expanded
+func parseConfigSource(source []byte) (*Configuration, error) {
+	cfg, err := ini.LoadSources(configLoadOptions, source)
+	if err != nil {
+		return nil, err
+	}
+
 	resolve := &ResolveConfig{
 		ResolveStrategy: "auto",
 	}
@@ -552,18 +1126,17 @@ func ParseConfig(path string) (*Configuration, error) {
 	wgConf, err := root.GetKey("WGConfig")
 	wgCfg := cfg
 	if err == nil {
-		wgCfg, err = ini.LoadSources(iniOpt, wgConf.String())
+		wgSource, err := loadConfigSource(wgConf.String())
+		if err != nil {
+			return nil, err
+		}
+		wgCfg, err = ini.LoadSources(configLoadOptions, wgSource)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	err = ParseInterface(wgCfg, device)
-	if err != nil {
-		return nil, err
-	}
-
-	err = ParsePeers(wgCfg, &device.Peers)
+	device, err := parseDeviceConfig(wgCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -595,13 +1168,18 @@ func ParseConfig(path string) (*Configuration, error) {
 		return nil, err
 	}
 
+	err = parseRoutinesConfig(&routinesSpawners, cfg, "Proxy", parseProxyConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	if resolveSection, err := cfg.GetSection("Resolve"); err == nil {
 		resolve, err = parseResolveConfig(resolveSection)
 		if err != nil {
 			return nil, err
-	  }
-  }
-    
+		}
+	}
+
 	err = parseRoutinesConfig(&routinesSpawners, cfg, "UDPProxyTunnel", parseUDPProxyTunnelConfig)
 	if err != nil {
 		return nil, err
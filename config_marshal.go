@@ -0,0 +1,226 @@
+package wireproxy
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// joinAddrs formats a list of addresses as a comma separated INI value
+func joinAddrs(addrs []netip.Addr) string {
+	values := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		values = append(values, addr.String())
+	}
+	return strings.Join(values, ", ")
+}
+
+// joinPrefixes formats a list of prefixes as a comma separated INI value
+func joinPrefixes(prefixes []netip.Prefix) string {
+	values := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		values = append(values, prefix.String())
+	}
+	return strings.Join(values, ", ")
+}
+
+// MarshalINI serializes the device configuration into the [Interface] / [Peer] format
+// of a configuration file, including the private key, so that parsing the result
+// gives back the same configuration
+func MarshalINI(cfg *DeviceConfig) ([]byte, error) {
+	if cfg == nil {
+		return nil, errors.New("nil device configuration")
+	}
+	if !isHexKey(cfg.SecretKey) {
+		return nil, errors.New("invalid private key")
+	}
+	for _, peer := range cfg.Peers {
+		if !isHexKey(peer.PublicKey) {
+			return nil, errors.New("invalid peer public key")
+		}
+		if peer.PreSharedKey != "" && !isHexKey(peer.PreSharedKey) {
+			return nil, errors.New("invalid peer preshared key")
+		}
+	}
+
+	var buf strings.Builder
+	cfg.writeINI(&buf, true)
+	return []byte(buf.String()), nil
+}
+
+// isHexKey reports whether key is a hex encoded 32 byte key
+func isHexKey(key string) bool {
+	decoded, err := hex.DecodeString(key)
+	return err == nil && len(decoded) == 32
+}
+
+// writeINI writes the device configuration in the wireproxy [Interface] / [Peer] format.
+// The PrivateKey line is left out when withPrivateKey is false
+func (conf *DeviceConfig) writeINI(buf *strings.Builder, withPrivateKey bool) {
+	// comments may quote secrets, they are only written along with the private key
+	writeComments := func(comments map[string][]string, key string) {
+		if withPrivateKey {
+			for _, comment := range comments[strings.ToLower(key)] {
+				buf.WriteString(comment)
+				buf.WriteString("\n")
+			}
+		}
+	}
+	writeKey := func(key string, value any) {
+		writeComments(conf.Comments, "Interface."+key)
+		fmt.Fprintf(buf, "%s = %v\n", key, value)
+	}
+
+	writeComments(conf.Comments, "Interface")
+	buf.WriteString("[Interface]\n")
+	if withPrivateKey {
+		writeKey("PrivateKey", encodeHexToBase64(conf.SecretKey))
+	}
+	if len(conf.Endpoint) > 0 || conf.DynamicAddress {
+		address := joinAddrs(conf.Endpoint)
+		if conf.DynamicAddress {
+			address = strings.TrimPrefix(address+", 0.0.0.0/0", ", ")
+		}
+		writeKey("Address", address)
+	}
+	if len(conf.DNS) > 0 || len(conf.DNSSearchDomains) > 0 {
+		dns := joinAddrs(conf.DNS)
+		for _, domain := range conf.DNSSearchDomains {
+			if dns != "" {
+				dns += ", "
+			}
+			dns += domain
+		}
+		writeKey("DNS", dns)
+	}
+	if conf.MTU != 0 {
+		writeKey("MTU", conf.MTU)
+	}
+	if conf.ListenPort != nil {
+		writeKey("ListenPort", *conf.ListenPort)
+	}
+	if conf.RouteTable != nil {
+		// the key of wg-quick, RoutingTable is only understood by wireproxy
+		writeKey("Table", *conf.RouteTable)
+	}
+	if len(conf.CheckAlive) > 0 {
+		writeKey("CheckAlive", joinAddrs(conf.CheckAlive))
+		writeKey("CheckAliveInterval", conf.CheckAliveInterval)
+	}
+	if conf.ASecConfig != nil {
+		for _, field := range conf.ASecConfig.outputFields() {
+			writeKey(field.key, field.value)
+		}
+	}
+	for _, hook := range conf.PostUp {
+		writeKey("PostUp", hook)
+	}
+	for _, hook := range conf.PostDown {
+		writeKey("PostDown", hook)
+	}
+	if conf.UpstreamSOCKS5 != "" {
+		writeKey("UpstreamSOCKS5", conf.UpstreamSOCKS5)
+	}
+	if conf.UpstreamSOCKS5Auth != nil && withPrivateKey {
+		writeKey("UpstreamSOCKS5Username", conf.UpstreamSOCKS5Auth.Username)
+		writeKey("UpstreamSOCKS5Password", conf.UpstreamSOCKS5Auth.Password)
+	}
+
+	for _, peer := range conf.Peers {
+		writePeerKey := func(key string, value any) {
+			writeComments(peer.Comments, "Peer."+key)
+			fmt.Fprintf(buf, "%s = %v\n", key, value)
+		}
+
+		buf.WriteString("\n")
+		writeComments(peer.Comments, "Peer")
+		buf.WriteString("[Peer]\n")
+		writePeerKey("PublicKey", encodeHexToBase64(peer.PublicKey))
+		if peer.hasPresharedKey() {
+			writePeerKey("PresharedKey", encodeHexToBase64(peer.PreSharedKey))
+		}
+		if peer.Endpoint != nil {
+			writePeerKey("Endpoint", *peer.Endpoint)
+		} else if peer.EndpointHost != "" {
+			writePeerKey("Endpoint", peer.EndpointHost)
+		}
+		if peer.KeepAlive > 0 {
+			writePeerKey("PersistentKeepalive", peer.KeepAlive)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			writePeerKey("AllowedIPs", joinPrefixes(peer.AllowedIPs))
+		}
+	}
+}
+
+// redacted replaces secret values in SensitiveString
+const redacted = "[redacted]"
+
+// SensitiveString describes the configuration on a single line with the private key
+// and preshared keys redacted, so it is safe to log
+func (conf *DeviceConfig) SensitiveString() string {
+	if conf == nil {
+		return "<nil>"
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "{PrivateKey: %s, Address: [%s], DNS: [%s], MTU: %d", redacted, joinAddrs(conf.Endpoint), joinAddrs(conf.DNS), conf.MTU)
+	if conf.ListenPort != nil {
+		fmt.Fprintf(&buf, ", ListenPort: %d", *conf.ListenPort)
+	}
+	if len(conf.CheckAlive) > 0 {
+		fmt.Fprintf(&buf, ", CheckAlive: [%s], CheckAliveInterval: %d", joinAddrs(conf.CheckAlive), conf.CheckAliveInterval)
+	}
+	if conf.ASecConfig != nil {
+		for _, field := range conf.ASecConfig.fields() {
+			fmt.Fprintf(&buf, ", %s: %s", field.key, field.value)
+		}
+	}
+
+	buf.WriteString(", Peers: [")
+	for i, peer := range conf.Peers {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "{PublicKey: %s", encodeHexToBase64(peer.PublicKey))
+		if peer.hasPresharedKey() {
+			fmt.Fprintf(&buf, ", PresharedKey: %s", redacted)
+		}
+		if peer.Endpoint != nil {
+			fmt.Fprintf(&buf, ", Endpoint: %s", *peer.Endpoint)
+		}
+		if peer.KeepAlive > 0 {
+			fmt.Fprintf(&buf, ", PersistentKeepalive: %d", peer.KeepAlive)
+		}
+		fmt.Fprintf(&buf, ", AllowedIPs: [%s]}", joinPrefixes(peer.AllowedIPs))
+	}
+	buf.WriteString("]}")
+	return buf.String()
+}
+
+// deviceConfig has the fields of DeviceConfig but not its Format method
+type deviceConfig DeviceConfig
+
+// Format implements fmt.Formatter so a configuration printed by accident with %v or %s
+// does not leak keys. %#v still prints the full Go syntax representation for debugging
+func (conf *DeviceConfig) Format(f fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && f.Flag('#'):
+		if conf == nil {
+			_, _ = io.WriteString(f, "(*wireproxy.DeviceConfig)(nil)")
+			return
+		}
+		goSyntax := fmt.Sprintf("%#v", (*deviceConfig)(conf))
+		_, _ = io.WriteString(f, strings.Replace(goSyntax, "wireproxy.deviceConfig", "wireproxy.DeviceConfig", 1))
+	case verb == 'v' || verb == 's':
+		_, _ = io.WriteString(f, conf.SensitiveString())
+	case verb == 'q':
+		_, _ = io.WriteString(f, strconv.Quote(conf.SensitiveString()))
+	default:
+		fmt.Fprintf(f, "%%!%c(*wireproxy.DeviceConfig)", verb)
+	}
+}
@@ -0,0 +1,192 @@
+package wireproxy
+
+import (
+	"errors"
+	"slices"
+)
+
+// MergeDeviceConfig returns base with overlay layered on top, e.g. AWG parameters kept
+// apart from a plain WireGuard configuration. Fields of overlay override base when they
+// are set: non-zero scalars, non-nil pointers and non-empty lists. AWG parameters are
+// merged one by one, peers by public key, with peers only in overlay appended.
+// The merged AWG parameters are validated again, as parameters valid on their own
+// may conflict once merged, e.g. Jmin of overlay above Jmax of base.
+// Neither configuration is modified
+func MergeDeviceConfig(base, overlay *DeviceConfig) (*DeviceConfig, error) {
+	if overlay == nil {
+		return base.Clone(), nil
+	}
+	if base == nil {
+		return overlay.Clone(), nil
+	}
+
+	merged := base.Clone()
+	overlay = overlay.Clone()
+	if overlay.SecretKey != "" {
+		merged.SecretKey = overlay.SecretKey
+	}
+	if len(overlay.Endpoint) > 0 || overlay.DynamicAddress {
+		merged.Endpoint = overlay.Endpoint
+		merged.DynamicAddress = overlay.DynamicAddress
+	}
+	if len(overlay.DNS) > 0 || len(overlay.DNSSearchDomains) > 0 {
+		merged.DNS = overlay.DNS
+		merged.DNSSearchDomains = overlay.DNSSearchDomains
+	}
+	if overlay.MTU != 0 {
+		merged.MTU = overlay.MTU
+	}
+	if overlay.ListenPort != nil {
+		merged.ListenPort = overlay.ListenPort
+	}
+	if overlay.RouteTable != nil {
+		merged.RouteTable = overlay.RouteTable
+	}
+	if len(overlay.CheckAlive) > 0 {
+		merged.CheckAlive = overlay.CheckAlive
+	}
+	if overlay.CheckAliveInterval != 0 {
+		merged.CheckAliveInterval = overlay.CheckAliveInterval
+	}
+	if len(overlay.PostUp) > 0 {
+		merged.PostUp = overlay.PostUp
+	}
+	if len(overlay.PostDown) > 0 {
+		merged.PostDown = overlay.PostDown
+	}
+	if overlay.UpstreamSOCKS5 != "" {
+		merged.UpstreamSOCKS5 = overlay.UpstreamSOCKS5
+		merged.UpstreamSOCKS5Auth = overlay.UpstreamSOCKS5Auth
+	}
+	if overlay.PeerEndpointResolver != nil {
+		merged.PeerEndpointResolver = overlay.PeerEndpointResolver
+	}
+	merged.ASecConfig = mergeASecConfig(merged.ASecConfig, overlay.ASecConfig)
+	for key, lines := range overlay.Comments {
+		if merged.Comments == nil {
+			merged.Comments = make(map[string][]string, len(overlay.Comments))
+		}
+		merged.Comments[key] = lines
+	}
+
+	for _, peer := range overlay.Peers {
+		i := slices.IndexFunc(merged.Peers, func(p PeerConfig) bool {
+			return p.PublicKey == peer.PublicKey
+		})
+		if i < 0 {
+			merged.Peers = append(merged.Peers, peer)
+			continue
+		}
+		mergePeerConfig(&merged.Peers[i], peer)
+	}
+
+	if merged.ASecConfig != nil {
+		if err := ValidateASecConfig(merged.ASecConfig); err != nil {
+			return nil, errors.New("merged AWG parameters are invalid: " + err.Error())
+		}
+	}
+	return merged, nil
+}
+
+// mergePeerConfig overrides the fields of base that are set in overlay
+func mergePeerConfig(base *PeerConfig, overlay PeerConfig) {
+	if overlay.hasPresharedKey() {
+		base.PreSharedKey = overlay.PreSharedKey
+	}
+	// an endpoint whose hostname did not resolve yet only has EndpointHost
+	if overlay.Endpoint != nil || overlay.EndpointHost != "" {
+		base.Endpoint = overlay.Endpoint
+		base.EndpointHost = overlay.EndpointHost
+	}
+	if overlay.KeepAlive != 0 {
+		base.KeepAlive = overlay.KeepAlive
+	}
+	if len(overlay.AllowedIPs) > 0 {
+		base.AllowedIPs = overlay.AllowedIPs
+	}
+	for key, lines := range overlay.Comments {
+		if base.Comments == nil {
+			base.Comments = make(map[string][]string, len(overlay.Comments))
+		}
+		base.Comments[key] = lines
+	}
+}
+
+// mergeASecConfig returns a copy of base with the parameters set in overlay overriding it
+func mergeASecConfig(base, overlay *ASecConfigType) *ASecConfigType {
+	if overlay == nil {
+		return base.Clone()
+	}
+	if base == nil {
+		return overlay.Clone()
+	}
+
+	n := base.Clone()
+	mergeInt := func(isSet bool, value int, hasTarget *bool, target *int) {
+		if isSet {
+			*hasTarget, *target = true, value
+		}
+	}
+	mergeHeader := func(isSet bool, minValue, maxValue uint32, hasTarget *bool, targetMin, targetMax *uint32) {
+		if isSet {
+			*hasTarget, *targetMin, *targetMax = true, minValue, maxValue
+		}
+	}
+	mergeString := func(value *string, target **string) {
+		if value != nil {
+			*target = clonePtr(value)
+		}
+	}
+
+	mergeInt(overlay.hasJunkPacketCount, overlay.junkPacketCount, &n.hasJunkPacketCount, &n.junkPacketCount)
+	mergeInt(overlay.hasJunkPacketMinSize, overlay.junkPacketMinSize, &n.hasJunkPacketMinSize, &n.junkPacketMinSize)
+	mergeInt(overlay.hasJunkPacketMaxSize, overlay.junkPacketMaxSize, &n.hasJunkPacketMaxSize, &n.junkPacketMaxSize)
+	mergeInt(overlay.hasInitPacketJunkSize, overlay.initPacketJunkSize, &n.hasInitPacketJunkSize, &n.initPacketJunkSize)
+	mergeInt(overlay.hasResponsePacketJunkSize, overlay.responsePacketJunkSize, &n.hasResponsePacketJunkSize, &n.responsePacketJunkSize)
+	mergeInt(overlay.hasCookieReplyPacketJunkSize, overlay.cookieReplyPacketJunkSize, &n.hasCookieReplyPacketJunkSize, &n.cookieReplyPacketJunkSize)
+	mergeInt(overlay.hasTransportPacketJunkSize, overlay.transportPacketJunkSize, &n.hasTransportPacketJunkSize, &n.transportPacketJunkSize)
+	mergeHeader(overlay.hasInitPacketMagicHeader, overlay.initPacketMagicHeader, overlay.initPacketMagicHeaderMax,
+		&n.hasInitPacketMagicHeader, &n.initPacketMagicHeader, &n.initPacketMagicHeaderMax)
+	mergeHeader(overlay.hasResponsePacketMagicHeader, overlay.responsePacketMagicHeader, overlay.responsePacketMagicHeaderMax,
+		&n.hasResponsePacketMagicHeader, &n.responsePacketMagicHeader, &n.responsePacketMagicHeaderMax)
+	mergeHeader(overlay.hasUnderloadPacketMagicHeader, overlay.underloadPacketMagicHeader, overlay.underloadPacketMagicHeaderMax,
+		&n.hasUnderloadPacketMagicHeader, &n.underloadPacketMagicHeader, &n.underloadPacketMagicHeaderMax)
+	mergeHeader(overlay.hasTransportPacketMagicHeader, overlay.transportPacketMagicHeader, overlay.transportPacketMagicHeaderMax,
+		&n.hasTransportPacketMagicHeader, &n.transportPacketMagicHeader, &n.transportPacketMagicHeaderMax)
+	mergeString(overlay.i1, &n.i1)
+	mergeString(overlay.i2, &n.i2)
+	mergeString(overlay.i3, &n.i3)
+	mergeString(overlay.i4, &n.i4)
+	mergeString(overlay.i5, &n.i5)
+	if overlay.mode != nil {
+		n.mode = clonePtr(overlay.mode)
+	}
+	n.UseHexFormatInOutput = n.UseHexFormatInOutput || overlay.UseHexFormatInOutput
+	return n
+}
+
+// MergeMultipleConfigs returns the first configuration with the peers of the others appended,
+// the rest of their [Interface] is ignored. All configurations must use the same private key
+// and a peer may only be defined once. Configurations are not modified
+func MergeMultipleConfigs(configs []*DeviceConfig) (*DeviceConfig, error) {
+	if len(configs) == 0 {
+		return nil, errors.New("no configuration to merge")
+	}
+
+	merged := configs[0].Clone()
+	for _, conf := range configs[1:] {
+		if conf.SecretKey != merged.SecretKey {
+			return nil, errors.New("configurations define different private keys")
+		}
+		for _, peer := range conf.Clone().Peers {
+			defined := slices.ContainsFunc(merged.Peers, func(p PeerConfig) bool {
+				return p.PublicKey == peer.PublicKey
+			})
+			if defined {
+				return nil, errors.New("peer " + encodeHexToBase64(peer.PublicKey) + " is defined in several configurations")
+			}
+			merged.Peers = append(merged.Peers, peer)
+		}
+	}
+	return merged, nil
+}
@@ -1,10 +1,30 @@
 package wireproxy
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/amnezia-vpn/amneziawg-go/device"
 	"github.com/go-ini/ini"
+	"go.yaml.in/yaml/v3"
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func loadIniConfig(config string) (*ini.File, error) {
@@ -423,6 +443,99 @@ PersistentKeepalive = 25`
 	}
 }
 
+func TestOnlyJminSet_TooLarge(t *testing.T) {
+	iniData, err := loadIniConfig(`
+[Interface]
+Jc = 5
+Jmin = 100`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const expectedError = "value of the Jmin field must be less than or equal to Jmax field value, which is 0 when not set"
+	_, err = ParseASecConfig(iniData.Section("Interface"))
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if err.Error() != expectedError {
+		t.Fatalf("error expected: %s, got: %s", expectedError, err.Error())
+	}
+}
+
+func TestOnlyJmaxSet(t *testing.T) {
+	iniData, err := loadIniConfig(`
+[Interface]
+Jc = 5
+Jmax = 50`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ParseASecConfig(iniData.Section("Interface"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.hasJunkPacketMaxSize || config.junkPacketMaxSize != 50 || config.hasJunkPacketMinSize {
+		t.Fatalf("only Jmax should be set, got %+v", config)
+	}
+}
+
+func TestIFieldTooLong(t *testing.T) {
+	iniData, err := loadIniConfig("[Interface]\nI1 = <b 0x" + strings.Repeat("ab", 2100) + ">\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ParseASecConfig(iniData.Section("Interface"))
+	var fieldErr *InvalidIFieldError
+	if !errors.As(err, &fieldErr) {
+		t.Fatalf("InvalidIFieldError expected, got %v", err)
+	}
+	if fieldErr.Field != "I1" || fieldErr.Len != 4206 {
+		t.Fatalf("unexpected error %+v", fieldErr)
+	}
+}
+
+func TestIFieldWithNullByte(t *testing.T) {
+	i1 := "<b 0x01>\x00<c>"
+	if err := ValidateASecConfig(&ASecConfigType{i1: &i1}); err == nil {
+		t.Fatal("I1 with a null byte should be rejected")
+	}
+}
+
+func TestJunkSizeRange(t *testing.T) {
+	tests := []struct {
+		config  string
+		wantErr bool
+	}{
+		{config: "S1 = -1", wantErr: true},
+		{config: "S2 = 65536", wantErr: true},
+		{config: "S3 = 65535"},
+		{config: "S4 = 0"},
+	}
+
+	for _, tt := range tests {
+		iniData, err := loadIniConfig("[Interface]\n" + tt.config + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ParseASecConfig(iniData.Section("Interface"))
+		if !tt.wantErr {
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", tt.config, err)
+			}
+			continue
+		}
+		var fieldErr *InvalidSFieldError
+		if !errors.As(err, &fieldErr) {
+			t.Fatalf("%s: InvalidSFieldError expected, got %v", tt.config, err)
+		}
+		if fieldErr.Field != tt.config[:2] {
+			t.Fatalf("%s: unexpected field %s", tt.config, fieldErr.Field)
+		}
+	}
+}
+
 func TestWireguardConfWithManyAddress(t *testing.T) {
 	const config = `
 [Interface]
@@ -489,6 +602,66 @@ PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
 	}
 }
 
+func TestWireguardConfWithTabIndentedValues(t *testing.T) {
+	const config = "[Interface]\n" +
+		"\tPrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\n" +
+		"  Address = 10.5.0.2\n" +
+		" \tDNS = 1.1.1.1\n" +
+		"\t\tMTU = 1280\n" +
+		"\t ListenPort = 51820\n" +
+		"\tJc = 5\n" +
+		"    H1 = 100-200\n" +
+		"\n" +
+		"[Peer]\n" +
+		"\tPublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=\n" +
+		"  \tEndpoint = 94.140.11.15:51820\n" +
+		"\tAllowedIPs = 0.0.0.0/0\n"
+
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section := iniData.Section("Interface")
+	for _, key := range []string{"PrivateKey", "Address", "DNS", "MTU", "ListenPort", "Jc", "H1"} {
+		if !section.HasKey(key) {
+			t.Fatalf("%s should be parsed without its indentation", key)
+		}
+		if section.HasKey("\t"+key) || section.HasKey(" "+key) {
+			t.Fatalf("%s should not keep an indentation prefix", key)
+		}
+	}
+
+	if err := ParseInterface(iniData, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParsePeers(iniData, &cfg.Peers); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.SecretKey != "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d" {
+		t.Fatal("PrivateKey should be parsed")
+	}
+	if len(cfg.Endpoint) != 1 || cfg.Endpoint[0] != netip.MustParseAddr("10.5.0.2") {
+		t.Fatalf("Address should be parsed, got %v", cfg.Endpoint)
+	}
+	if len(cfg.DNS) != 1 || cfg.DNS[0] != netip.MustParseAddr("1.1.1.1") {
+		t.Fatalf("DNS should be parsed, got %v", cfg.DNS)
+	}
+	if cfg.MTU != 1280 || cfg.ListenPort == nil || *cfg.ListenPort != 51820 {
+		t.Fatal("MTU and ListenPort should be parsed")
+	}
+	if cfg.ASecConfig == nil || cfg.ASecConfig.junkPacketCount != 5 ||
+		cfg.ASecConfig.initPacketMagicHeader != 100 || cfg.ASecConfig.initPacketMagicHeaderMax != 200 {
+		t.Fatalf("AWG parameters should be parsed, got %+v", cfg.ASecConfig)
+	}
+	if len(cfg.Peers) != 1 || cfg.Peers[0].Endpoint == nil || *cfg.Peers[0].Endpoint != "94.140.11.15:51820" ||
+		len(cfg.Peers[0].AllowedIPs) != 1 {
+		t.Fatalf("peer should be parsed, got %+v", cfg.Peers)
+	}
+}
+
 func TestWireguardConfWithPartialDuplicateHeaders(t *testing.T) {
 	const config = `
 [Interface]
@@ -632,6 +805,114 @@ H3 = 1-2
 	}
 }
 
+func TestWireguardConfWithDynamicAddress(t *testing.T) {
+	parse := func(address string) *DeviceConfig {
+		t.Helper()
+		iniData, err := loadIniConfig("[Interface]\nPrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\nAddress = " + address + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cfg DeviceConfig
+		if err := ParseInterface(iniData, &cfg); err != nil {
+			t.Fatal(err)
+		}
+		return &cfg
+	}
+
+	cfg := parse("0.0.0.0/0")
+	if !cfg.DynamicAddress || len(cfg.Endpoint) != 0 {
+		t.Fatalf("0.0.0.0/0 should be a dynamic address, got %v %v", cfg.DynamicAddress, cfg.Endpoint)
+	}
+	if got := dynamicDeviceAddr(cfg); len(got) != 1 || got[0] != netip.MustParseAddr("fd00::1") {
+		t.Fatalf("dynamic address should fall back to fd00::1, got %v", got)
+	}
+	marshaled, err := MarshalINI(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(marshaled), "Address = 0.0.0.0/0\n") {
+		t.Fatalf("dynamic address should be marshaled:\n%s", marshaled)
+	}
+
+	cfg = parse("10.5.0.2, 0.0.0.0/0")
+	if !cfg.DynamicAddress || !slices.Equal(dynamicDeviceAddr(cfg), []netip.Addr{netip.MustParseAddr("10.5.0.2")}) {
+		t.Fatalf("static addresses should be used next to a dynamic address, got %v", cfg.Endpoint)
+	}
+
+	if cfg := parse("0.0.0.0/32"); cfg.DynamicAddress {
+		t.Fatal("only 0.0.0.0/0 is a dynamic address")
+	}
+}
+
+func TestWireguardConfWithDNSSearchDomains(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1, corp.example.com, fd00::53, example.org.
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParsePeers(iniData, &cfg.Peers); err != nil {
+		t.Fatal(err)
+	}
+
+	wantDNS := []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("fd00::53")}
+	if !slices.Equal(cfg.DNS, wantDNS) {
+		t.Fatalf("unexpected DNS servers %v", cfg.DNS)
+	}
+	wantDomains := []string{"corp.example.com", "example.org"}
+	if !slices.Equal(cfg.DNSSearchDomains, wantDomains) {
+		t.Fatalf("unexpected search domains %v", cfg.DNSSearchDomains)
+	}
+
+	setting, err := CreateIPCRequest(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(setting.IpcRequest, "example") {
+		t.Fatal("search domains should not be part of the IPC request")
+	}
+	if !slices.Equal(setting.SearchDomains, wantDomains) {
+		t.Fatalf("search domains should be kept in the device setting, got %v", setting.SearchDomains)
+	}
+	marshaled, err := MarshalINI(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(marshaled), "DNS = 1.1.1.1, fd00::53, corp.example.com, example.org\n") {
+		t.Fatalf("search domains should be marshaled with the DNS servers:\n%s", marshaled)
+	}
+
+	for _, entry := range []string{"1.1.1.l", "10.0.0", "8.8.8.8x", "corp..example.com", "-corp.example.com", "corp_example.com"} {
+		iniData, err := loadIniConfig("[Interface]\nPrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\nAddress = 10.5.0.2\nDNS = 1.1.1.1, " + entry + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ParseInterface(iniData, &DeviceConfig{}); err == nil {
+			t.Fatalf("%q should be rejected instead of taken for a search domain", entry)
+		}
+	}
+
+	iniData, err = loadIniConfig("[Interface]\nDNS = 10.0.0.0/8\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &cfg); err == nil {
+		t.Fatal("a prefix is neither a DNS server nor a search domain")
+	}
+}
+
 func TestWireguardConfWithOverlappingHeaderRanges(t *testing.T) {
 	const config = `
 [Interface]
@@ -657,6 +938,32 @@ H2 = 200-300
 	}
 }
 
+func TestHeaderRangesWithReservedValues(t *testing.T) {
+	tests := []struct {
+		headers string
+		want    string
+	}{
+		{headers: "H1 = 0-3\nH2 = 100\nH3 = 200\nH4 = 300\n", want: "H1 range 0-3 includes reserved value 0"},
+		{headers: "H1 = 100\nH2 = 5\nH3 = 200\nH4 = 300\n", want: "H2 range 5 includes reserved value 5"},
+		{headers: "H1 = 100\nH2 = 200\nH3 = 0\nH4 = 300\n", want: "H3 range 0 includes reserved value 0"},
+		{headers: "H1 = 100\nH2 = 200\nH3 = 300\nH4 = 4-10\n", want: "H4 range 4-10 includes reserved value 5"},
+	}
+
+	for _, tt := range tests {
+		iniData, err := loadIniConfig("[Interface]\n" + tt.headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ParseASecConfig(iniData.Section("Interface"))
+		if err == nil {
+			t.Fatalf("%q: error expected", tt.headers)
+		}
+		if err.Error() != tt.want {
+			t.Fatalf("error expected: %s, got: %s", tt.want, err.Error())
+		}
+	}
+}
+
 func TestWireguardConfWithHeaderConflictAgainstDefaults(t *testing.T) {
 	const config = `
 [Interface]
@@ -680,3 +987,2511 @@ H1 = 2
 		t.Fatalf("unexpected error: %v", err)
 	}
 }
+
+func TestParseConfigWithInclude(t *testing.T) {
+	dir := t.TempDir()
+	peersDir := filepath.Join(dir, "peers")
+	if err := os.Mkdir(peersDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	const mainConfig = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1
+@include awg.conf
+
+@include peers/peer.conf
+`
+	const awgConfig = `Jc = 5
+Jmin = 10
+Jmax = 50`
+	const peerConfig = `
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 94.140.11.15:51820
+`
+	files := map[string]string{
+		filepath.Join(dir, "wireproxy.conf"): mainConfig,
+		filepath.Join(dir, "awg.conf"):       awgConfig,
+		filepath.Join(peersDir, "peer.conf"): peerConfig,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf, err := ParseConfig(filepath.Join(dir, "wireproxy.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.Device.ASecConfig == nil || conf.Device.ASecConfig.junkPacketCount != 5 {
+		t.Fatal("Jc from the included file should be parsed")
+	}
+	if conf.Device.ASecConfig.junkPacketMaxSize != 50 {
+		t.Fatal("Jmax from the included file should be parsed")
+	}
+	if len(conf.Device.Peers) != 1 {
+		t.Fatalf("expected 1 peer from the included file, got %d", len(conf.Device.Peers))
+	}
+}
+
+func TestParseConfigWithIncludeCycle(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.conf")
+	second := filepath.Join(dir, "second.conf")
+
+	if err := os.WriteFile(first, []byte("@include second.conf\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte("@include first.conf\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ParseConfig(first)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if !strings.Contains(err.Error(), "include cycle detected") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWireguardConfWithInvalidUTF8InIField(t *testing.T) {
+	const config = "\n[Interface]\n" +
+		"PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\n" +
+		"Address = 10.5.0.2\n" +
+		"I1 = <b 0xA1B2>\n" +
+		"I2 = <b 0x\xff\xfe>\n"
+
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseInterface(iniData, &cfg)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if err.Error() != "I2 contains invalid UTF-8 encoding" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestWireguardConfWithIPv6OnlyPeer(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = fd00::2/128
+DNS = 2606:4700:4700::1111
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = ::/0
+Endpoint = [2001:db8::1]:51820`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseInterface(iniData, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParsePeers(iniData, &cfg.Peers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Peers) != 1 {
+		t.Fatalf("expected 1 peer, got %d", len(cfg.Peers))
+	}
+	peer := cfg.Peers[0]
+	if peer.Endpoint == nil || *peer.Endpoint != "[2001:db8::1]:51820" {
+		t.Fatalf("endpoint should keep the bracketed IPv6 form, got %v", peer.Endpoint)
+	}
+	if len(peer.AllowedIPs) != 1 || peer.AllowedIPs[0].String() != "::/0" {
+		t.Fatalf("AllowedIPs should be a single IPv6 prefix, got %v", peer.AllowedIPs)
+	}
+
+	ipcReq, err := CreateIPCRequest(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ipcReq.IpcRequest, "endpoint=[2001:db8::1]:51820\n") {
+		t.Fatal("IPv6 endpoint should be emitted with brackets")
+	}
+	if !strings.Contains(ipcReq.IpcRequest, "allowed_ip=::/0\n") {
+		t.Fatal("IPv6 allowed IP should be emitted")
+	}
+	if strings.Contains(ipcReq.IpcRequest, "allowed_ip=0.0.0.0/0") {
+		t.Fatal("default IPv4 allowed IP should not be emitted")
+	}
+}
+
+func TestWireguardConfWithOutOfRangeHeaders(t *testing.T) {
+	values := []string{
+		"99999999999",
+		"1-99999999999",
+		"999999999999999999-999999999999999998",
+		"4294967296",
+	}
+
+	for _, value := range values {
+		config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+H1 = ` + value
+
+		var cfg DeviceConfig
+		iniData, err := loadIniConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ParseInterface(iniData, &cfg)
+		if err == nil {
+			t.Fatalf("%s: error expected", value)
+		}
+		if err.Error() != "magic header value out of uint32 range" {
+			t.Fatalf("%s: unexpected error: %v", value, err)
+		}
+	}
+}
+
+func TestWireguardConfWithS1S2OnlyNoS3S4(t *testing.T) {
+	const twoFieldError = "value of the field S1 + message initiation size (148) must not equal S2 + message response size (92)"
+	const fourFieldError = "value of the field S1 + message initiation size (148) must not equal S2 + message response size (92) + S3 + cookie reply size (64) + S4 + transport packet size (32)"
+
+	tests := []struct {
+		name          string
+		fields        string
+		expectedError string
+	}{
+		{name: "S1 S2 collision", fields: "S1 = 0\nS2 = 56", expectedError: twoFieldError},
+		{name: "S1 S2 distinct", fields: "S1 = 0\nS2 = 57"},
+		{name: "S1 S3 collision", fields: "S1 = 0\nS3 = 84", expectedError: fourFieldError},
+		{name: "S1 S4 collision", fields: "S1 = 0\nS4 = 116", expectedError: fourFieldError},
+		{name: "S2 S3 collision", fields: "S2 = 0\nS3 = 28", expectedError: fourFieldError},
+		{name: "S2 S4 collision", fields: "S2 = 0\nS4 = 60", expectedError: fourFieldError},
+		{name: "S3 S4 collision", fields: "S3 = 0\nS4 = 32", expectedError: fourFieldError},
+		{name: "S3 S4 distinct", fields: "S3 = 0\nS4 = 33"},
+		{name: "S1 alone", fields: "S1 = 0"},
+		{name: "S2 S4 distinct with S1", fields: "S1 = 10\nS2 = 0\nS4 = 61"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+` + tt.fields
+
+			var cfg DeviceConfig
+			iniData, err := loadIniConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ParseInterface(iniData, &cfg)
+			if tt.expectedError == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("error expected")
+			}
+			if err.Error() != tt.expectedError {
+				t.Fatalf("error expected: %s, got: %s", tt.expectedError, err.Error())
+			}
+		})
+	}
+}
+
+func TestDeviceConfigToWGSetConf(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+ListenPort = 51820
+Jc = 5
+H1 = 100-200
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+PresharedKey = UItQuvLsyh50ucXHfjF0bbR4IIpVBd74lwKc8uIPXXs=
+AllowedIPs = 10.0.0.0/8, fd00::/8
+Endpoint = 94.140.11.15:51820
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParsePeers(iniData, &cfg.Peers); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+ListenPort = 51820
+# Jc = 5
+# H1 = 100-200
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+PresharedKey = UItQuvLsyh50ucXHfjF0bbR4IIpVBd74lwKc8uIPXXs=
+Endpoint = 94.140.11.15:51820
+PersistentKeepalive = 25
+AllowedIPs = 10.0.0.0/8, fd00::/8
+
+[Peer]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+AllowedIPs = 0.0.0.0/0, ::/0
+`
+	if got := cfg.ToWGSetConf(); got != expected {
+		t.Fatalf("unexpected wg setconf output:\n%s", got)
+	}
+}
+
+func TestWireguardConfWithMode(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+Jc = 5
+Mode = 2
+`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseInterface(iniData, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ASecConfig == nil || cfg.ASecConfig.mode == nil || *cfg.ASecConfig.mode != 2 {
+		t.Fatal("Mode should be parsed")
+	}
+
+	ipcReq, err := CreateIPCRequest(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ipcReq.IpcRequest, "mode=") {
+		t.Fatalf("mode is not a UAPI key and should not be sent to the device:\n%s", ipcReq.IpcRequest)
+	}
+	data, err := MarshalINI(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "Mode = 2\n") {
+		t.Fatalf("mode should be kept in the configuration file:\n%s", data)
+	}
+
+	vt, err := StartWireguard(context.Background(), &cfg, device.LogLevelSilent)
+	if err != nil {
+		t.Fatalf("device should accept a configuration with Mode: %v", err)
+	}
+	vt.Dev.Close()
+}
+
+func TestWireguardConfWithUnsupportedMode(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+Mode = 7
+`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseInterface(iniData, &cfg)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if err.Error() != "value of the Mode field is not supported" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// TestParseInterfaceWithAllSupportedKeys documents every key accepted in the [Interface] section
+func TestParseInterfaceWithAllSupportedKeys(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2/23, fd00::2/64
+DNS = 1.1.1.1, 2606:4700:4700::1111
+ListenPort = 51820
+MTU = 1280
+CheckAlive = 1.1.1.1
+CheckAliveInterval = 10
+Mode = 1
+Jc = 5
+Jmin = 10
+Jmax = 50
+S1 = 15
+S2 = 18
+S3 = 20
+S4 = 23
+H1 = 100-101
+H2 = 102
+H3 = 104
+H4 = 105-106
+I1 = <b 0xA1B2C3D4E5F6>
+I2 = <b 0x01>
+I3 = <b 0x02>
+I4 = <b 0x03>
+I5 = <b 0x04>
+`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseInterface(iniData, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.SecretKey != "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d" {
+		t.Fatal("PrivateKey should be decoded to hex")
+	}
+	if len(cfg.Endpoint) != 2 || cfg.Endpoint[0].String() != "10.5.0.2" || cfg.Endpoint[1].String() != "fd00::2" {
+		t.Fatalf("Address should be parsed, got %v", cfg.Endpoint)
+	}
+	if len(cfg.DNS) != 2 || cfg.DNS[0].String() != "1.1.1.1" || cfg.DNS[1].String() != "2606:4700:4700::1111" {
+		t.Fatalf("DNS should be parsed, got %v", cfg.DNS)
+	}
+	if cfg.ListenPort == nil || *cfg.ListenPort != 51820 {
+		t.Fatal("ListenPort should be parsed")
+	}
+	if cfg.MTU != 1280 {
+		t.Fatal("MTU should be parsed")
+	}
+	if len(cfg.CheckAlive) != 1 || cfg.CheckAlive[0].String() != "1.1.1.1" {
+		t.Fatal("CheckAlive should be parsed")
+	}
+	if cfg.CheckAliveInterval != 10 {
+		t.Fatal("CheckAliveInterval should be parsed")
+	}
+
+	aSec := cfg.ASecConfig
+	if aSec == nil {
+		t.Fatal("ASecConfig should be created")
+	}
+	if aSec.mode == nil || *aSec.mode != 1 {
+		t.Fatal("Mode should be parsed")
+	}
+	if aSec.junkPacketCount != 5 || aSec.junkPacketMinSize != 10 || aSec.junkPacketMaxSize != 50 {
+		t.Fatal("Jc, Jmin and Jmax should be parsed")
+	}
+	if aSec.initPacketJunkSize != 15 || aSec.responsePacketJunkSize != 18 ||
+		aSec.cookieReplyPacketJunkSize != 20 || aSec.transportPacketJunkSize != 23 {
+		t.Fatal("S1-S4 should be parsed")
+	}
+	if aSec.initPacketMagicHeader != 100 || aSec.initPacketMagicHeaderMax != 101 {
+		t.Fatal("H1 should be parsed")
+	}
+	if aSec.responsePacketMagicHeader != 102 || aSec.responsePacketMagicHeaderMax != 102 {
+		t.Fatal("H2 should be parsed")
+	}
+	if aSec.underloadPacketMagicHeader != 104 || aSec.underloadPacketMagicHeaderMax != 104 {
+		t.Fatal("H3 should be parsed")
+	}
+	if aSec.transportPacketMagicHeader != 105 || aSec.transportPacketMagicHeaderMax != 106 {
+		t.Fatal("H4 should be parsed")
+	}
+	for i, got := range []*string{aSec.i1, aSec.i2, aSec.i3, aSec.i4, aSec.i5} {
+		if got == nil {
+			t.Fatalf("I%d should be parsed", i+1)
+		}
+	}
+	if *aSec.i1 != "<b 0xA1B2C3D4E5F6>" || *aSec.i5 != "<b 0x04>" {
+		t.Fatal("I-field values should be kept verbatim")
+	}
+}
+
+func TestDeviceConfigToKubernetesSecret(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1
+Jc = 5
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 94.140.11.15:51820`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParsePeers(iniData, &cfg.Peers); err != nil {
+		t.Fatal(err)
+	}
+
+	type manifest struct {
+		Kind     string `yaml:"kind"`
+		Metadata struct {
+			Name      string `yaml:"name"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"metadata"`
+		Data map[string]string `yaml:"data"`
+	}
+	secret := cfg.ToKubernetesSecret("wireproxy", "proxy")
+	var parsed manifest
+	if err := yaml.Unmarshal([]byte(secret), &parsed); err != nil {
+		t.Fatalf("%v:\n%s", err, secret)
+	}
+	if parsed.Kind != "Secret" || parsed.Metadata.Name != "wireproxy" || parsed.Metadata.Namespace != "proxy" {
+		t.Fatalf("unexpected manifest:\n%s", secret)
+	}
+	data := parsed.Data
+
+	// special characters must not change the structure of the manifest
+	injected := cfg.ToKubernetesSecret("a: b\ntype: injected # c", "ns\"\\")
+	parsed = manifest{}
+	if err := yaml.Unmarshal([]byte(injected), &parsed); err != nil {
+		t.Fatalf("%v:\n%s", err, injected)
+	}
+	if parsed.Metadata.Name != "a: b\ntype: injected # c" || parsed.Metadata.Namespace != "ns\"\\" || len(parsed.Data) != 2 {
+		t.Fatalf("name and namespace should be quoted:\n%s", injected)
+	}
+
+	privateKey, err := base64.StdEncoding.DecodeString(data["private.key"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(privateKey) != "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=" {
+		t.Fatal("private.key should hold the private key")
+	}
+
+	conf, err := base64.StdEncoding.DecodeString(data["config.conf"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(conf), "PrivateKey") {
+		t.Fatal("config.conf should not contain the private key")
+	}
+	for _, line := range []string{"Address = 10.5.0.2\n", "DNS = 1.1.1.1\n", "Jc = 5\n", "Endpoint = 94.140.11.15:51820\n"} {
+		if !strings.Contains(string(conf), line) {
+			t.Fatalf("config.conf should contain %q:\n%s", line, conf)
+		}
+	}
+}
+
+func TestParseMultipleProxySections(t *testing.T) {
+	const config = `
+[Proxy]
+Type = socks5
+BindAddress = 127.0.0.1:1080
+
+[Proxy]
+Type = HTTP
+BindAddress = 127.0.0.1:8080
+Username = user
+Password = pass
+`
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var routines []RoutineSpawner
+	if err := parseRoutinesConfig(&routines, iniData, "Proxy", parseProxyConfig); err != nil {
+		t.Fatal(err)
+	}
+	if len(routines) != 2 {
+		t.Fatalf("expected 2 proxies, got %d", len(routines))
+	}
+
+	socks5, ok := routines[0].(*Socks5Config)
+	if !ok || socks5.BindAddress != "127.0.0.1:1080" {
+		t.Fatalf("first proxy should be socks5 on port 1080, got %#v", routines[0])
+	}
+	http, ok := routines[1].(*HTTPConfig)
+	if !ok || http.BindAddress != "127.0.0.1:8080" || http.Username != "user" {
+		t.Fatalf("second proxy should be http on port 8080, got %#v", routines[1])
+	}
+
+	iniData, err = loadIniConfig("[Proxy]\nType = ftp\nBindAddress = 127.0.0.1:21\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parseRoutinesConfig(&routines, iniData, "Proxy", parseProxyConfig); err == nil {
+		t.Fatal("unknown proxy type should be rejected")
+	}
+}
+
+func TestParseSocks5UDPOptions(t *testing.T) {
+	iniData, err := loadIniConfig("[Socks5]\nBindAddress = 127.0.0.1:1080\nUDPMaxConnections = 50\nUDPIdleTimeout = 120\nUDPConnectionPerTarget = true\nUDPDNSCacheSize = 0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spawner, err := parseSocks5Config(iniData.Section("Socks5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := spawner.(*Socks5Config)
+	if config.UDPMaxConnections != 50 || config.UDPIdleTimeout != 2*time.Minute {
+		t.Fatalf("UDP options should be parsed, got %+v", config)
+	}
+
+	server := config.newServer(&VirtualTun{})
+	if server.udp.config.MaxConnections != 50 || server.udp.config.IdleTimeout != 2*time.Minute ||
+		server.udp.config.DNSCacheSize != 0 {
+		t.Fatalf("UDP options should reach the UDP server, got %+v", server.udp.config)
+	}
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	if config.UDPKeyFunc == nil || server.udp.config.KeyFunc(client, "1.1.1.1", 53) == server.udp.config.KeyFunc(client, "8.8.8.8", 53) {
+		t.Fatal("UDPConnectionPerTarget should key relay connections by destination")
+	}
+	server = (&Socks5Config{BindAddress: "127.0.0.1:1080"}).newServer(&VirtualTun{})
+	if want := defaultSocks5UDPConfig(); server.udp.config.MaxConnections != want.MaxConnections ||
+		server.udp.config.IdleTimeout != want.IdleTimeout || server.udp.config.DNSCacheSize != dnsCacheMaxSize {
+		t.Fatalf("unset UDP options should keep the defaults, got %+v", server.udp.config)
+	}
+
+	iniData, err = loadIniConfig("[Socks5]\nBindAddress = 127.0.0.1:1080\nUDPMaxConnections = -1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseSocks5Config(iniData.Section("Socks5")); err == nil {
+		t.Fatal("negative UDPMaxConnections should be rejected")
+	}
+}
+
+func TestASecConfigNormalize(t *testing.T) {
+	ipcRequest := func(config string) string {
+		var cfg DeviceConfig
+		iniData, err := loadIniConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ParseInterface(iniData, &cfg); err != nil {
+			t.Fatal(err)
+		}
+		ipcReq, err := CreateIPCRequest(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ipcReq.IpcRequest
+	}
+
+	const header = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+`
+	ranged := ipcRequest(header + "H1 = 7-7\n")
+	single := ipcRequest(header + "H1 = 7\n")
+	if ranged != single {
+		t.Fatalf("equivalent configurations should produce the same IPC request:\n%s\n%s", ranged, single)
+	}
+	if !strings.Contains(single, "h1=7\n") {
+		t.Fatal("single value range should be emitted as a point value")
+	}
+
+	i1 := "<b 0x01>"
+	config := &ASecConfigType{
+		junkPacketCount:          7,
+		initPacketMagicHeader:    9,
+		hasInitPacketMagicHeader: true,
+		i1:                       &i1,
+	}
+	normalized := config.Normalize()
+	if normalized.junkPacketCount != 0 {
+		t.Fatal("value of an unset field should be zeroed")
+	}
+	if normalized.initPacketMagicHeaderMax != 9 {
+		t.Fatal("missing upper bound should collapse to the lower bound")
+	}
+	if normalized.i1 == config.i1 || *normalized.i1 != i1 {
+		t.Fatal("I-fields should be copied")
+	}
+	if config.junkPacketCount != 7 || config.initPacketMagicHeaderMax != 0 {
+		t.Fatal("Normalize should not modify the receiver")
+	}
+	if (*ASecConfigType)(nil).Normalize() != nil {
+		t.Fatal("nil configuration should stay nil")
+	}
+}
+
+func TestWireguardConfPreservesWhitespaceInIFields(t *testing.T) {
+	const config = "\n[Interface]\n" +
+		"PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\n" +
+		"Address = 10.5.0.2\n" +
+		"I1 = <b 0xA1B2C3>  <extra-space>  \n"
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ParseInterface(iniData, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ASecConfig == nil || cfg.ASecConfig.i1 == nil {
+		t.Fatal("I1 should be parsed")
+	}
+	if *cfg.ASecConfig.i1 != "<b 0xA1B2C3>  <extra-space>" {
+		t.Fatalf("trailing whitespace should be stripped and internal whitespace kept, got %q", *cfg.ASecConfig.i1)
+	}
+}
+
+func TestASecConfigWarningsForEqualS1S2(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		warnings int
+	}{
+		{name: "equal", config: "S1 = 20\nS2 = 20\n", warnings: 1},
+		{name: "distinct", config: "S1 = 20\nS2 = 21\n", warnings: 0},
+		{name: "zero", config: "S1 = 0\nS2 = 0\n", warnings: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg DeviceConfig
+			iniData, err := loadIniConfig(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+` + tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ParseInterface(iniData, &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if got := ASecConfigWarnings(cfg.ASecConfig); len(got) != tt.warnings {
+				t.Fatalf("expected %d warnings, got %v", tt.warnings, got)
+			}
+		})
+	}
+}
+
+func TestDeviceConfigHashImpliesEqual(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	pick := func(n int) int { return rng.Intn(n) }
+
+	keys := []string{
+		"2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d",
+		"7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c",
+	}
+	addrs := [][]netip.Addr{nil, {netip.MustParseAddr("10.5.0.2")}}
+	endpoint := "94.140.11.15:51820"
+
+	randomConfig := func() *DeviceConfig {
+		conf := &DeviceConfig{
+			SecretKey:          keys[pick(2)],
+			Endpoint:           addrs[pick(2)],
+			DNS:                addrs[pick(2)],
+			MTU:                []int{1280, 1420}[pick(2)],
+			CheckAlive:         addrs[pick(2)],
+			CheckAliveInterval: 5 + pick(2),
+		}
+		if pick(2) == 0 {
+			port := 51820
+			conf.ListenPort = &port
+		}
+		if pick(2) == 0 {
+			table := RouteTableOff
+			conf.RouteTable = &table
+		}
+		if pick(2) == 0 {
+			conf.PostUp = []string{"true"}
+		}
+		if pick(2) == 0 {
+			conf.Comments = map[string][]string{"interface": {"# home"}}
+		}
+		switch pick(4) {
+		case 1:
+			conf.ASecConfig = &ASecConfigType{}
+		case 2:
+			conf.ASecConfig = &ASecConfigType{hasJunkPacketCount: true, junkPacketCount: 5}
+		case 3:
+			conf.ASecConfig = &ASecConfigType{
+				hasInitPacketMagicHeader: true,
+				initPacketMagicHeader:    5,
+				initPacketMagicHeaderMax: uint32(pick(2) * 5),
+			}
+		}
+		for i := pick(3); i > 0; i-- {
+			peer := PeerConfig{
+				PublicKey:    keys[pick(2)],
+				PreSharedKey: []string{"", zeroKey, keys[pick(2)]}[pick(3)],
+				KeepAlive:    pick(2) * 25,
+			}
+			if pick(2) == 0 {
+				peer.Endpoint = &endpoint
+			}
+			if pick(2) == 0 {
+				peer.AllowedIPs = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+			}
+			conf.Peers = append(conf.Peers, peer)
+		}
+		return conf
+	}
+	// mutate returns a copy of conf with one field changed, possibly to an equivalent value
+	mutate := func(conf *DeviceConfig) *DeviceConfig {
+		conf = conf.Clone()
+		switch pick(4) {
+		case 0:
+			slices.Reverse(conf.Peers)
+		case 1:
+			for i := range conf.Peers {
+				if !conf.Peers[i].hasPresharedKey() {
+					conf.Peers[i].PreSharedKey = []string{"", zeroKey}[pick(2)]
+				}
+			}
+		case 2:
+			conf.PostDown = []string{"true"}
+		case 3:
+			conf.Comments = map[string][]string{"interface.dns": {"# resolver"}}
+		}
+		return conf
+	}
+
+	equalPairs := 0
+	for i := 0; i < 5000; i++ {
+		a, b := randomConfig(), randomConfig()
+		if pick(2) == 0 {
+			b = mutate(a)
+		}
+		sameHash := a.Hash() == b.Hash()
+		if sameHash && !a.Equal(b) {
+			t.Fatalf("configurations with the same hash should be equal:\n%+v\n%+v", a, b)
+		}
+		if !sameHash && a.Equal(b) {
+			t.Fatalf("equal configurations should have the same hash:\n%+v\n%+v", a, b)
+		}
+		if sameHash {
+			equalPairs++
+		}
+	}
+	if equalPairs == 0 {
+		t.Fatal("the generator should produce some equal configurations")
+	}
+
+	invalidA, invalidB := &DeviceConfig{SecretKey: "a"}, &DeviceConfig{SecretKey: "b"}
+	if invalidA.Hash() == invalidB.Hash() || invalidA.Equal(invalidB) {
+		t.Fatal("invalid configurations should not collide")
+	}
+	withZeroKey := &DeviceConfig{Peers: []PeerConfig{{PublicKey: keys[1], PreSharedKey: zeroKey}}}
+	withoutKey := &DeviceConfig{Peers: []PeerConfig{{PublicKey: keys[1]}}}
+	if withZeroKey.Hash() != withoutKey.Hash() || !withZeroKey.Equal(withoutKey) {
+		t.Fatal("an all-zero preshared key should be the same as none")
+	}
+}
+
+func TestWireguardConfWithPeerAllowedIPsIPv4MappedIPv6(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = ::ffff:10.0.0.1/128, ::ffff:192.168.0.0/112
+Endpoint = 94.140.11.15:51820`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParsePeers(iniData, &cfg.Peers); err != nil {
+		t.Fatal(err)
+	}
+
+	ipcReq, err := CreateIPCRequest(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ipcReq.IpcRequest, "allowed_ip=10.0.0.1/32\n") {
+		t.Fatalf("IPv4-mapped address should be emitted in IPv4 form:\n%s", ipcReq.IpcRequest)
+	}
+	if !strings.Contains(ipcReq.IpcRequest, "allowed_ip=192.168.0.0/16\n") {
+		t.Fatalf("IPv4-mapped prefix should be emitted in IPv4 form:\n%s", ipcReq.IpcRequest)
+	}
+	if strings.Contains(ipcReq.IpcRequest, "::ffff:") {
+		t.Fatal("IPv4-mapped form should not be emitted")
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	const tmpl = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+Jc = {{ .JunkPacketCount }}
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = {{ .Host }}:{{ .Port }}
+`
+	conf, err := ParseTemplate(tmpl, map[string]interface{}{
+		"JunkPacketCount": 7,
+		"Host":            "94.140.11.15",
+		"Port":            51820,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ASecConfig == nil || conf.ASecConfig.junkPacketCount != 7 {
+		t.Fatal("Jc should be rendered from the template")
+	}
+	if len(conf.Peers) != 1 || conf.Peers[0].Endpoint == nil || *conf.Peers[0].Endpoint != "94.140.11.15:51820" {
+		t.Fatal("endpoint should be rendered from the template")
+	}
+
+	if _, err := ParseTemplate(tmpl, map[string]interface{}{"JunkPacketCount": 7}); err == nil {
+		t.Fatal("missing template variables should be reported")
+	}
+}
+
+func TestASecConfigWarningsForStandardHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		warnings int
+	}{
+		{name: "defaults", config: "H1 = 1\nH2 = 2\nH3 = 3\nH4 = 4\n", warnings: 4},
+		{name: "range overlapping", config: "H1 = 100\nH2 = 3-4\nH3 = 200\nH4 = 300\n", warnings: 1},
+		{name: "custom", config: "H1 = 100\nH2 = 200\nH3 = 300\nH4 = 400\n", warnings: 0},
+		{name: "unset", config: "Jc = 5\n", warnings: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg DeviceConfig
+			iniData, err := loadIniConfig(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+` + tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ParseInterface(iniData, &cfg); err != nil {
+				t.Fatal(err)
+			}
+			if got := ASecConfigWarnings(cfg.ASecConfig); len(got) != tt.warnings {
+				t.Fatalf("expected %d warnings, got %v", tt.warnings, got)
+			}
+		})
+	}
+}
+
+func TestWireguardConfWithCommentsAndBlankLines(t *testing.T) {
+	const config = `
+# interface settings
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+
+Address = 10.5.0.2 ; tunnel address
+Jc = 5 # junk count
+
+Jmin = 10
+; Jmax is the upper bound
+Jmax = 50
+
+
+[Peer]
+# upstream server
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+
+Endpoint = 94.140.11.15:51820 # server
+PersistentKeepalive = 25
+`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParsePeers(iniData, &cfg.Peers); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Endpoint) != 1 || cfg.Endpoint[0].String() != "10.5.0.2" {
+		t.Fatalf("Address should be parsed without the comment, got %v", cfg.Endpoint)
+	}
+	if cfg.ASecConfig == nil || cfg.ASecConfig.junkPacketCount != 5 {
+		t.Fatal("Jc should be parsed without the comment")
+	}
+	if cfg.ASecConfig.junkPacketMinSize != 10 || cfg.ASecConfig.junkPacketMaxSize != 50 {
+		t.Fatal("keys after blank lines and comments should be parsed")
+	}
+	if len(cfg.Peers) != 1 || *cfg.Peers[0].Endpoint != "94.140.11.15:51820" || cfg.Peers[0].KeepAlive != 25 {
+		t.Fatal("peer should be parsed without comments")
+	}
+}
+
+func TestASecConfigHexMagicHeaderOutput(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+H1 = 3735928559-3735928560
+H2 = 0x1000000
+H3 = 300
+H4 = 0xCAFEBABE
+`
+	parse := func(source string) *DeviceConfig {
+		t.Helper()
+		var cfg DeviceConfig
+		iniData, err := loadIniConfig(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ParseInterface(iniData, &cfg); err != nil {
+			t.Fatal(err)
+		}
+		return &cfg
+	}
+
+	cfg := parse(config)
+	if cfg.ASecConfig.responsePacketMagicHeader != 0x1000000 || cfg.ASecConfig.transportPacketMagicHeader != 0xCAFEBABE {
+		t.Fatal("hex magic headers should be parsed")
+	}
+
+	cfg.ASecConfig.UseHexFormatInOutput = true
+	var buf strings.Builder
+	cfg.writeINI(&buf, true)
+	for _, line := range []string{"H1 = 0xdeadbeef-0xdeadbef0\n", "H2 = 0x1000000\n", "H3 = 300\n", "H4 = 0xcafebabe\n"} {
+		if !strings.Contains(buf.String(), line) {
+			t.Fatalf("expected %q in output:\n%s", line, buf.String())
+		}
+	}
+	if !parse(buf.String()).Equal(cfg) {
+		t.Fatal("hex output should parse back to the same configuration")
+	}
+
+	request, err := CreateIPCRequest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(request.IpcRequest, "h1=3735928559-3735928560\n") {
+		t.Fatalf("IPC request should use decimal values:\n%s", request.IpcRequest)
+	}
+
+	for _, value := range []string{"0x", "0x123456789", "0xfoo"} {
+		if _, _, err := ParseMagicHeaderIntervalString(value); err == nil {
+			t.Fatalf("%s: error expected", value)
+		}
+	}
+}
+
+func TestMagicHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		value    string
+		min, max uint32
+		wantErr  bool
+	}{
+		{value: "0", min: 0, max: 0},
+		{value: "1", min: 1, max: 1},
+		{value: "100", min: 100, max: 100},
+		{value: "100-200", min: 100, max: 200},
+		{value: "7-7", min: 7, max: 7},
+		{value: "0-4294967295", min: 0, max: math.MaxUint32},
+		{value: "4294967294", min: math.MaxUint32 - 1, max: math.MaxUint32 - 1},
+		{value: "4294967294-4294967295", min: math.MaxUint32 - 1, max: math.MaxUint32},
+		{value: "4294967295", min: math.MaxUint32, max: math.MaxUint32},
+		{value: " 10-20 ", min: 10, max: 20},
+		{value: "0x10", min: 16, max: 16},
+		{value: "0xdeadbeef-0xdeadbef0", min: 0xdeadbeef, max: 0xdeadbef0},
+		{value: "0XFF", min: 255, max: 255},
+		{value: "", wantErr: true},
+		{value: "-", wantErr: true},
+		{value: "1-", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "1-2-3", wantErr: true},
+		{value: "20-10", wantErr: true},
+		{value: "4294967296", wantErr: true},
+		{value: "abc", wantErr: true},
+		{value: "*", wantErr: true},
+		{value: "1.5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		minValue, maxValue, err := ParseMagicHeaderIntervalString(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: error expected", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.value, err)
+			continue
+		}
+		if minValue != tt.min || maxValue != tt.max {
+			t.Errorf("%q: got %d-%d, want %d-%d", tt.value, minValue, maxValue, tt.min, tt.max)
+			continue
+		}
+
+		formatted := formatMagicHeaderInterval(minValue, maxValue)
+		minAgain, maxAgain, err := ParseMagicHeaderIntervalString(formatted)
+		if err != nil || minAgain != minValue || maxAgain != maxValue {
+			t.Errorf("%q: formatted as %q, parsed back as %d-%d, %v", tt.value, formatted, minAgain, maxAgain, err)
+		}
+	}
+}
+
+func FuzzParseMagicHeaderInterval(f *testing.F) {
+	for _, seed := range []string{"1", "100-200", "0xdeadbeef-0xdeadbef0", "4294967295", "1-", "-", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		minValue, maxValue, err := ParseMagicHeaderIntervalString(value)
+		if err != nil {
+			return
+		}
+		if minValue > maxValue {
+			t.Fatalf("%q: lower bound %d above upper bound %d", value, minValue, maxValue)
+		}
+		formatted := formatMagicHeaderInterval(minValue, maxValue)
+		minAgain, maxAgain, err := ParseMagicHeaderIntervalString(formatted)
+		if err != nil {
+			t.Fatalf("%q: formatted value %q does not parse: %v", value, formatted, err)
+		}
+		if minAgain != minValue || maxAgain != maxValue {
+			t.Fatalf("%q: got %d-%d after a round trip, want %d-%d", value, minAgain, maxAgain, minValue, maxValue)
+		}
+	})
+}
+
+func TestDeviceConfigFormatRedactsKeys(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1
+UpstreamSOCKS5 = 127.0.0.1:1080
+UpstreamSOCKS5Username = proxyuser
+UpstreamSOCKS5Password = proxysecret
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+PresharedKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 94.140.11.15:51820`
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParsePeers(iniData, &cfg.Peers); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := []string{
+		cfg.SecretKey, "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=",
+		cfg.Peers[0].PreSharedKey, "SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=",
+		"proxysecret",
+	}
+	for _, format := range []string{"%v", "%+v", "%s", "%q"} {
+		out := fmt.Sprintf(format, &cfg)
+		for _, secret := range secrets {
+			if strings.Contains(out, secret) {
+				t.Fatalf("%s leaks a key: %s", format, out)
+			}
+		}
+		if !strings.Contains(out, "e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=") || !strings.Contains(out, "10.5.0.2") {
+			t.Fatalf("%s should describe the configuration: %s", format, out)
+		}
+	}
+
+	goSyntax := fmt.Sprintf("%#v", &cfg)
+	if !strings.HasPrefix(goSyntax, "&wireproxy.DeviceConfig{") || !strings.Contains(goSyntax, cfg.SecretKey) {
+		t.Fatalf("%%#v should print the full configuration: %s", goSyntax)
+	}
+	if got := fmt.Sprintf("%v", (*DeviceConfig)(nil)); got != "<nil>" {
+		t.Fatalf("unexpected nil formatting: %s", got)
+	}
+}
+
+func FuzzValidateASecConfig(f *testing.F) {
+	// flags is a bit set of the has* fields in declaration order
+	f.Add(uint16(0b0000_0000_0010), 0, 10, 0, 0, 0, 0, 0, uint32(0), uint32(0), uint32(0), uint32(0), uint32(0), 0, false)
+	f.Add(uint16(0b0000_0000_0100), 0, 0, 1281, 0, 0, 0, 0, uint32(0), uint32(0), uint32(0), uint32(0), uint32(0), 0, false)
+	f.Add(uint16(0b0000_0000_0110), 5, 100, 50, 0, 0, 0, 0, uint32(0), uint32(0), uint32(0), uint32(0), uint32(0), 0, false)
+	f.Add(uint16(0b0000_0001_1000), 0, 0, 0, 56, 0, 0, 0, uint32(0), uint32(0), uint32(0), uint32(0), uint32(0), 0, false)
+	f.Add(uint16(0b0111_1000_0001), 5, 0, 0, 0, 0, 0, 0, uint32(100), uint32(50), uint32(200), uint32(300), uint32(400), 1, true)
+	f.Add(uint16(0b0111_1111_1111), -1, -1280, 1<<31-1, -148, -92, -64, -32, ^uint32(0), uint32(0), ^uint32(0), uint32(1), uint32(4), 3, true)
+
+	f.Fuzz(func(t *testing.T, flags uint16, jc, jmin, jmax, s1, s2, s3, s4 int, h1, h1Max, h2, h3, h4 uint32, mode int, hasMode bool) {
+		has := func(bit int) bool { return flags&(1<<bit) != 0 }
+		config := &ASecConfigType{
+			junkPacketCount:               jc,
+			junkPacketMinSize:             jmin,
+			junkPacketMaxSize:             jmax,
+			initPacketJunkSize:            s1,
+			responsePacketJunkSize:        s2,
+			cookieReplyPacketJunkSize:     s3,
+			transportPacketJunkSize:       s4,
+			initPacketMagicHeader:         h1,
+			initPacketMagicHeaderMax:      h1Max,
+			responsePacketMagicHeader:     h2,
+			responsePacketMagicHeaderMax:  h2,
+			underloadPacketMagicHeader:    h3,
+			underloadPacketMagicHeaderMax: h3,
+			transportPacketMagicHeader:    h4,
+			transportPacketMagicHeaderMax: h4,
+			hasJunkPacketCount:            has(0),
+			hasJunkPacketMinSize:          has(1),
+			hasJunkPacketMaxSize:          has(2),
+			hasInitPacketJunkSize:         has(3),
+			hasResponsePacketJunkSize:     has(4),
+			hasCookieReplyPacketJunkSize:  has(5),
+			hasTransportPacketJunkSize:    has(6),
+			hasInitPacketMagicHeader:      has(7),
+			hasResponsePacketMagicHeader:  has(8),
+			hasUnderloadPacketMagicHeader: has(9),
+			hasTransportPacketMagicHeader: has(10),
+		}
+		if hasMode {
+			config.mode = &mode
+		}
+
+		err := ValidateASecConfig(config)
+		_ = ASecConfigWarnings(config)
+		_ = config.Normalize().fields()
+
+		if err != nil {
+			return
+		}
+		effectiveJmin, effectiveJmax := 0, 0
+		if config.hasJunkPacketMinSize {
+			effectiveJmin = jmin
+		}
+		if config.hasJunkPacketMaxSize {
+			effectiveJmax = jmax
+		}
+		if (config.hasJunkPacketMinSize || config.hasJunkPacketMaxSize) && effectiveJmin > effectiveJmax {
+			t.Fatalf("Jmin %d > Jmax %d accepted", effectiveJmin, effectiveJmax)
+		}
+		if config.hasJunkPacketMaxSize && jmax > 1280 {
+			t.Fatalf("Jmax %d accepted", jmax)
+		}
+		if config.hasInitPacketMagicHeader && h1 > h1Max {
+			t.Fatalf("H1 range %d-%d accepted", h1, h1Max)
+		}
+		for i, size := range []int{s1, s2, s3, s4} {
+			if has(3+i) && (size < 0 || size > maxJunkSize) {
+				t.Fatalf("S%d = %d accepted", i+1, size)
+			}
+		}
+	})
+}
+
+func TestParseInterfaceWithASecConfigInPeer(t *testing.T) {
+	const iface = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+`
+	const peer = `
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+`
+	parse := func(config string) (*DeviceConfig, error) {
+		var cfg DeviceConfig
+		iniData, err := loadIniConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return &cfg, ParseInterface(iniData, &cfg)
+	}
+
+	cfg, err := parse(iface + peer + "Jc = 5\nJmin = 10\nJmax = 50\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ASecConfig == nil || cfg.ASecConfig.junkPacketCount != 5 || cfg.ASecConfig.junkPacketMaxSize != 50 {
+		t.Fatalf("AWG parameters of the peer should be used, got %+v", cfg.ASecConfig)
+	}
+
+	if _, err := parse(iface + "Jc = 5\n" + peer + "Jc = 5\n"); err == nil {
+		t.Fatal("AWG parameters in both sections should be rejected")
+	}
+	if _, err := parse(iface + peer + "Jc = 5\n" + peer + "Jc = 6\n"); err == nil {
+		t.Fatal("different AWG parameters in peers should be rejected")
+	}
+	if _, err := parse(iface + peer + "Jc = 5\n" + peer + "Jc = 5\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err = parse(iface + "Jc = 5\n" + peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ASecConfig == nil || cfg.ASecConfig.junkPacketCount != 5 {
+		t.Fatal("AWG parameters of the interface should be kept")
+	}
+}
+
+func TestASecConfigJSONSchema(t *testing.T) {
+	data, err := json.Marshal(ASecConfigType{}.JSONSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var schema struct {
+		Schema     string `json:"$schema"`
+		Type       string `json:"type"`
+		Properties map[string]struct {
+			Type    string   `json:"type"`
+			Minimum *float64 `json:"minimum"`
+			Maximum *float64 `json:"maximum"`
+			Pattern string   `json:"pattern"`
+		} `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("schema should be valid JSON: %v\n%s", err, data)
+	}
+	if schema.Type != "object" || len(schema.Properties) != 17 {
+		t.Fatalf("unexpected schema: %s", data)
+	}
+
+	if schema.Schema != "http://json-schema.org/draft-07/schema#" {
+		t.Fatalf("schema should be draft-07, got %s", schema.Schema)
+	}
+
+	jc := schema.Properties["jc"]
+	if jc.Type != "integer" || jc.Minimum == nil || *jc.Minimum != minJunkPacketCount || jc.Maximum == nil || *jc.Maximum != maxJunkPacketCount {
+		t.Fatalf("unexpected Jc schema: %+v", jc)
+	}
+	if jmax := schema.Properties["jmax"]; jmax.Maximum == nil || *jmax.Maximum != maxJunkPacketSize {
+		t.Fatalf("unexpected Jmax schema: %+v", jmax)
+	}
+	if i1 := schema.Properties["i1"]; i1.Type != "string" {
+		t.Fatalf("unexpected I1 schema: %+v", i1)
+	}
+
+	pattern := regexp.MustCompile(schema.Properties["h1"].Pattern)
+	for _, value := range []string{"1", "100-200", "0xdeadbeef", "0x10-0x20"} {
+		if !pattern.MatchString(value) {
+			t.Fatalf("%s should match the H1 pattern", value)
+		}
+		if _, _, err := ParseMagicHeaderIntervalString(value); err != nil {
+			t.Fatalf("%s should be accepted by the parser: %v", value, err)
+		}
+	}
+	for _, value := range []string{"", "abc", "1-", "-1", "1-2-3"} {
+		if pattern.MatchString(value) {
+			t.Fatalf("%s should not match the H1 pattern", value)
+		}
+	}
+}
+
+func TestASecConfigExportMatchesJSONSchema(t *testing.T) {
+	iniData, err := loadIniConfig(`
+[Interface]
+Mode = 2
+Jc = 5
+Jmin = 10
+Jmax = 50
+S1 = 15
+S2 = 18
+S3 = 20
+S4 = 23
+H1 = 100-101
+H2 = 102-103
+H3 = 104
+H4 = 105-106
+I1 = <b 0xA1B2>
+I2 = <r 16>
+I3 = <c>
+I4 = <t>
+I5 = <b 0xFF>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseASecConfig(iniData.Section("Interface"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(config.Export())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported map[string]any
+	if err := json.Unmarshal(data, &exported); err != nil {
+		t.Fatal(err)
+	}
+
+	schemaData, err := json.Marshal(ASecConfigType{}.JSONSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties map[string]struct {
+			Type    string    `json:"type"`
+			Minimum *float64  `json:"minimum"`
+			Maximum *float64  `json:"maximum"`
+			Pattern string    `json:"pattern"`
+			Enum    []float64 `json:"enum"`
+		} `json:"properties"`
+		AdditionalProperties *bool `json:"additionalProperties"`
+	}
+	if err := json.Unmarshal(schemaData, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if schema.AdditionalProperties == nil || *schema.AdditionalProperties {
+		t.Fatalf("schema should reject unknown properties: %s", schemaData)
+	}
+	if len(exported) != len(schema.Properties) {
+		t.Fatalf("exported %d parameters, the schema describes %d", len(exported), len(schema.Properties))
+	}
+
+	for key, value := range exported {
+		property, ok := schema.Properties[key]
+		if !ok {
+			t.Fatalf("exported parameter %s is not a property of the schema", key)
+		}
+		switch property.Type {
+		case "integer":
+			number, ok := value.(float64)
+			if !ok || number != float64(int(number)) {
+				t.Fatalf("%s: %v should be an integer", key, value)
+			}
+			if property.Minimum != nil && number < *property.Minimum || property.Maximum != nil && number > *property.Maximum {
+				t.Fatalf("%s: %v is out of range", key, value)
+			}
+			if len(property.Enum) > 0 && !slices.Contains(property.Enum, number) {
+				t.Fatalf("%s: %v is not one of %v", key, value, property.Enum)
+			}
+		case "string":
+			str, ok := value.(string)
+			if !ok {
+				t.Fatalf("%s: %v should be a string", key, value)
+			}
+			if property.Pattern != "" && !regexp.MustCompile(property.Pattern).MatchString(str) {
+				t.Fatalf("%s: %q should match %s", key, str, property.Pattern)
+			}
+		default:
+			t.Fatalf("%s: unexpected schema type %s", key, property.Type)
+		}
+	}
+}
+
+func TestDeviceConfigJSONSchema(t *testing.T) {
+	data, err := json.MarshalIndent(DeviceConfigJSONSchema(), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := os.ReadFile(filepath.Join("schema", "device_config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(generated) != string(data)+"\n" {
+		t.Fatal("schema/device_config.json is out of date, run go generate")
+	}
+
+	var schema struct {
+		Defs map[string]struct {
+			Properties map[string]struct {
+				Ref     string   `json:"$ref"`
+				Minimum *float64 `json:"minimum"`
+				Maximum *float64 `json:"maximum"`
+			} `json:"properties"`
+			Required []string `json:"required"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+	device := schema.Defs["DeviceConfig"]
+	if !slices.Equal(device.Required, []string{"SecretKey"}) {
+		t.Fatalf("unexpected required fields %v", device.Required)
+	}
+	if port := device.Properties["ListenPort"]; port.Maximum == nil || *port.Maximum != 65535 {
+		t.Fatalf("unexpected ListenPort schema: %+v", port)
+	}
+	if ref := device.Properties["ASecConfig"].Ref; ref != "#/$defs/ASecConfigType" {
+		t.Fatalf("ASecConfig should reference the AWG schema, got %q", ref)
+	}
+	if jc := schema.Defs["ASecConfigType"].Properties["jc"]; jc.Maximum == nil || *jc.Maximum != 128 {
+		t.Fatalf("unexpected Jc schema: %+v", jc)
+	}
+	if peer := schema.Defs["PeerConfig"]; !slices.Equal(peer.Required, []string{"PublicKey"}) {
+		t.Fatalf("unexpected required peer fields %v", peer.Required)
+	}
+}
+
+func TestASecPeerWarnings(t *testing.T) {
+	endpoint := func(value string) PeerConfig { return PeerConfig{Endpoint: &value} }
+	junk := &ASecConfigType{junkPacketCount: 5, hasJunkPacketCount: true}
+	headersOnly := &ASecConfigType{initPacketMagicHeader: 100, initPacketMagicHeaderMax: 100, hasInitPacketMagicHeader: true}
+
+	tests := []struct {
+		name     string
+		config   *ASecConfigType
+		peers    []PeerConfig
+		warnings int
+	}{
+		{name: "loopback", config: junk, peers: []PeerConfig{endpoint("127.0.0.1:51820")}, warnings: 1},
+		{name: "private", config: junk, peers: []PeerConfig{endpoint("192.168.1.10:51820"), endpoint("[fd00::1]:51820"), {}}, warnings: 1},
+		{name: "mapped private", config: junk, peers: []PeerConfig{endpoint("[::ffff:10.0.0.1]:51820")}, warnings: 1},
+		{name: "public", config: junk, peers: []PeerConfig{endpoint("10.0.0.1:51820"), endpoint("94.140.11.15:51820")}, warnings: 0},
+		{name: "no endpoints", config: junk, peers: []PeerConfig{{}}, warnings: 0},
+		{name: "headers only", config: headersOnly, peers: []PeerConfig{endpoint("127.0.0.1:51820")}, warnings: 0},
+		{name: "no AWG", config: nil, peers: []PeerConfig{endpoint("127.0.0.1:51820")}, warnings: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ASecPeerWarnings(tt.config, tt.peers); len(got) != tt.warnings {
+				t.Fatalf("expected %d warnings, got %v", tt.warnings, got)
+			}
+		})
+	}
+}
+
+func TestParseInterfaceRouteTable(t *testing.T) {
+	tests := []struct {
+		key     string
+		value   string
+		want    RouteTableMode
+		wantErr bool
+	}{
+		{key: "RoutingTable", value: "off", want: RouteTableOff},
+		{key: "RoutingTable", value: "Auto", want: RouteTableAuto},
+		{key: "RoutingTable", value: "51820", want: RouteTableCustom(51820)},
+		{key: "RoutingTable", value: "main", wantErr: true},
+		{key: "RoutingTable", value: "-1", wantErr: true},
+		{key: "Table", value: "off", want: RouteTableOff},
+		{key: "Table", value: "auto", want: RouteTableAuto},
+		{key: "Table", value: "1234", want: RouteTableCustom(1234)},
+		{key: "Table", value: "on", wantErr: true},
+		{key: "Table", value: "off\nRoutingTable = off", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var cfg DeviceConfig
+		iniData, err := loadIniConfig(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+` + tt.key + ` = ` + tt.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ParseInterface(iniData, &cfg)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: error expected", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.value, err)
+			continue
+		}
+		if cfg.RouteTable == nil || *cfg.RouteTable != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.value, cfg.RouteTable, tt.want)
+			continue
+		}
+
+		var buf strings.Builder
+		cfg.writeINI(&buf, true)
+		if !strings.Contains(buf.String(), "Table = "+string(tt.want)+"\n") || strings.Contains(buf.String(), "RoutingTable") {
+			t.Errorf("%s: Table of wg-quick should be written back:\n%s", tt.value, buf.String())
+		}
+	}
+}
+
+func TestParseInterfaceStrictAWG(t *testing.T) {
+	tests := []struct {
+		name    string
+		strict  string
+		config  string
+		wantErr bool
+	}{
+		{name: "partial headers", strict: "true", config: "H1 = 100\nH2 = 200\n", wantErr: true},
+		{name: "all headers", strict: "true", config: "H1 = 100\nH2 = 200\nH3 = 300\nH4 = 400\n"},
+		{name: "S1 only", strict: "true", config: "S1 = 10\n", wantErr: true},
+		{name: "S1 and S2", strict: "true", config: "S1 = 10\nS2 = 20\n"},
+		{name: "junk only", strict: "true", config: "Jc = 5\n"},
+		{name: "no AWG", strict: "true", config: ""},
+		{name: "not strict", strict: "false", config: "H1 = 100\nS1 = 10\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg DeviceConfig
+			iniData, err := loadIniConfig(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+StrictAWG = ` + tt.strict + "\n" + tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ParseInterface(iniData, &cfg)
+			if tt.wantErr && err == nil {
+				t.Fatal("error expected")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMarshalINIRoundTrip(t *testing.T) {
+	const iface = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+`
+	const peer = `
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+`
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{name: "minimal", config: iface + peer},
+		{name: "addresses", config: iface + "Address = 10.5.0.2, fd00::2/64\nDNS = 1.1.1.1, 2606:4700:4700::1111\n" + peer},
+		{name: "mtu and listen port", config: iface + "MTU = 1280\nListenPort = 51820\n" + peer},
+		{name: "routing table", config: iface + "RoutingTable = off\n" + peer},
+		{name: "check alive", config: iface + "CheckAlive = 1.1.1.1, 8.8.8.8\nCheckAliveInterval = 10\n" + peer},
+		{name: "junk", config: iface + "Jc = 5\nJmin = 10\nJmax = 50\nS1 = 15\nS2 = 20\nS3 = 25\nS4 = 30\n" + peer},
+		{name: "headers", config: iface + "H1 = 100\nH2 = 200-300\nH3 = 400\nH4 = 3735928559-3735928560\n" + peer},
+		{name: "signatures", config: iface + "I1 = <b 0xA1B2C3D4E5F6><c>\nI2 = <r 16>\nI3 = <t>\nI4 = <b 0x00>\nI5 = <rc 8>\nMode = 1\n" + peer},
+		{name: "upstream socks5", config: iface + "UpstreamSOCKS5 = proxy.example.com:1080\nUpstreamSOCKS5Username = user\nUpstreamSOCKS5Password = pass\n" + peer},
+		{name: "peer", config: iface + peer + "PresharedKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=\nEndpoint = 94.140.11.15:51820\nPersistentKeepalive = 25\nAllowedIPs = 0.0.0.0/0, ::/0\n"},
+		{name: "multiple peers", config: iface + peer + "AllowedIPs = 10.0.0.0/8\n" + "\n[Peer]\nPublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=\nEndpoint = [2001:db8::1]:51820\n"},
+		{name: "comments", config: "# office tunnel" + iface + "# lower for PPPoE\n; see the wiki\nMTU = 1400 # was 1420\nJc = 5\n\n# home router" + peer + "# rotated weekly\nPresharedKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=\n"},
+	}
+
+	parse := func(t *testing.T, source string) *DeviceConfig {
+		t.Helper()
+		var cfg DeviceConfig
+		iniData, err := loadIniConfig(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ParseInterface(iniData, &cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := ParsePeers(iniData, &cfg.Peers); err != nil {
+			t.Fatal(err)
+		}
+		return &cfg
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := parse(t, tt.config)
+			data, err := MarshalINI(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg2 := parse(t, string(data)); !reflect.DeepEqual(cfg, cfg2) {
+				t.Fatalf("round trip changed the configuration:\n%s\n%+v\n%+v", data, cfg, cfg2)
+			}
+		})
+	}
+
+	cfg := parse(t, tests[len(tests)-1].config)
+	data, err := MarshalINI(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "# office tunnel\n[Interface]\n") ||
+		!strings.Contains(string(data), "# lower for PPPoE\n; see the wiki\n# was 1420\nMTU = 1400\n") ||
+		!strings.Contains(string(data), "\n# home router\n[Peer]\n") ||
+		!strings.Contains(string(data), "# rotated weekly\nPresharedKey = ") {
+		t.Fatalf("comments should be written above their section and key:\n%s", data)
+	}
+	var withoutKey strings.Builder
+	cfg.writeINI(&withoutKey, false)
+	if strings.Contains(withoutKey.String(), "#") {
+		t.Fatalf("comments should not be written without the private key:\n%s", withoutKey.String())
+	}
+
+	if _, err := MarshalINI(nil); err == nil {
+		t.Fatal("nil configuration should be rejected")
+	}
+	if _, err := MarshalINI(&DeviceConfig{SecretKey: "invalid"}); err == nil {
+		t.Fatal("invalid private key should be rejected")
+	}
+}
+
+func TestWireguardConfWithWildcardMagicHeader(t *testing.T) {
+	for _, headers := range []string{"H1 = *\n", "H1 = *\nH2 = 200\nH3 = 300\nH4 = 400\n"} {
+		var cfg DeviceConfig
+		iniData, err := loadIniConfig(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+` + headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ParseInterface(iniData, &cfg)
+		if err == nil || !strings.Contains(err.Error(), "wildcard") {
+			t.Fatalf("wildcard magic header should be rejected with a clear error, got %v", err)
+		}
+	}
+}
+
+func TestWireguardConfWithDuplicateAllowedIPs(t *testing.T) {
+	iniData, err := loadIniConfig(`
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0, 10.0.0.0/8, 0.0.0.0/0, ::/0, 10.0.0.0/8, ::ffff:0.0.0.0/96`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var peers []PeerConfig
+	if err := ParsePeers(iniData, &peers); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("::/0"),
+	}
+	if !slices.Equal(peers[0].AllowedIPs, want) {
+		t.Fatalf("duplicates should be removed keeping the first occurrences, got %v", peers[0].AllowedIPs)
+	}
+
+	unique, duplicates := dedupPrefixes(want)
+	if !slices.Equal(unique, want) || len(duplicates) != 0 {
+		t.Fatal("unique prefixes should be kept as is")
+	}
+}
+
+func TestParseConfigFromReaderAndFile(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+Jc = 4
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 94.140.11.15:51820
+`
+	device, err := ParseConfigFromReader(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.MTU != 1420 || len(device.Peers) != 1 || device.ASecConfig == nil || device.ASecConfig.junkPacketCount != 4 {
+		t.Fatalf("unexpected configuration %+v", device)
+	}
+
+	if _, err := ParseConfigFromReader(strings.NewReader("[Interface]\nAddress = 10.5.0.2\n")); err == nil {
+		t.Fatal("validation errors of ParseInterface should be returned")
+	}
+
+	path := filepath.Join(t.TempDir(), "wg.conf")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseConfigFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(strings.Replace(config, "Jc = 4", "Jc = 0", 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseConfigFromFile(path)
+	var fileErr *ConfigFileError
+	if !errors.As(err, &fileErr) || fileErr.Path != path {
+		t.Fatalf("ConfigFileError with the path expected, got %v", err)
+	}
+
+	_, err = ParseConfigFromFile(filepath.Join(t.TempDir(), "missing.conf"))
+	if !errors.As(err, &fileErr) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ConfigFileError wrapping the read error expected, got %v", err)
+	}
+
+	// a reader has no directory, relative includes are resolved from the working directory
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "awg.conf"), []byte("Jc = 6\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	device, err = ParseConfigFromReader(strings.NewReader(strings.Replace(config, "Jc = 4", "@include awg.conf", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.ASecConfig == nil || device.ASecConfig.junkPacketCount != 6 {
+		t.Fatalf("included parameters should be parsed, got %+v", device.ASecConfig)
+	}
+	if _, err := ParseConfigFromReader(strings.NewReader("@include missing.conf\n")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing include should be reported, got %v", err)
+	}
+}
+
+func TestParseConfigFromEnvironment(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1
+MTU = 1380
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 94.140.11.15:51820`
+
+	for _, value := range []string{config, base64.StdEncoding.EncodeToString([]byte(config))} {
+		t.Setenv("WG_CONFIG", value)
+		device, err := ParseConfigFromEnvironment("WG_CONFIG")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device.SecretKey != "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d" {
+			t.Fatalf("unexpected private key %s", device.SecretKey)
+		}
+		if len(device.Endpoint) != 1 || device.Endpoint[0] != netip.MustParseAddr("10.5.0.2") {
+			t.Fatalf("unexpected address %v", device.Endpoint)
+		}
+		if len(device.DNS) != 1 || device.DNS[0] != netip.MustParseAddr("1.1.1.1") {
+			t.Fatalf("unexpected DNS %v", device.DNS)
+		}
+		if device.MTU != 1380 {
+			t.Fatalf("unexpected MTU %d", device.MTU)
+		}
+		if len(device.Peers) != 1 || device.Peers[0].PublicKey != "7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c" {
+			t.Fatalf("unexpected peers %+v", device.Peers)
+		}
+	}
+
+	if _, err := ParseConfigFromEnvironment("WIREPROXY_TEST_UNSET"); !errors.Is(err, ErrEnvVarNotSet) {
+		t.Fatalf("ErrEnvVarNotSet expected, got %v", err)
+	}
+
+	t.Setenv("WG_CONFIG", "not base64")
+	if _, err := ParseConfigFromEnvironment("WG_CONFIG"); err == nil || errors.Is(err, ErrEnvVarNotSet) {
+		t.Fatalf("invalid value should fail to parse, got %v", err)
+	}
+}
+
+func TestMergeDeviceConfig(t *testing.T) {
+	asec := func(flag string) *ASecConfigType {
+		config, err := ParseAmneziaFlagString(flag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	endpointA, endpointB := "94.140.11.15:51820", "94.140.11.16:51820"
+	port := 51820
+	const keyA = "7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c"
+	const keyB = "4879e1e02d9a0d7869d608c8a9c786849ae138b49e35872a58b29c627ce3d345"
+
+	newBase := func() *DeviceConfig {
+		return &DeviceConfig{
+			SecretKey:  "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d",
+			Endpoint:   []netip.Addr{netip.MustParseAddr("10.5.0.2")},
+			DNS:        []netip.Addr{netip.MustParseAddr("1.1.1.1")},
+			MTU:        1420,
+			ASecConfig: asec(`{"jc":5,"jmin":10,"jmax":50,"h1":"100-200"}`),
+			Peers: []PeerConfig{{
+				PublicKey:  keyA,
+				Endpoint:   &endpointA,
+				KeepAlive:  25,
+				AllowedIPs: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+			}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		base    *DeviceConfig
+		overlay *DeviceConfig
+		want    func(*DeviceConfig)
+	}{
+		{
+			name:    "nil overlay",
+			base:    newBase(),
+			overlay: nil,
+			want:    func(*DeviceConfig) {},
+		},
+		{
+			name:    "empty overlay",
+			base:    newBase(),
+			overlay: &DeviceConfig{},
+			want:    func(*DeviceConfig) {},
+		},
+		{
+			name:    "scalars",
+			base:    newBase(),
+			overlay: &DeviceConfig{MTU: 1280, DNS: []netip.Addr{netip.MustParseAddr("9.9.9.9")}, ListenPort: &port, CheckAliveInterval: 10},
+			want: func(c *DeviceConfig) {
+				c.MTU = 1280
+				c.DNS = []netip.Addr{netip.MustParseAddr("9.9.9.9")}
+				c.ListenPort = &port
+				c.CheckAliveInterval = 10
+			},
+		},
+		{
+			name:    "partial AWG overlay",
+			base:    newBase(),
+			overlay: &DeviceConfig{ASecConfig: asec(`{"jc":7}`)},
+			want: func(c *DeviceConfig) {
+				c.ASecConfig = asec(`{"jc":7,"jmin":10,"jmax":50,"h1":"100-200"}`)
+			},
+		},
+		{
+			name:    "AWG header range and I fields",
+			base:    newBase(),
+			overlay: &DeviceConfig{ASecConfig: asec(`{"mode":1,"h1":"300-400","h2":"500","i1":"<b 0xA1B2>"}`)},
+			want: func(c *DeviceConfig) {
+				c.ASecConfig = asec(`{"mode":1,"jc":5,"jmin":10,"jmax":50,"h1":"300-400","h2":"500","i1":"<b 0xA1B2>"}`)
+			},
+		},
+		{
+			name: "AWG overlay on plain WireGuard",
+			base: func() *DeviceConfig {
+				c := newBase()
+				c.ASecConfig = nil
+				return c
+			}(),
+			overlay: &DeviceConfig{ASecConfig: asec(`{"jc":3,"jmin":40,"jmax":70}`)},
+			want: func(c *DeviceConfig) {
+				c.ASecConfig = asec(`{"jc":3,"jmin":40,"jmax":70}`)
+			},
+		},
+		{
+			name: "peer update",
+			base: newBase(),
+			overlay: &DeviceConfig{Peers: []PeerConfig{{
+				PublicKey: keyA,
+				Endpoint:  &endpointB,
+			}}},
+			want: func(c *DeviceConfig) {
+				c.Peers[0].Endpoint = &endpointB
+			},
+		},
+		{
+			name: "peer without preshared key keeps the key of base",
+			base: func() *DeviceConfig {
+				c := newBase()
+				c.Peers[0].PreSharedKey = keyB
+				return c
+			}(),
+			overlay: &DeviceConfig{Peers: []PeerConfig{{
+				PublicKey:    keyA,
+				PreSharedKey: zeroKey,
+				KeepAlive:    10,
+			}}},
+			want: func(c *DeviceConfig) {
+				c.Peers[0].KeepAlive = 10
+			},
+		},
+		{
+			name:    "unresolved peer endpoint",
+			base:    newBase(),
+			overlay: &DeviceConfig{Peers: []PeerConfig{{PublicKey: keyA, EndpointHost: "vpn.corp.invalid:51820"}}},
+			want: func(c *DeviceConfig) {
+				c.Peers[0].Endpoint = nil
+				c.Peers[0].EndpointHost = "vpn.corp.invalid:51820"
+			},
+		},
+		{
+			name: "peer addition",
+			base: newBase(),
+			overlay: &DeviceConfig{Peers: []PeerConfig{{
+				PublicKey:  keyB,
+				Endpoint:   &endpointB,
+				AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+			}}},
+			want: func(c *DeviceConfig) {
+				c.Peers = append(c.Peers, PeerConfig{
+					PublicKey:  keyB,
+					Endpoint:   &endpointB,
+					AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+				})
+			},
+		},
+		{
+			name: "comments",
+			base: func() *DeviceConfig {
+				c := newBase()
+				c.Comments = map[string][]string{"interface": {"# base"}}
+				return c
+			}(),
+			overlay: &DeviceConfig{Comments: map[string][]string{"interface.jc": {"# overlay"}}},
+			want: func(c *DeviceConfig) {
+				c.Comments["interface.jc"] = []string{"# overlay"}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		want := tt.base.Clone()
+		tt.want(want)
+		original := tt.base.Clone()
+
+		merged, err := MergeDeviceConfig(tt.base, tt.overlay)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(merged, want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, merged, want)
+		}
+		if !reflect.DeepEqual(tt.base, original) {
+			t.Errorf("%s: base should not be modified", tt.name)
+		}
+		if merged == tt.base || (len(merged.Peers) > 0 && &merged.Peers[0] == &tt.base.Peers[0]) {
+			t.Errorf("%s: merged configuration should not share memory with base", tt.name)
+		}
+	}
+
+	if merged, err := MergeDeviceConfig(nil, newBase()); err != nil || !reflect.DeepEqual(merged, newBase()) {
+		t.Fatalf("nil base should return the overlay, got %+v, %v", merged, err)
+	}
+	if _, err := MergeDeviceConfig(newBase(), &DeviceConfig{ASecConfig: &ASecConfigType{junkPacketMinSize: 60, hasJunkPacketMinSize: true}}); err == nil {
+		t.Fatal("Jmin of overlay above Jmax of base should be rejected")
+	}
+}
+
+func TestParseAndMergeMultipleConfigs(t *testing.T) {
+	const iface = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+`
+	files := map[string]string{
+		"10-first.conf": iface + `DNS = 1.1.1.1
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 10.0.0.0/24
+`,
+		"20-second.conf": iface + `
+[Peer]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+AllowedIPs = 10.0.1.0/24
+`,
+		"30-third.conf": iface + `
+[Peer]
+PublicKey = KbXv9EJvSm6lkTxD5bMlutdtH7FJyDO/FK1OsuF+PkI=
+AllowedIPs = 10.0.2.0/24
+`,
+		"notes.txt": "not a configuration",
+	}
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configs, err := ParseMultipleConfigs(dir, "*.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 3 {
+		t.Fatalf("expected 3 configurations, got %d", len(configs))
+	}
+
+	merged, err := MergeMultipleConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.DNS) != 1 || merged.DNS[0] != netip.MustParseAddr("1.1.1.1") {
+		t.Fatalf("[Interface] should come from the first configuration, got DNS %v", merged.DNS)
+	}
+	if len(merged.Peers) != 3 {
+		t.Fatalf("expected 3 peers, got %d", len(merged.Peers))
+	}
+	for i, prefix := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"} {
+		if merged.Peers[i].AllowedIPs[0] != netip.MustParsePrefix(prefix) {
+			t.Fatalf("peers should be appended in file order, got %v at %d", merged.Peers[i].AllowedIPs, i)
+		}
+	}
+	if len(configs[0].Peers) != 1 {
+		t.Fatal("first configuration should not be modified")
+	}
+
+	if _, err := MergeMultipleConfigs([]*DeviceConfig{configs[0], configs[0]}); err == nil {
+		t.Fatal("peer defined twice should be rejected")
+	}
+	other := configs[1].Clone()
+	other.SecretKey = "280af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b7d"
+	if _, err := MergeMultipleConfigs([]*DeviceConfig{configs[0], other}); err == nil {
+		t.Fatal("different private keys should be rejected")
+	}
+	if _, err := MergeMultipleConfigs(nil); err == nil {
+		t.Fatal("no configuration should be rejected")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "40-broken.conf"), []byte("[Peer]\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var fileErr *ConfigFileError
+	if _, err := ParseMultipleConfigs(dir, "*.conf"); !errors.As(err, &fileErr) || filepath.Base(fileErr.Path) != "40-broken.conf" {
+		t.Fatalf("error of the broken file expected, got %v", err)
+	}
+}
+
+func TestASecConfigAmneziaFlagString(t *testing.T) {
+	iniData, err := loadIniConfig(`
+[Interface]
+Jc = 5
+Jmin = 10
+Jmax = 50
+S1 = 0
+S2 = 0
+H1 = 1
+H2 = 2
+H3 = 3
+H4 = 4`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseASecConfig(iniData.Section("Interface"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const want = `{"jc":5,"jmin":10,"jmax":50,"s1":0,"s2":0,"h1":1,"h2":2,"h3":3,"h4":4}`
+	flag := config.ToAmneziaFlagString()
+	if flag != want {
+		t.Fatalf("got %s, want %s", flag, want)
+	}
+	parsed, err := ParseAmneziaFlagString(flag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Normalize(), config.Normalize()) {
+		t.Fatalf("round trip changed the configuration: %+v", parsed)
+	}
+
+	iniData, err = loadIniConfig(`
+[Interface]
+Mode = 1
+H1 = 100-200
+I1 = <b 0x"quoted">`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = ParseASecConfig(iniData.Section("Interface"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flag = config.ToAmneziaFlagString()
+	if flag != `{"mode":1,"h1":"100-200","i1":"<b 0x\"quoted\">"}` {
+		t.Fatalf("unexpected flag string %s", flag)
+	}
+	parsed, err = ParseAmneziaFlagString(flag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Normalize(), config.Normalize()) {
+		t.Fatalf("round trip changed the configuration: %+v", parsed)
+	}
+
+	for _, invalid := range []string{`{"jc":0}`, `{"x1":1}`, `{"jc":"five"}`, `[1]`} {
+		if _, err := ParseAmneziaFlagString(invalid); err == nil {
+			t.Errorf("%s should be rejected", invalid)
+		}
+	}
+}
+
+func TestASecConfigExportRoundTrip(t *testing.T) {
+	iniData, err := loadIniConfig(`
+[Interface]
+Mode = 2
+Jc = 5
+Jmin = 10
+Jmax = 50
+S1 = 15
+S2 = 18
+S3 = 20
+S4 = 23
+H1 = 100-101
+H2 = 102-103
+H3 = 104
+H4 = 105-106
+I1 = <b 0xA1B2>
+I2 = <r 16>
+I3 = <c>
+I4 = <t>
+I5 = <b 0xFF>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ParseASecConfig(iniData.Section("Interface"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported := config.Export()
+	ints := map[string]*int{
+		"mode": exported.Mode, "jc": exported.Jc, "jmin": exported.Jmin, "jmax": exported.Jmax,
+		"s1": exported.S1, "s2": exported.S2, "s3": exported.S3, "s4": exported.S4,
+	}
+	wantInts := map[string]int{"mode": 2, "jc": 5, "jmin": 10, "jmax": 50, "s1": 15, "s2": 18, "s3": 20, "s4": 23}
+	for key, want := range wantInts {
+		if ints[key] == nil || *ints[key] != want {
+			t.Errorf("%s: got %v, want %d", key, ints[key], want)
+		}
+	}
+	strs := map[string]*string{
+		"h1": exported.H1, "h2": exported.H2, "h3": exported.H3, "h4": exported.H4,
+		"i1": exported.I1, "i2": exported.I2, "i3": exported.I3, "i4": exported.I4, "i5": exported.I5,
+	}
+	wantStrs := map[string]string{
+		"h1": "100-101", "h2": "102-103", "h3": "104", "h4": "105-106",
+		"i1": "<b 0xA1B2>", "i2": "<r 16>", "i3": "<c>", "i4": "<t>", "i5": "<b 0xFF>",
+	}
+	for key, want := range wantStrs {
+		if strs[key] == nil || *strs[key] != want {
+			t.Errorf("%s: got %v, want %s", key, strs[key], want)
+		}
+	}
+
+	internal, err := exported.ToInternal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(internal.Normalize(), config.Normalize()) {
+		t.Fatalf("round trip changed the configuration: %+v", internal)
+	}
+
+	data, err := json.Marshal(ASecConfig{Jc: exported.Jc, S1: new(int)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"jc":5,"s1":0}` {
+		t.Fatalf("absent fields should be omitted, zero values kept, got %s", data)
+	}
+
+	var nilConfig *ASecConfigType
+	if exported := nilConfig.Export(); exported != (ASecConfig{}) {
+		t.Fatalf("nil configuration should export no parameter, got %+v", exported)
+	}
+	if internal, err := (ASecConfig{}).ToInternal(); err != nil || internal != nil {
+		t.Fatalf("empty configuration should convert to nil, got %+v, %v", internal, err)
+	}
+
+	invalid := 0
+	if _, err := (ASecConfig{Jc: &invalid}).ToInternal(); err == nil {
+		t.Fatal("invalid configuration should be rejected")
+	}
+}
+
+func TestPeerWithPresharedKey(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+PresharedKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+
+[Peer]
+PublicKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=`
+	const presharedKey = "4879e1e02d9a0d7869d608c8a9c786849ae138b49e35872a58b29c627ce3d345"
+
+	var cfg DeviceConfig
+	iniData, err := loadIniConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParseInterface(iniData, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := ParsePeers(iniData, &cfg.Peers); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Peers[0].PreSharedKey != presharedKey {
+		t.Fatalf("unexpected preshared key %s", cfg.Peers[0].PreSharedKey)
+	}
+
+	ipcReq, err := CreateIPCRequest(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(ipcReq.IpcRequest, "preshared_key=") != 1 || strings.Count(ipcReq.IpcRequest, "preshared_key="+presharedKey+"\n") != 1 {
+		t.Fatalf("the preshared key should appear exactly once and the unset one not at all:\n%s", ipcReq.IpcRequest)
+	}
+
+	data, err := MarshalINI(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "PresharedKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=\n") {
+		t.Fatalf("preshared key should round trip:\n%s", data)
+	}
+
+	iniData, err = loadIniConfig(strings.Replace(config, "SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=", "c2hvcnQ=", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ParsePeers(iniData, &cfg.Peers); err == nil {
+		t.Fatal("a preshared key that is not 32 bytes should be rejected")
+	}
+}
+
+// stubResolver answers A queries for every name with addr through a Go resolver, AAAA queries get no answer
+func stubResolver(addr [4]byte) *net.Resolver {
+	serve := func(conn net.Conn) {
+		defer func() { _ = conn.Close() }()
+		for {
+			var size [2]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(size[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+				return
+			}
+			question := msg.Questions[0]
+			msg.Header.Response, msg.Header.RecursionAvailable = true, true
+			if question.Type == dnsmessage.TypeA {
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: addr},
+				}}
+			}
+			reply, err := msg.AppendPack(binary.BigEndian.AppendUint16(nil, 0))
+			if err != nil {
+				return
+			}
+			binary.BigEndian.PutUint16(reply, uint16(len(reply)-2))
+			if _, err := conn.Write(reply); err != nil {
+				return
+			}
+		}
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serve(server)
+			return client, nil
+		},
+	}
+}
+
+func TestPeerEndpointResolver(t *testing.T) {
+	endpoint := "94.140.11.15:51820"
+	conf := &DeviceConfig{
+		SecretKey: "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d",
+		Peers: []PeerConfig{{
+			PublicKey:    "7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c",
+			Endpoint:     &endpoint,
+			EndpointHost: "vpn.corp.example.com:51820",
+		}},
+		PeerEndpointResolver: stubResolver([4]byte{10, 20, 30, 40}),
+	}
+
+	resolved, err := resolvePeerEndpoints(context.Background(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting, err := CreateIPCRequest(resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(setting.IpcRequest, "endpoint=10.20.30.40:51820\n") {
+		t.Fatalf("endpoint should be resolved with the peer endpoint resolver:\n%s", setting.IpcRequest)
+	}
+	if strings.Contains(setting.IpcRequest, "vpn.corp.example.com") {
+		t.Fatalf("IPC request should not contain the hostname:\n%s", setting.IpcRequest)
+	}
+	if *conf.Peers[0].Endpoint != endpoint {
+		t.Fatal("configuration should not be modified")
+	}
+
+	conf.PeerEndpointResolver = nil
+	resolved, err = resolvePeerEndpoints(context.Background(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting, err = CreateIPCRequest(resolved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(setting.IpcRequest, "endpoint="+endpoint+"\n") {
+		t.Fatalf("endpoint resolved by the parser should be kept without a resolver:\n%s", setting.IpcRequest)
+	}
+}
+
+func TestParsePeersDefersEndpointResolution(t *testing.T) {
+	config, err := ParseConfigFromReader(strings.NewReader(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = vpn.corp.invalid:51820`))
+	if err != nil {
+		t.Fatal("a hostname endpoint that does not resolve yet should not fail the parsing:", err)
+	}
+	peer := config.Peers[0]
+	if peer.Endpoint != nil || peer.EndpointHost != "vpn.corp.invalid:51820" {
+		t.Fatalf("endpoint should be kept unresolved, got %v, %q", peer.Endpoint, peer.EndpointHost)
+	}
+	written, err := MarshalINI(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(written), "Endpoint = vpn.corp.invalid:51820\n") {
+		t.Fatalf("unresolved endpoint should be written back:\n%s", written)
+	}
+
+	if _, err := resolvePeerEndpoints(context.Background(), config); err == nil {
+		t.Fatal("endpoint that does not resolve should fail without a resolver")
+	}
+	config.PeerEndpointResolver = stubResolver([4]byte{10, 20, 30, 40})
+	resolved, err := resolvePeerEndpoints(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *resolved.Peers[0].Endpoint != "10.20.30.40:51820" || config.Peers[0].Endpoint != nil {
+		t.Fatalf("endpoint should be resolved on a copy, got %s", *resolved.Peers[0].Endpoint)
+	}
+}
+
+func TestDeviceConfigUnmarshalYAML(t *testing.T) {
+	const iface = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+`
+	const peer = `
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+`
+	const yamlIface = "privatekey: LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\naddress: [10.5.0.2]\n"
+	const yamlPeer = "peers:\n  - publickey: e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=\n"
+	tests := []struct {
+		name string
+		ini  string
+		yaml string
+	}{
+		{name: "minimal", ini: iface + peer, yaml: yamlIface + yamlPeer},
+		{
+			name: "addresses",
+			ini:  "[Interface]\nPrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\nAddress = 10.5.0.2, fd00::2/64\nDNS = 1.1.1.1, corp.example.com\n" + peer,
+			yaml: "privatekey: LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\naddress: [10.5.0.2, fd00::2/64]\ndns: [1.1.1.1, corp.example.com]\n" + yamlPeer,
+		},
+		{name: "dynamic address", ini: "[Interface]\nPrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\nAddress = 0.0.0.0/0\n" + peer, yaml: "privatekey: LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=\naddress: [0.0.0.0/0]\n" + yamlPeer},
+		{name: "mtu and listen port", ini: iface + "MTU = 1280\nListenPort = 51820\n" + peer, yaml: yamlIface + "mtu: 1280\nlistenport: 51820\n" + yamlPeer},
+		{name: "routing table", ini: iface + "RoutingTable = Off\n" + peer, yaml: yamlIface + "table: Off\n" + yamlPeer},
+		{name: "check alive", ini: iface + "CheckAlive = 1.1.1.1, 8.8.8.8\nCheckAliveInterval = 10\n" + peer, yaml: yamlIface + "checkalive: [1.1.1.1, 8.8.8.8]\ncheckaliveinterval: 10\n" + yamlPeer},
+		{
+			name: "upstream socks5",
+			ini:  iface + "UpstreamSOCKS5 = 127.0.0.1:1080\nUpstreamSOCKS5Username = user\nUpstreamSOCKS5Password = pass\n" + peer,
+			yaml: yamlIface + "upstreamsocks5: 127.0.0.1:1080\nupstreamsocks5auth:\n  username: user\n  password: pass\n" + yamlPeer,
+		},
+		{name: "hooks", ini: iface + "PostUp = echo up\nPostDown = echo down\nPostDown = echo bye\n" + peer, yaml: yamlIface + "postup: [echo up]\npostdown: [echo down, echo bye]\n" + yamlPeer},
+		{name: "junk", ini: iface + "Jc = 5\nJmin = 10\nJmax = 50\nS1 = 15\nS2 = 20\nS3 = 25\nS4 = 30\n" + peer, yaml: yamlIface + "jc: 5\njmin: 10\njmax: 50\ns1: 15\ns2: 20\ns3: 25\ns4: 30\n" + yamlPeer},
+		{name: "headers", ini: iface + "H1 = 100\nH2 = 200-300\nH3 = 400\nH4 = 3735928559-3735928560\n" + peer, yaml: yamlIface + "h1: \"100\"\nh2: 200-300\nh3: \"400\"\nh4: 3735928559-3735928560\n" + yamlPeer},
+		{name: "signatures", ini: iface + "I1 = <b 0xA1B2C3D4E5F6><c>\nI2 = <r 16>\nMode = 1\n" + peer, yaml: yamlIface + "i1: <b 0xA1B2C3D4E5F6><c>\ni2: <r 16>\nmode: 1\n" + yamlPeer},
+		{
+			name: "peer",
+			ini:  iface + peer + "PresharedKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=\nEndpoint = 94.140.11.15:51820\nPersistentKeepalive = 25\nAllowedIPs = 0.0.0.0/0, ::/0, 0.0.0.0/0\n",
+			yaml: yamlIface + yamlPeer + "    presharedkey: SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=\n    endpoint: 94.140.11.15:51820\n    persistentkeepalive: 25\n    allowedips: [0.0.0.0/0, \"::/0\", 0.0.0.0/0]\n",
+		},
+		{
+			name: "multiple peers",
+			ini:  iface + peer + "AllowedIPs = 10.0.0.0/8\n" + "\n[Peer]\nPublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=\nEndpoint = [2001:db8::1]:51820\n",
+			yaml: yamlIface + yamlPeer + "    allowedips: [10.0.0.0/8]\n  - publickey: SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=\n    endpoint: \"[2001:db8::1]:51820\"\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want DeviceConfig
+			iniData, err := loadIniConfig(tt.ini)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ParseInterface(iniData, &want); err != nil {
+				t.Fatal(err)
+			}
+			if err := ParsePeers(iniData, &want.Peers); err != nil {
+				t.Fatal(err)
+			}
+
+			var got DeviceConfig
+			if err := yaml.Unmarshal([]byte(tt.yaml), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(&want, &got) {
+				t.Fatalf("YAML and INI configurations differ:\n%+v\n%+v", want, got)
+			}
+		})
+	}
+
+	for _, invalid := range []string{
+		"privatekey: invalid\n" + yamlPeer,
+		yamlIface + "dns: [1.1.1.l]\n" + yamlPeer,
+		yamlIface + "table: main\n" + yamlPeer,
+		yamlIface + "checkaliveinterval: 10\n" + yamlPeer,
+		yamlIface + "jmin: 60\njmax: 50\n" + yamlPeer,
+		yamlIface + "peers:\n  - publickey: invalid\n",
+		yamlIface + "upstreamsocks5: 127.0.0.1\n" + yamlPeer,
+	} {
+		var cfg DeviceConfig
+		if err := yaml.Unmarshal([]byte(invalid), &cfg); err == nil {
+			t.Fatalf("invalid configuration should be rejected:\n%s", invalid)
+		}
+	}
+}
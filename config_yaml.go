@@ -0,0 +1,145 @@
+package wireproxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/go-ini/ini"
+	"go.yaml.in/yaml/v3"
+)
+
+//go:generate go run ./cmd/yaml-tags -f config.go -f asec_exported.go
+
+// yamlINIValues are the keys of a YAML device configuration parsed like the values of
+// the [Interface] section, a list stands for the comma separated INI value
+type yamlINIValues struct {
+	Address            []string `yaml:"address"`
+	DNS                []string `yaml:"dns"`
+	CheckAliveInterval *int     `yaml:"checkaliveinterval"`
+}
+
+// UnmarshalYAML reads a device configuration with the keys of the [Interface] section
+// in lower case, the AWG parameters included, and its peers listed under peers.
+// Values are written and checked as in INI, e.g. keys are base64
+func (c *DeviceConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain DeviceConfig
+	var config plain
+	if err := value.Decode(&config); err != nil {
+		return err
+	}
+	var iniValues yamlINIValues
+	if err := value.Decode(&iniValues); err != nil {
+		return err
+	}
+	var aSecConfig ASecConfig
+	if err := value.Decode(&aSecConfig); err != nil {
+		return err
+	}
+
+	secretKey, err := encodeBase64ToHex(config.SecretKey)
+	if err != nil {
+		return err
+	}
+	config.SecretKey = secretKey
+
+	section, err := ini.Empty(configLoadOptions).NewSection("Interface")
+	if err != nil {
+		return err
+	}
+	if len(iniValues.Address) > 0 {
+		if _, err := section.NewKey("Address", strings.Join(iniValues.Address, ", ")); err != nil {
+			return err
+		}
+	}
+	if len(iniValues.DNS) > 0 {
+		if _, err := section.NewKey("DNS", strings.Join(iniValues.DNS, ", ")); err != nil {
+			return err
+		}
+	}
+	address, err := parseCIDRNetIP(section, "Address")
+	if err != nil {
+		return err
+	}
+	config.Endpoint, config.DynamicAddress = parseDynamicAddress(section, address)
+	if config.DNS, config.DNSSearchDomains, err = parseDNS(section); err != nil {
+		return err
+	}
+
+	if config.UpstreamSOCKS5 != "" {
+		if _, _, err := net.SplitHostPort(config.UpstreamSOCKS5); err != nil {
+			return errors.New("invalid UpstreamSOCKS5: " + err.Error())
+		}
+	}
+
+	if config.RouteTable != nil {
+		mode, err := parseRouteTable(string(*config.RouteTable))
+		if err != nil {
+			return err
+		}
+		config.RouteTable = &mode
+	}
+
+	if config.CheckAlive == nil {
+		config.CheckAlive = []netip.Addr{}
+	}
+	config.CheckAliveInterval = 5
+	if iniValues.CheckAliveInterval != nil {
+		if len(config.CheckAlive) == 0 {
+			return errors.New("CheckAliveInterval is only valid when CheckAlive is set")
+		}
+		config.CheckAliveInterval = *iniValues.CheckAliveInterval
+	}
+
+	if config.ASecConfig, err = aSecConfig.ToInternal(); err != nil {
+		return err
+	}
+
+	*c = DeviceConfig(config)
+	return nil
+}
+
+// UnmarshalYAML reads a peer with the keys of the [Peer] section in lower case
+func (p *PeerConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain PeerConfig
+	var peer plain
+	if err := value.Decode(&peer); err != nil {
+		return err
+	}
+
+	publicKey, err := encodeBase64ToHex(peer.PublicKey)
+	if err != nil {
+		return err
+	}
+	peer.PublicKey = publicKey
+
+	if peer.PreSharedKey == "" {
+		peer.PreSharedKey = zeroKey
+	} else if peer.PreSharedKey, err = encodeBase64ToHex(peer.PreSharedKey); err != nil {
+		return err
+	}
+
+	if endpoint := peer.Endpoint; endpoint != nil {
+		peer.Endpoint = nil
+		if err := (*PeerConfig)(&peer).parseEndpoint(*endpoint); err != nil {
+			return err
+		}
+	}
+
+	allowedIPs := peer.AllowedIPs
+	if allowedIPs == nil {
+		allowedIPs = []netip.Prefix{}
+	}
+	for i, prefix := range allowedIPs {
+		allowedIPs[i] = unmapPrefix(prefix)
+	}
+	var duplicates []netip.Prefix
+	peer.AllowedIPs, duplicates = dedupPrefixes(allowedIPs)
+	if len(duplicates) > 0 {
+		errorLogger.Printf("Warning: removed duplicate AllowedIPs of peer %s: %s\n", encodeHexToBase64(publicKey), joinPrefixes(duplicates))
+	}
+
+	*p = PeerConfig(peer)
+	return nil
+}
@@ -0,0 +1,159 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// tunnelDNS holds the DNS servers set at runtime with SetDNS.
+// netstack.Net has no API to change its servers once created, so lookups are
+// done with a Go resolver that dials the servers through the tunnel instead
+type tunnelDNS struct {
+	mu       sync.RWMutex
+	set      bool
+	servers  []netip.Addr
+	next     atomic.Uint32
+	resolver *net.Resolver
+	// searchDomains are DeviceSetting.SearchDomains, fixed when the tunnel is created
+	searchDomains []string
+}
+
+// currentServers returns the servers set with SetDNS and whether they are set at all
+func (t *tunnelDNS) currentServers() ([]netip.Addr, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.servers, t.set
+}
+
+// nextServer picks the servers in turn, so the retries of the resolver move on to the next one
+func (t *tunnelDNS) nextServer() (netip.Addr, error) {
+	servers, _ := t.currentServers()
+	if len(servers) == 0 {
+		return netip.Addr{}, errors.New("no DNS servers configured")
+	}
+	return servers[int(t.next.Add(1)-1)%len(servers)], nil
+}
+
+// searchNames returns the names to try before name itself, one per search domain.
+// As with the ndots:1 default of resolv.conf, only names without a dot are searched
+func searchNames(name string, domains []string) []string {
+	if strings.Contains(name, ".") || strings.Contains(name, ":") {
+		return nil
+	}
+	names := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		names = append(names, name+"."+domain)
+	}
+	return names
+}
+
+// SetDNS replaces the DNS servers used for lookups through the tunnel without restarting the device.
+// An empty list falls back to the system resolver. Conf.DNS keeps the configured servers,
+// so a Reload of the same configuration is not taken for a change of DNS
+func (d VirtualTun) SetDNS(resolvers []netip.Addr) error {
+	if d.dns == nil {
+		return errors.New("DNS reconfiguration is not supported by this tunnel")
+	}
+	for _, addr := range resolvers {
+		if !addr.IsValid() {
+			return errors.New("invalid DNS server address")
+		}
+	}
+
+	servers := append([]netip.Addr(nil), resolvers...)
+
+	d.dns.mu.Lock()
+	d.dns.set = true
+	d.dns.servers = servers
+	if d.dns.resolver == nil {
+		d.dns.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				server, err := d.dns.nextServer()
+				if err != nil {
+					return nil, err
+				}
+				return d.Tnet.DialContext(ctx, network, net.JoinHostPort(server.String(), strconv.Itoa(53)))
+			},
+		}
+	}
+	d.dns.mu.Unlock()
+
+	// Addresses cached by Dial came from the previous servers
+	if d.dialDNS != nil {
+		d.dialDNS.mu.Lock()
+		if d.dialDNS.cache != nil {
+			d.dialDNS.cache.Flush()
+		}
+		d.dialDNS.mu.Unlock()
+	}
+	return nil
+}
+
+// dialDNS caches the addresses resolved by Dial. The cache is created on the first
+// Dial, so DialDNSTTL and DialDNSMaxEntries can still be changed once the tunnel is started
+type dialDNS struct {
+	mu    sync.Mutex
+	cache *dnsCache
+}
+
+// Dial connects to address through the tunnel. A host name is resolved with the DNS
+// settings of the tunnel, see LookupAddr, and the address is cached for DialDNSTTL
+func (d VirtualTun) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return d.Tnet.DialContext(ctx, network, address)
+	}
+
+	var ip net.IP
+	if d.dialDNS == nil {
+		addr, err := d.ResolveAddrWithContext(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ip = addr.AsSlice()
+	} else {
+		d.dialDNS.mu.Lock()
+		if d.dialDNS.cache == nil {
+			ttl := d.DialDNSTTL
+			if ttl <= 0 {
+				ttl = dnsCacheTTL
+			}
+			d.dialDNS.cache = newDNSCacheWithOptions(dnsCacheOptions{
+				TTL:           ttl,
+				LookupContext: d.lookupIP,
+				MaxEntries:    d.DialDNSMaxEntries,
+			})
+		}
+		cache := d.dialDNS.cache
+		d.dialDNS.mu.Unlock()
+		if ip, err = cache.ResolveContext(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	return d.Tnet.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+// lookupIP resolves name with LookupAddr for the cache of Dial
+func (d VirtualTun) lookupIP(ctx context.Context, name string) ([]net.IP, error) {
+	addrs, err := d.LookupAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
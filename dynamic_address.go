@@ -0,0 +1,53 @@
+package wireproxy
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// Some AmneziaWG configurations set Address = 0.0.0.0/0 and expect the tunnel address
+// to be assigned dynamically, which DeviceConfig records as DynamicAddress.
+//
+// wireproxy cannot obtain such an address over DHCP. A WireGuard tunnel only carries
+// IP packets between peers: there is no broadcast domain, a DISCOVER sent to
+// 255.255.255.255 is dropped unless a peer claims that address in its AllowedIPs, and
+// peers do not run DHCP servers on the tunnel. Before the netstack is created there is
+// no source address to send the request from either. A configuration that only has a
+// dynamic address therefore starts with dynamicFallbackAddr, an IPv6 unique local
+// address, and a warning is logged. Addresses listed next to 0.0.0.0/0 are used as is.
+
+// dynamicFallbackAddr is the tunnel address used when only a dynamic address is configured
+var dynamicFallbackAddr = netip.MustParseAddr("fd00::1")
+
+// parseDynamicAddress reports whether the Address key of section lists 0.0.0.0/0
+// and returns addresses without the 0.0.0.0 it was parsed into
+func parseDynamicAddress(section *ini.Section, addresses []netip.Addr) ([]netip.Addr, bool) {
+	value, err := parseString(section, "Address")
+	if err != nil {
+		return addresses, false
+	}
+
+	dynamic := slices.ContainsFunc(strings.Split(value, ","), func(entry string) bool {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(entry))
+		return err == nil && prefix == netip.PrefixFrom(netip.IPv4Unspecified(), 0)
+	})
+	if !dynamic {
+		return addresses, false
+	}
+	return slices.DeleteFunc(addresses, func(addr netip.Addr) bool {
+		return addr == netip.IPv4Unspecified()
+	}), true
+}
+
+// dynamicDeviceAddr returns the addresses of the tunnel for a configuration with a
+// dynamic address, see the comment at the top of the file
+func dynamicDeviceAddr(conf *DeviceConfig) []netip.Addr {
+	if len(conf.Endpoint) > 0 {
+		return conf.Endpoint
+	}
+	errorLogger.Printf("Warning: Address = 0.0.0.0/0 cannot be assigned over WireGuard, using %s/128\n", dynamicFallbackAddr)
+	return []netip.Addr{dynamicFallbackAddr}
+}
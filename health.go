@@ -0,0 +1,110 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultHandshakeMaxAge is the handshake age above which a peer is considered stale.
+// WireGuard renews the session every 2 minutes while traffic flows, so a working peer
+// never gets close to it
+const defaultHandshakeMaxAge = 3 * time.Minute
+
+// HandshakeStaleError reports a peer whose last handshake is too old
+type HandshakeStaleError struct {
+	PeerKey string        // base64 public key of the peer
+	Age     time.Duration // time since the last handshake, 0 if none was completed
+}
+
+func (e *HandshakeStaleError) Error() string {
+	if e.Age == 0 {
+		return "peer " + e.PeerKey + " never completed a handshake"
+	}
+	return "last handshake with peer " + e.PeerKey + " was " + e.Age.Truncate(time.Second).String() + " ago"
+}
+
+// HealthCheck reports whether the tunnel is exchanging handshakes with its peers.
+// It succeeds when the newest handshake across all peers is younger than HandshakeMaxAge,
+// otherwise a *HandshakeStaleError is joined for every stale peer
+func (d VirtualTun) HealthCheck(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	maxAge := d.HandshakeMaxAge
+	if maxAge <= 0 {
+		maxAge = defaultHandshakeMaxAge
+	}
+	return checkHandshakes(d.Dev, time.Now(), maxAge)
+}
+
+// checkHandshakes fails when no peer of dev completed a handshake within maxAge of now
+func checkHandshakes(dev ipcDevice, now time.Time, maxAge time.Duration) error {
+	handshakes, err := getPeerHandshakes(dev)
+	if err != nil {
+		return err
+	}
+	if len(handshakes) == 0 {
+		return errors.New("no peer configured")
+	}
+
+	var errs []error
+	for _, peer := range handshakes {
+		if peer.last.IsZero() {
+			errs = append(errs, &HandshakeStaleError{PeerKey: encodeHexToBase64(peer.publicKey)})
+			continue
+		}
+		age := now.Sub(peer.last)
+		if age <= maxAge {
+			return nil
+		}
+		errs = append(errs, &HandshakeStaleError{PeerKey: encodeHexToBase64(peer.publicKey), Age: age})
+	}
+	return errors.Join(errs...)
+}
+
+// peerHandshake is the time of the last handshake of a peer, zero if none was completed
+type peerHandshake struct {
+	publicKey string // hex public key
+	last      time.Time
+}
+
+// getPeerHandshakes returns the last handshake of every peer of dev in device order
+func getPeerHandshakes(dev ipcDevice) ([]peerHandshake, error) {
+	state, err := dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	var handshakes []peerHandshake
+	var sec, nsec int64
+	flush := func() {
+		if len(handshakes) > 0 && sec != 0 {
+			handshakes[len(handshakes)-1].last = time.Unix(sec, nsec)
+		}
+		sec, nsec = 0, 0
+	}
+	for _, line := range strings.Split(state, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			flush()
+			handshakes = append(handshakes, peerHandshake{publicKey: value})
+		case "last_handshake_time_sec":
+			if sec, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, err
+			}
+		case "last_handshake_time_nsec":
+			if nsec, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+	}
+	flush()
+	return handshakes, nil
+}
@@ -0,0 +1,50 @@
+package wireproxy
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckHandshakes(t *testing.T) {
+	const keyA = "7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c"
+	const keyB = "4879e1e02d9a0d7869d608c8a9c786849ae138b49e35872a58b29c627ce3d345"
+
+	now := time.Unix(1_700_000_000, 0)
+	state := func(secA, secB int64) string {
+		return "private_key=2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d\nlisten_port=51820\n" +
+			"public_key=" + keyA + "\nlast_handshake_time_sec=" + strconv.FormatInt(secA, 10) + "\nlast_handshake_time_nsec=0\n" +
+			"public_key=" + keyB + "\nlast_handshake_time_sec=" + strconv.FormatInt(secB, 10) + "\nlast_handshake_time_nsec=0\nerrno=0\n"
+	}
+
+	dev := &fakeIPCDevice{state: state(now.Unix()-600, now.Unix()-30)}
+	if err := checkHandshakes(dev, now, 3*time.Minute); err != nil {
+		t.Fatalf("one recent handshake should be healthy, got %v", err)
+	}
+
+	dev.state = state(now.Unix()-600, 0)
+	err := checkHandshakes(dev, now, 3*time.Minute)
+	if err == nil {
+		t.Fatal("stale handshakes should fail the health check")
+	}
+	var stale *HandshakeStaleError
+	if !errors.As(err, &stale) {
+		t.Fatalf("HandshakeStaleError expected, got %v", err)
+	}
+	if stale.PeerKey != "e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=" || stale.Age != 10*time.Minute {
+		t.Fatalf("unexpected stale peer %+v", stale)
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) != 2 {
+		t.Fatalf("one error per stale peer expected, got %v", err)
+	}
+	if never := joined.Unwrap()[1].(*HandshakeStaleError); never.Age != 0 {
+		t.Fatalf("peer without handshake should have no age, got %+v", never)
+	}
+
+	dev.state = "private_key=2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d\nerrno=0\n"
+	if err := checkHandshakes(dev, now, 3*time.Minute); err == nil {
+		t.Fatal("a device without peers should not be healthy")
+	}
+}
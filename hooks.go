@@ -0,0 +1,51 @@
+package wireproxy
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/go-ini/ini"
+)
+
+// defaultInterfaceName replaces %i in hooks when DeviceConfig.InterfaceName is empty
+const defaultInterfaceName = "wireproxy"
+
+// RunHooks runs the PostUp or PostDown commands of a configuration one after the other
+// with sh, or cmd on Windows, %i is replaced by interfaceName. It stops at the first
+// command that fails. StartWireguard only calls it when DeviceConfig.EnableHooks is set
+func RunHooks(hooks []string, interfaceName string) error {
+	for _, hook := range hooks {
+		command := strings.ReplaceAll(hook, "%i", interfaceName)
+		output, err := hookCommand(command).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("hook %q failed: %w: %s", command, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+// hookCommand returns the shell command running command
+func hookCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// parseHooks returns the commands of all keyName keys of section, empty ones are skipped
+func parseHooks(section *ini.Section, keyName string) []string {
+	sectionKey, err := section.GetKey(keyName)
+	if err != nil {
+		return nil
+	}
+
+	var hooks []string
+	for _, hook := range sectionKey.ValueWithShadows() {
+		if hook = strings.TrimSpace(hook); hook != "" {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
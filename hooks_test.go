@@ -0,0 +1,136 @@
+package wireproxy
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestRunHooks(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+
+	err := RunHooks([]string{"echo up %i >> " + log, "echo again %i >> " + log}, "wg0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "up wg0\nagain wg0\n" {
+		t.Fatalf("hooks should run in order with %%i replaced, got %q", data)
+	}
+
+	skipped := filepath.Join(dir, "skipped")
+	err = RunHooks([]string{"echo broken >&2; exit 3", "touch " + skipped}, "wg0")
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("failing hook should be reported with its output, got %v", err)
+	}
+	if _, err := os.Stat(skipped); !os.IsNotExist(err) {
+		t.Fatal("hooks after a failure should not run")
+	}
+}
+
+func TestParseInterfaceHooks(t *testing.T) {
+	iniData, err := loadIniConfig(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+PostUp = ip rule add table 200 from %i
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+PostDown = iptables -D FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := parseDeviceConfig(iniData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantUp := []string{"ip rule add table 200 from %i", "iptables -A FORWARD -i %i -j ACCEPT"}
+	if !reflect.DeepEqual(conf.PostUp, wantUp) {
+		t.Fatalf("unexpected PostUp %q", conf.PostUp)
+	}
+	if !reflect.DeepEqual(conf.PostDown, []string{"iptables -D FORWARD -i %i -j ACCEPT"}) {
+		t.Fatalf("unexpected PostDown %q", conf.PostDown)
+	}
+
+	written, err := MarshalINI(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(written), "PostUp = "+wantUp[0]+"\nPostUp = "+wantUp[1]+"\nPostDown = ") {
+		t.Fatalf("hooks should be written back:\n%s", written)
+	}
+}
+
+func TestStartWireguardRunsHooks(t *testing.T) {
+	dir := t.TempDir()
+	up, down := filepath.Join(dir, "up"), filepath.Join(dir, "down")
+	port := freeUDPPort(t)
+	conf := &DeviceConfig{
+		SecretKey:  "280af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b7d",
+		Endpoint:   []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		MTU:        1420,
+		ListenPort: &port,
+		Peers: []PeerConfig{{
+			PublicKey:  "29b5eff4426f4a6ea5913c43e5b325bad76d1fb149c833bf14ad4eb2e17e3e42",
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")},
+		}},
+		PostUp:   []string{"echo %i > " + up},
+		PostDown: []string{"echo %i > " + down},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	vt, err := StartWireguard(ctx, conf, device.LogLevelSilent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := vt.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(up); !os.IsNotExist(err) {
+		t.Fatal("PostUp should not run unless hooks are enabled")
+	}
+	if _, err := os.Stat(down); !os.IsNotExist(err) {
+		t.Fatal("PostDown should not run unless hooks are enabled")
+	}
+
+	conf.EnableHooks = true
+	conf.InterfaceName = "wg0"
+	ctx, cancel = context.WithCancel(context.Background())
+	vt, err = StartWireguard(ctx, conf, device.LogLevelSilent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(up); err != nil || string(data) != "wg0\n" {
+		t.Fatalf("PostUp should run with the device name once the tunnel is up, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(down); !os.IsNotExist(err) {
+		t.Fatal("PostDown should not run before shutdown")
+	}
+
+	cancel()
+	if err := vt.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(down); err != nil {
+		t.Fatal("PostDown should run on shutdown")
+	}
+
+	conf.PostUp = []string{"exit 1"}
+	if _, err := StartWireguard(context.Background(), conf, device.LogLevelSilent); err == nil {
+		t.Fatal("failing PostUp should abort the start")
+	}
+}
@@ -10,17 +10,30 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
 const proxyAuthHeaderKey = "Proxy-Authorization"
 
+// httpHeaderTimeout bounds the time a client takes to send its request headers
+const httpHeaderTimeout = 30 * time.Second
+
+// credentialStore validates the user name and password of a client
+type credentialStore interface {
+	Valid(username, password string) bool
+}
+
 type HTTPServer struct {
 	config *HTTPConfig
 
-	auth CredentialValidator
+	auth credentialStore
 	dial func(network, address string) (net.Conn, error)
 
 	authRequired bool
+	// connectOnly refuses the requests that are not CONNECT
+	connectOnly bool
+	// headerTimeout overrides httpHeaderTimeout when not 0
+	headerTimeout time.Duration
 }
 
 func (s *HTTPServer) authenticate(req *http.Request) (int, error) {
@@ -92,10 +105,24 @@ func (s *HTTPServer) handle(req *http.Request) (peer net.Conn, err error) {
 }
 
 func (s *HTTPServer) serve(conn net.Conn) {
+	headerTimeout := s.headerTimeout
+	if headerTimeout == 0 {
+		headerTimeout = httpHeaderTimeout
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(headerTimeout))
+
 	var rd = bufio.NewReader(conn)
 	req, err := http.ReadRequest(rd)
 	if err != nil {
 		log.Printf("read request failed: %s\n", err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	if s.connectOnly && req.Method != http.MethodConnect {
+		_ = responseWith(req, http.StatusMethodNotAllowed).Write(conn)
+		_ = conn.Close()
 		return
 	}
 
@@ -106,6 +133,7 @@ func (s *HTTPServer) serve(conn net.Conn) {
 			resp.Header.Set("Proxy-Authenticate", "Basic realm=\"Proxy\"")
 		}
 		_ = resp.Write(conn)
+		_ = conn.Close()
 		log.Println(err)
 		return
 	}
@@ -119,13 +147,18 @@ func (s *HTTPServer) serve(conn net.Conn) {
 	}
 	if err != nil {
 		log.Printf("dial proxy failed: %s\n", err)
+		_ = conn.Close()
 		return
 	}
 	if peer == nil {
 		log.Println("dial proxy failed: peer nil")
+		_ = conn.Close()
 		return
 	}
 
+	// bytes the client sent right after the request are already buffered in rd
+	client := bufferedConn{Conn: conn, reader: rd}
+
 	go func() {
 		defer func() { _ = conn.Close() }()
 		defer func() { _ = peer.Close() }()
@@ -137,10 +170,20 @@ func (s *HTTPServer) serve(conn net.Conn) {
 		defer func() { _ = conn.Close() }()
 		defer func() { _ = peer.Close() }()
 
-		_, _ = io.Copy(peer, conn)
+		_, _ = io.Copy(peer, client)
 	}()
 }
 
+// bufferedConn reads from a reader wrapping the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
 // ListenAndServe is used to create a listener and serve on it
 func (s *HTTPServer) ListenAndServe(network, addr string) error {
 	server, err := net.Listen(network, addr)
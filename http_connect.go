@@ -0,0 +1,36 @@
+package wireproxy
+
+import (
+	"crypto/subtle"
+)
+
+// HTTPConnectConfig configures the proxy started by StartHTTPConnectProxy
+type HTTPConnectConfig struct {
+	// Credentials maps user names to passwords, authentication is required when it is not empty
+	Credentials map[string]string
+}
+
+// StartHTTPConnectProxy serves HTTP CONNECT requests on bindAddress and tunnels them
+// through vt, other methods are refused. config may be nil for a proxy without
+// authentication. It blocks until the listener fails
+func StartHTTPConnectProxy(bindAddress string, vt *VirtualTun, config *HTTPConnectConfig) error {
+	server := &HTTPServer{
+		config:      &HTTPConfig{BindAddress: bindAddress},
+		dial:        vt.Tnet.Dial,
+		connectOnly: true,
+	}
+	if config != nil && len(config.Credentials) > 0 {
+		server.auth = credentialMap(config.Credentials)
+		server.authRequired = true
+	}
+	return server.ListenAndServe("tcp", bindAddress)
+}
+
+// credentialMap maps user names to their password
+type credentialMap map[string]string
+
+// Valid compares password to the one of username in constant time
+func (c credentialMap) Valid(username, password string) bool {
+	expected, ok := c[username]
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
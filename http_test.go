@@ -2,6 +2,7 @@ package wireproxy
 
 import (
 	"bufio"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -143,3 +144,121 @@ func TestHTTPServePlainPostNotRejected(t *testing.T) {
 
 	_ = clientConn.Close()
 }
+
+// TestHTTPConnectServer verifies that the CONNECT proxy requires the configured
+// credentials and then tunnels bytes in both directions.
+func TestHTTPConnectServer(t *testing.T) {
+	upstreamClient, upstream := net.Pipe()
+	s := &HTTPServer{
+		config:       &HTTPConfig{},
+		auth:         credentialMap{"alice": "secret"},
+		authRequired: true,
+		connectOnly:  true,
+		dial: func(network, address string) (net.Conn, error) {
+			if want := "example.com:443"; address != want {
+				t.Errorf("dial address = %q, want %q", address, want)
+			}
+			return upstreamClient, nil
+		},
+	}
+
+	request := func(header string) (net.Conn, *bufio.Reader, *http.Response) {
+		t.Helper()
+		clientConn, proxyConn := net.Pipe()
+		go s.serve(proxyConn)
+		go func() {
+			_, _ = clientConn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n" + header + "\r\n"))
+		}()
+
+		_ = clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+		rd := bufio.NewReader(clientConn)
+		resp, err := http.ReadResponse(rd, nil)
+		if err != nil {
+			t.Fatalf("reading CONNECT response: %v", err)
+		}
+		return clientConn, rd, resp
+	}
+
+	clientConn, _, resp := request("")
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("status = %d, want 407", resp.StatusCode)
+	}
+	if resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Error("407 response should ask for credentials")
+	}
+	_ = clientConn.Close()
+
+	// alice:wrong
+	clientConn, _, resp = request("Proxy-Authorization: Basic YWxpY2U6d3Jvbmc=\r\n")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", resp.StatusCode)
+	}
+	_ = clientConn.Close()
+
+	// alice:secret
+	clientConn, rd, resp := request("Proxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n")
+	defer func() { _ = clientConn.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+
+	_ = upstream.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() { _, _ = clientConn.Write([]byte("ping")) }()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(upstream, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("upstream read %q, %v", buf, err)
+	}
+	go func() { _, _ = upstream.Write([]byte("pong")) }()
+	if _, err := io.ReadFull(rd, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("client read %q, %v", buf, err)
+	}
+	_ = upstream.Close()
+}
+
+func TestHTTPConnectServerRejectsOtherMethods(t *testing.T) {
+	s := &HTTPServer{
+		config:      &HTTPConfig{},
+		connectOnly: true,
+		dial: func(network, address string) (net.Conn, error) {
+			t.Error("a GET request should not be dialed")
+			return nil, io.EOF
+		},
+	}
+
+	clientConn, proxyConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+	go s.serve(proxyConn)
+	go func() {
+		_, _ = clientConn.Write([]byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	}()
+
+	_ = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestHTTPServeHeaderTimeout(t *testing.T) {
+	s := &HTTPServer{
+		config:        &HTTPConfig{},
+		headerTimeout: 50 * time.Millisecond,
+		dial: func(network, address string) (net.Conn, error) {
+			t.Error("an incomplete request should not be dialed")
+			return nil, io.EOF
+		},
+	}
+
+	clientConn, proxyConn := net.Pipe()
+	defer func() { _ = clientConn.Close() }()
+	go s.serve(proxyConn)
+	_, _ = clientConn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\n"))
+
+	_ = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := clientConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection without complete headers should be closed, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ServeIPC exposes the configuration protocol of the device on a unix socket or
+// TCP address, so external tools such as wg show can inspect and manage the tunnel.
+// Unix socket connections are only accepted from the same user, TCP connections
+// only from loopback addresses. It blocks until ctx is done, returning nil, or the
+// listener fails
+func (d VirtualTun) ServeIPC(ctx context.Context, network, address string) error {
+	var listener net.Listener
+	var err error
+	switch network {
+	case "unix":
+		listener, err = listenUnixPrivate(address)
+	case "tcp", "tcp4", "tcp6":
+		listener, err = net.Listen(network, address)
+	default:
+		return fmt.Errorf("unsupported IPC network %s", network)
+	}
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	stop := context.AfterFunc(ctx, func() { _ = listener.Close() })
+	defer stop()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if err := checkIPCPeer(conn); err != nil {
+			errorLogger.Printf("Rejected IPC connection: %s\n", err.Error())
+			_ = conn.Close()
+			continue
+		}
+		go d.Dev.IpcHandle(conn)
+	}
+}
+
+// listenUnixPrivate listens on a unix socket that only the current user can connect
+// to. The socket is created with mode 0600 in a 0700 directory next to address and
+// then moved in place, so it is never reachable with the default permissions
+func listenUnixPrivate(address string) (net.Listener, error) {
+	if _, err := os.Lstat(address); err == nil {
+		return nil, fmt.Errorf("listen unix %s: address already in use", address)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(address), ".wireproxy-ipc-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "ipc.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(private, 0o600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, address); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return &unixSocketListener{UnixListener: listener, path: address}, nil
+}
+
+// unixSocketListener removes the moved socket file once closed, net.UnixListener
+// only knows its original path
+type unixSocketListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+	err  error
+}
+
+func (l *unixSocketListener) Close() error {
+	l.once.Do(func() {
+		l.err = l.UnixListener.Close()
+		if err := os.Remove(l.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			l.err = errors.Join(l.err, err)
+		}
+	})
+	return l.err
+}
+
+// checkIPCPeer allows connections from loopback or from a unix socket peer of the same user
+func checkIPCPeer(conn net.Conn) error {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		addr, ok := c.RemoteAddr().(*net.TCPAddr)
+		if !ok || !addr.IP.IsLoopback() {
+			return fmt.Errorf("%s is not a loopback address", c.RemoteAddr())
+		}
+		return nil
+	case *net.UnixConn:
+		return checkUnixPeer(c)
+	default:
+		return errors.New("unsupported IPC connection type")
+	}
+}
@@ -0,0 +1,32 @@
+package wireproxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// checkUnixPeer compares the user of the connected process with the current user
+func checkUnixPeer(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return credErr
+	}
+
+	if int(cred.Uid) != os.Getuid() {
+		return fmt.Errorf("peer uid %d does not match uid %d", cred.Uid, os.Getuid())
+	}
+	return nil
+}
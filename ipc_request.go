@@ -0,0 +1,103 @@
+package wireproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// IPCFields is the structured form of the IPC request configuring a device,
+// see Serialize for the protocol text
+type IPCFields struct {
+	PrivateKey string // hex
+	ListenPort *int
+	AWG        *ASecConfig
+	Peers      []PeerIPC
+}
+
+// PeerIPC is the part of an IPC request configuring one peer
+type PeerIPC struct {
+	PublicKey           string // hex
+	PresharedKey        string // hex, empty leaves the key of the peer unchanged
+	Endpoint            *string
+	PersistentKeepalive int
+	ReplaceAllowedIPs   bool
+	AllowedIPs          []netip.Prefix
+}
+
+// CreateIPCFields builds the IPC request configuring a device from conf.
+// Peers are ordered by public key and default to all addresses when no AllowedIPs are set
+func CreateIPCFields(conf *DeviceConfig) (*IPCFields, error) {
+	fields := &IPCFields{
+		PrivateKey: conf.SecretKey,
+		ListenPort: clonePtr(conf.ListenPort),
+	}
+	if conf.ASecConfig != nil {
+		awg := conf.ASecConfig.Export()
+		fields.AWG = &awg
+	}
+	for _, peer := range sortedPeers(conf.Peers) {
+		fields.Peers = append(fields.Peers, newPeerIPC(peer, false))
+	}
+	return fields, nil
+}
+
+// newPeerIPC returns the IPC fields configuring peer. With replaceAllowedIPs the
+// allowed IPs of an existing peer are replaced instead of being added to.
+// An unset preshared key is only written then, to clear the key of the existing peer
+func newPeerIPC(peer PeerConfig, replaceAllowedIPs bool) PeerIPC {
+	fields := PeerIPC{
+		PublicKey:           peer.PublicKey,
+		Endpoint:            clonePtr(peer.Endpoint),
+		PersistentKeepalive: peer.KeepAlive,
+		ReplaceAllowedIPs:   replaceAllowedIPs,
+		AllowedIPs:          peer.AllowedIPs,
+	}
+	if peer.hasPresharedKey() {
+		fields.PresharedKey = peer.PreSharedKey
+	} else if replaceAllowedIPs {
+		fields.PresharedKey = zeroKey
+	}
+	if len(fields.AllowedIPs) == 0 {
+		fields.AllowedIPs = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	}
+	return fields
+}
+
+// Serialize returns the request in the WireGuard IPC protocol
+func (f *IPCFields) Serialize() string {
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "private_key=%s\n", f.PrivateKey)
+	if f.ListenPort != nil {
+		fmt.Fprintf(&request, "listen_port=%d\n", *f.ListenPort)
+	}
+	if f.AWG != nil {
+		for _, field := range f.AWG.fields() {
+			if field.uapi() {
+				fmt.Fprintf(&request, "%s=%s\n", strings.ToLower(field.key), field.value)
+			}
+		}
+	}
+	for _, peer := range f.Peers {
+		peer.writeTo(&request)
+	}
+	return request.String()
+}
+
+// writeTo writes the IPC lines of the peer to request
+func (p PeerIPC) writeTo(request *bytes.Buffer) {
+	fmt.Fprintf(request, "public_key=%s\npersistent_keepalive_interval=%d\n", p.PublicKey, p.PersistentKeepalive)
+	if p.PresharedKey != "" {
+		fmt.Fprintf(request, "preshared_key=%s\n", p.PresharedKey)
+	}
+	if p.Endpoint != nil {
+		fmt.Fprintf(request, "endpoint=%s\n", *p.Endpoint)
+	}
+	if p.ReplaceAllowedIPs {
+		request.WriteString("replace_allowed_ips=true\n")
+	}
+	for _, prefix := range p.AllowedIPs {
+		fmt.Fprintf(request, "allowed_ip=%s\n", prefix.String())
+	}
+}
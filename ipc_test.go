@@ -0,0 +1,111 @@
+package wireproxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeIPC(t *testing.T) {
+	_, vt, _ := newTestTunnelPair(t)
+
+	socket := filepath.Join(t.TempDir(), "wg.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- vt.ServeIPC(ctx, "unix", socket) }()
+
+	var conn net.Conn
+	var err error
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err = net.Dial("unix", socket)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket should only be accessible to the user: %v, %v", info, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := conn.Write([]byte("get=1\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	var response strings.Builder
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.WriteString(line)
+		if line == "\n" {
+			break
+		}
+	}
+
+	if !strings.Contains(response.String(), "public_key=29b5eff4426f4a6ea5913c43e5b325bad76d1fb149c833bf14ad4eb2e17e3e42\n") ||
+		!strings.HasSuffix(response.String(), "errno=0\n\n") {
+		t.Fatalf("unexpected IPC response:\n%s", response.String())
+	}
+
+	if err := vt.ServeIPC(ctx, "unix", socket); err == nil {
+		t.Fatal("a socket in use should not be replaced")
+	}
+	if err := vt.ServeIPC(ctx, "udp", "127.0.0.1:0"); err == nil {
+		t.Fatal("unsupported network should be rejected")
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeIPC should return once the context is done")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("socket should be removed, got %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(socket)); len(entries) != 0 {
+		t.Fatalf("temporary files should be removed, got %v", entries)
+	}
+}
+
+func TestCheckIPCPeer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if err := checkIPCPeer(server); err != nil {
+		t.Fatalf("loopback connection should be accepted: %v", err)
+	}
+
+	pipe, _ := net.Pipe()
+	if err := checkIPCPeer(pipe); err == nil {
+		t.Fatal("unknown connection type should be rejected")
+	}
+}
@@ -0,0 +1,34 @@
+package wireproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ToKubernetesSecret renders the device configuration as a Kubernetes Secret manifest.
+// The configuration without its PrivateKey is stored under config.conf and the
+// base64 private key under private.key, so the two can be mounted separately.
+// name and namespace are quoted, a value that is not a valid Kubernetes name is
+// rejected when the manifest is applied rather than changing its structure
+func (conf *DeviceConfig) ToKubernetesSecret(name, namespace string) string {
+	var config strings.Builder
+	conf.writeINI(&config, false)
+
+	var buf strings.Builder
+	buf.WriteString("apiVersion: v1\n")
+	buf.WriteString("kind: Secret\n")
+	buf.WriteString("metadata:\n")
+	// a double quoted YAML scalar accepts the escapes of strconv.Quote
+	fmt.Fprintf(&buf, "  name: %s\n", strconv.Quote(name))
+	if namespace != "" {
+		fmt.Fprintf(&buf, "  namespace: %s\n", strconv.Quote(namespace))
+	}
+	buf.WriteString("type: Opaque\n")
+	buf.WriteString("data:\n")
+	fmt.Fprintf(&buf, "  config.conf: %s\n", base64.StdEncoding.EncodeToString([]byte(config.String())))
+	fmt.Fprintf(&buf, "  private.key: %s\n", base64.StdEncoding.EncodeToString([]byte(encodeHexToBase64(conf.SecretKey))))
+
+	return buf.String()
+}
@@ -0,0 +1,48 @@
+package wireproxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// latencyConn records the time from the start of the dial to the first byte read in LatencyRecord
+type latencyConn struct {
+	net.Conn
+	vt      VirtualTun
+	address string
+	start   time.Time
+	once    sync.Once
+}
+
+func (c *latencyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(func() {
+			c.vt.recordLatency(c.address, time.Since(c.start))
+		})
+	}
+	return n, err
+}
+
+// DialWithLatency dials address through the tunnel and returns the time taken by the dial.
+// The time from the start of the dial to the first byte read from the connection
+// is stored in LatencyRecord under address
+func (d VirtualTun) DialWithLatency(ctx context.Context, network, address string) (net.Conn, time.Duration, error) {
+	start := time.Now()
+	conn, err := d.Tnet.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &latencyConn{Conn: conn, vt: d, address: address, start: start}, time.Since(start), nil
+}
+
+func (d VirtualTun) recordLatency(address string, latency time.Duration) {
+	if d.LatencyRecordLock == nil {
+		return
+	}
+	d.LatencyRecordLock.Lock()
+	d.LatencyRecord[address] = latency
+	d.LatencyRecordLock.Unlock()
+}
@@ -0,0 +1,109 @@
+package wireproxy
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	// maxPathMTU is the largest path MTU DetectMTU reports
+	maxPathMTU = 1500
+	// minPathMTUv4 and minPathMTUv6 are the smallest MTUs IPv4 and IPv6 links must support
+	minPathMTUv4 = 576
+	minPathMTUv6 = 1280
+	// wireguardOverhead is the size of the outer IPv6, UDP and WireGuard headers of a packet
+	wireguardOverhead = 80
+	// defaultMTU is used for the tunnel when the MTU is neither configured nor detected
+	defaultMTU = 1420
+	// mtuProbeTimeout bounds the MTU detection done when the tunnel starts
+	mtuProbeTimeout = 2 * time.Second
+)
+
+// errMTUProbeUnsupported is returned by DetectMTU where the don't fragment bit cannot be set
+var errMTUProbeUnsupported = errors.New("path MTU discovery is not supported on this platform")
+
+// DetectMTU searches the path MTU towards endpoint, given as host:port, by sending UDP probes
+// with the don't fragment bit set. The kernel rejects probes larger than the MTU of the route,
+// which is lowered by the ICMP fragmentation needed messages received during the search.
+// The result is clamped to 1500
+func DetectMTU(endpoint string) (int, error) {
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	network, headerSize, minMTU := "udp4", 28, minPathMTUv4
+	if addr.IP.To4() == nil {
+		network, headerSize, minMTU = "udp6", 48, minPathMTUv6
+	}
+
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if err := setDontFragment(conn, network); err != nil {
+		return 0, err
+	}
+
+	return searchMTU(minMTU, maxPathMTU, func(mtu int) (bool, error) {
+		_, err := conn.WriteToUDP(make([]byte, mtu-headerSize), addr)
+		if isMessageTooLong(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// searchMTU returns the largest MTU between lo and hi for which fits reports true,
+// lo is returned when no probe fits
+func searchMTU(lo, hi int, fits func(mtu int) (bool, error)) (int, error) {
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		ok, err := fits(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo, nil
+}
+
+// detectTunnelMTU returns the tunnel MTU derived from the path MTU towards the first
+// peer with an endpoint, or defaultMTU if the detection fails or takes longer than mtuProbeTimeout
+func detectTunnelMTU(peers []PeerConfig) int {
+	var endpoint string
+	for _, peer := range peers {
+		if peer.Endpoint != nil {
+			endpoint = *peer.Endpoint
+			break
+		}
+	}
+	if endpoint == "" {
+		return defaultMTU
+	}
+
+	result := make(chan int, 1)
+	go func() {
+		mtu, err := DetectMTU(endpoint)
+		if err != nil {
+			errorLogger.Printf("Warning: MTU detection towards %s failed, using %d: %s\n", endpoint, defaultMTU, err.Error())
+			mtu = defaultMTU + wireguardOverhead
+		}
+		result <- mtu - wireguardOverhead
+	}()
+
+	select {
+	case mtu := <-result:
+		return mtu
+	case <-time.After(mtuProbeTimeout):
+		errorLogger.Printf("Warning: MTU detection towards %s timed out, using %d\n", endpoint, defaultMTU)
+		return defaultMTU
+	}
+}
@@ -0,0 +1,31 @@
+package wireproxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// setDontFragment makes the kernel reject datagrams larger than the path MTU instead of fragmenting them
+func setDontFragment(conn *net.UDPConn, network string) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		if network == "udp4" {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		}
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func isMessageTooLong(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package wireproxy
+
+import "net"
+
+// setDontFragment is only implemented on Linux, DetectMTU fails elsewhere
+func setDontFragment(conn *net.UDPConn, network string) error {
+	return errMTUProbeUnsupported
+}
+
+func isMessageTooLong(err error) bool {
+	return false
+}
@@ -0,0 +1,56 @@
+package wireproxy
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestSearchMTU(t *testing.T) {
+	for _, pathMTU := range []int{576, 1280, 1420, 1499, 1500} {
+		probes := 0
+		got, err := searchMTU(minPathMTUv4, maxPathMTU, func(mtu int) (bool, error) {
+			probes++
+			return mtu <= pathMTU, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != pathMTU {
+			t.Errorf("got %d, want %d", got, pathMTU)
+		}
+		if probes > 10 {
+			t.Errorf("%d probes for a binary search over %d values", probes, maxPathMTU-minPathMTUv4)
+		}
+	}
+
+	probeErr := errors.New("network unreachable")
+	if _, err := searchMTU(minPathMTUv4, maxPathMTU, func(int) (bool, error) { return false, probeErr }); !errors.Is(err, probeErr) {
+		t.Fatalf("probe error should be returned, got %v", err)
+	}
+}
+
+func TestDetectMTU(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("path MTU discovery is only supported on Linux")
+	}
+
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	mtu, err := DetectMTU(listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mtu != maxPathMTU {
+		t.Fatalf("the MTU of the loopback interface should be clamped to %d, got %d", maxPathMTU, mtu)
+	}
+
+	if mtu := detectTunnelMTU(nil); mtu != defaultMTU {
+		t.Fatalf("default MTU expected without endpoint, got %d", mtu)
+	}
+}
@@ -0,0 +1,339 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// ReconnectOptions controls how StartWireguardWithReconnect recovers the tunnel
+type ReconnectOptions struct {
+	// Interval is the delay between two connection attempts
+	Interval time.Duration
+	// MaxAttempts is the number of consecutive failed attempts before giving up, 0 retries forever
+	MaxAttempts int
+	// LogLevel is passed to StartWireguard
+	LogLevel int
+}
+
+// StartWireguardWithReconnect starts the tunnel and starts it again whenever its device is closed
+// or fails to start. Every successfully started tunnel is sent on the first channel, the previous
+// one must not be used anymore. When MaxAttempts consecutive attempts fail, the last error is sent
+// on the second channel. Both channels are closed once ctx is cancelled or retries are exhausted
+func StartWireguardWithReconnect(ctx context.Context, conf *DeviceConfig, opts ReconnectOptions) (<-chan *VirtualTun, <-chan error) {
+	tunnels := make(chan *VirtualTun)
+	errs := make(chan error, 1)
+
+	go reconnectLoop(ctx, func() (*VirtualTun, error) {
+		return StartWireguard(ctx, conf, opts.LogLevel)
+	}, opts, tunnels, errs)
+
+	return tunnels, errs
+}
+
+func reconnectLoop(
+	ctx context.Context,
+	start func() (*VirtualTun, error),
+	opts ReconnectOptions,
+	tunnels chan<- *VirtualTun,
+	errs chan<- error,
+) {
+	defer close(tunnels)
+	defer close(errs)
+
+	wait := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(opts.Interval):
+			return true
+		}
+	}
+
+	failures := 0
+	for {
+		vt, err := start()
+		if err != nil {
+			failures++
+			errorLogger.Printf("Failed to start wireguard (attempt %d): %s\n", failures, err.Error())
+			if opts.MaxAttempts > 0 && failures >= opts.MaxAttempts {
+				errs <- fmt.Errorf("wireguard failed to start after %d attempts: %w", failures, err)
+				return
+			}
+			if !wait() {
+				return
+			}
+			continue
+		}
+		failures = 0
+
+		select {
+		case tunnels <- vt:
+		case <-ctx.Done():
+			vt.Dev.Close()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			vt.Dev.Close()
+			return
+		case <-vt.Dev.Wait():
+			errorLogger.Printf("Wireguard device closed, reconnecting\n")
+		}
+
+		if !wait() {
+			return
+		}
+	}
+}
+
+// Reconnect resolves the endpoint hostnames of the peers again and points the device to the
+// new address of every peer whose endpoint moved, e.g. after a dynamic DNS update or a failover.
+// Peers configured with an IP endpoint are skipped. The errors of all peers are joined.
+// It can be called periodically, a tunnel with unchanged endpoints is left untouched
+func (d VirtualTun) Reconnect(ctx context.Context) error {
+	conf := d.currentConf()
+	resolver := conf.PeerEndpointResolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	moved, err := reconnectPeers(ctx, d.Dev, conf.Peers, func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return resolver.LookupNetIP(ctx, "ip", host)
+	})
+	if len(moved) > 0 {
+		d.setPeerEndpoints(moved)
+	}
+	return err
+}
+
+// setPeerEndpoints replaces the endpoints of the peers by hex public key with an updated
+// copy of the peers under ConfLock, peers returned by GetPeer are left unchanged
+func (d VirtualTun) setPeerEndpoints(endpoints map[string]string) {
+	if d.ConfLock != nil {
+		d.ConfLock.Lock()
+		defer d.ConfLock.Unlock()
+	}
+
+	peers := slices.Clone(d.Conf.Peers)
+	for i := range peers {
+		if endpoint, ok := endpoints[peers[i].PublicKey]; ok {
+			peers[i].Endpoint = &endpoint
+		}
+	}
+	d.Conf.Peers = peers
+}
+
+// reconnectPeers updates the endpoints of peers that resolve to an address other than the one
+// used by dev. It returns the new endpoints by hex public key, peers are not modified
+func reconnectPeers(
+	ctx context.Context,
+	dev ipcDevice,
+	peers []PeerConfig,
+	lookup func(ctx context.Context, host string) ([]netip.Addr, error),
+) (map[string]string, error) {
+	var current map[string]string
+	moved := make(map[string]string)
+	var errs []error
+	for _, peer := range peers {
+		if peer.EndpointHost == "" {
+			continue
+		}
+		if current == nil {
+			var err error
+			if current, err = getPeerEndpoints(dev); err != nil {
+				return moved, err
+			}
+		}
+
+		host, port, err := net.SplitHostPort(peer.EndpointHost)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		addrs, err := lookup(ctx, host)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resolve %s: %w", host, err))
+			continue
+		}
+		if len(addrs) == 0 {
+			errs = append(errs, errors.New("no address found for "+host))
+			continue
+		}
+
+		// round robin DNS may list the current address in another position
+		inUse := slices.ContainsFunc(addrs, func(addr netip.Addr) bool {
+			return net.JoinHostPort(addr.Unmap().String(), port) == current[peer.PublicKey]
+		})
+		if inUse {
+			continue
+		}
+
+		endpoint := net.JoinHostPort(addrs[0].Unmap().String(), port)
+		request := fmt.Sprintf("public_key=%s\nupdate_only=true\nendpoint=%s\n", peer.PublicKey, endpoint)
+		if err := dev.IpcSet(request); err != nil {
+			errs = append(errs, fmt.Errorf("update endpoint of %s: %w", peer.EndpointHost, err))
+			continue
+		}
+		errorLogger.Printf("Endpoint %s moved to %s\n", peer.EndpointHost, endpoint)
+		moved[peer.PublicKey] = endpoint
+	}
+	return moved, errors.Join(errs...)
+}
+
+// getPeerEndpoints returns the endpoint used by dev for every peer by hex public key
+func getPeerEndpoints(dev ipcDevice) (map[string]string, error) {
+	state, err := dev.IpcGet()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make(map[string]string)
+	publicKey := ""
+	for _, line := range strings.Split(state, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "public_key":
+			publicKey = value
+		case "endpoint":
+			if publicKey != "" {
+				endpoints[publicKey] = value
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+// RetryConfig controls how StartWireguardWithRetry waits for the first handshake
+type RetryConfig struct {
+	// MaxAttempts is the number of tunnels started before giving up, 0 retries until ctx is cancelled
+	MaxAttempts int
+	// HandshakeTimeout is how long each tunnel waits for a handshake before it is closed
+	HandshakeTimeout time.Duration
+	// InitialDelay is the pause after the first failed attempt, it doubles after every attempt
+	InitialDelay time.Duration
+	// MaxDelay caps the pause, 0 leaves it uncapped
+	MaxDelay time.Duration
+}
+
+const (
+	// defaultRetryHandshakeTimeout is used when RetryConfig.HandshakeTimeout is not set. WireGuard
+	// sends a new handshake initiation every 5 seconds, this leaves room for three of them
+	defaultRetryHandshakeTimeout = 15 * time.Second
+	// defaultRetryInitialDelay is used when RetryConfig.InitialDelay is not set
+	defaultRetryInitialDelay = time.Second
+)
+
+// StartWireguardWithRetry starts the tunnel and returns it once a handshake with one of its peers
+// succeeded, e.g. on headless servers whose network is not routable yet when the process starts.
+// Handshakes are initiated right away instead of waiting for traffic. A tunnel without handshake
+// after HandshakeTimeout is shut down like on ctx cancellation, PostDown included, and started
+// again after a pause doubling with every attempt, up to MaxDelay
+func StartWireguardWithRetry(ctx context.Context, conf *DeviceConfig, logLevel int, retry RetryConfig) (*VirtualTun, error) {
+	timeout := retry.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultRetryHandshakeTimeout
+	}
+	delay := retry.InitialDelay
+	if delay <= 0 {
+		delay = defaultRetryInitialDelay
+	}
+
+	var err error
+	for attempt := 1; retry.MaxAttempts <= 0 || attempt <= retry.MaxAttempts; attempt++ {
+		var vt *VirtualTun
+		if vt, err = startWireguardAttempt(ctx, conf, logLevel, timeout); err == nil {
+			return vt, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		errorLogger.Printf("Wireguard is not connected (attempt %d): %s\n", attempt, err.Error())
+		if attempt == retry.MaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if retry.MaxDelay > 0 && delay > retry.MaxDelay {
+			delay = retry.MaxDelay
+		}
+	}
+	return nil, fmt.Errorf("wireguard failed to connect after %d attempts: %w", retry.MaxAttempts, err)
+}
+
+// startWireguardAttempt starts the tunnel with a context of its own, cancelled to shut the
+// tunnel down when no handshake happens within timeout
+func startWireguardAttempt(ctx context.Context, conf *DeviceConfig, logLevel int, timeout time.Duration) (*VirtualTun, error) {
+	attemptCtx, cancel := context.WithCancel(ctx)
+	vt, err := StartWireguard(attemptCtx, conf, logLevel)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	initiateHandshakes(vt.Dev, conf.Peers)
+	if err := waitForHandshake(ctx, vt.Dev, timeout); err != nil {
+		cancel()
+		return nil, errors.Join(err, vt.Wait())
+	}
+
+	// attemptCtx is cancelled with ctx, release it earlier if the device is closed directly
+	go func() {
+		_ = vt.Wait()
+		cancel()
+	}()
+	return vt, nil
+}
+
+// initiateHandshakes sends a keepalive to every peer, the device starts a handshake to send it
+func initiateHandshakes(dev *device.Device, peers []PeerConfig) {
+	for _, peer := range peers {
+		var publicKey device.NoisePublicKey
+		if err := publicKey.FromHex(peer.PublicKey); err != nil {
+			continue
+		}
+		if p := dev.LookupPeer(publicKey); p != nil {
+			p.SendKeepalive()
+		}
+	}
+}
+
+// waitForHandshake polls dev until one of its peers completed a handshake or timeout elapses
+func waitForHandshake(ctx context.Context, dev ipcDevice, timeout time.Duration) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	for {
+		handshakes, err := getPeerHandshakes(dev)
+		if err != nil {
+			return err
+		}
+		if slices.ContainsFunc(handshakes, func(peer peerHandshake) bool { return !peer.last.IsZero() }) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return errors.New("no handshake within " + timeout.String())
+		case <-ticker.C:
+		}
+	}
+}
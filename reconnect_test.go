@@ -0,0 +1,214 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+func TestReconnectLoopGivesUp(t *testing.T) {
+	attempts := 0
+	start := func() (*VirtualTun, error) {
+		attempts++
+		return nil, errors.New("device failed")
+	}
+
+	tunnels := make(chan *VirtualTun)
+	errs := make(chan error, 1)
+	go reconnectLoop(context.Background(), start, ReconnectOptions{MaxAttempts: 3}, tunnels, errs)
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("error expected after the last attempt")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retries should be exhausted")
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+	if _, ok := <-tunnels; ok {
+		t.Fatal("tunnel channel should be closed")
+	}
+}
+
+func TestStartWireguardWithReconnect(t *testing.T) {
+	conf := &DeviceConfig{
+		SecretKey: "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d",
+		MTU:       1420,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnels, errs := StartWireguardWithReconnect(ctx, conf, ReconnectOptions{Interval: 10 * time.Millisecond, LogLevel: device.LogLevelSilent})
+
+	next := func() *VirtualTun {
+		select {
+		case vt := <-tunnels:
+			return vt
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("tunnel should be started")
+		}
+		return nil
+	}
+
+	first := next()
+	first.Dev.Close()
+
+	second := next()
+	if second == first {
+		t.Fatal("a new tunnel should be started after the device is closed")
+	}
+
+	cancel()
+	select {
+	case <-second.Dev.Wait():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the device should be closed when the context is cancelled")
+	}
+}
+
+func TestReconnectPeers(t *testing.T) {
+	const keyA = "7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c"
+	const keyB = "4879e1e02d9a0d7869d608c8a9c786849ae138b49e35872a58b29c627ce3d345"
+	const keyC = "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d"
+	endpointA, endpointB, endpointC := "192.0.2.1:51820", "192.0.2.2:51820", "192.0.2.3:51820"
+	peers := []PeerConfig{
+		{PublicKey: keyA, Endpoint: &endpointA, EndpointHost: "moved.example:51820"},
+		{PublicKey: keyB, Endpoint: &endpointB, EndpointHost: "same.example:51820"},
+		{PublicKey: keyC, Endpoint: &endpointC},
+	}
+	dev := &fakeIPCDevice{state: "public_key=" + keyA + "\nendpoint=192.0.2.1:51820\n" +
+		"public_key=" + keyB + "\nendpoint=192.0.2.2:51820\n" +
+		"public_key=" + keyC + "\nendpoint=192.0.2.3:51820\n"}
+	lookup := func(ctx context.Context, host string) ([]netip.Addr, error) {
+		switch host {
+		case "moved.example":
+			return []netip.Addr{netip.MustParseAddr("::ffff:198.51.100.7")}, nil
+		case "same.example":
+			return []netip.Addr{netip.MustParseAddr("198.51.100.8"), netip.MustParseAddr("192.0.2.2")}, nil
+		}
+		return nil, errors.New("unexpected lookup of " + host)
+	}
+
+	moved, err := reconnectPeers(context.Background(), dev, peers, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "public_key=" + keyA + "\nupdate_only=true\nendpoint=198.51.100.7:51820\n"
+	if len(dev.requests) != 1 || dev.requests[0] != want {
+		t.Fatalf("only the moved endpoint should be updated, got %q", dev.requests)
+	}
+	if len(moved) != 1 || moved[keyA] != "198.51.100.7:51820" {
+		t.Fatalf("only the endpoint of the updated peer should be returned, got %v", moved)
+	}
+	if *peers[0].Endpoint != endpointA {
+		t.Fatal("peers should not be modified")
+	}
+
+	vt := VirtualTun{Conf: &DeviceConfig{Peers: peers}, ConfLock: new(sync.RWMutex)}
+	vt.setPeerEndpoints(moved)
+	if *vt.Conf.Peers[0].Endpoint != "198.51.100.7:51820" || *vt.Conf.Peers[1].Endpoint != endpointB || *peers[0].Endpoint != endpointA {
+		t.Fatalf("endpoint of the updated peer should change on a copy, got %s and %s", *vt.Conf.Peers[0].Endpoint, *vt.Conf.Peers[1].Endpoint)
+	}
+
+	dev.requests = nil
+	failing := func(ctx context.Context, host string) ([]netip.Addr, error) {
+		return nil, errors.New("lookup failed")
+	}
+	_, err = reconnectPeers(context.Background(), dev, peers, failing)
+	if err == nil || len(dev.requests) != 0 {
+		t.Fatalf("failed lookups should be reported without updating the device, got %v", err)
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); !ok || len(joined.Unwrap()) != 2 {
+		t.Fatalf("errors of both peers should be joined, got %v", err)
+	}
+}
+
+func TestParsePeersKeepsEndpointHost(t *testing.T) {
+	iniData, err := loadIniConfig(`
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = LocalHost:51820
+
+[Peer]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+Endpoint = 127.0.0.1:51820`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var peers []PeerConfig
+	if err := ParsePeers(iniData, &peers); err != nil {
+		t.Fatal(err)
+	}
+	if peers[0].EndpointHost != "localhost:51820" {
+		t.Fatalf("hostname endpoint should be kept, got %q", peers[0].EndpointHost)
+	}
+	if peers[1].EndpointHost != "" {
+		t.Fatalf("IP endpoint should not be kept as a hostname, got %q", peers[1].EndpointHost)
+	}
+}
+
+func TestWaitForHandshake(t *testing.T) {
+	const peer = "public_key=7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c\n"
+
+	dev := &fakeIPCDevice{state: peer + "last_handshake_time_sec=0\nlast_handshake_time_nsec=0\n"}
+	if err := waitForHandshake(context.Background(), dev, 50*time.Millisecond); err == nil {
+		t.Fatal("waiting should time out without handshake")
+	}
+
+	dev.state = peer + "last_handshake_time_sec=1700000000\nlast_handshake_time_nsec=0\n"
+	if err := waitForHandshake(context.Background(), dev, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartWireguardWithRetry(t *testing.T) {
+	confA, vtA, _ := newTestTunnelPair(t)
+	vtA.Dev.Close()
+	_ = vtA.Wait()
+
+	// the peer has no PersistentKeepalive, the handshake must be initiated by the retry
+	vt, err := StartWireguardWithRetry(context.Background(), confA, device.LogLevelSilent, RetryConfig{
+		MaxAttempts:      3,
+		HandshakeTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vt.Dev.Close()
+
+	unreachable := confA.Clone()
+	endpoint := "127.0.0.1:" + strconv.Itoa(freeUDPPort(t))
+	unreachable.Peers[0].Endpoint = &endpoint
+	down := filepath.Join(t.TempDir(), "down")
+	unreachable.EnableHooks = true
+	unreachable.PostDown = []string{"echo down >> " + down}
+	start := time.Now()
+	_, err = StartWireguardWithRetry(context.Background(), unreachable, device.LogLevelSilent, RetryConfig{
+		MaxAttempts:      2,
+		HandshakeTimeout: 50 * time.Millisecond,
+		InitialDelay:     300 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("retries should be exhausted without a reachable peer")
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("attempts should be separated by the delay, took %s", elapsed)
+	}
+	if data, err := os.ReadFile(down); err != nil || string(data) != "down\ndown\n" {
+		t.Fatalf("every failed attempt should be shut down with PostDown, got %q, %v", data, err)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -38,15 +39,48 @@ type CredentialValidator struct {
 	password string
 }
 
+// defaultPingRecordExpiry is how long a ping record is kept without being refreshed
+const defaultPingRecordExpiry = 5 * time.Minute
+
 // VirtualTun stores a reference to netstack network and DNS configuration
 type VirtualTun struct {
 	Tnet      *netstack.Net
 	Dev       *device.Device
 	SystemDNS bool
 	Conf      *DeviceConfig
+	// ConfLock guards Conf and PeerIndex, which Reload replaces while the tunnel runs
+	ConfLock *sync.RWMutex
 	// PingRecord stores the last time an IP was pinged
-	PingRecord     map[string]uint64
+	PingRecord     map[string]pingRecordEntry
 	PingRecordLock *sync.Mutex
+	// PingRecordExpiry is how long a ping record is kept without receiving a pong
+	PingRecordExpiry time.Duration
+	// LatencyRecord stores the time to the first byte of the last connection to an address, see DialWithLatency
+	LatencyRecord     map[string]time.Duration
+	LatencyRecordLock *sync.Mutex
+	// PeerIndex maps the hex public key of a peer to its position in Conf.Peers
+	PeerIndex map[string]int
+	// HandshakeMaxAge is the age of the newest handshake above which HealthCheck fails, see defaultHandshakeMaxAge
+	HandshakeMaxAge time.Duration
+	// DetectedMTU is the tunnel MTU derived from the path MTU when none was configured, 0 otherwise
+	DetectedMTU int
+	// DialDNSTTL is how long Dial caches a resolved address, read on the first Dial
+	DialDNSTTL time.Duration
+	// DialDNSMaxEntries is how many addresses Dial keeps cached, 0 for no limit, read on the first Dial
+	DialDNSMaxEntries int
+	// dns holds the DNS servers set at runtime, see SetDNS
+	dns *tunnelDNS
+	// dialDNS caches the addresses resolved by Dial
+	dialDNS *dialDNS
+	// shutdown is closed once the device is closed, see Wait
+	shutdown *tunnelShutdown
+}
+
+// pingRecordEntry stores the result of the last successful ping of an IP
+type pingRecordEntry struct {
+	lastPong uint64        // unix time of the last pong, 0 if none was received
+	rtt      time.Duration // round trip time of the last pong
+	updated  time.Time     // local time the entry was last written
 }
 
 // RoutineSpawner spawns a routine (e.g. socks5, tcp static routes) after the configuration is parsed
@@ -59,9 +93,55 @@ type addressPort struct {
 	port    uint16
 }
 
-// LookupAddr lookups a hostname.
+// currentConf returns a copy of Conf read under ConfLock, empty without Conf.
+// The slices and pointers of Conf are replaced and never changed in place,
+// so the copy can be used once the lock is released
+func (d VirtualTun) currentConf() DeviceConfig {
+	if d.Conf == nil {
+		return DeviceConfig{}
+	}
+	if d.ConfLock != nil {
+		d.ConfLock.RLock()
+		defer d.ConfLock.RUnlock()
+	}
+	return *d.Conf
+}
+
+// Config returns a deep copy of the configuration the tunnel runs with,
+// it is safe to call while Reload changes the configuration
+func (d VirtualTun) Config() *DeviceConfig {
+	if d.Conf == nil {
+		return nil
+	}
+	conf := d.currentConf()
+	return conf.Clone()
+}
+
+// LookupAddr lookups a hostname, single label names are first tried in the DNS search domains.
 // DNS traffic may or may not be routed depending on VirtualTun's setting
 func (d VirtualTun) LookupAddr(ctx context.Context, name string) ([]string, error) {
+	searchDomains := d.currentConf().DNSSearchDomains
+	if d.dns != nil {
+		searchDomains = d.dns.searchDomains
+	}
+	for _, fqdn := range searchNames(name, searchDomains) {
+		if addrs, err := d.lookupHost(ctx, fqdn); err == nil {
+			return addrs, nil
+		}
+	}
+	return d.lookupHost(ctx, name)
+}
+
+// lookupHost resolves name as is with the resolver selected by the tunnel settings
+func (d VirtualTun) lookupHost(ctx context.Context, name string) ([]string, error) {
+	if d.dns != nil {
+		if servers, set := d.dns.currentServers(); set {
+			if len(servers) == 0 {
+				return net.DefaultResolver.LookupHost(ctx, name)
+			}
+			return d.dns.resolver.LookupHost(ctx, name)
+		}
+	}
 	if d.SystemDNS {
 		return net.DefaultResolver.LookupHost(ctx, name)
 	}
@@ -135,17 +215,121 @@ func (d VirtualTun) resolveToAddrPort(endpoint *addressPort) (*netip.AddrPort, e
 	return &addrPort, nil
 }
 
-// SpawnRoutine spawns a socks5 server using custom implementation.
-func (config *Socks5Config) SpawnRoutine(vt *VirtualTun) {
-	errorLogger.Printf("Starting SOCKS5 on %s", config.BindAddress)
+// parseListenAddr parses a host:port listen address on the wireguard interface.
+// The host must be empty, unspecified or one of the interface addresses
+func (d VirtualTun) parseListenAddr(addr string) (netip.AddrPort, error) {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	port, err := strconv.ParseUint(sport, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, errors.New("invalid port: " + sport)
+	}
 
+	if host == "" {
+		return netip.AddrPortFrom(netip.Addr{}, uint16(port)), nil
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	ip = ip.Unmap()
+
+	if !ip.IsUnspecified() && !slices.Contains(d.currentConf().Endpoint, ip) {
+		return netip.AddrPort{}, errors.New("address " + host + " is not assigned to the wireguard interface")
+	}
+
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
+
+// ListenTCP listens for inbound TCP connections on the wireguard interface
+func (d VirtualTun) ListenTCP(addr string) (net.Listener, error) {
+	addrPort, err := d.parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.Tnet.ListenTCPAddrPort(addrPort)
+}
+
+// ListenUDP listens for inbound UDP packets on the wireguard interface
+func (d VirtualTun) ListenUDP(addr string) (net.PacketConn, error) {
+	addrPort, err := d.parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.Tnet.ListenUDPAddrPort(addrPort)
+}
+
+// buildPeerIndex maps the public key of every peer to its position in peers
+func buildPeerIndex(peers []PeerConfig) map[string]int {
+	index := make(map[string]int, len(peers))
+	for i, peer := range peers {
+		index[peer.PublicKey] = i
+	}
+	return index
+}
+
+// GetPeer returns the peer with the given base64 public key.
+// PeerIndex is used when available, otherwise the peers are scanned.
+// The peer must not be modified, Reload and UpdatePeerAllowedIPs replace it instead
+func (d VirtualTun) GetPeer(publicKey string) (*PeerConfig, error) {
+	key, err := encodeBase64ToHex(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if d.ConfLock != nil {
+		d.ConfLock.RLock()
+		defer d.ConfLock.RUnlock()
+	}
+
+	if d.PeerIndex != nil {
+		if i, ok := d.PeerIndex[key]; ok && i < len(d.Conf.Peers) && d.Conf.Peers[i].PublicKey == key {
+			return &d.Conf.Peers[i], nil
+		}
+		return nil, errors.New("no peer with public key " + publicKey)
+	}
+
+	for i := range d.Conf.Peers {
+		if d.Conf.Peers[i].PublicKey == key {
+			return &d.Conf.Peers[i], nil
+		}
+	}
+	return nil, errors.New("no peer with public key " + publicKey)
+}
+
+// newServer creates the socks5 server configured by config
+func (config *Socks5Config) newServer(vt *VirtualTun) *CustomSocks5Server {
 	server := NewCustomSocks5Server(
 		config.BindAddress,
 		vt,
 		config.Username,
 		config.Password,
 	)
+	server.tcp.bindTimeout = config.BindTimeout
+	server.tcp.dialTimeout = config.DialTimeout
+	server.tcp.readTimeout = config.ReadTimeout
+	server.tcp.writeTimeout = config.WriteTimeout
+	if config.UDPMaxConnections > 0 {
+		server.udp.config.MaxConnections = config.UDPMaxConnections
+	}
+	if config.UDPIdleTimeout > 0 {
+		server.udp.config.IdleTimeout = config.UDPIdleTimeout
+	}
+	server.udp.config.KeyFunc = config.UDPKeyFunc
+	if config.UDPDNSCacheSize != nil {
+		server.udp.config.DNSCacheSize = *config.UDPDNSCacheSize
+	}
+	return server
+}
 
+// SpawnRoutine spawns a socks5 server using custom implementation.
+func (config *Socks5Config) SpawnRoutine(vt *VirtualTun) {
+	errorLogger.Printf("Starting SOCKS5 on %s", config.BindAddress)
+
+	server := config.newServer(vt)
 	if err := server.Start(); err != nil {
 		errorLogger.Printf("Failed to start SOCKS5 server: %v", err)
 		return
@@ -313,7 +497,14 @@ func (d VirtualTun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Health metric request: %s\n", r.URL.Path)
 	switch path.Clean(r.URL.Path) {
 	case "/readyz":
-		body, err := json.Marshal(d.PingRecord)
+		d.PingRecordLock.Lock()
+		lastPongs := make(map[string]uint64, len(d.PingRecord))
+		for addr, record := range d.PingRecord {
+			lastPongs[addr] = record.lastPong
+		}
+		d.PingRecordLock.Unlock()
+
+		body, err := json.Marshal(lastPongs)
 		if err != nil {
 			errorLogger.Printf("Failed to get device metrics: %s\n", err.Error())
 			w.WriteHeader(http.StatusInternalServerError)
@@ -321,10 +512,10 @@ func (d VirtualTun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		status := http.StatusOK
-		for _, record := range d.PingRecord {
+		for _, record := range lastPongs {
 			lastPong := time.Unix(int64(record), 0)
 			// +2 seconds to account for the time it takes to ping the IP
-			if time.Since(lastPong) > time.Duration(d.Conf.CheckAliveInterval+2)*time.Second {
+			if time.Since(lastPong) > time.Duration(d.currentConf().CheckAliveInterval+2)*time.Second {
 				status = http.StatusServiceUnavailable
 				break
 			}
@@ -364,7 +555,8 @@ func (d VirtualTun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (d VirtualTun) pingIPs() {
-	for _, addr := range d.Conf.CheckAlive {
+	conf := d.currentConf()
+	for _, addr := range conf.CheckAlive {
 		socket, err := d.Tnet.Dial("ping", addr.String())
 		if err != nil {
 			errorLogger.Printf("Failed to ping %s: %s\n", addr, err.Error())
@@ -390,12 +582,13 @@ func (d VirtualTun) pingIPs() {
 			continue
 		}
 
-		err = socket.SetReadDeadline(time.Now().Add(time.Duration(d.Conf.CheckAliveInterval) * time.Second))
+		err = socket.SetReadDeadline(time.Now().Add(time.Duration(conf.CheckAliveInterval) * time.Second))
 		if err != nil {
 			errorLogger.Printf("Failed to set ping read deadline for %s: %s\n", addr, err.Error())
 			_ = socket.Close()
 			continue
 		}
+		sentAt := time.Now()
 		_, err = socket.Write(icmpBytes)
 		if err != nil {
 			errorLogger.Printf("Failed to ping %s: %s\n", addr, err.Error())
@@ -446,22 +639,108 @@ func (d VirtualTun) pingIPs() {
 				}
 			}
 
+			now := time.Now()
 			d.PingRecordLock.Lock()
-			d.PingRecord[addr.String()] = uint64(time.Now().Unix())
+			d.PingRecord[addr.String()] = pingRecordEntry{
+				lastPong: uint64(now.Unix()),
+				rtt:      now.Sub(sentAt),
+				updated:  now,
+			}
 			d.PingRecordLock.Unlock()
 		}()
 	}
 }
 
 func (d VirtualTun) StartPingIPs() {
-	for _, addr := range d.Conf.CheckAlive {
-		d.PingRecord[addr.String()] = 0
+	d.PingRecordLock.Lock()
+	for _, addr := range d.currentConf().CheckAlive {
+		d.PingRecord[addr.String()] = pingRecordEntry{updated: time.Now()}
 	}
+	d.PingRecordLock.Unlock()
 
 	go func() {
 		for {
 			d.pingIPs()
-			time.Sleep(time.Duration(d.Conf.CheckAliveInterval) * time.Second)
+			time.Sleep(time.Duration(d.currentConf().CheckAliveInterval) * time.Second)
+		}
+	}()
+}
+
+// expirePingRecords evicts ping records that have not been refreshed within PingRecordExpiry.
+// Records of addresses still listed in CheckAlive are reset instead of removed,
+// so that /readyz keeps reporting them as unreachable
+func (d VirtualTun) expirePingRecords(now time.Time) {
+	conf := d.currentConf()
+	checkAlive := make(map[string]bool, len(conf.CheckAlive))
+	for _, addr := range conf.CheckAlive {
+		checkAlive[addr.String()] = true
+	}
+
+	d.PingRecordLock.Lock()
+	defer d.PingRecordLock.Unlock()
+	for addr, record := range d.PingRecord {
+		if now.Sub(record.updated) < d.PingRecordExpiry {
+			continue
+		}
+		if checkAlive[addr] {
+			d.PingRecord[addr] = pingRecordEntry{updated: now}
+		} else {
+			delete(d.PingRecord, addr)
+		}
+	}
+}
+
+// PingStats returns the round trip time of the last pong of every pinged address.
+// Addresses that have not answered yet are left out
+func (d VirtualTun) PingStats() map[string]time.Duration {
+	d.PingRecordLock.Lock()
+	defer d.PingRecordLock.Unlock()
+
+	stats := make(map[string]time.Duration, len(d.PingRecord))
+	for addr, record := range d.PingRecord {
+		if record.lastPong != 0 {
+			stats[addr] = record.rtt
+		}
+	}
+	return stats
+}
+
+// ResetPingRecord forgets the results of all pings, the next pings fill the record again.
+// CheckAlive addresses are kept without pong like in expirePingRecords, so that /readyz
+// reports them as unreachable until they answer again
+func (d VirtualTun) ResetPingRecord() {
+	conf := d.currentConf()
+	now := time.Now()
+
+	d.PingRecordLock.Lock()
+	defer d.PingRecordLock.Unlock()
+	clear(d.PingRecord)
+	for _, addr := range conf.CheckAlive {
+		d.PingRecord[addr.String()] = pingRecordEntry{updated: now}
+	}
+}
+
+// StartPingRecordExpiry periodically evicts stale ping records until the device is closed
+func (d VirtualTun) StartPingRecordExpiry() {
+	if d.PingRecordExpiry <= 0 {
+		return
+	}
+
+	var closed <-chan struct{}
+	if d.Dev != nil {
+		closed = d.Dev.Wait()
+	}
+
+	go func() {
+		ticker := time.NewTicker(d.PingRecordExpiry / 5)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case now := <-ticker.C:
+				d.expirePingRecords(now)
+			}
 		}
 	}()
 }
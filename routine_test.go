@@ -0,0 +1,360 @@
+package wireproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpirePingRecords(t *testing.T) {
+	now := time.Now()
+	vt := VirtualTun{
+		Conf: &DeviceConfig{
+			CheckAlive: []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("3.3.3.3")},
+		},
+		PingRecord: map[string]pingRecordEntry{
+			"1.1.1.1": {lastPong: 100, rtt: 20 * time.Millisecond, updated: now.Add(-10 * time.Minute)},
+			"3.3.3.3": {lastPong: 200, rtt: 30 * time.Millisecond, updated: now.Add(-time.Minute)},
+			"8.8.8.8": {lastPong: 300, rtt: 40 * time.Millisecond, updated: now.Add(-10 * time.Minute)},
+		},
+		PingRecordLock:   new(sync.Mutex),
+		PingRecordExpiry: 5 * time.Minute,
+	}
+
+	vt.expirePingRecords(now)
+
+	if record := vt.PingRecord["1.1.1.1"]; record.lastPong != 0 || record.rtt != 0 {
+		t.Errorf("stale record of a CheckAlive address should be reset, got %+v", record)
+	}
+	if record := vt.PingRecord["3.3.3.3"]; record.lastPong != 200 || record.rtt != 30*time.Millisecond {
+		t.Errorf("fresh record should be kept, got %+v", record)
+	}
+	if _, ok := vt.PingRecord["8.8.8.8"]; ok {
+		t.Error("stale record of an address not in CheckAlive should be removed")
+	}
+}
+
+func TestPingStats(t *testing.T) {
+	now := time.Now()
+	vt := VirtualTun{
+		PingRecord: map[string]pingRecordEntry{
+			"1.1.1.1": {lastPong: 100, rtt: 20 * time.Millisecond, updated: now},
+			"3.3.3.3": {lastPong: 200, rtt: 1500 * time.Microsecond, updated: now},
+			"8.8.8.8": {updated: now},
+		},
+		PingRecordLock: new(sync.Mutex),
+	}
+
+	stats := vt.PingStats()
+	if len(stats) != 2 || stats["1.1.1.1"] != 20*time.Millisecond || stats["3.3.3.3"] != 1500*time.Microsecond {
+		t.Fatalf("unexpected ping stats %v", stats)
+	}
+	if _, ok := stats["8.8.8.8"]; ok {
+		t.Fatal("address without pong should be left out")
+	}
+
+	stats["1.1.1.1"] = 0
+	if vt.PingRecord["1.1.1.1"].rtt != 20*time.Millisecond {
+		t.Fatal("ping stats should be a copy")
+	}
+
+	vt.ResetPingRecord()
+	if len(vt.PingRecord) != 0 || len(vt.PingStats()) != 0 {
+		t.Fatal("ping record should be empty after a reset")
+	}
+}
+
+func TestResetPingRecordReadyz(t *testing.T) {
+	now := time.Now()
+	vt := VirtualTun{
+		Conf: &DeviceConfig{
+			CheckAlive:         []netip.Addr{netip.MustParseAddr("1.1.1.1")},
+			CheckAliveInterval: 5,
+		},
+		PingRecord: map[string]pingRecordEntry{
+			"1.1.1.1": {lastPong: uint64(now.Unix()), rtt: 20 * time.Millisecond, updated: now},
+			"8.8.8.8": {lastPong: uint64(now.Unix()), rtt: 40 * time.Millisecond, updated: now},
+		},
+		PingRecordLock: new(sync.Mutex),
+	}
+	readyz := func() int {
+		recorder := httptest.NewRecorder()
+		vt.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return recorder.Code
+	}
+
+	if code := readyz(); code != http.StatusOK {
+		t.Fatalf("readyz should succeed with recent pongs, got %d", code)
+	}
+
+	vt.ResetPingRecord()
+	if record, ok := vt.PingRecord["1.1.1.1"]; !ok || record.lastPong != 0 {
+		t.Fatalf("CheckAlive address should be kept without pong, got %+v", record)
+	}
+	if _, ok := vt.PingRecord["8.8.8.8"]; ok {
+		t.Fatal("address not in CheckAlive should be removed")
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz should fail until CheckAlive addresses answer again, got %d", code)
+	}
+}
+
+func TestParseListenAddr(t *testing.T) {
+	vt := VirtualTun{
+		Conf: &DeviceConfig{
+			Endpoint: []netip.Addr{netip.MustParseAddr("10.5.0.2"), netip.MustParseAddr("fd00::2")},
+		},
+	}
+
+	tests := []struct {
+		addr    string
+		want    netip.AddrPort
+		wantErr bool
+	}{
+		{addr: ":8080", want: netip.AddrPortFrom(netip.Addr{}, 8080)},
+		{addr: "0.0.0.0:8080", want: netip.MustParseAddrPort("0.0.0.0:8080")},
+		{addr: "10.5.0.2:8080", want: netip.MustParseAddrPort("10.5.0.2:8080")},
+		{addr: "[fd00::2]:53", want: netip.MustParseAddrPort("[fd00::2]:53")},
+		{addr: "10.5.0.3:8080", wantErr: true},
+		{addr: "example.com:8080", wantErr: true},
+		{addr: "10.5.0.2:99999", wantErr: true},
+		{addr: "10.5.0.2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := vt.parseListenAddr(tt.addr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: error expected", tt.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.addr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestSetDNS(t *testing.T) {
+	if err := (VirtualTun{}).SetDNS([]netip.Addr{netip.MustParseAddr("1.1.1.1")}); err == nil {
+		t.Fatal("SetDNS should fail without DNS reconfiguration support")
+	}
+
+	vt := VirtualTun{Conf: &DeviceConfig{}, dns: &tunnelDNS{}}
+	servers := []netip.Addr{netip.MustParseAddr("1.1.1.1"), netip.MustParseAddr("9.9.9.9")}
+	if err := vt.SetDNS(servers); err != nil {
+		t.Fatal(err)
+	}
+	if len(vt.Conf.DNS) != 0 {
+		t.Fatalf("Conf.DNS should keep the configured servers, got %v", vt.Conf.DNS)
+	}
+
+	for i := 0; i < 4; i++ {
+		server, err := vt.dns.nextServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if server != servers[i%2] {
+			t.Fatalf("servers should be used in turn, got %s", server)
+		}
+	}
+
+	if err := vt.SetDNS(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vt.dns.nextServer(); err == nil {
+		t.Fatal("no server expected after clearing the DNS servers")
+	}
+
+	if err := vt.SetDNS([]netip.Addr{{}}); err == nil {
+		t.Fatal("invalid address should be rejected")
+	}
+}
+
+func TestSearchNames(t *testing.T) {
+	domains := []string{"corp.example.com", "example.org"}
+	if got := searchNames("db", domains); !slices.Equal(got, []string{"db.corp.example.com", "db.example.org"}) {
+		t.Fatalf("single label name should be tried in every search domain, got %v", got)
+	}
+	if got := searchNames("db.internal", domains); len(got) != 0 {
+		t.Fatalf("name with a dot should not be searched, got %v", got)
+	}
+	if got := searchNames("fd00::1", domains); len(got) != 0 {
+		t.Fatalf("IPv6 address should not be searched, got %v", got)
+	}
+}
+
+func TestGetPeer(t *testing.T) {
+	peers := []PeerConfig{
+		{PublicKey: "7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c"},
+		{PublicKey: "4879e1e02d9a0d7869d608c8a9c786849ae138b49e35872a58b29c627ce3d345"},
+	}
+
+	for _, vt := range []VirtualTun{
+		{Conf: &DeviceConfig{Peers: peers}},
+		{Conf: &DeviceConfig{Peers: peers}, PeerIndex: buildPeerIndex(peers)},
+	} {
+		peer, err := vt.GetPeer("SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if peer != &vt.Conf.Peers[1] {
+			t.Fatal("GetPeer should return the matching peer of the configuration")
+		}
+
+		if peer, err := vt.GetPeer("SHnh4C2aDXhp1gjI"); err == nil || peer != nil {
+			t.Fatal("a public key prefix should not match")
+		}
+		if _, err := vt.GetPeer("LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0="); err == nil {
+			t.Fatal("unknown public key should not match")
+		}
+	}
+}
+
+func TestProxySectionsShareTunnel(t *testing.T) {
+	_, vtA, vtB := newTestTunnelPair(t)
+
+	echo, err := vtB.ListenTCP("10.0.0.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = echo.Close() }()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	freeTCPAddr := func() string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = listener.Close() }()
+		return listener.Addr().String()
+	}
+	socksAddr, httpAddr := freeTCPAddr(), freeTCPAddr()
+	iniData, err := loadIniConfig("[Proxy]\nType = socks5\nBindAddress = " + socksAddr +
+		"\n\n[Proxy]\nType = http\nBindAddress = " + httpAddr + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routines []RoutineSpawner
+	if err := parseRoutinesConfig(&routines, iniData, "Proxy", parseProxyConfig); err != nil {
+		t.Fatal(err)
+	}
+	for _, routine := range routines {
+		go routine.SpawnRoutine(vtA)
+	}
+
+	dial := func(address string) (net.Conn, error) {
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			conn, err := net.Dial("tcp", address)
+			if err == nil || time.Now().After(deadline) {
+				return conn, err
+			}
+		}
+	}
+	viaSOCKS5 := func(message string) (string, error) {
+		conn, err := dial(socksAddr)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+			return "", err
+		}
+		if _, err := conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 2, 0x1f, 0x90}); err != nil {
+			return "", err
+		}
+		reply := make([]byte, 10)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return "", err
+		}
+		if reply[1] != 0x00 {
+			return "", fmt.Errorf("CONNECT failed with code %d", reply[1])
+		}
+		if _, err := conn.Write([]byte(message)); err != nil {
+			return "", err
+		}
+		buf := make([]byte, len(message))
+		_, err = io.ReadFull(conn, buf)
+		return string(buf), err
+	}
+	viaHTTP := func(message string) (string, error) {
+		conn, err := dial(httpAddr)
+		if err != nil {
+			return "", err
+		}
+		defer func() { _ = conn.Close() }()
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		if _, err := conn.Write([]byte("CONNECT 10.0.0.2:8080 HTTP/1.1\r\nHost: 10.0.0.2:8080\r\n\r\n")); err != nil {
+			return "", err
+		}
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("CONNECT failed with status %s", resp.Status)
+		}
+		if _, err := conn.Write([]byte(message)); err != nil {
+			return "", err
+		}
+		buf := make([]byte, len(message))
+		_, err = io.ReadFull(reader, buf)
+		return string(buf), err
+	}
+
+	const clients = 8
+	errs := make(chan error, 2*clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		for name, proxy := range map[string]func(string) (string, error){"socks5": viaSOCKS5, "http": viaHTTP} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				message := name + " client " + strconv.Itoa(i)
+				got, err := proxy(message)
+				if err == nil && got != message {
+					err = fmt.Errorf("got %q", got)
+				}
+				if err != nil {
+					errs <- fmt.Errorf("%s: %w", message, err)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
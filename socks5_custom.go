@@ -1,28 +1,50 @@
 package wireproxy
 
 import (
+	"bytes"
+	"container/heap"
+	"container/list"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"sort"
+	"net/netip"
+	"os"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"weak"
 )
 
 // ========== КОНСТАНТЫ ==========
 const (
 	udpBufferSize        = 1500
+	udpHeaderOverhead    = 262 + 48 // заголовок SOCKS5 UDP с доменом (до 262), IPv6 (40) и UDP (8) сверх MTU
 	maxUDPConnections    = 1000
 	udpConnectionTimeout = 40 * time.Second
 	udpCleanupInterval   = 30 * time.Second
 	dnsCacheTTL          = 5 * time.Second
 	dnsCacheMaxSize      = 1000
 	udpReadTimeout       = 1000 * time.Millisecond
+	udpPoolShutdownDelay = 5 * time.Second
+	udpReceiveBufferSize = 64 * 1024
+	dnsRefreshWorkers    = 4
+	// Ошибки чтения: после udpReaderMaxErrors ошибок за udpReaderErrorWindow соединение
+	// закрывается, иначе повтор с задержкой udpReaderBackoff, удваиваемой до udpReaderMaxBackoff
+	udpReaderMaxErrors   = 3
+	udpReaderErrorWindow = time.Second
+	udpReaderBackoff     = 100 * time.Millisecond
+	udpReaderMaxBackoff  = 400 * time.Millisecond
+	// Сборка фрагментов (RFC 1928, раздел 7): незавершенная последовательность
+	// отбрасывается через udpFragmentTimeout или при превышении udpFragmentMaxSize
+	udpFragmentTimeout = 500 * time.Millisecond
+	udpFragmentMaxSize = 65535
 )
 
 // ========== DNS КЭШ ==========
@@ -30,94 +52,327 @@ type dnsCache struct {
 	cache   map[string]*cacheEntry
 	mu      sync.RWMutex
 	ttl     time.Duration
-	maxSize int
+	maxSize int        // 0 - без ограничения
+	lru     *list.List // хосты записей cache, недавно добавленные спереди, меняется под mu
+	lookup  func(ctx context.Context, host string) ([]net.IP, error)
+	// inflight - идущие запросы по хостам, под mu. Запрос идет без блокировки,
+	// одновременные Resolve того же хоста ждут его результат
+	inflight map[string]*dnsLookupCall
+	// generation увеличивается Flush, результаты начатых до него запросов не сохраняются
+	generation uint64
+	// static - записи, которые не истекают и не вытесняются, только для чтения
+	static map[string]net.IP
+	// preferIPv6 - выбирать IPv6 адрес, если он есть, вместо IPv4
+	preferIPv6 bool
+
+	// Фоновое обновление, refresh == nil если оно выключено
+	refresh    chan string
+	refreshing map[string]bool // хосты в очереди или в работе, под mu
+	stop       chan struct{}
+	stopOnce   sync.Once
+	workers    sync.WaitGroup
+
+	// Счетчики ответов из кэша и DNS запросов
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// dnsCacheOptions - параметры создания DNS кэша
+type dnsCacheOptions struct {
+	TTL time.Duration
+	// Lookup - функция резолва, nil означает системный резолвер
+	Lookup func(host string) ([]net.IP, error)
+	// LookupContext заменяет Lookup, если задана, и получает ctx из ResolveContext
+	LookupContext func(ctx context.Context, host string) ([]net.IP, error)
+	// StaticEntries возвращаются без DNS запроса, никогда не истекают и не вытесняются
+	StaticEntries map[string]net.IP
+	// EnableBackgroundRefresh заранее перерезолвивает записи, у которых осталось
+	// меньше 10% TTL, чтобы истечение не давало задержку на запросе
+	EnableBackgroundRefresh bool
+	// RefreshWorkers - максимум одновременных фоновых запросов, 0 - dnsRefreshWorkers
+	RefreshWorkers int
+	// PreferIPv6 - выбирать IPv6 адрес, если он есть, например для туннеля только с IPv6
+	PreferIPv6 bool
+	// MaxEntries - максимум записей, при превышении вытесняется давно не использованная.
+	// 0 снимает ограничение
+	MaxEntries int
 }
 
 type cacheEntry struct {
 	ip        net.IP
 	timestamp time.Time
+	element   *list.Element // позиция хоста в dnsCache.lru
+	// used выставляется попаданием под RLock: при вытеснении такая запись не удаляется,
+	// а переносится в начало lru, так попадания не берут полную блокировку
+	used atomic.Bool
+}
+
+// dnsLookupCall - идущий DNS запрос хоста, поля заполняются до закрытия done
+type dnsLookupCall struct {
+	done       chan struct{}
+	ctx        context.Context // ctx вызова, выполняющего запрос
+	generation uint64
+	ip         net.IP
+	err        error
 }
 
+// newDNSCache создает кэш без ограничения числа записей
 func newDNSCache(ttl time.Duration) *dnsCache {
-	return &dnsCache{
-		cache:   make(map[string]*cacheEntry),
-		ttl:     ttl,
-		maxSize: dnsCacheMaxSize,
-	}
+	return newDNSCacheWithOptions(dnsCacheOptions{TTL: ttl})
 }
 
-func (d *dnsCache) Resolve(host string) (net.IP, error) {
-	// Быстрая проверка с read lock
-	d.mu.RLock()
-	if entry, exists := d.cache[host]; exists {
-		if time.Since(entry.timestamp) < d.ttl {
-			d.mu.RUnlock()
-			return entry.ip, nil
+func newDNSCacheWithOptions(opts dnsCacheOptions) *dnsCache {
+	lookup := opts.LookupContext
+	if lookup == nil && opts.Lookup != nil {
+		lookup = func(_ context.Context, host string) ([]net.IP, error) {
+			return opts.Lookup(host)
 		}
 	}
-	d.mu.RUnlock()
+	if lookup == nil {
+		lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		}
+	}
+
+	// Копируем, чтобы изменения у вызывающего не влияли на кэш
+	static := make(map[string]net.IP, len(opts.StaticEntries))
+	for host, ip := range opts.StaticEntries {
+		static[host] = ip
+	}
+
+	maxSize := opts.MaxEntries
+	if maxSize < 0 {
+		maxSize = 0
+	}
+
+	d := &dnsCache{
+		cache:      make(map[string]*cacheEntry),
+		inflight:   make(map[string]*dnsLookupCall),
+		ttl:        opts.TTL,
+		maxSize:    maxSize,
+		lru:        list.New(),
+		lookup:     lookup,
+		static:     static,
+		preferIPv6: opts.PreferIPv6,
+	}
+
+	if opts.EnableBackgroundRefresh {
+		workers := opts.RefreshWorkers
+		if workers <= 0 {
+			workers = dnsRefreshWorkers
+		}
+		queueSize := d.maxSize
+		if queueSize == 0 {
+			queueSize = dnsCacheMaxSize
+		}
+		d.refresh = make(chan string, queueSize)
+		d.refreshing = make(map[string]bool)
+		d.stop = make(chan struct{})
+		d.workers.Add(workers)
+		for i := 0; i < workers; i++ {
+			go d.refreshWorker()
+		}
+	}
+	return d
+}
+
+// needsRefresh сообщает, что у записи осталось меньше 10% TTL
+func (d *dnsCache) needsRefresh(entry *cacheEntry) bool {
+	return d.refresh != nil && time.Since(entry.timestamp) >= d.ttl-d.ttl/10
+}
 
-	// Берем полную блокировку на время резолва
+// scheduleRefresh ставит хост в очередь фонового обновления. Если очередь заполнена,
+// запись просто истечет и будет срезолвлена на следующем запросе
+func (d *dnsCache) scheduleRefresh(host string) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	if d.refreshing[host] {
+		return
+	}
+	select {
+	case d.refresh <- host:
+		d.refreshing[host] = true
+	default:
+	}
+}
 
-	// Повторная проверка - другая горутина могла уже срезолвить
-	if entry, exists := d.cache[host]; exists {
-		if time.Since(entry.timestamp) < d.ttl {
-			return entry.ip, nil
+func (d *dnsCache) refreshWorker() {
+	defer d.workers.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case host := <-d.refresh:
+			d.mu.RLock()
+			generation := d.generation
+			d.mu.RUnlock()
+
+			// Запрос делаем без блокировки, чтобы не задерживать Resolve
+			ips, err := d.lookup(context.Background(), host)
+
+			if err != nil {
+				errorLogger.Printf("Background DNS refresh failed for %s: %v", host, err)
+			}
+
+			d.mu.Lock()
+			delete(d.refreshing, host)
+			// Запись могла быть вытеснена или сброшена Flush, пока шел запрос
+			if entry, exists := d.cache[host]; exists && err == nil && len(ips) > 0 && generation == d.generation {
+				entry.ip, entry.timestamp = pickIP(ips, d.preferIPv6), time.Now()
+			}
+			d.mu.Unlock()
 		}
 	}
+}
 
-	// Делаем DNS запрос под блокировкой
-	ips, err := net.LookupIP(host)
-	if err != nil {
-		return nil, fmt.Errorf("DNS lookup failed for %s: %w", host, err)
-	}
-	if len(ips) == 0 {
-		return nil, fmt.Errorf("no IP found for %s", host)
+// Close останавливает фоновое обновление и ждет завершения запросов
+func (d *dnsCache) Close() {
+	if d.refresh == nil {
+		return
 	}
+	d.stopOnce.Do(func() { close(d.stop) })
+	d.workers.Wait()
+}
 
-	var ip net.IP
+// pickIP выбирает первый адрес предпочитаемого семейства, IPv4 если не preferIPv6,
+// иначе первый из списка
+func pickIP(ips []net.IP, preferIPv6 bool) net.IP {
 	for _, candidate := range ips {
-		if candidate.To4() != nil {
-			ip = candidate
-			break
+		if (candidate.To4() == nil) == preferIPv6 {
+			return candidate
 		}
 	}
-	if ip == nil {
-		ip = ips[0]
+	return ips[0]
+}
+
+func (d *dnsCache) Resolve(host string) (net.IP, error) {
+	return d.ResolveContext(context.Background(), host)
+}
+
+// ResolveContext возвращает адрес host из кэша или резолвит его. Запрос идет без
+// блокировки кэша, ctx ограничивает и запрос, и ожидание чужого запроса того же хоста
+func (d *dnsCache) ResolveContext(ctx context.Context, host string) (net.IP, error) {
+	// Статические записи не требуют блокировки
+	if ip, ok := d.static[host]; ok {
+		d.hits.Add(1)
+		return ip, nil
 	}
 
-	// Более агрессивная очистка, если кэш заполнен
-	if len(d.cache) >= d.maxSize {
-		// Удаляем 10% старейших записей
-		toRemove := d.maxSize / 10
-		if toRemove < 1 {
-			toRemove = 1
+	// Попадание только отмечает запись, порядок lru меняется при вытеснении
+	d.mu.RLock()
+	if entry, exists := d.cache[host]; exists {
+		if time.Since(entry.timestamp) < d.ttl {
+			entry.used.Store(true)
+			ip, refresh := entry.ip, d.needsRefresh(entry)
+			d.mu.RUnlock()
+			d.hits.Add(1)
+			if refresh {
+				d.scheduleRefresh(host)
+			}
+			return ip, nil
 		}
+	}
+	d.mu.RUnlock()
 
-		type keyTime struct {
-			key string
-			t   time.Time
+	for {
+		d.mu.Lock()
+		// Запись могла появиться, пока блокировка была отпущена
+		if entry, exists := d.cache[host]; exists && time.Since(entry.timestamp) < d.ttl {
+			entry.used.Store(true)
+			ip := entry.ip
+			d.mu.Unlock()
+			d.hits.Add(1)
+			return ip, nil
 		}
-		oldest := make([]keyTime, 0, len(d.cache))
-		for key, entry := range d.cache {
-			oldest = append(oldest, keyTime{key: key, t: entry.timestamp})
+		call, exists := d.inflight[host]
+		if !exists {
+			call = &dnsLookupCall{done: make(chan struct{}), ctx: ctx, generation: d.generation}
+			d.inflight[host] = call
+			d.mu.Unlock()
+			d.runLookup(host, call)
+			return call.ip, call.err
 		}
-		sort.Slice(oldest, func(i, j int) bool {
-			return oldest[i].t.Before(oldest[j].t)
-		})
+		d.mu.Unlock()
 
-		for i := 0; i < toRemove && i < len(oldest); i++ {
-			delete(d.cache, oldest[i].key)
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
+		// Запрос прерван ctx другого вызова, повторяем со своим
+		if call.err != nil && call.ctx.Err() != nil && ctx.Err() == nil {
+			continue
+		}
+		if call.err == nil {
+			d.hits.Add(1)
+		}
+		return call.ip, call.err
+	}
+}
+
+// runLookup выполняет запрос call и сохраняет результат, если с его начала не было Flush
+func (d *dnsCache) runLookup(host string, call *dnsLookupCall) {
+	defer close(call.done)
+
+	d.misses.Add(1)
+	ips, err := d.lookup(call.ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = fmt.Errorf("no IP found for %s", host)
+	} else if err != nil {
+		err = fmt.Errorf("DNS lookup failed for %s: %w", host, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.inflight[host] == call {
+		delete(d.inflight, host)
+	}
+	if err != nil {
+		call.err = err
+		return
+	}
+	call.ip = pickIP(ips, d.preferIPv6)
+	if call.generation != d.generation {
+		return
+	}
+
+	// Истекшая запись обновляется на месте
+	if entry, exists := d.cache[host]; exists {
+		entry.ip, entry.timestamp = call.ip, time.Now()
+		d.lru.MoveToFront(entry.element)
+		return
 	}
 
 	d.cache[host] = &cacheEntry{
-		ip:        ip,
+		ip:        call.ip,
 		timestamp: time.Now(),
+		element:   d.lru.PushFront(host),
+	}
+	d.evictLocked()
+}
+
+// evictLocked вытесняет записи сверх maxSize с конца lru. Запись, использованная с
+// прошлого прохода, получает второй шанс и переносится в начало. d.mu должен быть захвачен
+func (d *dnsCache) evictLocked() {
+	for d.maxSize > 0 && len(d.cache) > d.maxSize {
+		host := d.lru.Back().Value.(string)
+		if entry := d.cache[host]; entry.used.Swap(false) {
+			d.lru.MoveToFront(entry.element)
+			continue
+		}
+		d.removeLocked(host)
+	}
+}
+
+// removeLocked удаляет запись host, d.mu должен быть захвачен
+func (d *dnsCache) removeLocked(host string) bool {
+	entry, exists := d.cache[host]
+	if !exists {
+		return false
 	}
-	return ip, nil
+	d.lru.Remove(entry.element)
+	delete(d.cache, host)
+	return true
 }
 
 func (d *dnsCache) Cleanup() {
@@ -126,11 +381,29 @@ func (d *dnsCache) Cleanup() {
 	now := time.Now()
 	for host, entry := range d.cache {
 		if now.Sub(entry.timestamp) > d.ttl*3/2 {
-			delete(d.cache, host)
+			d.removeLocked(host)
 		}
 	}
 }
 
+// Flush удаляет все записи, кроме статических. Идущие запросы завершатся, но их
+// результаты не попадут в кэш
+func (d *dnsCache) Flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cache = make(map[string]*cacheEntry)
+	d.inflight = make(map[string]*dnsLookupCall)
+	d.generation++
+	d.lru.Init()
+}
+
+// FlushEntry удаляет запись host и сообщает, была ли она в кэше
+func (d *dnsCache) FlushEntry(host string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.removeLocked(host)
+}
+
 func (d *dnsCache) Size() int {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
@@ -138,31 +411,60 @@ func (d *dnsCache) Size() int {
 }
 
 // ========== ПУЛЫ БУФЕРОВ ==========
-var udpBufferPool = sync.Pool{
-	New: func() interface{} {
-		buf := make([]byte, udpBufferSize)
+// udpBufferPool - пул буферов одного размера. Размер выбирается по MTU туннеля,
+// иначе пакеты больше буфера молча обрезаются
+type udpBufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newUDPBufferPool создает пул буферов размера size, 0 - udpBufferSize
+func newUDPBufferPool(size int) *udpBufferPool {
+	if size <= 0 {
+		size = udpBufferSize
+	}
+	p := &udpBufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, size)
 		return &buf
-	},
+	}
+	return p
+}
+
+// udpBufferSizeForMTU - размер буфера для пакета размером в MTU, не меньше udpBufferSize
+func udpBufferSizeForMTU(mtu int) int {
+	return max(mtu+udpHeaderOverhead, udpBufferSize)
 }
 
-func getUDPBuffer() []byte {
-	return *udpBufferPool.Get().(*[]byte)
+func (p *udpBufferPool) get() []byte {
+	return *p.pool.Get().(*[]byte)
 }
 
-func putUDPBuffer(buf []byte) {
-	if cap(buf) == udpBufferSize {
+func (p *udpBufferPool) put(buf []byte) {
+	if cap(buf) == p.size {
 		buf = buf[:cap(buf)]
-		udpBufferPool.Put(&buf)
+		p.pool.Put(&buf)
 	}
 }
 
 // ========== UDP СОЕДИНЕНИЕ ==========
+// udpClockBase - точка отсчета для lastUsed. Время хранится как смещение от нее,
+// поэтому LastUsed сохраняет монотонные показания и переводы системных часов
+// (например, коррекция NTP) не влияют на возраст соединений
+var udpClockBase = time.Now()
+
+func udpClockNow() int64 {
+	return int64(time.Since(udpClockBase))
+}
+
 type udpConnection struct {
 	conn       net.Conn
 	lastUsed   atomic.Int64
+	created    int64 // момент создания по udpClockNow
 	client     *net.UDPAddr
 	targetAddr *net.UDPAddr
 	resolvedIP net.IP
+	target     string // адрес назначения в том виде, как его прислал клиент
 	closeChan  chan struct{}
 	closed     atomic.Bool
 	mu         sync.Mutex
@@ -171,6 +473,10 @@ type udpConnection struct {
 	cancel     context.CancelFunc
 	readDone   chan struct{}
 	closeOnce  sync.Once
+	// Поля пула, меняются только под его блокировкой
+	key          string // ключ в пуле
+	heapIndex    int    // позиция в udpConnHeap пула
+	heapLastUsed int64  // lastUsed на момент последнего упорядочивания кучи
 }
 
 func newUDPConnection(conn net.Conn, client *net.UDPAddr, targetAddr *net.UDPAddr, resolvedIP net.IP) *udpConnection {
@@ -185,7 +491,8 @@ func newUDPConnection(conn net.Conn, client *net.UDPAddr, targetAddr *net.UDPAdd
 		cancel:     cancel,
 		readDone:   make(chan struct{}),
 	}
-	uc.lastUsed.Store(time.Now().UnixNano())
+	uc.created = udpClockNow()
+	uc.lastUsed.Store(uc.created)
 	return uc
 }
 
@@ -213,11 +520,11 @@ func (c *udpConnection) IsClosed() bool {
 }
 
 func (c *udpConnection) LastUsed() time.Time {
-	return time.Unix(0, c.lastUsed.Load())
+	return udpClockBase.Add(time.Duration(c.lastUsed.Load()))
 }
 
 func (c *udpConnection) UpdateLastUsed() {
-	c.lastUsed.Store(time.Now().UnixNano())
+	c.lastUsed.Store(udpClockNow())
 }
 
 func (c *udpConnection) Context() context.Context {
@@ -233,61 +540,199 @@ func (c *udpConnection) MarkReadDone() {
 }
 
 // ========== ПУЛ СОЕДИНЕНИЙ ==========
+// udpMetrics - счетчики для диагностики UDP relay
+type udpMetrics struct {
+	// ConnectionsCreated - соединения, добавленные в пул
+	ConnectionsCreated atomic.Uint64
+	// ConnectionsEvicted - соединения, вытесненные по возрасту или размеру пула
+	ConnectionsEvicted atomic.Uint64
+}
+
+// udpPoolStats - снимок счетчиков пула, см. Stats
+type udpPoolStats struct {
+	CurrentConnections int
+	TotalCreated       uint64
+	TotalEvicted       uint64
+	DNSHits            uint64
+	DNSMisses          uint64
+}
+
+// udpConnInfo - описание живого соединения для отладки, см. Snapshot
+type udpConnInfo struct {
+	ClientAddr string
+	TargetAddr string
+	ResolvedIP string
+	LastUsed   time.Time
+	Age        time.Duration
+}
+
+// udpConnHeap - куча соединений пула, сверху соединение с наименьшим heapLastUsed.
+// lastUsed обновляется на каждом пакете без блокировки пула, поэтому куча упорядочена
+// по последнему известному значению и уточняется при вытеснении, см. cleanupOldestLocked
+type udpConnHeap []*udpConnection
+
+func (h udpConnHeap) Len() int           { return len(h) }
+func (h udpConnHeap) Less(i, j int) bool { return h[i].heapLastUsed < h[j].heapLastUsed }
+
+func (h udpConnHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+
+func (h *udpConnHeap) Push(x any) {
+	conn := x.(*udpConnection)
+	conn.heapIndex = len(*h)
+	*h = append(*h, conn)
+}
+
+func (h *udpConnHeap) Pop() any {
+	old := *h
+	conn := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return conn
+}
+
 type udpConnectionPool struct {
 	connections  map[string]*udpConnection
+	byAge        udpConnHeap // те же соединения, что и в connections
 	mu           sync.RWMutex
 	dnsCache     *dnsCache
-	maxSize      int
+	maxSize      atomic.Int32
 	currentSize  atomic.Int32
 	creationLock sync.Map
 	ctx          context.Context
 	cancel       context.CancelFunc
-	wg           sync.WaitGroup
+	cleanupDone  chan struct{}
+	readers      sync.WaitGroup
+	metrics      udpMetrics
+	keyFunc      UDPKeyFunc
+	bufPool      *udpBufferPool
+	fragments    *udpFragmentReassembler
+}
+
+// udpConnectionPoolOptions - параметры создания пула
+type udpConnectionPoolOptions struct {
+	MaxSize int
+	// Lookup - функция резолва для DNS кэша, nil означает системный резолвер
+	Lookup func(host string) ([]net.IP, error)
+	// KeyFunc - ключ соединения в пуле, nil означает UDPKeyByClient
+	KeyFunc UDPKeyFunc
+	// CleanupInterval - период очистки, 0 - udpCleanupInterval
+	CleanupInterval time.Duration
+	// IdleTimeout - время простоя, после которого соединение закрывается, 0 - udpConnectionTimeout
+	IdleTimeout time.Duration
+	// PreferIPv6 передается DNS кэшу
+	PreferIPv6 bool
+	// BufferSize - размер буферов чтения пакетов, 0 - udpBufferSize
+	BufferSize int
+	// DNSCacheMaxEntries - максимум записей DNS кэша, 0 - без ограничения
+	DNSCacheMaxEntries int
+}
+
+// UDPKeyFunc выводит ключ соединения пула из адреса клиента и адреса назначения
+type UDPKeyFunc func(clientAddr *net.UDPAddr, targetHost string, targetPort uint16) string
+
+// UDPKeyByClient - одно соединение на клиента, смена адреса назначения его пересоздает
+func UDPKeyByClient(clientAddr *net.UDPAddr, targetHost string, targetPort uint16) string {
+	return clientAddr.String()
+}
+
+// UDPKeyByClientAndTarget - отдельное соединение на каждую пару клиента и адреса назначения
+func UDPKeyByClientAndTarget(clientAddr *net.UDPAddr, targetHost string, targetPort uint16) string {
+	return clientAddr.String() + "|" + net.JoinHostPort(targetHost, strconv.Itoa(int(targetPort)))
 }
 
-func newUDPConnectionPool(maxSize int) *udpConnectionPool {
+func newUDPConnectionPool(opts udpConnectionPoolOptions) *udpConnectionPool {
 	ctx, cancel := context.WithCancel(context.Background())
 	pool := &udpConnectionPool{
 		connections: make(map[string]*udpConnection),
-		dnsCache:    newDNSCache(dnsCacheTTL),
-		maxSize:     maxSize,
-		ctx:         ctx,
-		cancel:      cancel,
-	}
+		dnsCache: newDNSCacheWithOptions(dnsCacheOptions{
+			TTL:        dnsCacheTTL,
+			Lookup:     opts.Lookup,
+			PreferIPv6: opts.PreferIPv6,
+			MaxEntries: opts.DNSCacheMaxEntries,
+		}),
+		ctx:     ctx,
+		cancel:  cancel,
+		keyFunc: opts.KeyFunc,
+		bufPool: newUDPBufferPool(opts.BufferSize),
+	}
+	pool.fragments = newUDPFragmentReassembler(udpFragmentTimeout)
+	if pool.keyFunc == nil {
+		pool.keyFunc = UDPKeyByClient
+	}
+	pool.maxSize.Store(int32(opts.MaxSize))
 	pool.currentSize.Store(0)
 
 	// Запускаем горутину очистки внутри пула
-	pool.wg.Add(1)
-	go pool.cleanupRoutine()
+	pool.cleanupDone = make(chan struct{})
+	cleanupInterval, idleTimeout := opts.CleanupInterval, opts.IdleTimeout
+	if cleanupInterval <= 0 {
+		cleanupInterval = udpCleanupInterval
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = udpConnectionTimeout
+	}
+	go runPoolCleanup(weak.Make(pool), ctx, pool.cleanupDone, cleanupInterval, idleTimeout)
 
+	runtime.SetFinalizer(pool, (*udpConnectionPool).finalize)
 	return pool
 }
 
-func (p *udpConnectionPool) cleanupRoutine() {
-	defer p.wg.Done()
+// finalize предупреждает о пуле, брошенном без Shutdown, и останавливает его горутины.
+// Reader горутины держат пул, поэтому так находятся пулы без активных соединений
+// или с соединениями без reader
+func (p *udpConnectionPool) finalize() {
+	if p.ctx.Err() != nil {
+		return
+	}
+	errorLogger.Printf("Warning: UDP connection pool with %d connections was garbage collected without Shutdown", p.currentSize.Load())
+	p.cancel()
+	p.closeAll()
+}
+
+// runPoolCleanup периодически чистит пул. Горутина держит только слабую ссылку,
+// чтобы брошенный без Shutdown пул мог быть собран и его финализатор сработал
+func runPoolCleanup(pool weak.Pointer[udpConnectionPool], ctx context.Context, done chan struct{}, interval, idleTimeout time.Duration) {
+	defer close(done)
 
-	ticker := time.NewTicker(udpCleanupInterval)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-p.ctx.Done():
-			// Закрываем все соединения при завершении
-			p.mu.Lock()
-			for _, conn := range p.connections {
-				conn.Close()
+		case <-ctx.Done():
+			if p := pool.Value(); p != nil {
+				p.closeAll()
 			}
-			p.connections = make(map[string]*udpConnection)
-			p.currentSize.Store(0)
-			p.mu.Unlock()
 			return
 		case <-ticker.C:
-			p.Cleanup(udpConnectionTimeout)
+			p := pool.Value()
+			if p == nil {
+				return
+			}
+			p.Cleanup(idleTimeout)
 			p.dnsCache.Cleanup()
+			p.fragments.Cleanup()
 		}
 	}
 }
 
+// closeAll закрывает все соединения при завершении
+func (p *udpConnectionPool) closeAll() {
+	p.mu.Lock()
+	for _, conn := range p.connections {
+		conn.Close()
+	}
+	p.connections = make(map[string]*udpConnection)
+	p.byAge = nil
+	p.currentSize.Store(0)
+	p.mu.Unlock()
+	p.dnsCache.Close()
+}
+
 func (p *udpConnectionPool) Get(key string) (*udpConnection, bool) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -303,26 +748,99 @@ func (p *udpConnectionPool) Set(key string, conn *udpConnection) bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	if p.currentSize.Load() >= int32(p.maxSize) {
+	// Соединение клиента на прежний адрес назначения заменяется новым
+	if old, exists := p.connections[key]; exists {
+		old.Close()
+		p.removeLocked(old)
+		conn.UpdateLastUsed()
+		p.storeLocked(key, conn)
+		p.metrics.ConnectionsCreated.Add(1)
+		return true
+	}
+
+	maxSize := p.maxSize.Load()
+	if p.currentSize.Load() >= maxSize {
 		// Принудительно удаляем самые старые соединения
-		p.cleanupOldestLocked(p.maxSize / 4)
-		if p.currentSize.Load() >= int32(p.maxSize) {
+		p.cleanupOldestLocked(int(maxSize / 4))
+		if p.currentSize.Load() >= maxSize {
 			return false
 		}
 	}
 
 	conn.UpdateLastUsed()
-	p.connections[key] = conn
+	p.storeLocked(key, conn)
 	p.currentSize.Add(1)
+	p.metrics.ConnectionsCreated.Add(1)
 	return true
 }
 
+// ErrInvalidPoolSize возвращается Resize для размера меньше 1
+var ErrInvalidPoolSize = errors.New("UDP connection pool size must be at least 1")
+
+// Resize меняет максимальный размер пула. Если соединений больше нового размера,
+// самые старые сразу вытесняются
+func (p *udpConnectionPool) Resize(newMax int) error {
+	if newMax < 1 {
+		return ErrInvalidPoolSize
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.maxSize.Store(int32(newMax))
+	if excess := int(p.currentSize.Load()) - newMax; excess > 0 {
+		p.cleanupOldestLocked(excess)
+	}
+	return nil
+}
+
+// storeLocked добавляет соединение в пул под ключом key
+func (p *udpConnectionPool) storeLocked(key string, conn *udpConnection) {
+	conn.key = key
+	conn.heapLastUsed = conn.lastUsed.Load()
+	p.connections[key] = conn
+	heap.Push(&p.byAge, conn)
+}
+
+// removeLocked удаляет соединение из пула, не закрывая его, и сбрасывает DNS запись
+// его адреса назначения, чтобы новое соединение резолвило его заново
+func (p *udpConnectionPool) removeLocked(conn *udpConnection) {
+	delete(p.connections, conn.key)
+	heap.Remove(&p.byAge, conn.heapIndex)
+	if host, _, err := net.SplitHostPort(conn.target); err == nil && net.ParseIP(host) == nil {
+		p.dnsCache.FlushEntry(host)
+	}
+}
+
+// getForTarget возвращает соединение клиента, только если оно ведет на тот же адрес назначения
+func (p *udpConnectionPool) getForTarget(key string, target string) (*udpConnection, bool) {
+	conn, exists := p.Get(key)
+	if !exists || conn.target != target {
+		return nil, false
+	}
+	return conn, true
+}
+
+// deleteIfCurrent удаляет соединение, только если под ключом все еще лежит именно оно,
+// а не созданное ему на замену
+func (p *udpConnectionPool) deleteIfCurrent(key string, conn *udpConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.connections[key] == conn {
+		conn.Close()
+		p.removeLocked(conn)
+		p.currentSize.Add(-1)
+		p.creationLock.Delete(key)
+	}
+}
+
+// Delete закрывает соединение, DNS запись его адреса назначения сбрасывается removeLocked
 func (p *udpConnectionPool) Delete(key string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if conn, exists := p.connections[key]; exists {
 		conn.Close()
-		delete(p.connections, key)
+		p.removeLocked(conn)
 		p.currentSize.Add(-1)
 		// Удаляем creationLock только если соединение существовало
 		p.creationLock.Delete(key)
@@ -348,8 +866,9 @@ func (p *udpConnectionPool) cleanupOldLocked(maxAge time.Duration) {
 	for _, key := range toDelete {
 		if conn, exists := p.connections[key]; exists {
 			conn.Close()
-			delete(p.connections, key)
+			p.removeLocked(conn)
 			p.currentSize.Add(-1)
+			p.metrics.ConnectionsEvicted.Add(1)
 		}
 		p.creationLock.Delete(key)
 	}
@@ -360,43 +879,31 @@ func (p *udpConnectionPool) cleanupOldLocked(maxAge time.Duration) {
 //	}
 }
 
+// cleanupOldestLocked закрывает count давно не использованных соединений за O(count log n).
+// Соединение, использованное после упорядочивания кучи, переупорядочивается вместо вытеснения
 func (p *udpConnectionPool) cleanupOldestLocked(count int) {
 	if p.currentSize.Load() <= int32(count) {
 		return
 	}
 
-	type keyTime struct {
-		key string
-		t   time.Time
-	}
-
-	oldest := make([]keyTime, 0, count)
-	for key, conn := range p.connections {
-		if conn.IsClosed() {
-			continue
-		}
-		if len(oldest) < count {
-			oldest = append(oldest, keyTime{key: key, t: conn.LastUsed()})
+	for evicted := 0; evicted < count && p.byAge.Len() > 0; {
+		oldest := p.byAge[0]
+		if lastUsed := oldest.lastUsed.Load(); lastUsed != oldest.heapLastUsed && !oldest.IsClosed() {
+			oldest.heapLastUsed = lastUsed
+			heap.Fix(&p.byAge, 0)
 			continue
 		}
-		maxIdx := 0
-		for i := 1; i < len(oldest); i++ {
-			if oldest[i].t.Before(oldest[maxIdx].t) {
-				maxIdx = i
-			}
-		}
-		if conn.LastUsed().Before(oldest[maxIdx].t) {
-			oldest[maxIdx] = keyTime{key: key, t: conn.LastUsed()}
-		}
-	}
 
-	for _, kt := range oldest {
-		if conn, exists := p.connections[kt.key]; exists {
-			conn.Close()
-			delete(p.connections, kt.key)
-			p.currentSize.Add(-1)
+		// Закрытое соединение убирается из пула, но не считается вытесненным
+		closed := oldest.IsClosed()
+		oldest.Close()
+		p.removeLocked(oldest)
+		p.currentSize.Add(-1)
+		p.creationLock.Delete(oldest.key)
+		if !closed {
+			p.metrics.ConnectionsEvicted.Add(1)
+			evicted++
 		}
-		p.creationLock.Delete(kt.key)
 	}
 }
 
@@ -417,20 +924,123 @@ func (p *udpConnectionPool) resolveTarget(host string, port uint16) (string, net
 	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), ip, nil
 }
 
-func (p *udpConnectionPool) Shutdown() {
+// spawnReader запускает reader горутину, если пул еще не остановлен
+func (p *udpConnectionPool) spawnReader(conn *udpConnection, serverConn *net.UDPConn, connKey string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctx.Err() != nil {
+		return false
+	}
+
+	p.readers.Add(1)
+	go func() {
+		defer p.readers.Done()
+		startUDPReader(conn, serverConn, p, connKey)
+	}()
+	return true
+}
+
+// Shutdown останавливает очистку и все reader горутины. Если они не завершились
+// за deadline, оставшиеся соединения закрываются принудительно
+func (p *udpConnectionPool) Shutdown(deadline time.Duration) error {
+	p.mu.Lock()
 	p.cancel()
-	p.wg.Wait()
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		<-p.cleanupDone
+		p.readers.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+	}
+
+	p.mu.Lock()
+	for key, conn := range p.connections {
+		conn.Close()
+		p.removeLocked(conn)
+		p.currentSize.Add(-1)
+		p.creationLock.Delete(key)
+	}
+	p.mu.Unlock()
+	return context.DeadlineExceeded
 }
 
 func (p *udpConnectionPool) GetStats() map[string]interface{} {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	return map[string]interface{}{
-		"udp_connections": p.currentSize.Load(),
-		"dns_cache_size":  p.dnsCache.Size(),
+		"udp_connections":            p.currentSize.Load(),
+		"dns_cache_size":             p.dnsCache.Size(),
+		"fragmented_packets_dropped": p.fragments.dropped.Load(),
+		"connections_created":        p.metrics.ConnectionsCreated.Load(),
+		"connections_evicted":        p.metrics.ConnectionsEvicted.Load(),
+		"dns_hits":                   p.dnsCache.hits.Load(),
+		"dns_misses":                 p.dnsCache.misses.Load(),
 	}
 }
 
+// Stats возвращает текущее число соединений и счетчики пула и DNS кэша
+func (p *udpConnectionPool) Stats() udpPoolStats {
+	return udpPoolStats{
+		CurrentConnections: int(p.currentSize.Load()),
+		TotalCreated:       p.metrics.ConnectionsCreated.Load(),
+		TotalEvicted:       p.metrics.ConnectionsEvicted.Load(),
+		DNSHits:            p.dnsCache.hits.Load(),
+		DNSMisses:          p.dnsCache.misses.Load(),
+	}
+}
+
+// Snapshot возвращает описание всех живых соединений пула.
+// Под блокировкой копируются только указатели, чтобы не задерживать входящие пакеты
+func (p *udpConnectionPool) Snapshot() []udpConnInfo {
+	p.mu.RLock()
+	conns := make([]*udpConnection, 0, len(p.connections))
+	for _, conn := range p.connections {
+		conns = append(conns, conn)
+	}
+	p.mu.RUnlock()
+
+	now := udpClockNow()
+	infos := make([]udpConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		info := udpConnInfo{
+			LastUsed: conn.LastUsed(),
+			Age:      time.Duration(now - conn.created),
+		}
+		if conn.client != nil {
+			info.ClientAddr = conn.client.String()
+		}
+		if conn.target != "" {
+			info.TargetAddr = conn.target
+		} else if conn.targetAddr != nil {
+			info.TargetAddr = conn.targetAddr.String()
+		}
+		if conn.resolvedIP != nil {
+			info.ResolvedIP = conn.resolvedIP.String()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// ResetStats обнуляет счетчики пула и DNS кэша, число соединений не меняется
+func (p *udpConnectionPool) ResetStats() {
+	p.fragments.dropped.Store(0)
+	p.metrics.ConnectionsCreated.Store(0)
+	p.metrics.ConnectionsEvicted.Store(0)
+	p.dnsCache.hits.Store(0)
+	p.dnsCache.misses.Store(0)
+}
+
 // ========== ПАРСИНГ SOCKS5 UDP ЗАГОЛОВКА ==========
 func parseSocks5UDPHeader(data []byte) (host string, port uint16, headerLen int, ok bool) {
 	if len(data) < 4 {
@@ -442,10 +1052,7 @@ func parseSocks5UDPHeader(data []byte) (host string, port uint16, headerLen int,
 		return "", 0, 0, false
 	}
 
-	// FRAG поле должно быть 0x00
-	if data[2] != 0x00 {
-		return "", 0, 0, false
-	}
+	// FRAG поле (data[2]) обрабатывает вызывающий
 
 	atyp := data[3]
 
@@ -461,7 +1068,7 @@ func parseSocks5UDPHeader(data []byte) (host string, port uint16, headerLen int,
 		ok = true
 
 	case 0x03: // Domain name
-		if len(data) < 4 {
+		if len(data) < 5 {
 			return "", 0, 0, false
 		}
 		domainLen := int(data[4])
@@ -491,31 +1098,36 @@ func parseSocks5UDPHeader(data []byte) (host string, port uint16, headerLen int,
 }
 
 // ========== ОТПРАВКА UDP ОТВЕТА ==========
-func sendUDPResponse(serverConn *net.UDPConn, clientAddr *net.UDPAddr, targetIP net.IP, targetPort int, data []byte) {
-	var headerLen int
-	var atyp byte
+// socks5AddrBytes возвращает ATYP и адрес для заголовка SOCKS5.
+// Zone ID (например, fe80::1%eth0) нельзя закодировать в 16 байтах адреса, поэтому он отбрасывается
+func socks5AddrBytes(addr netip.Addr) (byte, []byte) {
+	addr = addr.Unmap().WithZone("")
+	if addr.Is4() {
+		ip := addr.As4()
+		return 0x01, ip[:]
+	}
+	ip := addr.As16()
+	return 0x04, ip[:]
+}
 
-	if targetIP.To4() != nil {
-		headerLen = 10
-		atyp = 0x01
-	} else {
-		headerLen = 22
-		atyp = 0x04
-	}
+func sendUDPResponse(serverConn *net.UDPConn, bufPool *udpBufferPool, clientAddr *net.UDPAddr, targetIP net.IP, targetPort int, data []byte) {
+	target, _ := netip.AddrFromSlice(targetIP)
+	atyp, addrBytes := socks5AddrBytes(target)
+	headerLen := 4 + len(addrBytes) + 2
 
 	totalLen := headerLen + len(data)
 
-	poolBuf := getUDPBuffer()
+	poolBuf := bufPool.get()
 	var buf []byte
 	
 	if cap(poolBuf) >= totalLen {
 		// Используем буфер из пула
 		buf = poolBuf[:totalLen]
-		defer putUDPBuffer(poolBuf)
+		defer bufPool.put(poolBuf)
 	} else {
 		// Буфер из пула слишком мал, создаем новый и возвращаем пул-буфер
 		buf = make([]byte, totalLen)
-		putUDPBuffer(poolBuf)
+		bufPool.put(poolBuf)
 	}
 
 	// RSV, RSV, FRAG
@@ -524,15 +1136,9 @@ func sendUDPResponse(serverConn *net.UDPConn, clientAddr *net.UDPAddr, targetIP
 	buf[2] = 0x00
 	buf[3] = atyp
 
-	if atyp == 0x01 {
-		copy(buf[4:8], targetIP.To4())
-		binary.BigEndian.PutUint16(buf[8:10], uint16(targetPort))
-		copy(buf[10:], data)
-	} else {
-		copy(buf[4:20], targetIP)
-		binary.BigEndian.PutUint16(buf[20:22], uint16(targetPort))
-		copy(buf[22:], data)
-	}
+	copy(buf[4:], addrBytes)
+	binary.BigEndian.PutUint16(buf[headerLen-2:headerLen], uint16(targetPort))
+	copy(buf[headerLen:], data)
 
 	_, _ = serverConn.WriteToUDP(buf, clientAddr)
 }
@@ -545,11 +1151,15 @@ func startUDPReader(conn *udpConnection, serverConn *net.UDPConn, pool *udpConne
 		}
 		conn.MarkReadDone()
 		// Вызываем удаление только один раз
-		pool.Delete(connKey)
+		pool.deleteIfCurrent(connKey, conn)
 	}()
 
-	buf := getUDPBuffer()
-	defer putUDPBuffer(buf)
+	buf := pool.bufPool.get()
+	defer pool.bufPool.put(buf)
+
+	// Время недавних ошибок и задержка перед повтором, сбрасывается успешным чтением
+	var recentErrors []time.Time
+	backoff := udpReaderBackoff
 
 	for {
 		select {
@@ -557,6 +1167,8 @@ func startUDPReader(conn *udpConnection, serverConn *net.UDPConn, pool *udpConne
 			return
 		case <-conn.ctx.Done():
 			return
+		case <-pool.ctx.Done():
+			return
 		default:
 		}
 
@@ -572,12 +1184,38 @@ func startUDPReader(conn *udpConnection, serverConn *net.UDPConn, pool *udpConne
 				}
 				continue
 			}
+			if errors.Is(err, net.ErrClosed) || conn.IsClosed() {
+				return
+			}
+
+			// Временная ошибка (например ICMP port unreachable) не должна сразу убивать соединение
+			now := time.Now()
+			recentErrors = slices.DeleteFunc(recentErrors, func(t time.Time) bool {
+				return now.Sub(t) > udpReaderErrorWindow
+			})
+			recentErrors = append(recentErrors, now)
+			if len(recentErrors) >= udpReaderMaxErrors {
+				return
+			}
+
+			timer := time.NewTimer(backoff)
+			backoff = min(backoff*2, udpReaderMaxBackoff)
+			select {
+			case <-timer.C:
+				continue
+			case <-conn.closeChan:
+			case <-conn.ctx.Done():
+			case <-pool.ctx.Done():
+			}
+			timer.Stop()
 			return
 		}
 
 		if conn.IsClosed() {
 			return
 		}
+		recentErrors = recentErrors[:0]
+		backoff = udpReaderBackoff
 
 		// Данные получены - ОБНОВЛЯЕМ время активности
 		conn.UpdateLastUsed()
@@ -585,7 +1223,133 @@ func startUDPReader(conn *udpConnection, serverConn *net.UDPConn, pool *udpConne
 		// Копируем данные для отправки, т.к. буфер будет возвращен в пул
 		data := make([]byte, n)
 		copy(data, buf[:n])
-		sendUDPResponse(serverConn, conn.client, conn.resolvedIP, conn.targetAddr.Port, data)
+		sendUDPResponse(serverConn, pool.bufPool, conn.client, conn.resolvedIP, conn.targetAddr.Port, data)
+	}
+}
+
+// ========== СБОРКА ФРАГМЕНТОВ ==========
+// udpFragmentReassembler собирает датаграммы, разбитые клиентом по полю FRAG:
+// номера фрагментов 1-127, старший бит отмечает последний фрагмент. Очереди
+// ведутся отдельно для каждой пары клиента и адреса назначения
+type udpFragmentReassembler struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	queues  map[udpFragmentKey]*udpFragmentQueue
+	// pending - число очередей, позволяет не захватывать mu для нефрагментированных пакетов
+	pending atomic.Int64
+	// dropped - фрагменты, отброшенные без сборки датаграммы
+	dropped atomic.Uint64
+}
+
+// udpFragmentKey - клиент и адрес назначения из заголовка фрагмента
+type udpFragmentKey struct {
+	client string
+	target string
+}
+
+// udpFragmentQueue - фрагменты одной датаграммы по номерам
+type udpFragmentQueue struct {
+	fragments map[byte][]byte
+	size      int
+	started   time.Time
+	// highest - наибольший полученный номер фрагмента
+	highest byte
+}
+
+func newUDPFragmentReassembler(timeout time.Duration) *udpFragmentReassembler {
+	return &udpFragmentReassembler{
+		timeout: timeout,
+		queues:  make(map[udpFragmentKey]*udpFragmentQueue),
+	}
+}
+
+// Feed добавляет фрагмент клиента client для target и возвращает собранную датаграмму,
+// когда пришел последний фрагмент и все предыдущие на месте
+func (r *udpFragmentReassembler) Feed(client, target string, frag byte, data []byte) ([]byte, bool) {
+	position, last := frag&0x7f, frag&0x80 != 0
+	if position == 0 {
+		r.dropped.Add(1)
+		return nil, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := udpFragmentKey{client: client, target: target}
+	queue := r.queues[key]
+	// Просроченная очередь, повтор номера или номер меньше уже полученного начинают
+	// новую последовательность (RFC 1928, раздел 7)
+	if queue != nil {
+		if position <= queue.highest || time.Since(queue.started) > r.timeout {
+			r.drop(key, queue)
+			queue = nil
+		}
+	}
+	if queue == nil {
+		queue = &udpFragmentQueue{fragments: make(map[byte][]byte), started: time.Now()}
+		r.queues[key] = queue
+		r.pending.Add(1)
+	}
+
+	if queue.size+len(data) > udpFragmentMaxSize {
+		r.dropped.Add(1)
+		r.drop(key, queue)
+		return nil, false
+	}
+	queue.fragments[position] = bytes.Clone(data)
+	queue.size += len(data)
+	queue.highest = position
+	if !last {
+		return nil, false
+	}
+
+	// Все номера от 1 до последнего должны быть получены, больших номеров быть не должно
+	complete := len(queue.fragments) == int(position)
+	for i := byte(1); complete && i <= position; i++ {
+		_, complete = queue.fragments[i]
+	}
+	if !complete {
+		r.drop(key, queue)
+		return nil, false
+	}
+	delete(r.queues, key)
+	r.pending.Add(-1)
+	payload := make([]byte, 0, queue.size)
+	for i := byte(1); i <= position; i++ {
+		payload = append(payload, queue.fragments[i]...)
+	}
+	return payload, true
+}
+
+// Reset отбрасывает незавершенную очередь клиента client для target: по RFC 1928,
+// раздел 7, датаграмма с FRAG 0 сбрасывает очередь сборки
+func (r *udpFragmentReassembler) Reset(client, target string) {
+	if r.pending.Load() == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := udpFragmentKey{client: client, target: target}
+	if queue, ok := r.queues[key]; ok {
+		r.drop(key, queue)
+	}
+}
+
+// drop отбрасывает незавершенную очередь, r.mu должен быть захвачен
+func (r *udpFragmentReassembler) drop(key udpFragmentKey, queue *udpFragmentQueue) {
+	r.dropped.Add(uint64(len(queue.fragments)))
+	delete(r.queues, key)
+	r.pending.Add(-1)
+}
+
+// Cleanup отбрасывает просроченные очереди клиентов, которые больше не присылают фрагменты
+func (r *udpFragmentReassembler) Cleanup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, queue := range r.queues {
+		if time.Since(queue.started) > r.timeout {
+			r.drop(key, queue)
+		}
 	}
 }
 
@@ -603,19 +1367,30 @@ func handleUDPPacket(serverConn *net.UDPConn, clientAddr *net.UDPAddr, data []by
 		return
 	}
 
-	// Сразу создаем копию payload до блокировок
-	payloadLen := len(data) - headerLen
-	if payloadLen <= 0 {
+	// Сразу создаем копию payload до блокировок. Фрагмент копируется в очередь сборки
+	// клиента для адреса назначения, датаграмма без фрагментации сбрасывает эту очередь
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	var payload []byte
+	if frag := data[2]; frag != 0x00 {
+		assembled, complete := pool.fragments.Feed(clientAddr.String(), target, frag, data[headerLen:])
+		if !complete {
+			return
+		}
+		payload = assembled
+	} else {
+		pool.fragments.Reset(clientAddr.String(), target)
+		payload = make([]byte, len(data)-headerLen)
+		copy(payload, data[headerLen:])
+	}
+	if len(payload) == 0 {
 		errorLogger.Printf("Empty payload from %s", clientAddr.String())
 		return
 	}
-	payload := make([]byte, payloadLen)
-	copy(payload, data[headerLen:])
 
-	connKey := clientAddr.String()
+	connKey := pool.keyFunc(clientAddr, host, port)
 
 	// Проверяем существующее соединение
-	if udpConn, exists := pool.Get(connKey); exists {
+	if udpConn, exists := pool.getForTarget(connKey, target); exists {
 		udpConn.writeMu.Lock()
 		defer udpConn.writeMu.Unlock()
 		if !udpConn.IsClosed() {
@@ -631,7 +1406,7 @@ func handleUDPPacket(serverConn *net.UDPConn, clientAddr *net.UDPAddr, data []by
 	}
 
 	// Проверяем еще раз после получения блокировки
-	if udpConn, exists := pool.Get(connKey); exists {
+	if udpConn, exists := pool.getForTarget(connKey, target); exists {
 		pool.creationLock.Delete(connKey)
 		udpConn.writeMu.Lock()
 		defer udpConn.writeMu.Unlock()
@@ -650,8 +1425,8 @@ func handleUDPPacket(serverConn *net.UDPConn, clientAddr *net.UDPAddr, data []by
 		}()
 
 		// Проверяем лимит соединений с использованием atomic
-		if pool.currentSize.Load() >= int32(pool.maxSize) {
-			errorLogger.Printf("UDP connection limit reached (%d), dropping packet from %s", pool.maxSize, connKey)
+		if pool.currentSize.Load() >= pool.maxSize.Load() {
+			errorLogger.Printf("UDP connection limit reached (%d), dropping packet from %s", pool.maxSize.Load(), connKey)
 			return
 		}
 
@@ -687,14 +1462,19 @@ func handleUDPPacket(serverConn *net.UDPConn, clientAddr *net.UDPAddr, data []by
 		}
 
 		conn := newUDPConnection(udpConn, clientAddr, targetUDPAddr, resolvedIP)
+		conn.target = target
 
 		if !pool.Set(connKey, conn) {
 			_ = udpConn.Close()
-			errorLogger.Printf("UDP connection limit reached (%d), dropping packet for %s", pool.maxSize, connKey)
+			errorLogger.Printf("UDP connection limit reached (%d), dropping packet for %s", pool.maxSize.Load(), connKey)
 			return
 		}
 
-		go startUDPReader(conn, serverConn, pool, connKey)
+		if !pool.spawnReader(conn, serverConn, connKey) {
+			conn.MarkReadDone()
+			pool.Delete(connKey)
+			return
+		}
 
 		conn.writeMu.Lock()
 		defer conn.writeMu.Unlock()
@@ -704,9 +1484,44 @@ func handleUDPPacket(serverConn *net.UDPConn, clientAddr *net.UDPAddr, data []by
 	}()
 }
 
+// ipv6Only сообщает, что у туннеля есть только IPv6 адреса, IPv4 цели через него недоступны
+func ipv6Only(addrs []netip.Addr) bool {
+	hasIPv6 := false
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			return false
+		}
+		hasIPv6 = true
+	}
+	return hasIPv6
+}
+
 // ========== SOCKS5 UDP СЕРВЕР ==========
+// socks5UDPConfig - параметры UDP сервера, нулевые значения, кроме DNSCacheSize, заменяются
+// значениями по умолчанию
+type socks5UDPConfig struct {
+	BindAddress     string
+	MaxConnections  int
+	CleanupInterval time.Duration
+	IdleTimeout     time.Duration
+	KeyFunc         UDPKeyFunc // nil означает UDPKeyByClient
+	DNSCacheSize    int        // максимум записей DNS кэша, 0 - без ограничения
+}
+
+// defaultSocks5UDPConfig возвращает прежние фиксированные параметры: 1000 соединений,
+// очистка каждые 30 секунд, закрытие после 40 секунд простоя
+func defaultSocks5UDPConfig() socks5UDPConfig {
+	return socks5UDPConfig{
+		MaxConnections:  maxUDPConnections,
+		CleanupInterval: udpCleanupInterval,
+		IdleTimeout:     udpConnectionTimeout,
+		DNSCacheSize:    dnsCacheMaxSize,
+	}
+}
+
 type socks5UDPServer struct {
 	addr   string
+	config socks5UDPConfig
 	vt     *VirtualTun
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -715,10 +1530,14 @@ type socks5UDPServer struct {
 	pool   *udpConnectionPool
 }
 
-func newSocks5UDPServer(addr string, vt *VirtualTun) *socks5UDPServer {
+func newSocks5UDPServer(cfg socks5UDPConfig, vt *VirtualTun) *socks5UDPServer {
+	if cfg.MaxConnections <= 0 {
+		cfg.MaxConnections = maxUDPConnections
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &socks5UDPServer{
-		addr:   addr,
+		addr:   cfg.BindAddress,
+		config: cfg,
 		vt:     vt,
 		ctx:    ctx,
 		cancel: cancel,
@@ -739,14 +1558,22 @@ func (s *socks5UDPServer) Start() error {
 
 	errorLogger.Printf("SOCKS5 UDP listening on %s", s.addr)
 
-	if err := conn.SetReadBuffer(64 * 1024); err != nil {
+	if err := conn.SetReadBuffer(udpReceiveBufferSize); err != nil {
 		errorLogger.Printf("Warning: failed to set read buffer: %v", err)
 	}
 	if err := conn.SetWriteBuffer(64 * 1024); err != nil {
 		errorLogger.Printf("Warning: failed to set write buffer: %v", err)
 	}
 
-	s.pool = newUDPConnectionPool(maxUDPConnections)
+	s.pool = newUDPConnectionPool(udpConnectionPoolOptions{
+		MaxSize:            s.config.MaxConnections,
+		CleanupInterval:    s.config.CleanupInterval,
+		IdleTimeout:        s.config.IdleTimeout,
+		KeyFunc:            s.config.KeyFunc,
+		PreferIPv6:         s.vt != nil && ipv6Only(s.vt.currentConf().Endpoint),
+		BufferSize:         s.bufferSize(),
+		DNSCacheMaxEntries: s.config.DNSCacheSize,
+	})
 
 	s.wg.Add(1)
 	go s.serve()
@@ -754,11 +1581,28 @@ func (s *socks5UDPServer) Start() error {
 	return nil
 }
 
+// bufferSize - размер буфера по действующему MTU туннеля: заданному в конфигурации
+// или определенному при запуске. Без туннеля - udpBufferSize
+func (s *socks5UDPServer) bufferSize() int {
+	if s.vt == nil || s.vt.Conf == nil {
+		return udpBufferSize
+	}
+	mtu := s.vt.currentConf().MTU
+	if mtu == 0 {
+		mtu = s.vt.DetectedMTU
+	}
+	return udpBufferSizeForMTU(mtu)
+}
+
 func (s *socks5UDPServer) serve() {
 	defer s.wg.Done()
 	// nolint:errcheck // close errors are not critical
 	defer s.conn.Close()
-	defer s.pool.Shutdown()
+	defer func() {
+		if err := s.pool.Shutdown(udpPoolShutdownDelay); err != nil {
+			errorLogger.Printf("UDP pool shutdown: %v", err)
+		}
+	}()
 
 	for {
 		select {
@@ -767,13 +1611,13 @@ func (s *socks5UDPServer) serve() {
 		default:
 		}
 
-		buf := getUDPBuffer()
+		buf := s.pool.bufPool.get()
 
 		_ = s.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
 
 		n, clientAddr, err := s.conn.ReadFromUDP(buf)
 		if err != nil {
-			putUDPBuffer(buf)
+			s.pool.bufPool.put(buf)
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				continue
 			}
@@ -784,7 +1628,7 @@ func (s *socks5UDPServer) serve() {
 		// Создаем копию данных для горутины
 		data := make([]byte, n)
 		copy(data, buf[:n])
-		putUDPBuffer(buf)
+		s.pool.bufPool.put(buf)
 
 		select {
 		case <-s.ctx.Done():
@@ -830,8 +1674,24 @@ type socks5TCPServer struct {
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
 	listener net.Listener
+	// bindTimeout - время ожидания входящего соединения для BIND, 0 - socks5BindTimeout
+	bindTimeout time.Duration
+	// dialTimeout - время установки соединения для CONNECT, 0 - socks5DialTimeout
+	dialTimeout time.Duration
+	// readTimeout и writeTimeout - время бездействия чтения и записи при пересылке, 0 - без ограничения
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// dial устанавливает соединение для CONNECT, nil - через туннель
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
 }
 
+const (
+	// socks5BindTimeout - время ожидания входящего соединения для BIND по умолчанию
+	socks5BindTimeout = 30 * time.Second
+	// socks5DialTimeout - время установки соединения для CONNECT по умолчанию
+	socks5DialTimeout = 30 * time.Second
+)
+
 func newSocks5TCPServer(addr string, vt *VirtualTun, username, password string) *socks5TCPServer {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &socks5TCPServer{
@@ -899,123 +1759,180 @@ func (s *socks5TCPServer) serve() {
 	}
 }
 
-func (s *socks5TCPServer) handleTCP(conn net.Conn) {
-	// nolint:errcheck // close errors are not critical
-	defer conn.Close()
+// ========== SOCKS5 TCP РУКОПОЖАТИЕ ==========
+// socks5State - состояние рукопожатия SOCKS5 (RFC 1928, аутентификация по RFC 1929)
+type socks5State int
 
-	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+const (
+	stateGreeting socks5State = iota // VER NMETHODS METHODS
+	stateAuth                        // подпереговоры username/password
+	stateRequest                     // VER CMD RSV ATYP DST.ADDR DST.PORT
+	stateRelay                       // рукопожатие завершено, дальше обработка команды
+)
 
-	buf := make([]byte, 512)
-	n, err := conn.Read(buf)
-	if err != nil {
-		errorLogger.Printf("Handshake read error: %v", err)
-		return
+const (
+	socks5Version        = 0x05
+	socks5AuthVersion    = 0x01
+	socks5MethodNoAuth   = 0x00
+	socks5MethodUserPass = 0x02
+	socks5MethodNone     = 0xFF
+)
+
+// socks5Handshake проводит клиента по состояниям рукопожатия
+type socks5Handshake struct {
+	state socks5State
+	// auth - учетные данные, nil если аутентификация не требуется
+	auth *CredentialValidator
+	// Заполняются в stateRequest
+	cmd  byte
+	host string
+	port uint16
+}
+
+func newSocks5Handshake(username, password string) *socks5Handshake {
+	h := &socks5Handshake{state: stateGreeting}
+	// Как и в HTTP прокси, аутентификация нужна, если задано хотя бы одно из полей
+	if username != "" || password != "" {
+		h.auth = &CredentialValidator{username: username, password: password}
 	}
+	return h
+}
 
-	if n < 1 || buf[0] != 0x05 {
-		errorLogger.Printf("Not SOCKS5")
-		return
+// step читает сообщение текущего состояния, отвечает клиенту и переходит в следующее.
+// Ответ на запрос зависит от команды и отправляется уже после stateRelay
+func (h *socks5Handshake) step(r io.Reader, w io.Writer) error {
+	switch h.state {
+	case stateGreeting:
+		return h.greeting(r, w)
+	case stateAuth:
+		return h.authenticate(r, w)
+	case stateRequest:
+		return h.request(r)
+	default:
+		return errors.New("SOCKS5 handshake is already complete")
 	}
+}
 
-	// Аутентификация
-	if s.username != "" {
-		if n < 3 {
-			errorLogger.Printf("Handshake packet too short")
-			return
-		}
-		methods := buf[2:n]
-		hasAuth := false
-		for _, m := range methods {
-			if m == 0x02 {
-				hasAuth = true
-				break
-			}
-		}
-		if !hasAuth {
-			// nolint:errcheck // write errors are not critical
-			conn.Write([]byte{0x05, 0xFF})
-			errorLogger.Printf("No auth method supported")
-			return
-		}
+func (h *socks5Handshake) greeting(r io.Reader, w io.Writer) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("handshake read error: %w", err)
+	}
+	if header[0] != socks5Version {
+		return errors.New("not SOCKS5")
+	}
+	methods := make([]byte, int(header[1]))
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return fmt.Errorf("handshake read error: %w", err)
+	}
 
-		if _, err := conn.Write([]byte{0x05, 0x02}); err != nil {
-			errorLogger.Printf("Failed to write auth method: %v", err)
-			return
-		}
+	// Выбираем единственный метод, который поддерживаем при текущих настройках
+	method, next := byte(socks5MethodNoAuth), stateRequest
+	if h.auth != nil {
+		method, next = socks5MethodUserPass, stateAuth
+	}
+	if !slices.Contains(methods, method) {
+		_, _ = w.Write([]byte{socks5Version, socks5MethodNone})
+		return errors.New("no acceptable authentication method")
+	}
 
-		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
-		n, err = conn.Read(buf)
-		if err != nil {
-			errorLogger.Printf("Auth read error: %v", err)
-			return
-		}
+	if _, err := w.Write([]byte{socks5Version, method}); err != nil {
+		return fmt.Errorf("failed to write auth method: %w", err)
+	}
+	h.state = next
+	return nil
+}
 
-		if n < 3 || buf[0] != 0x01 {
-			errorLogger.Printf("Invalid auth packet")
-			return
-		}
+func (h *socks5Handshake) authenticate(r io.Reader, w io.Writer) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("auth read error: %w", err)
+	}
+	if header[0] != socks5AuthVersion {
+		return errors.New("invalid auth packet")
+	}
 
-		userLen := int(buf[1])
-		if n < 2+userLen+1 {
-			errorLogger.Printf("Auth packet too short")
-			return
-		}
-		username := string(buf[2 : 2+userLen])
-		passLen := int(buf[2+userLen])
-		if n < 3+userLen+passLen {
-			errorLogger.Printf("Auth packet too short for password")
-			return
-		}
-		password := string(buf[3+userLen : 3+userLen+passLen])
+	// UNAME и следующий за ним PLEN
+	username := make([]byte, int(header[1])+1)
+	if _, err := io.ReadFull(r, username); err != nil {
+		return fmt.Errorf("auth read error: %w", err)
+	}
+	password := make([]byte, int(username[len(username)-1]))
+	if _, err := io.ReadFull(r, password); err != nil {
+		return fmt.Errorf("auth read error: %w", err)
+	}
 
-		if username != s.username || password != s.password {
-			// nolint:errcheck // write errors are not critical
-			conn.Write([]byte{0x05, 0x01})
-			errorLogger.Printf("Auth failed")
-			return
-		}
+	if !h.auth.Valid(string(username[:len(username)-1]), string(password)) {
+		_, _ = w.Write([]byte{socks5AuthVersion, 0x01})
+		return errors.New("auth failed")
+	}
 
-		if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
-			errorLogger.Printf("Failed to write auth success: %v", err)
-			return
-		}
-	} else {
-		if _, err := conn.Write([]byte{0x05, 0x00}); err != nil {
-			errorLogger.Printf("Failed to write no-auth: %v", err)
-			return
-		}
+	if _, err := w.Write([]byte{socks5AuthVersion, 0x00}); err != nil {
+		return fmt.Errorf("failed to write auth success: %w", err)
 	}
+	h.state = stateRequest
+	return nil
+}
 
-	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
-	n, err = conn.Read(buf)
-	if err != nil {
-		errorLogger.Printf("Command read error: %v", err)
-		return
+func (h *socks5Handshake) request(r io.Reader) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("command read error: %w", err)
+	}
+	if header[0] != socks5Version {
+		return errors.New("invalid command version")
 	}
 
-	if n < 4 {
-		errorLogger.Printf("Command too short")
-		return
+	var addr []byte
+	switch header[3] {
+	case 0x01: // IPv4
+		addr = make([]byte, net.IPv4len+2)
+	case 0x03: // Domain name
+		domainLen := make([]byte, 1)
+		if _, err := io.ReadFull(r, domainLen); err != nil {
+			return fmt.Errorf("command read error: %w", err)
+		}
+		addr = make([]byte, int(domainLen[0])+2)
+	case 0x04: // IPv6
+		addr = make([]byte, net.IPv6len+2)
+	default:
+		return fmt.Errorf("unknown address type: %x", header[3])
 	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return fmt.Errorf("command read error: %w", err)
+	}
+
+	hostBytes := addr[:len(addr)-2]
+	if header[3] == 0x03 {
+		h.host = string(hostBytes)
+	} else {
+		h.host = net.IP(hostBytes).String()
+	}
+	h.port = binary.BigEndian.Uint16(addr[len(addr)-2:])
+	h.cmd = header[1]
+	h.state = stateRelay
+	return nil
+}
 
-	cmd := buf[1]
+func (s *socks5TCPServer) handleTCP(conn net.Conn) {
+	// nolint:errcheck // close errors are not critical
+	defer conn.Close()
 
-	// DNS запрос
-	if cmd == 0xF0 {
-		if n < 5 {
-			// nolint:errcheck // write errors are not critical
-			conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-			return
-		}
-		domainLen := int(buf[4])
-		if n < 5+domainLen {
-			// nolint:errcheck // write errors are not critical
-			conn.Write([]byte{0x05, 0x04, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	handshake := newSocks5Handshake(s.username, s.password)
+	for handshake.state != stateRelay {
+		if err := handshake.step(conn, conn); err != nil {
+			errorLogger.Printf("SOCKS5 handshake failed: %v", err)
 			return
 		}
-		domain := string(buf[5 : 5+domainLen])
+	}
+
+	cmd, host, port := handshake.cmd, handshake.host, handshake.port
 
-		addr, err := s.vt.ResolveAddrWithContext(s.ctx, domain)
+	// DNS запрос
+	if cmd == 0xF0 {
+		addr, err := s.vt.ResolveAddrWithContext(s.ctx, host)
 		if err != nil {
 			errorLogger.Printf("DNS resolution failed: %v", err)
 			// nolint:errcheck // write errors are not critical
@@ -1081,53 +1998,22 @@ func (s *socks5TCPServer) handleTCP(conn net.Conn) {
 		return
 	}
 
-	// CONNECT
-	if cmd != 0x01 {
-		errorLogger.Printf("Unsupported command: %x", cmd)
+	// BIND
+	if cmd == 0x02 {
+		s.handleBind(conn)
 		return
 	}
 
-	var host string
-	var port uint16
-	addrType := buf[3]
-
-	switch addrType {
-	case 0x01:
-		if n < 10 {
-			errorLogger.Printf("IPv4 address too short")
-			return
-		}
-		ip := net.IPv4(buf[4], buf[5], buf[6], buf[7])
-		host = ip.String()
-		port = binary.BigEndian.Uint16(buf[8:10])
-	case 0x03:
-		if n < 5 {
-			errorLogger.Printf("Domain address too short")
-			return
-		}
-		domainLen := int(buf[4])
-		if n < 5+domainLen+2 {
-			errorLogger.Printf("Domain address too short")
-			return
-		}
-		host = string(buf[5 : 5+domainLen])
-		port = binary.BigEndian.Uint16(buf[5+domainLen : 5+domainLen+2])
-	case 0x04:
-		if n < 22 {
-			errorLogger.Printf("IPv6 address too short")
-			return
-		}
-		host = net.IP(buf[4:20]).String()
-		port = binary.BigEndian.Uint16(buf[20:22])
-	default:
-		errorLogger.Printf("Unknown address type: %x", addrType)
+	// CONNECT
+	if cmd != 0x01 {
+		errorLogger.Printf("Unsupported command: %x", cmd)
 		return
 	}
 
 	_ = conn.SetDeadline(time.Time{}) // Убираем дедлайн для долгого соединения
 
 	targetAddr := net.JoinHostPort(host, strconv.Itoa(int(port)))
-	target, err := s.vt.Tnet.Dial("tcp", targetAddr)
+	target, err := s.dialTarget(targetAddr)
 	if err != nil {
 		errorLogger.Printf("Failed to connect: %v", err)
 		// nolint:errcheck // write errors are not critical
@@ -1138,6 +2024,164 @@ func (s *socks5TCPServer) handleTCP(conn net.Conn) {
 	// nolint:errcheck // write errors are not critical
 	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 
+	s.relay(conn, target)
+}
+
+// dialTarget устанавливает соединение для CONNECT, ожидая не дольше dialTimeout
+func (s *socks5TCPServer) dialTarget(address string) (net.Conn, error) {
+	timeout := s.dialTimeout
+	if timeout == 0 {
+		timeout = socks5DialTimeout
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+
+	if s.dial != nil {
+		return s.dial(ctx, "tcp", address)
+	}
+	return s.vt.Tnet.DialContext(ctx, "tcp", address)
+}
+
+// relay пересылает данные между conn и target. Без таймаутов используется relayTCP,
+// io.Copy которого сохраняет быстрые пути ReadFrom и WriteTo соединений
+func (s *socks5TCPServer) relay(conn, target net.Conn) {
+	if s.readTimeout == 0 && s.writeTimeout == 0 {
+		relayTCP(conn, target)
+		return
+	}
+	relayTCPWithTimeouts(conn, target, s.readTimeout, s.writeTimeout)
+}
+
+// handleBind обрабатывает команду BIND: открывает порт в туннеле, сообщает его клиенту,
+// ждет одно входящее соединение, сообщает его источник и связывает его с клиентом.
+// Порт закрывается, если клиент отключился или соединение не пришло за bindTimeout
+func (s *socks5TCPServer) handleBind(conn net.Conn) {
+	failure := func(rep byte) {
+		// nolint:errcheck // write errors are not critical
+		conn.Write([]byte{0x05, rep, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	}
+
+	listener, err := s.vt.Tnet.ListenTCPAddrPort(netip.AddrPortFrom(s.bindAddr(), 0))
+	if err != nil {
+		errorLogger.Printf("Failed to listen for BIND: %v", err)
+		failure(0x01)
+		return
+	}
+	// nolint:errcheck // close errors are not critical
+	defer listener.Close()
+
+	bound, err := netip.ParseAddrPort(listener.Addr().String())
+	if err != nil {
+		errorLogger.Printf("Failed to get BIND address: %v", err)
+		failure(0x01)
+		return
+	}
+	if _, err := conn.Write(socks5Reply(0x00, bound)); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		defer close(accepted)
+		if inbound, err := listener.Accept(); err == nil {
+			accepted <- inbound
+		}
+	}()
+	// До второго ответа клиент ничего не отправляет, чтение завершится при его отключении
+	var clientErr error
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		var b [1]byte
+		if _, clientErr = conn.Read(b[:]); clientErr == nil {
+			clientErr = errors.New("unexpected data before the BIND reply")
+		}
+	}()
+	abort := func() {
+		// nolint:errcheck // close errors are not critical
+		listener.Close()
+		if inbound, ok := <-accepted; ok {
+			// nolint:errcheck // close errors are not critical
+			inbound.Close()
+		}
+	}
+
+	timeout := s.bindTimeout
+	if timeout <= 0 {
+		timeout = socks5BindTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var inbound net.Conn
+	select {
+	case inbound = <-accepted:
+	case <-clientDone:
+		abort()
+		return
+	case <-timer.C:
+		abort()
+		failure(0x06)
+		return
+	case <-s.ctx.Done():
+		abort()
+		return
+	}
+	if inbound == nil {
+		failure(0x01)
+		return
+	}
+
+	// Останавливаем чтение клиента, дальше его данные идут во входящее соединение
+	_ = conn.SetReadDeadline(time.Now())
+	<-clientDone
+	if !errors.Is(clientErr, os.ErrDeadlineExceeded) {
+		// nolint:errcheck // close errors are not critical
+		inbound.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	source, err := netip.ParseAddrPort(inbound.RemoteAddr().String())
+	if err != nil {
+		// nolint:errcheck // close errors are not critical
+		inbound.Close()
+		failure(0x01)
+		return
+	}
+	if _, err := conn.Write(socks5Reply(0x00, source)); err != nil {
+		// nolint:errcheck // close errors are not critical
+		inbound.Close()
+		return
+	}
+
+	s.relay(conn, inbound)
+}
+
+// bindAddr возвращает адрес туннеля для BIND, IPv4 предпочтительнее
+func (s *socks5TCPServer) bindAddr() netip.Addr {
+	endpoint := s.vt.currentConf().Endpoint
+	if len(endpoint) == 0 {
+		return netip.IPv4Unspecified()
+	}
+	for _, addr := range endpoint {
+		if addr.Is4() {
+			return addr
+		}
+	}
+	return endpoint[0]
+}
+
+// socks5Reply формирует ответ на команду с кодом rep и адресом addr
+func socks5Reply(rep byte, addr netip.AddrPort) []byte {
+	atyp, addrBytes := socks5AddrBytes(addr.Addr())
+	reply := append([]byte{0x05, rep, 0x00, atyp}, addrBytes...)
+	return binary.BigEndian.AppendUint16(reply, addr.Port())
+}
+
+// relayTCP копирует данные в обе стороны, пока обе стороны не закончат отправку
+func relayTCP(conn, target net.Conn) {
 	// Правильное копирование с ожиданием обеих сторон
 	var wg sync.WaitGroup
 	wg.Add(2)
@@ -1161,6 +2205,61 @@ func (s *socks5TCPServer) handleTCP(conn net.Conn) {
 	wg.Wait()
 }
 
+// relayTCPWithTimeouts пересылает данные как relayTCP, но закрывает соединения, только если
+// ни в одном направлении ничего не передавалось дольше readTimeout: при передаче в одну
+// сторону другое направление простаивает. writeTimeout ограничивает каждую запись
+func relayTCPWithTimeouts(conn, target net.Conn, readTimeout, writeTimeout time.Duration) {
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+	idle := func() bool {
+		return time.Since(time.Unix(0, lastActivity.Load())) >= readTimeout
+	}
+
+	copyIdle := func(dst, src net.Conn) {
+		buf := make([]byte, 32*1024)
+		for {
+			if readTimeout > 0 {
+				_ = src.SetReadDeadline(time.Now().Add(readTimeout))
+			}
+			n, err := src.Read(buf)
+			if n > 0 {
+				lastActivity.Store(time.Now().UnixNano())
+				if writeTimeout > 0 {
+					_ = dst.SetWriteDeadline(time.Now().Add(writeTimeout))
+				}
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return
+				}
+				lastActivity.Store(time.Now().UnixNano())
+			}
+			if err != nil {
+				// Таймаут чтения не важен, пока данные идут в другую сторону
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() && !idle() {
+					continue
+				}
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// nolint:errcheck // close errors are not critical
+		defer target.Close()
+		copyIdle(target, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		// nolint:errcheck // close errors are not critical
+		defer conn.Close()
+		copyIdle(conn, target)
+	}()
+	wg.Wait()
+}
+
 func (s *socks5TCPServer) Shutdown() {
 	s.cancel()
 	if s.listener != nil {
@@ -1178,9 +2277,11 @@ type CustomSocks5Server struct {
 }
 
 func NewCustomSocks5Server(addr string, vt *VirtualTun, username, password string) *CustomSocks5Server {
+	udpConfig := defaultSocks5UDPConfig()
+	udpConfig.BindAddress = addr
 	return &CustomSocks5Server{
 		tcp: newSocks5TCPServer(addr, vt, username, password),
-		udp: newSocks5UDPServer(addr, vt),
+		udp: newSocks5UDPServer(udpConfig, vt),
 	}
 }
 
@@ -0,0 +1,1487 @@
+package wireproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUDPConnectionPoolShutdown(t *testing.T) {
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+
+	local, remote := net.Pipe()
+	defer func() { _ = remote.Close() }()
+
+	client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	target := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+	conn := newUDPConnection(local, client, target, target.IP)
+
+	if !pool.Set(client.String(), conn) {
+		t.Fatal("connection should be added to the pool")
+	}
+	if !pool.spawnReader(conn, nil, client.String()) {
+		t.Fatal("reader should be started")
+	}
+
+	if err := pool.Shutdown(5 * time.Second); err != nil {
+		t.Fatalf("shutdown should finish before the deadline: %v", err)
+	}
+	if !conn.IsClosed() {
+		t.Fatal("connection should be closed after shutdown")
+	}
+	if size := pool.currentSize.Load(); size != 0 {
+		t.Fatalf("pool should be empty after shutdown, got %d connections", size)
+	}
+	if pool.spawnReader(conn, nil, client.String()) {
+		t.Fatal("readers should not be started after shutdown")
+	}
+}
+
+func TestDNSCacheWithLookup(t *testing.T) {
+	lookups := 0
+	lookup := func(host string) ([]net.IP, error) {
+		lookups++
+		switch host {
+		case "dual.example":
+			return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}, nil
+		case "v6.example":
+			return []net.IP{net.ParseIP("2001:db8::2")}, nil
+		default:
+			return nil, errors.New("no such host")
+		}
+	}
+
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10, Lookup: lookup})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	addr, ip, err := pool.resolveTarget("dual.example", 53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "192.0.2.1:53" || !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("IPv4 address should be preferred, got %s", addr)
+	}
+
+	if _, _, err := pool.resolveTarget("dual.example", 53); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 1 {
+		t.Fatalf("cached entry should be reused, got %d lookups", lookups)
+	}
+
+	addr, _, err = pool.resolveTarget("v6.example", 443)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "[2001:db8::2]:443" {
+		t.Fatalf("unexpected address %s", addr)
+	}
+
+	if _, _, err := pool.resolveTarget("missing.example", 53); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestHandleUDPPacketBuffersFragments(t *testing.T) {
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	fragmented := []byte{0x00, 0x00, 0x01, 0x01, 127, 0, 0, 1, 0x00, 0x35, 0xff}
+	malformed := []byte{0x01, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x35, 0xff}
+
+	handleUDPPacket(nil, clientAddr, fragmented, nil, pool)
+	handleUDPPacket(nil, clientAddr, malformed, nil, pool)
+
+	if len(pool.fragments.queues) != 1 {
+		t.Fatal("fragment should wait for the rest of the datagram")
+	}
+	if pool.currentSize.Load() != 0 {
+		t.Fatal("incomplete and malformed packets should not create connections")
+	}
+}
+
+func TestUDPFragmentReassembler(t *testing.T) {
+	r := newUDPFragmentReassembler(50 * time.Millisecond)
+	dropped := &r.dropped
+
+	if _, complete := r.Feed("a", "t", 0x01, []byte("ab")); complete {
+		t.Fatal("first fragment should not complete the datagram")
+	}
+	if _, complete := r.Feed("b", "t", 0x81, []byte("other")); !complete {
+		t.Fatal("single last fragment should complete the datagram of its own client")
+	}
+	if _, complete := r.Feed("a", "t", 0x02, []byte("cd")); complete {
+		t.Fatal("second fragment should not complete the datagram")
+	}
+	payload, complete := r.Feed("a", "t", 0x83, []byte("ef"))
+	if !complete || string(payload) != "abcdef" {
+		t.Fatalf("fragments should be joined in order, got %q", payload)
+	}
+
+	// a lower number than one already received starts a new datagram, RFC 1928 section 7
+	r.Feed("a", "t", 0x02, []byte("cd"))
+	r.Feed("a", "t", 0x01, []byte("ab"))
+	if got := dropped.Load(); got != 1 {
+		t.Fatalf("queue should be dropped when a lower number arrives, got %d dropped", got)
+	}
+	payload, complete = r.Feed("a", "t", 0x82, []byte("cd"))
+	if !complete || string(payload) != "abcd" {
+		t.Fatalf("fragments of the new datagram should be joined, got %q", payload)
+	}
+
+	r.Feed("a", "t", 0x01, []byte("ab"))
+	if _, complete := r.Feed("a", "t", 0x83, []byte("ef")); complete {
+		t.Fatal("datagram with a missing fragment should not complete")
+	}
+	if got := dropped.Load(); got != 3 {
+		t.Fatalf("fragments of the incomplete datagram should be dropped, got %d", got)
+	}
+
+	// fragment 2 is missing while 5 was received before the last one, 3
+	r.Feed("a", "t", 0x01, []byte("AA"))
+	r.Feed("a", "t", 0x05, []byte("EE"))
+	if payload, complete := r.Feed("a", "t", 0x83, []byte("CC")); complete {
+		t.Fatalf("datagram with a gap should not complete, got %q", payload)
+	}
+	if got := dropped.Load(); got != 6 || len(r.queues) != 0 {
+		t.Fatalf("fragments around the gap should be dropped, got %d dropped and %d queues", got, len(r.queues))
+	}
+
+	r.Feed("a", "t", 0x01, []byte("ab"))
+	time.Sleep(100 * time.Millisecond)
+	r.Cleanup()
+	if len(r.queues) != 0 || dropped.Load() != 7 {
+		t.Fatalf("expired fragments should be evicted, %d queues and %d dropped", len(r.queues), dropped.Load())
+	}
+
+	if _, complete := r.Feed("a", "t", 0x80, nil); complete || dropped.Load() != 8 {
+		t.Fatal("fragment number 0 should be dropped")
+	}
+	if _, complete := r.Feed("a", "t", 0x01, make([]byte, udpFragmentMaxSize+1)); complete || len(r.queues) != 0 {
+		t.Fatal("oversized datagram should be dropped")
+	}
+
+	r.Feed("a", "t", 0x01, []byte("ab"))
+	if _, complete := r.Feed("a", "u", 0x81, []byte("other")); !complete {
+		t.Fatal("fragment for another destination should not join the queue of the first one")
+	}
+	payload, complete = r.Feed("a", "t", 0x82, []byte("cd"))
+	if !complete || string(payload) != "abcd" {
+		t.Fatalf("fragments should be queued per destination, got %q", payload)
+	}
+
+	before := dropped.Load()
+	r.Feed("a", "t", 0x01, []byte("ab"))
+	r.Feed("a", "u", 0x01, []byte("ab"))
+	r.Reset("a", "t")
+	if _, complete := r.Feed("a", "t", 0x82, []byte("cd")); complete {
+		t.Fatal("datagram with FRAG 0 should reset the reassembly queue")
+	}
+	if _, complete := r.Feed("a", "u", 0x82, []byte("cd")); !complete {
+		t.Fatal("reset should only affect the queue of its destination")
+	}
+	if got := dropped.Load() - before; got != 2 {
+		t.Fatalf("reset and incomplete fragments should be dropped, got %d", got)
+	}
+	r.Reset("a", "t")
+	if len(r.queues) != 0 || r.pending.Load() != 0 {
+		t.Fatalf("no queue should be left, %d queues and %d pending", len(r.queues), r.pending.Load())
+	}
+}
+
+func TestUDPConnectionAgingUsesMonotonicClock(t *testing.T) {
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	fresh, _ := net.Pipe()
+	stale, _ := net.Pipe()
+	freshConn := newUDPConnection(fresh, &net.UDPAddr{Port: 1}, nil, nil)
+	staleConn := newUDPConnection(stale, &net.UDPAddr{Port: 2}, nil, nil)
+	freshConn.MarkReadDone()
+	staleConn.MarkReadDone()
+	pool.Set("fresh", freshConn)
+	pool.Set("stale", staleConn)
+
+	// A wall clock jump would only move the wall reading, the age must be
+	// derived from the monotonic reading that Round(0) strips
+	lastUsed := freshConn.LastUsed()
+	if lastUsed == lastUsed.Round(0) {
+		t.Fatal("LastUsed should carry a monotonic clock reading")
+	}
+
+	staleConn.lastUsed.Store(udpClockNow() - int64(time.Hour))
+	pool.Cleanup(time.Minute)
+
+	if _, ok := pool.Get("stale"); ok {
+		t.Fatal("stale connection should be evicted")
+	}
+	if _, ok := pool.Get("fresh"); !ok {
+		t.Fatal("fresh connection should be kept")
+	}
+}
+
+func TestParseSocks5UDPHeaderDomain(t *testing.T) {
+	domain := strings.Repeat("a", 255)
+	packet := append([]byte{0x00, 0x00, 0x00, 0x03, byte(len(domain))}, domain...)
+	packet = append(packet, 0x01, 0xbb, 0xff)
+
+	host, port, headerLen, ok := parseSocks5UDPHeader(packet)
+	if !ok {
+		t.Fatal("header with a 255 byte domain should be parsed")
+	}
+	if host != domain || port != 443 || headerLen != 7+len(domain) {
+		t.Fatalf("unexpected header: host length %d, port %d, header length %d", len(host), port, headerLen)
+	}
+
+	for _, truncated := range [][]byte{packet[:4], packet[:5], packet[:5+len(domain)+1]} {
+		if _, _, _, ok := parseSocks5UDPHeader(truncated); ok {
+			t.Fatalf("truncated header of %d bytes should be rejected", len(truncated))
+		}
+	}
+}
+
+func TestSocks5HandshakeStates(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		state    socks5State
+		input    []byte
+		reply    []byte
+		next     socks5State
+		wantErr  bool
+	}{
+		{name: "greeting no auth", state: stateGreeting, input: []byte{0x05, 0x01, 0x00}, reply: []byte{0x05, 0x00}, next: stateRequest},
+		{name: "greeting no auth among methods", state: stateGreeting, input: []byte{0x05, 0x02, 0x02, 0x00}, reply: []byte{0x05, 0x00}, next: stateRequest},
+		{name: "greeting without no auth method", state: stateGreeting, input: []byte{0x05, 0x01, 0x02}, reply: []byte{0x05, 0xFF}, next: stateGreeting, wantErr: true},
+		{name: "greeting user/pass", username: "user", password: "pass", state: stateGreeting, input: []byte{0x05, 0x02, 0x00, 0x02}, reply: []byte{0x05, 0x02}, next: stateAuth},
+		{name: "greeting user/pass not offered", username: "user", password: "pass", state: stateGreeting, input: []byte{0x05, 0x01, 0x00}, reply: []byte{0x05, 0xFF}, next: stateGreeting, wantErr: true},
+		{name: "greeting password only", password: "pass", state: stateGreeting, input: []byte{0x05, 0x01, 0x00}, reply: []byte{0x05, 0xFF}, next: stateGreeting, wantErr: true},
+		{name: "auth empty username", password: "pass", state: stateAuth,
+			input: []byte{0x01, 0x00, 0x04, 'p', 'a', 's', 's'}, reply: []byte{0x01, 0x00}, next: stateRequest},
+		{name: "greeting wrong version", state: stateGreeting, input: []byte{0x04, 0x01, 0x00}, next: stateGreeting, wantErr: true},
+		{name: "greeting truncated", state: stateGreeting, input: []byte{0x05, 0x02, 0x00}, next: stateGreeting, wantErr: true},
+		{name: "auth success", username: "user", password: "pass", state: stateAuth,
+			input: []byte{0x01, 0x04, 'u', 's', 'e', 'r', 0x04, 'p', 'a', 's', 's'}, reply: []byte{0x01, 0x00}, next: stateRequest},
+		{name: "auth wrong password", username: "user", password: "pass", state: stateAuth,
+			input: []byte{0x01, 0x04, 'u', 's', 'e', 'r', 0x04, 'p', 'a', 's', 'x'}, reply: []byte{0x01, 0x01}, next: stateAuth, wantErr: true},
+		{name: "auth wrong version", username: "user", password: "pass", state: stateAuth,
+			input: []byte{0x05, 0x04, 'u', 's', 'e', 'r', 0x04, 'p', 'a', 's', 's'}, next: stateAuth, wantErr: true},
+		{name: "request IPv4", state: stateRequest, input: []byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50}, next: stateRelay},
+		{name: "request domain", state: stateRequest, input: []byte{0x05, 0x01, 0x00, 0x03, 0x03, 'a', '.', 'b', 0x01, 0xbb}, next: stateRelay},
+		{name: "request IPv6", state: stateRequest, input: append([]byte{0x05, 0x03, 0x00, 0x04}, append(net.ParseIP("fd00::1"), 0x00, 0x35)...), next: stateRelay},
+		{name: "request unknown address type", state: stateRequest, input: []byte{0x05, 0x01, 0x00, 0x05}, next: stateRequest, wantErr: true},
+		{name: "request truncated", state: stateRequest, input: []byte{0x05, 0x01, 0x00, 0x01, 10, 0}, next: stateRequest, wantErr: true},
+		{name: "relay is final", state: stateRelay, next: stateRelay, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handshake := newSocks5Handshake(tt.username, tt.password)
+			handshake.state = tt.state
+
+			var reply bytes.Buffer
+			err := handshake.step(bytes.NewReader(tt.input), &reply)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(reply.Bytes(), tt.reply) {
+				t.Fatalf("unexpected reply %x, want %x", reply.Bytes(), tt.reply)
+			}
+			if handshake.state != tt.next {
+				t.Fatalf("unexpected state %d, want %d", handshake.state, tt.next)
+			}
+		})
+	}
+}
+
+func TestSocks5HandshakeRequestAddress(t *testing.T) {
+	tests := []struct {
+		input []byte
+		cmd   byte
+		host  string
+		port  uint16
+	}{
+		{input: []byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 1, 0x00, 0x50}, cmd: 0x01, host: "10.0.0.1", port: 80},
+		{input: []byte{0x05, 0xF0, 0x00, 0x03, 0x03, 'a', '.', 'b', 0x01, 0xbb}, cmd: 0xF0, host: "a.b", port: 443},
+		{input: append([]byte{0x05, 0x03, 0x00, 0x04}, append(net.ParseIP("fd00::1"), 0x00, 0x35)...), cmd: 0x03, host: "fd00::1", port: 53},
+	}
+
+	for _, tt := range tests {
+		handshake := newSocks5Handshake("", "")
+		handshake.state = stateRequest
+		if err := handshake.step(bytes.NewReader(tt.input), io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if handshake.cmd != tt.cmd || handshake.host != tt.host || handshake.port != tt.port {
+			t.Fatalf("unexpected request %x %s:%d", handshake.cmd, handshake.host, handshake.port)
+		}
+	}
+}
+
+func TestDNSCacheStaticEntries(t *testing.T) {
+	lookups := 0
+	static := map[string]net.IP{"internal.example": net.ParseIP("10.0.0.5")}
+	cache := newDNSCacheWithOptions(dnsCacheOptions{
+		TTL: time.Nanosecond,
+		Lookup: func(host string) ([]net.IP, error) {
+			lookups++
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		},
+		StaticEntries: static,
+	})
+	static["internal.example"] = net.ParseIP("10.0.0.6")
+
+	for i := 0; i < 3; i++ {
+		ip, err := cache.Resolve("internal.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Equal(net.ParseIP("10.0.0.5")) {
+			t.Fatalf("static entry should be returned, got %s", ip)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cache.Cleanup()
+	if lookups != 0 {
+		t.Fatalf("static entries should not be looked up, got %d lookups", lookups)
+	}
+
+	if _, err := cache.Resolve("other.example"); err != nil {
+		t.Fatal(err)
+	}
+	if lookups != 1 {
+		t.Fatal("other hosts should still be looked up")
+	}
+	if ip, _ := cache.Resolve("internal.example"); !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatal("static entry should survive cleanup")
+	}
+}
+
+func TestDNSCacheMaxEntriesEvictsLeastRecentlyUsed(t *testing.T) {
+	lookups := map[string]int{}
+	lookup := func(host string) ([]net.IP, error) {
+		lookups[host]++
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	cache := newDNSCacheWithOptions(dnsCacheOptions{TTL: time.Minute, Lookup: lookup, MaxEntries: 3})
+
+	resolve := func(host string) {
+		t.Helper()
+		if _, err := cache.Resolve(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolve("a.example")
+	resolve("b.example")
+	resolve("c.example")
+	// a becomes the most recently used entry, b the least
+	resolve("a.example")
+	resolve("d.example")
+	resolve("e.example")
+
+	if cache.Size() != 3 {
+		t.Fatalf("cache should be capped at 3 entries, got %d", cache.Size())
+	}
+	for _, host := range []string{"b.example", "c.example"} {
+		if _, exists := cache.cache[host]; exists {
+			t.Fatalf("%s should be evicted as least recently used", host)
+		}
+	}
+	for _, host := range []string{"a.example", "d.example", "e.example"} {
+		if _, exists := cache.cache[host]; !exists {
+			t.Fatalf("%s should be kept", host)
+		}
+	}
+	if cache.lru.Len() != len(cache.cache) {
+		t.Fatalf("LRU list and entries are out of sync: %d and %d", cache.lru.Len(), len(cache.cache))
+	}
+	resolve("a.example")
+	if lookups["a.example"] != 1 {
+		t.Fatalf("kept entry should be answered from the cache, got %d lookups", lookups["a.example"])
+	}
+
+	unlimited := newDNSCacheWithOptions(dnsCacheOptions{TTL: time.Minute, Lookup: lookup})
+	for i := 0; i < dnsCacheMaxSize+10; i++ {
+		if _, err := unlimited.Resolve("host" + strconv.Itoa(i) + ".example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if unlimited.Size() != dnsCacheMaxSize+10 {
+		t.Fatalf("zero MaxEntries should not cap the cache, got %d entries", unlimited.Size())
+	}
+	if newDNSCache(time.Minute).maxSize != 0 {
+		t.Fatal("default cache should not be capped")
+	}
+}
+
+func TestDNSCacheResolveContext(t *testing.T) {
+	release := make(chan struct{})
+	var lookups atomic.Int32
+	cache := newDNSCacheWithOptions(dnsCacheOptions{
+		TTL: time.Minute,
+		LookupContext: func(ctx context.Context, host string) ([]net.IP, error) {
+			lookups.Add(1)
+			if host == "slow.example" {
+				select {
+				case <-release:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			}
+			return []net.IP{net.ParseIP("192.0.2.1")}, nil
+		},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cache.ResolveContext(ctx, "slow.example"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("lookup should stop with its context, got %v", err)
+	}
+
+	// A slow lookup holds no lock, other hosts resolve meanwhile
+	slow := make(chan error, 1)
+	go func() {
+		_, err := cache.Resolve("slow.example")
+		slow <- err
+	}()
+	for lookups.Load() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := cache.Resolve("fast.example"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The result of a lookup started before Flush is not cached
+	cache.Flush()
+	close(release)
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+	if cache.Size() != 0 {
+		t.Fatalf("lookup started before Flush should not be cached, got %d entries", cache.Size())
+	}
+}
+
+func TestDNSCacheParallelHits(t *testing.T) {
+	var lookups atomic.Int32
+	lookup := func(host string) ([]net.IP, error) {
+		lookups.Add(1)
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	cache := newDNSCacheWithOptions(dnsCacheOptions{TTL: time.Minute, Lookup: lookup, MaxEntries: 8})
+	hosts := make([]string, 8)
+	for i := range hosts {
+		hosts[i] = "host" + strconv.Itoa(i) + ".example"
+		if _, err := cache.Resolve(hosts[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Hits only take the read lock, misses evict concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				host := hosts[(i+j)%len(hosts)]
+				if j%50 == 0 {
+					host = "miss" + strconv.Itoa(i*1000+j) + ".example"
+				}
+				if _, err := cache.Resolve(host); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if cache.Size() != 8 || cache.lru.Len() != 8 {
+		t.Fatalf("cache should stay capped at 8 entries, got %d entries and %d in the LRU list", cache.Size(), cache.lru.Len())
+	}
+}
+
+func TestDNSCacheFlush(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10, Lookup: lookup})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	for _, host := range []string{"a.example", "b.example", "c.example"} {
+		if _, err := pool.dnsCache.Resolve(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !pool.dnsCache.FlushEntry("a.example") {
+		t.Fatal("FlushEntry should report an existing entry")
+	}
+	if pool.dnsCache.FlushEntry("a.example") {
+		t.Fatal("FlushEntry should report a missing entry")
+	}
+	if pool.dnsCache.Size() != 2 {
+		t.Fatalf("only one entry should be removed, got %d entries", pool.dnsCache.Size())
+	}
+
+	// Deleting a connection purges the DNS entry of its target
+	local, _ := net.Pipe()
+	conn := newUDPConnection(local, &net.UDPAddr{Port: 1}, nil, nil)
+	conn.target = "b.example:53"
+	conn.MarkReadDone()
+	pool.Set("client", conn)
+	pool.Delete("client")
+	if pool.dnsCache.FlushEntry("b.example") {
+		t.Fatal("Delete should flush the DNS entry of the connection target")
+	}
+
+	// as does every other removal, e.g. the eviction of idle connections
+	if _, err := pool.dnsCache.Resolve("b.example"); err != nil {
+		t.Fatal(err)
+	}
+	local, _ = net.Pipe()
+	conn = newUDPConnection(local, &net.UDPAddr{Port: 1}, nil, nil)
+	conn.target = "b.example:53"
+	conn.MarkReadDone()
+	pool.Set("client", conn)
+	pool.Cleanup(0)
+	if pool.dnsCache.FlushEntry("b.example") {
+		t.Fatal("evicting a connection should flush the DNS entry of its target")
+	}
+
+	pool.dnsCache.Flush()
+	if pool.dnsCache.Size() != 0 {
+		t.Fatal("Flush should remove all entries")
+	}
+}
+
+func TestUDPConnectionPoolStats(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10, Lookup: lookup})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	for _, host := range []string{"a.example", "a.example", "b.example", "a.example"} {
+		if _, _, err := pool.resolveTarget(host, 53); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// IP targets do not use the DNS cache
+	if _, _, err := pool.resolveTarget("192.0.2.7", 53); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		local, _ := net.Pipe()
+		conn := newUDPConnection(local, &net.UDPAddr{Port: i + 1}, nil, nil)
+		conn.MarkReadDone()
+		pool.Set(strconv.Itoa(i), conn)
+	}
+	stale, _ := pool.Get("0")
+	stale.lastUsed.Store(udpClockNow() - int64(time.Hour))
+	pool.Cleanup(time.Minute)
+
+	want := udpPoolStats{CurrentConnections: 2, TotalCreated: 3, TotalEvicted: 1, DNSHits: 2, DNSMisses: 2}
+	if got := pool.Stats(); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	pool.ResetStats()
+	if got := pool.Stats(); got != (udpPoolStats{CurrentConnections: 2}) {
+		t.Fatalf("counters should be reset, got %+v", got)
+	}
+}
+
+func TestUDPConnectionPoolSnapshot(t *testing.T) {
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	want := map[string]udpConnInfo{}
+	for i := 0; i < 3; i++ {
+		local, _ := net.Pipe()
+		client := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000 + i}
+		target := &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i+1)), Port: 53}
+		conn := newUDPConnection(local, client, target, target.IP)
+		conn.target = "host" + strconv.Itoa(i) + ".example:53"
+		conn.MarkReadDone()
+		pool.Set(client.String(), conn)
+		want[client.String()] = udpConnInfo{ClientAddr: client.String(), TargetAddr: conn.target, ResolvedIP: target.IP.String()}
+	}
+
+	snapshot := pool.Snapshot()
+	if len(snapshot) != 3 {
+		t.Fatalf("expected 3 connections, got %d", len(snapshot))
+	}
+	for _, info := range snapshot {
+		expected, ok := want[info.ClientAddr]
+		if !ok {
+			t.Fatalf("unexpected connection %+v", info)
+		}
+		if info.TargetAddr != expected.TargetAddr || info.ResolvedIP != expected.ResolvedIP {
+			t.Fatalf("got %+v, want %+v", info, expected)
+		}
+		if info.LastUsed.IsZero() || info.Age < 0 {
+			t.Fatalf("timestamps should be set, got %+v", info)
+		}
+		delete(want, info.ClientAddr)
+	}
+}
+
+func TestUDPConnectionPoolIdleTimeout(t *testing.T) {
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{
+		MaxSize:         10,
+		CleanupInterval: 10 * time.Millisecond,
+		IdleTimeout:     50 * time.Millisecond,
+	})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	local, _ := net.Pipe()
+	conn := newUDPConnection(local, &net.UDPAddr{Port: 1}, nil, nil)
+	conn.MarkReadDone()
+	pool.Set("client", conn)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.currentSize.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection should be closed by the periodic cleanup")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !conn.IsClosed() {
+		t.Fatal("evicted connection should be closed")
+	}
+
+	server := newSocks5UDPServer(socks5UDPConfig{BindAddress: "127.0.0.1:0"}, nil)
+	defer server.cancel()
+	if server.config.MaxConnections != maxUDPConnections {
+		t.Fatalf("zero MaxConnections should default to %d, got %d", maxUDPConnections, server.config.MaxConnections)
+	}
+}
+
+func TestUDPBufferPoolSizeForMTU(t *testing.T) {
+	server := newSocks5UDPServer(socks5UDPConfig{BindAddress: "127.0.0.1:0"}, &VirtualTun{Conf: &DeviceConfig{MTU: 9000}})
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+
+	buf := server.pool.bufPool.get()
+	if len(buf) < 9000+262+48 {
+		t.Fatalf("buffers for MTU 9000 should hold the worst case headers, got %d", len(buf))
+	}
+	server.pool.bufPool.put(buf)
+
+	detected := newSocks5UDPServer(socks5UDPConfig{BindAddress: "127.0.0.1:0"}, &VirtualTun{Conf: &DeviceConfig{}, DetectedMTU: 1420})
+	defer detected.cancel()
+	if size := detected.bufferSize(); size != 1420+262+48 {
+		t.Fatalf("buffers should be sized from the detected MTU, got %d", size)
+	}
+
+	if size := udpBufferSizeForMTU(1000); size != udpBufferSize {
+		t.Fatalf("buffers should not shrink below %d bytes, got %d", udpBufferSize, size)
+	}
+	if got := len(newUDPBufferPool(0).get()); got != udpBufferSize {
+		t.Fatalf("zero size should default to %d bytes, got %d", udpBufferSize, got)
+	}
+}
+
+func TestDNSCachePreferIPv6(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")}, nil
+	}
+
+	for _, tt := range []struct {
+		preferIPv6 bool
+		want       string
+	}{
+		{preferIPv6: false, want: "192.0.2.1"},
+		{preferIPv6: true, want: "2001:db8::1"},
+	} {
+		pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10, Lookup: lookup, PreferIPv6: tt.preferIPv6})
+		_, ip, err := pool.resolveTarget("dual.example", 53)
+		_ = pool.Shutdown(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("PreferIPv6 %v: got %s, want %s", tt.preferIPv6, ip, tt.want)
+		}
+	}
+
+	if ip := pickIP([]net.IP{net.ParseIP("192.0.2.1")}, true); !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatal("IPv4 address should be used when there is no IPv6 address")
+	}
+
+	for _, tt := range []struct {
+		addrs []string
+		want  bool
+	}{
+		{addrs: []string{"fd00::1"}, want: true},
+		{addrs: []string{"10.5.0.2", "fd00::1"}, want: false},
+		{addrs: []string{"10.5.0.2"}, want: false},
+		{addrs: nil, want: false},
+	} {
+		var addrs []netip.Addr
+		for _, addr := range tt.addrs {
+			addrs = append(addrs, netip.MustParseAddr(addr))
+		}
+		if got := ipv6Only(addrs); got != tt.want {
+			t.Errorf("ipv6Only(%v) = %v, want %v", tt.addrs, got, tt.want)
+		}
+	}
+}
+
+func TestSocks5AddrBytes(t *testing.T) {
+	tests := []struct {
+		addr string
+		atyp byte
+		want []byte
+	}{
+		{addr: "10.0.0.1", atyp: 0x01, want: []byte{10, 0, 0, 1}},
+		{addr: "::ffff:10.0.0.1", atyp: 0x01, want: []byte{10, 0, 0, 1}},
+		{addr: "fe80::1%eth0", atyp: 0x04, want: net.ParseIP("fe80::1")},
+		{addr: "2001:db8::1", atyp: 0x04, want: net.ParseIP("2001:db8::1")},
+	}
+
+	for _, tt := range tests {
+		atyp, got := socks5AddrBytes(netip.MustParseAddr(tt.addr))
+		if atyp != tt.atyp || !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got atyp %x address %x", tt.addr, atyp, got)
+		}
+	}
+}
+
+func TestUDPConnectionPoolResize(t *testing.T) {
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	newConn := func(port int) *udpConnection {
+		local, _ := net.Pipe()
+		conn := newUDPConnection(local, &net.UDPAddr{Port: port}, nil, nil)
+		conn.MarkReadDone()
+		return conn
+	}
+
+	for i := 0; i < 6; i++ {
+		conn := newConn(i)
+		conn.lastUsed.Store(udpClockNow() - int64(time.Duration(10-i)*time.Minute))
+		if !pool.Set(strconv.Itoa(i), conn) {
+			t.Fatal("connection should be added")
+		}
+		conn.lastUsed.Store(udpClockNow() - int64(time.Duration(10-i)*time.Minute))
+	}
+
+	if err := pool.Resize(0); err != ErrInvalidPoolSize {
+		t.Fatalf("expected ErrInvalidPoolSize, got %v", err)
+	}
+	if err := pool.Resize(4); err != nil {
+		t.Fatal(err)
+	}
+	if pool.currentSize.Load() != 4 {
+		t.Fatalf("pool should be shrunk to 4 connections, got %d", pool.currentSize.Load())
+	}
+	for _, key := range []string{"0", "1"} {
+		if _, ok := pool.Get(key); ok {
+			t.Fatalf("oldest connection %s should be evicted", key)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(2)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := strconv.Itoa(100 + worker*100 + i)
+				pool.Set(key, newConn(i))
+				pool.Delete(key)
+			}
+		}(worker)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := pool.Resize(1 + (worker+i)%8); err != nil {
+					t.Error(err)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if size := pool.currentSize.Load(); size < 0 || size > pool.maxSize.Load() {
+		t.Fatalf("pool size %d is out of bounds after concurrent resizes (max %d)", size, pool.maxSize.Load())
+	}
+}
+
+func TestDNSCacheBackgroundRefresh(t *testing.T) {
+	var inFlight, maxInFlight, lookups atomic.Int32
+	release := make(chan struct{})
+	lookup := func(host string) ([]net.IP, error) {
+		n := lookups.Add(1)
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			seen := maxInFlight.Load()
+			if current <= seen || maxInFlight.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		if n > 5 {
+			<-release
+		}
+		return []net.IP{net.IPv4(192, 0, 2, byte(n))}, nil
+	}
+
+	cache := newDNSCacheWithOptions(dnsCacheOptions{
+		TTL:                     time.Minute,
+		Lookup:                  lookup,
+		EnableBackgroundRefresh: true,
+		RefreshWorkers:          2,
+	})
+	defer cache.Close()
+
+	hosts := []string{"a.example", "b.example", "c.example", "d.example", "e.example"}
+	initial := make(map[string]net.IP)
+	for _, host := range hosts {
+		ip, err := cache.Resolve(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		initial[host] = ip
+	}
+
+	// Resolving a fresh entry must not schedule a refresh
+	if _, err := cache.Resolve(hosts[0]); err != nil {
+		t.Fatal(err)
+	}
+	if lookups.Load() != 5 {
+		t.Fatalf("fresh entry should not be refreshed, got %d lookups", lookups.Load())
+	}
+
+	cache.mu.Lock()
+	for _, entry := range cache.cache {
+		entry.timestamp = time.Now().Add(-55 * time.Second)
+	}
+	cache.mu.Unlock()
+
+	for _, host := range hosts {
+		ip, err := cache.Resolve(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ip.Equal(initial[host]) {
+			t.Fatal("entry near expiry should still be served from the cache")
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if maxInFlight.Load() > 2 {
+		t.Fatalf("at most 2 concurrent refreshes expected, got %d", maxInFlight.Load())
+	}
+	close(release)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for _, host := range hosts {
+		for {
+			cache.mu.RLock()
+			refreshed := !cache.cache[host].ip.Equal(initial[host])
+			cache.mu.RUnlock()
+			if refreshed {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was not refreshed in the background", host)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if lookups.Load() != 10 {
+		t.Fatalf("each entry should be refreshed once, got %d lookups", lookups.Load())
+	}
+}
+
+func TestHandleUDPPacketRecyclesConnectionOnTargetChange(t *testing.T) {
+	_, vtA, vtB := newTestTunnelPair(t)
+
+	listen := func(port uint16) net.PacketConn {
+		conn, err := vtB.Tnet.ListenUDPAddrPort(netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		return conn
+	}
+	targetA, targetB := listen(7001), listen(7002)
+
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	packet := func(port uint16, payload string) []byte {
+		return append([]byte{0x00, 0x00, 0x00, 0x01, 10, 0, 0, 2, byte(port >> 8), byte(port)}, payload...)
+	}
+	receive := func(conn net.PacketConn, want string) {
+		t.Helper()
+		buf := make([]byte, 64)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != want {
+			t.Fatalf("got %q, want %q", buf[:n], want)
+		}
+	}
+	current := func() *udpConnection {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if conn, ok := pool.Get(clientAddr.String()); ok {
+				return conn
+			}
+		}
+		t.Fatal("connection was not created")
+		return nil
+	}
+
+	handleUDPPacket(serverConn, clientAddr, packet(7001, "to A"), vtA, pool)
+	receive(targetA, "to A")
+	first := current()
+
+	handleUDPPacket(serverConn, clientAddr, packet(7002, "to B"), vtA, pool)
+	receive(targetB, "to B")
+	second := current()
+
+	if first == second {
+		t.Fatal("a new connection should be created for a different target")
+	}
+	if !first.IsClosed() {
+		t.Fatal("connection to the previous target should be closed")
+	}
+	if second.target != "10.0.0.2:7002" || pool.currentSize.Load() != 1 {
+		t.Fatalf("pool should hold only the connection to the new target, got %s and size %d", second.target, pool.currentSize.Load())
+	}
+
+	// Reader of the replaced connection exits without removing its replacement
+	time.Sleep(50 * time.Millisecond)
+	if conn, ok := pool.Get(clientAddr.String()); !ok || conn != second {
+		t.Fatal("replacement connection should stay in the pool")
+	}
+}
+
+func TestHandleUDPPacketKeyByClientAndTarget(t *testing.T) {
+	_, vtA, vtB := newTestTunnelPair(t)
+
+	targets := make([]net.PacketConn, 2)
+	for i := range targets {
+		conn, err := vtB.Tnet.ListenUDPAddrPort(netip.AddrPortFrom(netip.MustParseAddr("10.0.0.2"), uint16(7001+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		targets[i] = conn
+	}
+
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10, KeyFunc: UDPKeyByClientAndTarget})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	clientAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	for i, target := range targets {
+		port := uint16(7001 + i)
+		handleUDPPacket(serverConn, clientAddr, []byte{0x00, 0x00, 0x00, 0x01, 10, 0, 0, 2, byte(port >> 8), byte(port), 'x'}, vtA, pool)
+
+		buf := make([]byte, 64)
+		_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := target.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, ok := pool.Get(UDPKeyByClientAndTarget(clientAddr, "10.0.0.2", 7001))
+	if !ok || first.IsClosed() {
+		t.Fatal("connection to the first target should stay open")
+	}
+	if _, ok := pool.Get(UDPKeyByClientAndTarget(clientAddr, "10.0.0.2", 7002)); !ok {
+		t.Fatal("connection to the second target should be in the pool")
+	}
+	if pool.currentSize.Load() != 2 {
+		t.Fatalf("one connection per target expected, got %d", pool.currentSize.Load())
+	}
+	if UDPKeyByClient(clientAddr, "10.0.0.2", 7001) != UDPKeyByClient(clientAddr, "10.0.0.2", 7002) {
+		t.Fatal("UDPKeyByClient should not depend on the target")
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// scriptedConn returns the queued read results in order and times out afterwards
+type scriptedConn struct {
+	net.Conn
+	mu      sync.Mutex
+	results []func(b []byte) (int, error)
+	repeat  error
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.results) > 0 {
+		result := c.results[0]
+		c.results = c.results[1:]
+		return result(b)
+	}
+	if c.repeat != nil {
+		return 0, c.repeat
+	}
+	time.Sleep(10 * time.Millisecond)
+	return 0, timeoutError{}
+}
+
+func (c *scriptedConn) SetReadDeadline(time.Time) error { return nil }
+func (c *scriptedConn) Close() error                    { return nil }
+
+func TestUDPReaderRetriesTransientErrors(t *testing.T) {
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	refused := errors.New("connection refused")
+	newConn := func(key string, target *scriptedConn) *udpConnection {
+		conn := newUDPConnection(target, client.LocalAddr().(*net.UDPAddr), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53}, net.IPv4(192, 0, 2, 1))
+		if !pool.Set(key, conn) || !pool.spawnReader(conn, serverConn, key) {
+			t.Fatal("connection should be added")
+		}
+		return conn
+	}
+
+	transient := newConn("transient", &scriptedConn{results: []func([]byte) (int, error){
+		func([]byte) (int, error) { return 0, refused },
+		func([]byte) (int, error) { return 0, refused },
+		func(b []byte) (int, error) { return copy(b, "hello"), nil },
+	}})
+
+	buf := make([]byte, 64)
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(buf[:n], []byte("hello")) {
+		t.Fatalf("unexpected response %q", buf[:n])
+	}
+	if conn, ok := pool.Get("transient"); !ok || conn != transient {
+		t.Fatal("connection should survive transient read errors")
+	}
+
+	start := time.Now()
+	failing := newConn("failing", &scriptedConn{repeat: refused})
+	select {
+	case <-failing.readDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reader should stop after repeated read errors")
+	}
+	if elapsed := time.Since(start); elapsed < udpReaderBackoff*3 {
+		t.Fatalf("reader should back off between errors, stopped after %s", elapsed)
+	}
+	if _, ok := pool.Get("failing"); ok {
+		t.Fatal("connection with repeated read errors should be removed")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent loggers
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+func TestUDPConnectionPoolFinalizerWarnsWithoutShutdown(t *testing.T) {
+	logs := &syncBuffer{}
+	errorLogger.SetOutput(logs)
+	defer errorLogger.SetOutput(os.Stderr)
+
+	func() {
+		pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+		local, _ := net.Pipe()
+		conn := newUDPConnection(local, &net.UDPAddr{Port: 1}, nil, nil)
+		conn.MarkReadDone()
+		pool.Set("leaked", conn)
+	}()
+
+	for i := 0; i < 50 && !strings.Contains(logs.String(), "without Shutdown"); i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "UDP connection pool with 1 connections was garbage collected without Shutdown") {
+		t.Fatalf("dropped pool should be reported, got %q", logs.String())
+	}
+
+	logs.Reset()
+	func() {
+		pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+		_ = pool.Shutdown(time.Second)
+	}()
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if strings.Contains(logs.String(), "without Shutdown") {
+		t.Fatalf("pool that was shut down should not be reported, got %q", logs.String())
+	}
+}
+
+func TestSocks5TCPServerBind(t *testing.T) {
+	_, vtA, vtB := newTestTunnelPair(t)
+
+	server := newSocks5TCPServer("127.0.0.1:0", vtA, "", "")
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+
+	bind := func() (net.Conn, netip.AddrPort) {
+		t.Helper()
+		client, err := net.Dial("tcp", server.listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+		_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+
+		if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+			t.Fatal(err)
+		}
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(client, greeting); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write([]byte{0x05, 0x02, 0x00, 0x01, 10, 0, 0, 2, 0x00, 0x00}); err != nil {
+			t.Fatal(err)
+		}
+		return client, readSocks5Reply(t, client)
+	}
+
+	client, bound := bind()
+	if bound.Addr() != netip.MustParseAddr("10.0.0.1") || bound.Port() == 0 {
+		t.Fatalf("BIND should listen on the tunnel address, got %s", bound)
+	}
+
+	peer, err := vtB.Tnet.DialContextTCPAddrPort(context.Background(), bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = peer.Close() }()
+
+	source := readSocks5Reply(t, client)
+	if source.String() != peer.LocalAddr().String() {
+		t.Fatalf("second reply should carry the source of the inbound connection %s, got %s", peer.LocalAddr(), source)
+	}
+
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("client data should reach the inbound connection, got %q, %v", buf, err)
+	}
+	if _, err := peer.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("inbound data should reach the client, got %q, %v", buf, err)
+	}
+
+	server.bindTimeout = 50 * time.Millisecond
+	client, _ = bind()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x06 {
+		t.Fatalf("BIND without inbound connection should time out, got reply %x", reply)
+	}
+}
+
+// readSocks5Reply reads a SOCKS5 command reply with an IPv4 address and fails on an error code
+func TestSocks5TCPServerConnectTimeout(t *testing.T) {
+	server := newSocks5TCPServer("127.0.0.1:0", &VirtualTun{}, "", "")
+	server.dialTimeout = 100 * time.Millisecond
+	dialed := make(chan bool, 1)
+	server.dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		_, hasDeadline := ctx.Deadline()
+		dialed <- hasDeadline
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+
+	client, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(client, greeting); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := client.Write([]byte{0x05, 0x01, 0x00, 0x01, 10, 0, 0, 2, 0x00, 0x50}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x04 {
+		t.Fatalf("timed out CONNECT should reply host unreachable, got %x", reply)
+	}
+	if !<-dialed {
+		t.Fatal("dial should be given a deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("CONNECT should fail after the dial timeout, took %s", elapsed)
+	}
+}
+
+func TestRelayTCPWithTimeoutsOneWay(t *testing.T) {
+	client, conn := net.Pipe()
+	target, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relayTCPWithTimeouts(conn, target, 200*time.Millisecond, time.Second)
+	}()
+
+	// only the target sends, for longer than the read timeout of the client side
+	go func() {
+		for i := 0; i < 10; i++ {
+			if _, err := server.Write([]byte("chunk")); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	buf := make([]byte, 5)
+	for i := 0; i < 10; i++ {
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatalf("one-way transfer should not time out, chunk %d: %v", i, err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("relay should stop once both directions are idle")
+	}
+	if _, err := client.Read(buf); err == nil {
+		t.Fatal("client connection should be closed")
+	}
+}
+
+func readSocks5Reply(t *testing.T, conn net.Conn) netip.AddrPort {
+	t.Helper()
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[0] != 0x05 || reply[1] != 0x00 || reply[3] != 0x01 {
+		t.Fatalf("unexpected reply %x", reply)
+	}
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(reply[4:8])), binary.BigEndian.Uint16(reply[8:]))
+}
+
+func TestCleanupOldestReordersRecentlyUsed(t *testing.T) {
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	conns := make([]*udpConnection, 4)
+	for i := range conns {
+		local, _ := net.Pipe()
+		conns[i] = newUDPConnection(local, &net.UDPAddr{Port: i + 1}, nil, nil)
+		conns[i].MarkReadDone()
+		pool.Set(strconv.Itoa(i), conns[i])
+	}
+	// used after it was ordered in the heap, it must not be taken for the oldest
+	conns[0].UpdateLastUsed()
+
+	pool.mu.Lock()
+	pool.cleanupOldestLocked(2)
+	pool.mu.Unlock()
+
+	for i, want := range []bool{true, false, false, true} {
+		if _, ok := pool.Get(strconv.Itoa(i)); ok != want {
+			t.Fatalf("connection %d kept: %v, want %v", i, ok, want)
+		}
+	}
+	if len(pool.byAge) != len(pool.connections) {
+		t.Fatalf("heap and map should hold the same connections, got %d and %d", len(pool.byAge), len(pool.connections))
+	}
+}
+
+func TestCleanupOldestSkipsClosed(t *testing.T) {
+	pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: 10})
+	defer func() { _ = pool.Shutdown(time.Second) }()
+
+	conns := make([]*udpConnection, 5)
+	for i := range conns {
+		local, _ := net.Pipe()
+		conns[i] = newUDPConnection(local, &net.UDPAddr{Port: i + 1}, nil, nil)
+		conns[i].MarkReadDone()
+		pool.Set(strconv.Itoa(i), conns[i])
+		time.Sleep(time.Millisecond)
+	}
+	conns[0].Close()
+
+	pool.mu.Lock()
+	pool.cleanupOldestLocked(2)
+	pool.mu.Unlock()
+
+	if evicted := pool.metrics.ConnectionsEvicted.Load(); evicted != 2 {
+		t.Fatalf("only open connections should count as evicted, got %d", evicted)
+	}
+	for i, want := range []bool{false, false, false, true, true} {
+		if _, ok := pool.Get(strconv.Itoa(i)); ok != want {
+			t.Fatalf("connection %d kept: %v, want %v", i, ok, want)
+		}
+	}
+	if len(pool.connections) != 2 {
+		t.Fatalf("closed connection should be removed from the pool, %d left", len(pool.connections))
+	}
+}
+
+// oldestKeysLinear is the former O(n) selection of cleanupOldestLocked, kept for BenchmarkCleanupOldest
+func oldestKeysLinear(connections map[string]*udpConnection, count int) []string {
+	type keyTime struct {
+		key string
+		t   time.Time
+	}
+
+	oldest := make([]keyTime, 0, count)
+	for key, conn := range connections {
+		if len(oldest) < count {
+			oldest = append(oldest, keyTime{key: key, t: conn.LastUsed()})
+			continue
+		}
+		maxIdx := 0
+		for i := 1; i < len(oldest); i++ {
+			if oldest[maxIdx].t.Before(oldest[i].t) {
+				maxIdx = i
+			}
+		}
+		if conn.LastUsed().Before(oldest[maxIdx].t) {
+			oldest[maxIdx] = keyTime{key: key, t: conn.LastUsed()}
+		}
+	}
+
+	keys := make([]string, 0, len(oldest))
+	for _, kt := range oldest {
+		keys = append(keys, kt.key)
+	}
+	return keys
+}
+
+// BenchmarkCleanupOldest evicts a quarter of a full pool, as Set does when the pool overflows
+func BenchmarkCleanupOldest(b *testing.B) {
+	fill := func(pool *udpConnectionPool, size int) {
+		for pool.currentSize.Load() < int32(size) {
+			local, _ := net.Pipe()
+			conn := newUDPConnection(local, &net.UDPAddr{Port: 1}, nil, nil)
+			conn.MarkReadDone()
+			pool.Set(strconv.FormatUint(uint64(pool.metrics.ConnectionsCreated.Load()), 10), conn)
+		}
+	}
+
+	for _, size := range []int{1000, 10000} {
+		b.Run("linear/"+strconv.Itoa(size), func(b *testing.B) {
+			pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: size})
+			defer func() { _ = pool.Shutdown(time.Second) }()
+			fill(pool, size)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = oldestKeysLinear(pool.connections, size/4)
+			}
+		})
+		b.Run("heap/"+strconv.Itoa(size), func(b *testing.B) {
+			pool := newUDPConnectionPool(udpConnectionPoolOptions{MaxSize: size})
+			defer func() { _ = pool.Shutdown(time.Second) }()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				fill(pool, size)
+				b.StartTimer()
+				pool.mu.Lock()
+				pool.cleanupOldestLocked(size / 4)
+				pool.mu.Unlock()
+			}
+		})
+	}
+}
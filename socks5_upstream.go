@@ -0,0 +1,260 @@
+package wireproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+)
+
+// upstreamSOCKS5Timeout bounds the setup of the UDP association with the upstream proxy
+const upstreamSOCKS5Timeout = 10 * time.Second
+
+// Credentials are the user name and password of a SOCKS5 proxy, see RFC 1929
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// socks5UpstreamBind is a conn.Bind that relays the packets of the device through the
+// UDP ASSOCIATE command of an upstream SOCKS5 proxy, see DeviceConfig.UpstreamSOCKS5.
+// golang.org/x/net/proxy only implements CONNECT, which cannot carry the UDP packets
+// of WireGuard, so the association is requested here. The relay lasts as long as the
+// TCP connection that requested it
+type socks5UpstreamBind struct {
+	proxyAddr string
+	auth      *Credentials
+
+	mu      sync.Mutex
+	control net.Conn
+	conn    *net.UDPConn
+	relay   netip.AddrPort
+}
+
+var _ conn.Bind = (*socks5UpstreamBind)(nil)
+
+func newSOCKS5UpstreamBind(proxyAddr string, auth *Credentials) *socks5UpstreamBind {
+	return &socks5UpstreamBind{proxyAddr: proxyAddr, auth: auth}
+}
+
+// Open listens on port and asks the proxy for a UDP relay for it
+func (b *socks5UpstreamBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(port)})
+	if err != nil {
+		return nil, 0, err
+	}
+	control, relay, err := b.associate()
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, 0, err
+	}
+	b.control, b.conn, b.relay = control, udpConn, relay
+
+	// the proxy drops the relay once the control connection closes, which nothing
+	// is sent on after the handshake
+	go func() {
+		_, _ = io.Copy(io.Discard, control)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.control == control {
+			errorLogger.Printf("Warning: upstream SOCKS5 proxy %s closed the UDP association\n", b.proxyAddr)
+		}
+	}()
+
+	actualPort := uint16(udpConn.LocalAddr().(*net.UDPAddr).Port)
+	return []conn.ReceiveFunc{b.receiveFunc(udpConn, relay)}, actualPort, nil
+}
+
+// associate connects to the proxy, authenticates and requests a UDP relay
+func (b *socks5UpstreamBind) associate() (net.Conn, netip.AddrPort, error) {
+	control, err := net.DialTimeout("tcp", b.proxyAddr, upstreamSOCKS5Timeout)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	_ = control.SetDeadline(time.Now().Add(upstreamSOCKS5Timeout))
+
+	relay, err := b.handshake(control)
+	if err != nil {
+		_ = control.Close()
+		return nil, netip.AddrPort{}, errors.New("upstream SOCKS5 proxy " + b.proxyAddr + ": " + err.Error())
+	}
+	_ = control.SetDeadline(time.Time{})
+
+	// a relay on an unspecified address is reached at the address of the proxy
+	if relay.Addr().IsUnspecified() {
+		relay = netip.AddrPortFrom(control.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(), relay.Port())
+	}
+	return control, netip.AddrPortFrom(relay.Addr().Unmap(), relay.Port()), nil
+}
+
+func (b *socks5UpstreamBind) handshake(control net.Conn) (netip.AddrPort, error) {
+	method := byte(socks5MethodNoAuth)
+	if b.auth != nil {
+		method = socks5MethodUserPass
+	}
+	if _, err := control.Write([]byte{socks5Version, 1, method}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(control, reply); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return netip.AddrPort{}, errors.New("authentication method not accepted")
+	}
+
+	if b.auth != nil {
+		if len(b.auth.Username) > 255 || len(b.auth.Password) > 255 {
+			return netip.AddrPort{}, errors.New("user name and password must be at most 255 bytes")
+		}
+		request := []byte{socks5AuthVersion, byte(len(b.auth.Username))}
+		request = append(request, b.auth.Username...)
+		request = append(request, byte(len(b.auth.Password)))
+		request = append(request, b.auth.Password...)
+		if _, err := control.Write(request); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.ReadFull(control, reply); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if reply[1] != 0x00 {
+			return netip.AddrPort{}, errors.New("authentication failed")
+		}
+	}
+
+	// the packets come from an address the proxy cannot know in advance behind NAT,
+	// so the request leaves it unspecified
+	if _, err := control.Write([]byte{socks5Version, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(control, header); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if header[0] != socks5Version {
+		return netip.AddrPort{}, errors.New("invalid reply version " + strconv.Itoa(int(header[0])))
+	}
+	if header[1] != 0x00 {
+		return netip.AddrPort{}, errors.New("UDP ASSOCIATE failed with code " + strconv.Itoa(int(header[1])))
+	}
+
+	var addrLen int
+	switch header[3] {
+	case 0x01:
+		addrLen = 4
+	case 0x04:
+		addrLen = 16
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(control, length); err != nil {
+			return netip.AddrPort{}, err
+		}
+		addrLen = int(length[0])
+	default:
+		return netip.AddrPort{}, errors.New("invalid address type " + strconv.Itoa(int(header[3])))
+	}
+	addr := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(control, addr); err != nil {
+		return netip.AddrPort{}, err
+	}
+	port := binary.BigEndian.Uint16(addr[addrLen:])
+	if header[3] == 0x03 {
+		relay, err := net.ResolveUDPAddr("udp", net.JoinHostPort(string(addr[:addrLen]), strconv.Itoa(int(port))))
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		return relay.AddrPort(), nil
+	}
+	ip, _ := netip.AddrFromSlice(addr[:addrLen])
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+// receiveFunc reads the packets the relay sends back and strips their SOCKS5 header
+func (b *socks5UpstreamBind) receiveFunc(udpConn *net.UDPConn, relay netip.AddrPort) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		for {
+			n, from, err := udpConn.ReadFromUDPAddrPort(packets[0])
+			if err != nil {
+				return 0, err
+			}
+			if netip.AddrPortFrom(from.Addr().Unmap(), from.Port()) != relay {
+				continue
+			}
+			host, port, headerLen, ok := parseSocks5UDPHeader(packets[0][:n])
+			// fragments are not used by WireGuard packets, see RFC 1928 section 7
+			if !ok || packets[0][2] != 0x00 {
+				continue
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				continue
+			}
+			sizes[0] = copy(packets[0], packets[0][headerLen:n])
+			eps[0] = &conn.StdNetEndpoint{AddrPort: netip.AddrPortFrom(addr.Unmap(), port)}
+			return 1, nil
+		}
+	}
+}
+
+// Close ends the UDP association
+func (b *socks5UpstreamBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn == nil {
+		return nil
+	}
+	err := errors.Join(b.conn.Close(), b.control.Close())
+	b.control, b.conn, b.relay = nil, nil, netip.AddrPort{}
+	return err
+}
+
+// SetMark has no effect, the packets leave through the proxy
+func (b *socks5UpstreamBind) SetMark(mark uint32) error {
+	return nil
+}
+
+// Send writes the packets to the relay with the SOCKS5 header of their destination
+func (b *socks5UpstreamBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	udpConn, relay := b.conn, b.relay
+	b.mu.Unlock()
+	if udpConn == nil {
+		return net.ErrClosed
+	}
+
+	atyp, addr := socks5AddrBytes(ep.DstIP())
+	header := append([]byte{0x00, 0x00, 0x00, atyp}, addr...)
+	header = binary.BigEndian.AppendUint16(header, ep.(*conn.StdNetEndpoint).Port())
+	for _, buf := range bufs {
+		if _, err := udpConn.WriteToUDPAddrPort(append(header[:len(header):len(header)], buf...), relay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseEndpoint parses the ip:port endpoint of a peer
+func (b *socks5UpstreamBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())}, nil
+}
+
+// BatchSize is 1, packets are read one by one
+func (b *socks5UpstreamBind) BatchSize() int {
+	return 1
+}
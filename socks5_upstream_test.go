@@ -0,0 +1,144 @@
+package wireproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/conn"
+)
+
+// startUDPAssociateProxy runs a SOCKS5 proxy that only accepts UDP ASSOCIATE with the
+// user name and password user:pass, and relays the datagrams on the local network
+func startUDPAssociateProxy(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		control, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = control.Close() }()
+
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(control, greeting); err != nil || greeting[2] != socks5MethodUserPass {
+			return
+		}
+		_, _ = control.Write([]byte{socks5Version, socks5MethodUserPass})
+		auth := make([]byte, 1+1+4+1+4)
+		if _, err := io.ReadFull(control, auth); err != nil || string(auth[2:6]) != "user" || string(auth[7:]) != "pass" {
+			_, _ = control.Write([]byte{socks5AuthVersion, 0x01})
+			return
+		}
+		_, _ = control.Write([]byte{socks5AuthVersion, 0x00})
+		request := make([]byte, 10)
+		if _, err := io.ReadFull(control, request); err != nil || request[1] != 0x03 {
+			return
+		}
+
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer func() { _ = relay.Close() }()
+		// an unspecified address means the address of the proxy
+		_, _ = control.Write(socks5Reply(0x00, netip.AddrPortFrom(netip.IPv4Unspecified(), relay.LocalAddr().(*net.UDPAddr).AddrPort().Port())))
+
+		go func() {
+			var client netip.AddrPort
+			buf := make([]byte, 2048)
+			for {
+				n, from, err := relay.ReadFromUDPAddrPort(buf)
+				if err != nil {
+					return
+				}
+				if host, port, headerLen, ok := parseSocks5UDPHeader(buf[:n]); ok {
+					client = from
+					_, _ = relay.WriteToUDPAddrPort(buf[headerLen:n], netip.AddrPortFrom(netip.MustParseAddr(host), port))
+					continue
+				}
+				atyp, addr := socks5AddrBytes(from.Addr())
+				packet := append([]byte{0x00, 0x00, 0x00, atyp}, addr...)
+				packet = binary.BigEndian.AppendUint16(packet, from.Port())
+				_, _ = relay.WriteToUDPAddrPort(append(packet, buf[:n]...), client)
+			}
+		}()
+		_, _ = io.Copy(io.Discard, control)
+	}()
+	return listener.Addr().String()
+}
+
+func TestSOCKS5UpstreamBind(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = echo.Close() }()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(append([]byte("echo "), buf[:n]...), from)
+		}
+	}()
+
+	bind := newSOCKS5UpstreamBind(startUDPAssociateProxy(t), &Credentials{Username: "user", Password: "pass"})
+	fns, _, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = bind.Close() }()
+
+	ep, err := bind.ParseEndpoint(echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bind.Send([][]byte{[]byte("handshake")}, ep); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan error, 1)
+	packets, sizes, eps := [][]byte{make([]byte, 2048)}, make([]int, 1), make([]conn.Endpoint, 1)
+	go func() {
+		_, err := fns[0](packets, sizes, eps)
+		received <- err
+	}()
+	select {
+	case err := <-received:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet received through the relay")
+	}
+	if !bytes.Equal(packets[0][:sizes[0]], []byte("echo handshake")) {
+		t.Fatalf("unexpected packet %q", packets[0][:sizes[0]])
+	}
+	if eps[0].DstToString() != echo.LocalAddr().String() {
+		t.Fatalf("packet should come from the peer, got %s", eps[0].DstToString())
+	}
+
+	if err := bind.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fns[0](packets, sizes, eps); err == nil {
+		t.Fatal("receive should fail once the bind is closed")
+	}
+
+	wrongAuth := newSOCKS5UpstreamBind(startUDPAssociateProxy(t), &Credentials{Username: "user", Password: "nope"})
+	if _, _, err := wrongAuth.Open(0); err == nil {
+		t.Fatal("rejected credentials should fail to open the bind")
+	}
+}
@@ -0,0 +1,27 @@
+package wireproxy
+
+import (
+	"bytes"
+	"text/template"
+)
+
+// ParseTemplate renders tmpl with text/template using vars and parses the result as a
+// configuration file. @include lines are not expanded and a WGConfig path is
+// resolved from the working directory
+func ParseTemplate(tmpl string, vars map[string]interface{}) (*DeviceConfig, error) {
+	t, err := template.New("config").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	if err := t.Execute(&rendered, vars); err != nil {
+		return nil, err
+	}
+
+	conf, err := parseConfigSource(rendered.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return conf.Device, nil
+}
@@ -0,0 +1,126 @@
+package wireproxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// viperInterfaceKeys maps Viper keys to the [Interface] keys of a configuration file
+var viperInterfaceKeys = []struct {
+	key    string
+	iniKey string
+}{
+	{"wireguard.privateKey", "PrivateKey"},
+	{"wireguard.address", "Address"},
+	{"wireguard.dns", "DNS"},
+	{"wireguard.mtu", "MTU"},
+	{"wireguard.listenPort", "ListenPort"},
+	{"wireguard.checkAlive", "CheckAlive"},
+	{"wireguard.checkAliveInterval", "CheckAliveInterval"},
+	{"awg.mode", "Mode"},
+	{"awg.jc", "Jc"},
+	{"awg.jmin", "Jmin"},
+	{"awg.jmax", "Jmax"},
+	{"awg.s1", "S1"},
+	{"awg.s2", "S2"},
+	{"awg.s3", "S3"},
+	{"awg.s4", "S4"},
+	{"awg.h1", "H1"},
+	{"awg.h2", "H2"},
+	{"awg.h3", "H3"},
+	{"awg.h4", "H4"},
+	{"awg.i1", "I1"},
+	{"awg.i2", "I2"},
+	{"awg.i3", "I3"},
+	{"awg.i4", "I4"},
+	{"awg.i5", "I5"},
+}
+
+// viperPeer is a single entry of the wireguard.peers list
+type viperPeer struct {
+	PublicKey           string   `mapstructure:"publicKey"`
+	PresharedKey        string   `mapstructure:"presharedKey"`
+	Endpoint            string   `mapstructure:"endpoint"`
+	PersistentKeepalive int      `mapstructure:"persistentKeepalive"`
+	AllowedIPs          []string `mapstructure:"allowedIPs"`
+}
+
+// NewViperBackedConfig reads the device configuration from a Viper instance, so it can
+// come from any Viper backend such as TOML, YAML or environment variables.
+// Interface settings live under wireguard (wireguard.privateKey, wireguard.address, ...),
+// AWG parameters under awg (awg.jc, awg.h1, ...) and peers in the wireguard.peers list.
+// The values go through the same parsing and validation as a configuration file
+func NewViperBackedConfig(v *viper.Viper) (*DeviceConfig, error) {
+	var source strings.Builder
+	source.WriteString("[Interface]\n")
+	for _, mapping := range viperInterfaceKeys {
+		if !v.IsSet(mapping.key) {
+			continue
+		}
+		if err := writeViperValue(&source, mapping.iniKey, viperString(v, mapping.key)); err != nil {
+			return nil, err
+		}
+	}
+
+	var peers []viperPeer
+	if err := v.UnmarshalKey("wireguard.peers", &peers); err != nil {
+		return nil, fmt.Errorf("wireguard.peers: %w", err)
+	}
+	for _, peer := range peers {
+		source.WriteString("\n[Peer]\n")
+		keepalive := ""
+		if peer.PersistentKeepalive != 0 {
+			keepalive = strconv.Itoa(peer.PersistentKeepalive)
+		}
+		values := []struct {
+			key   string
+			value string
+		}{
+			{"PublicKey", peer.PublicKey},
+			{"PresharedKey", peer.PresharedKey},
+			{"Endpoint", peer.Endpoint},
+			{"PersistentKeepalive", keepalive},
+			{"AllowedIPs", strings.Join(peer.AllowedIPs, ",")},
+		}
+		for _, value := range values {
+			if value.value == "" {
+				continue
+			}
+			if err := writeViperValue(&source, value.key, value.value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	conf, err := parseConfigSource([]byte(source.String()))
+	if err != nil {
+		return nil, err
+	}
+	return conf.Device, nil
+}
+
+// viperString returns a Viper value as a configuration file value, lists are comma separated
+func viperString(v *viper.Viper, key string) string {
+	if values, ok := v.Get(key).([]interface{}); ok {
+		parts := make([]string, 0, len(values))
+		for _, value := range values {
+			parts = append(parts, fmt.Sprint(value))
+		}
+		return strings.Join(parts, ",")
+	}
+	return v.GetString(key)
+}
+
+// writeViperValue writes a key of the generated configuration file, rejecting values
+// that would start a new line
+func writeViperValue(source *strings.Builder, key string, value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return errors.New("value of " + key + " must not contain line breaks")
+	}
+	fmt.Fprintf(source, "%s = %s\n", key, value)
+	return nil
+}
@@ -0,0 +1,77 @@
+package wireproxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestNewViperBackedConfig(t *testing.T) {
+	const config = `
+[wireguard]
+privateKey = "LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0="
+address = ["10.5.0.2", "fd00::2"]
+dns = "1.1.1.1"
+mtu = 1280
+
+[[wireguard.peers]]
+publicKey = "e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w="
+endpoint = "94.140.11.15:51820"
+persistentKeepalive = 25
+allowedIPs = ["0.0.0.0/0", "::/0"]
+
+[awg]
+jc = 5
+jmin = 10
+jmax = 50
+h1 = "100-200"
+h2 = 300
+`
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := NewViperBackedConfig(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := ParseTemplate(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2, fd00::2
+DNS = 1.1.1.1
+MTU = 1280
+Jc = 5
+Jmin = 10
+Jmax = 50
+H1 = 100-200
+H2 = 300
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+PersistentKeepalive = 25
+AllowedIPs = 0.0.0.0/0, ::/0
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.Equal(expected) {
+		t.Fatalf("unexpected configuration: %v", conf)
+	}
+
+	v.Set("awg.jc", 0)
+	if _, err := NewViperBackedConfig(v); err == nil {
+		t.Fatal("invalid AWG parameters should be rejected")
+	}
+
+	v.Set("awg.jc", 5)
+	v.Set("wireguard.dns", "1.1.1.1\n[Peer]")
+	if _, err := NewViperBackedConfig(v); err == nil {
+		t.Fatal("values with line breaks should be rejected")
+	}
+}
@@ -0,0 +1,65 @@
+package wireproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"time"
+)
+
+// configWatcher keeps the state needed to detect changes of a configuration file
+type configWatcher struct {
+	path     string
+	lastHash [sha256.Size]byte
+}
+
+// poll re-parses the configuration only if the file content changed since the last poll
+func (w *configWatcher) poll() (*Configuration, bool, error) {
+	source, err := loadConfigSource(w.path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hash := sha256.Sum256(source)
+	if hash == w.lastHash {
+		return nil, false, nil
+	}
+	w.lastHash = hash
+
+	conf, err := ParseConfig(w.path)
+	if err != nil {
+		return nil, true, err
+	}
+	return conf, true, nil
+}
+
+// WatchConfig polls the configuration file at path every interval and calls onChange
+// with the parsed configuration whenever the file content changes.
+// Included files are part of the watched content, the file referenced by WGConfig is not.
+// It blocks until ctx is cancelled
+func WatchConfig(ctx context.Context, path string, interval time.Duration, onChange func(*Configuration)) error {
+	watcher := &configWatcher{path: path}
+	source, err := loadConfigSource(path)
+	if err != nil {
+		return err
+	}
+	watcher.lastHash = sha256.Sum256(source)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			conf, changed, err := watcher.poll()
+			if err != nil {
+				errorLogger.Printf("Failed to reload configuration %s: %s\n", path, err.Error())
+				continue
+			}
+			if changed {
+				onChange(conf)
+			}
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package wireproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigWatcherSkipsUnchangedContent(t *testing.T) {
+	const config = `
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+DNS = 1.1.1.1
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+AllowedIPs = 0.0.0.0/0
+Endpoint = 94.140.11.15:51820
+`
+	path := filepath.Join(t.TempDir(), "wireproxy.conf")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher := &configWatcher{path: path}
+
+	conf, changed, err := watcher.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || conf == nil {
+		t.Fatal("first poll should parse the configuration")
+	}
+
+	conf, changed, err = watcher.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed || conf != nil {
+		t.Fatal("unchanged configuration should not be parsed again")
+	}
+
+	if err := os.WriteFile(path, []byte(config+"PersistentKeepalive = 25\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, changed, err = watcher.poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || conf == nil {
+		t.Fatal("modified configuration should be parsed")
+	}
+	if conf.Device.Peers[0].KeepAlive != 25 {
+		t.Fatal("modified configuration should be returned")
+	}
+}
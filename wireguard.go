@@ -2,13 +2,19 @@ package wireproxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	"net/netip"
 
-	"github.com/MakeNowJust/heredoc/v2"
 	"github.com/amnezia-vpn/amneziawg-go/conn"
 	"github.com/amnezia-vpn/amneziawg-go/device"
 	"github.com/amnezia-vpn/amneziawg-go/tun/netstack"
@@ -16,148 +22,548 @@ import (
 
 // DeviceSetting contains the parameters for setting up a tun interface
 type DeviceSetting struct {
-	IpcRequest string
-	DNS        []netip.Addr
-	DeviceAddr []netip.Addr
-	MTU        int
+	IpcRequest    string     // IPC serialized
+	IPC           *IPCFields // structured form of IpcRequest
+	DNS           []netip.Addr
+	SearchDomains []string // not part of the IPC request, used by the tunnel resolver
+	DeviceAddr    []netip.Addr
+	MTU           int
 }
 
-// CreateIPCRequest serialize the config into an IPC request and DeviceSetting
-func CreateIPCRequest(conf *DeviceConfig) (*DeviceSetting, error) {
-	var request bytes.Buffer
-
-	fmt.Fprintf(&request, "private_key=%s\n", conf.SecretKey)
+// peerEndpointResolveTimeout bounds the resolution of the hostname endpoints of the peers
+const peerEndpointResolveTimeout = 10 * time.Second
 
-	if conf.ListenPort != nil {
-		fmt.Fprintf(&request, "listen_port=%d\n", *conf.ListenPort)
+// CreateIPCRequest serialize the config into an IPC request and DeviceSetting.
+// Peers are written ordered by public key, so the request does not depend on their order.
+// No name is resolved, a peer whose hostname endpoint is not resolved yet is written
+// without endpoint, see StartWireguard
+func CreateIPCRequest(conf *DeviceConfig) (*DeviceSetting, error) {
+	fields, err := CreateIPCFields(conf)
+	if err != nil {
+		return nil, err
 	}
 
-	if conf.ASecConfig != nil {
-		aSecConfig := conf.ASecConfig
+	setting := &DeviceSetting{
+		IpcRequest:    fields.Serialize(),
+		IPC:           fields,
+		DNS:           conf.DNS,
+		SearchDomains: conf.DNSSearchDomains,
+		DeviceAddr:    conf.Endpoint,
+		MTU:           conf.MTU,
+	}
+	return setting, nil
+}
 
-		var aSecBuilder strings.Builder
+// resolvePeerEndpoints returns a copy of conf with the hostname endpoints of the peers resolved
+// with PeerEndpointResolver. Without a resolver, the endpoints ParseConfig already resolved are
+// kept and the others are resolved with net.DefaultResolver. conf is not modified
+func resolvePeerEndpoints(ctx context.Context, conf *DeviceConfig) (*DeviceConfig, error) {
+	ctx, cancel := context.WithTimeout(ctx, peerEndpointResolveTimeout)
+	defer cancel()
 
-		if aSecConfig.hasJunkPacketCount {
-			fmt.Fprintf(&aSecBuilder, "jc=%d\n", aSecConfig.junkPacketCount)
+	resolver := conf.PeerEndpointResolver
+	peers := slices.Clone(conf.Peers)
+	for i, peer := range conf.Peers {
+		if peer.EndpointHost == "" || (resolver == nil && peer.Endpoint != nil) {
+			continue
 		}
-		if aSecConfig.hasJunkPacketMinSize {
-			fmt.Fprintf(&aSecBuilder, "jmin=%d\n", aSecConfig.junkPacketMinSize)
+		host, port, err := net.SplitHostPort(peer.EndpointHost)
+		if err != nil {
+			return nil, err
 		}
-		if aSecConfig.hasJunkPacketMaxSize {
-			fmt.Fprintf(&aSecBuilder, "jmax=%d\n", aSecConfig.junkPacketMaxSize)
+		lookup := resolver
+		if lookup == nil {
+			lookup = net.DefaultResolver
 		}
-		if aSecConfig.hasInitPacketJunkSize {
-			fmt.Fprintf(&aSecBuilder, "s1=%d\n", aSecConfig.initPacketJunkSize)
+		addrs, err := lookup.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, fmt.Errorf("resolve endpoint %s: %w", peer.EndpointHost, err)
 		}
-		if aSecConfig.hasResponsePacketJunkSize {
-			fmt.Fprintf(&aSecBuilder, "s2=%d\n", aSecConfig.responsePacketJunkSize)
+		if len(addrs) == 0 {
+			return nil, errors.New("no address found for endpoint " + peer.EndpointHost)
 		}
-		if aSecConfig.hasCookieReplyPacketJunkSize {
-			fmt.Fprintf(&aSecBuilder, "s3=%d\n", aSecConfig.cookieReplyPacketJunkSize)
+
+		endpoint := net.JoinHostPort(addrs[0].Unmap().String(), port)
+		peers[i].Endpoint = &endpoint
+	}
+
+	resolved := *conf
+	resolved.Peers = peers
+	return &resolved, nil
+}
+
+// writePeerIPC writes the IPC lines configuring peer, see newPeerIPC
+func writePeerIPC(request *bytes.Buffer, peer PeerConfig, replaceAllowedIPs bool) {
+	newPeerIPC(peer, replaceAllowedIPs).writeTo(request)
+}
+
+// Reload applies conf to the running device without recreating it, e.g. from the
+// WatchConfig callback. Only the settings that changed are sent to the device, so
+// established sessions and connections through the tunnel are kept.
+// Address, DNS, MTU and UpstreamSOCKS5 are fixed when the tunnel is created and cannot be reloaded.
+// Removed AWG parameters are reset to the defaults of the device, except Jc, Jmin, Jmax and
+// I1-I5 which the device cannot reset and require a restart.
+// Conf is replaced by a copy of conf under ConfLock, conf is not retained
+func (d VirtualTun) Reload(conf *DeviceConfig) error {
+	conf, err := resolvePeerEndpoints(context.Background(), conf)
+	if err != nil {
+		return err
+	}
+	conf = conf.Clone()
+	if d.ConfLock != nil {
+		d.ConfLock.Lock()
+		defer d.ConfLock.Unlock()
+	}
+
+	if !slices.Equal(d.Conf.Endpoint, conf.Endpoint) || !slices.Equal(d.Conf.DNS, conf.DNS) ||
+		!slices.Equal(d.Conf.DNSSearchDomains, conf.DNSSearchDomains) || d.Conf.MTU != conf.MTU {
+		return errors.New("changing Address, DNS or MTU requires restarting the tunnel")
+	}
+	oldAuth, newAuth := d.Conf.UpstreamSOCKS5Auth, conf.UpstreamSOCKS5Auth
+	if d.Conf.UpstreamSOCKS5 != conf.UpstreamSOCKS5 || (oldAuth == nil) != (newAuth == nil) || (oldAuth != nil && *oldAuth != *newAuth) {
+		return errors.New("changing UpstreamSOCKS5 requires restarting the tunnel")
+	}
+
+	var request bytes.Buffer
+	if conf.SecretKey != d.Conf.SecretKey {
+		fmt.Fprintf(&request, "private_key=%s\n", conf.SecretKey)
+	}
+	// setting listen_port rebinds the socket even if the port is the same
+	if conf.ListenPort != nil && (d.Conf.ListenPort == nil || *d.Conf.ListenPort != *conf.ListenPort) {
+		fmt.Fprintf(&request, "listen_port=%d\n", *conf.ListenPort)
+	}
+	if oldFields, newFields := d.Conf.ASecConfig.setFields(), conf.ASecConfig.setFields(); !slices.Equal(oldFields, newFields) {
+		// a parameter removed from the configuration is reset to the default of the device
+		for _, field := range oldFields {
+			if !field.uapi() || slices.ContainsFunc(newFields, func(f awgField) bool { return f.key == field.key }) {
+				continue
+			}
+			value, ok := awgDeviceDefaults[field.key]
+			if !ok {
+				return errors.New("removing " + field.key + " requires restarting the tunnel")
+			}
+			fmt.Fprintf(&request, "%s=%s\n", strings.ToLower(field.key), value)
 		}
-		if aSecConfig.hasTransportPacketJunkSize {
-			fmt.Fprintf(&aSecBuilder, "s4=%d\n", aSecConfig.transportPacketJunkSize)
+		for _, field := range newFields {
+			if field.uapi() {
+				fmt.Fprintf(&request, "%s=%s\n", strings.ToLower(field.key), field.value)
+			}
 		}
-		if aSecConfig.hasInitPacketMagicHeader {
-			fmt.Fprintf(&aSecBuilder, 
-				"h1=%s\n",
-				formatMagicHeaderInterval(aSecConfig.initPacketMagicHeader, aSecConfig.initPacketMagicHeaderMax),
-			)
+	}
+
+	for _, peer := range d.Conf.Peers {
+		removed := !slices.ContainsFunc(conf.Peers, func(p PeerConfig) bool {
+			return p.PublicKey == peer.PublicKey
+		})
+		if removed {
+			fmt.Fprintf(&request, "public_key=%s\nremove=true\n", peer.PublicKey)
 		}
-		if aSecConfig.hasResponsePacketMagicHeader {
-			fmt.Fprintf(&aSecBuilder, 
-				"h2=%s\n",
-				formatMagicHeaderInterval(aSecConfig.responsePacketMagicHeader, aSecConfig.responsePacketMagicHeaderMax),
-			)
+	}
+	for _, peer := range conf.Peers {
+		unchanged := slices.ContainsFunc(d.Conf.Peers, func(p PeerConfig) bool {
+			return equalPeer(p, peer)
+		})
+		if !unchanged {
+			writePeerIPC(&request, peer, true)
 		}
-		if aSecConfig.hasUnderloadPacketMagicHeader {
-			fmt.Fprintf(&aSecBuilder, 
-				"h3=%s\n",
-				formatMagicHeaderInterval(aSecConfig.underloadPacketMagicHeader, aSecConfig.underloadPacketMagicHeaderMax),
-			)
+	}
+
+	if request.Len() > 0 {
+		if err := d.Dev.IpcSet(request.String()); err != nil {
+			return err
 		}
-		if aSecConfig.hasTransportPacketMagicHeader {
-			fmt.Fprintf(&aSecBuilder, 
-				"h4=%s\n",
-				formatMagicHeaderInterval(aSecConfig.transportPacketMagicHeader, aSecConfig.transportPacketMagicHeaderMax),
-			)
+	}
+
+	*d.Conf = *conf
+	if d.PeerIndex != nil {
+		clear(d.PeerIndex)
+		for key, i := range buildPeerIndex(conf.Peers) {
+			d.PeerIndex[key] = i
 		}
+	}
+	return nil
+}
+
+// ipcDevice is the part of *device.Device used to read and change peers through the IPC protocol
+type ipcDevice interface {
+	IpcSet(request string) error
+	IpcGet() (string, error)
+}
+
+// UpdatePeerAllowedIPs replaces the allowed IPs of the peer with the given base64 public key
+// on the running device, other peers and established sessions are not affected.
+// An empty allowedIPs removes all allowed IPs of the peer
+func (d VirtualTun) UpdatePeerAllowedIPs(publicKey string, allowedIPs []netip.Prefix) error {
+	key, err := encodeBase64ToHex(publicKey)
+	if err != nil {
+		return err
+	}
+	if d.ConfLock != nil {
+		d.ConfLock.Lock()
+		defer d.ConfLock.Unlock()
+	}
+
+	i := slices.IndexFunc(d.Conf.Peers, func(p PeerConfig) bool {
+		return p.PublicKey == key
+	})
+	if i < 0 {
+		return errors.New("no peer with public key " + publicKey)
+	}
+	if err := setPeerAllowedIPs(d.Dev, key, allowedIPs); err != nil {
+		return err
+	}
+
+	// Peers returned by GetPeer stay unchanged, the peers are replaced by an updated copy
+	peers := slices.Clone(d.Conf.Peers)
+	peers[i].AllowedIPs = slices.Clone(allowedIPs)
+	d.Conf.Peers = peers
+	return nil
+}
 
-		if aSecConfig.i1 != nil {
-			fmt.Fprintf(&aSecBuilder, "i1=%s\n", *aSecConfig.i1)
+// GetPeerAllowedIPs returns the allowed IPs of the peer with the given base64 public key
+// as currently applied to the device
+func (d VirtualTun) GetPeerAllowedIPs(publicKey string) ([]netip.Prefix, error) {
+	key, err := encodeBase64ToHex(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedIPs, found, err := getPeerAllowedIPs(d.Dev, key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("no peer with public key " + publicKey)
+	}
+	return allowedIPs, nil
+}
+
+// setPeerAllowedIPs sends the IPC request replacing the allowed IPs of the peer with the hex public key
+func setPeerAllowedIPs(dev ipcDevice, publicKey string, allowedIPs []netip.Prefix) error {
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "public_key=%s\nupdate_only=true\nreplace_allowed_ips=true\n", publicKey)
+	for _, prefix := range allowedIPs {
+		fmt.Fprintf(&request, "allowed_ip=%s\n", prefix.String())
+	}
+	return dev.IpcSet(request.String())
+}
+
+// getPeerAllowedIPs reads the allowed IPs of the peer with the hex public key from the IPC state,
+// found reports whether the device has the peer
+func getPeerAllowedIPs(dev ipcDevice, publicKey string) (allowedIPs []netip.Prefix, found bool, err error) {
+	state, err := dev.IpcGet()
+	if err != nil {
+		return nil, false, err
+	}
+
+	allowedIPs = []netip.Prefix{}
+	for _, line := range strings.Split(state, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
 		}
-		if aSecConfig.i2 != nil {
-			fmt.Fprintf(&aSecBuilder, "i2=%s\n", *aSecConfig.i2)
+		switch key {
+		case "public_key":
+			if found {
+				return allowedIPs, true, nil
+			}
+			found = value == publicKey
+		case "allowed_ip":
+			if !found {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, false, err
+			}
+			allowedIPs = append(allowedIPs, prefix)
 		}
-		if aSecConfig.i3 != nil {
-			fmt.Fprintf(&aSecBuilder, "i3=%s\n", *aSecConfig.i3)
+	}
+
+	if !found {
+		return nil, false, nil
+	}
+	return allowedIPs, true, nil
+}
+
+// Hash returns the SHA-256 of the canonical form of the configuration, see Equal.
+// Configurations with the same hash are Equal, invalid ones included
+func (conf *DeviceConfig) Hash() [32]byte {
+	return sha256.Sum256(conf.canonicalForm())
+}
+
+// Equal reports whether both configurations are the same once normalized: AWG parameters
+// are compared by the values that are set, peers regardless of their order and an all-zero
+// preshared key is the same as none. PeerEndpointResolver, EnableHooks and InterfaceName
+// are runtime options and are not compared
+func (conf *DeviceConfig) Equal(other *DeviceConfig) bool {
+	if conf == nil || other == nil {
+		return conf == other
+	}
+	return bytes.Equal(conf.canonicalForm(), other.canonicalForm())
+}
+
+// canonicalForm writes the fields compared by Equal one per line, strings quoted
+func (conf *DeviceConfig) canonicalForm() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "private_key=%q\n", conf.SecretKey)
+	fmt.Fprintf(&buf, "address=%s\n", joinAddrs(conf.Endpoint))
+	fmt.Fprintf(&buf, "dynamic_address=%t\n", conf.DynamicAddress)
+	fmt.Fprintf(&buf, "dns=%s\n", joinAddrs(conf.DNS))
+	fmt.Fprintf(&buf, "dns_search=%q\n", conf.DNSSearchDomains)
+	fmt.Fprintf(&buf, "mtu=%d\n", conf.MTU)
+	if conf.ListenPort != nil {
+		fmt.Fprintf(&buf, "listen_port=%d\n", *conf.ListenPort)
+	}
+	if conf.RouteTable != nil {
+		fmt.Fprintf(&buf, "table=%q\n", *conf.RouteTable)
+	}
+	fmt.Fprintf(&buf, "check_alive=%s\n", joinAddrs(conf.CheckAlive))
+	fmt.Fprintf(&buf, "check_alive_interval=%d\n", conf.CheckAliveInterval)
+	for _, field := range conf.ASecConfig.setFields() {
+		fmt.Fprintf(&buf, "%s=%s\n", strings.ToLower(field.key), field.value)
+	}
+	fmt.Fprintf(&buf, "post_up=%q\n", conf.PostUp)
+	fmt.Fprintf(&buf, "post_down=%q\n", conf.PostDown)
+	fmt.Fprintf(&buf, "upstream_socks5=%q\n", conf.UpstreamSOCKS5)
+	if conf.UpstreamSOCKS5Auth != nil {
+		fmt.Fprintf(&buf, "upstream_socks5_auth=%q:%q\n", conf.UpstreamSOCKS5Auth.Username, conf.UpstreamSOCKS5Auth.Password)
+	}
+	for _, key := range slices.Sorted(maps.Keys(conf.Comments)) {
+		fmt.Fprintf(&buf, "comment[%q]=%q\n", key, conf.Comments[key])
+	}
+
+	for _, peer := range sortedPeers(conf.Peers) {
+		fmt.Fprintf(&buf, "public_key=%q\n", peer.PublicKey)
+		if peer.hasPresharedKey() {
+			fmt.Fprintf(&buf, "preshared_key=%q\n", peer.PreSharedKey)
 		}
-		if aSecConfig.i4 != nil {
-			fmt.Fprintf(&aSecBuilder, "i4=%s\n", *aSecConfig.i4)
+		if peer.Endpoint != nil {
+			fmt.Fprintf(&buf, "endpoint=%q\n", *peer.Endpoint)
 		}
-		if aSecConfig.i5 != nil {
-			fmt.Fprintf(&aSecBuilder, "i5=%s\n", *aSecConfig.i5)
+		fmt.Fprintf(&buf, "endpoint_host=%q\n", peer.EndpointHost)
+		fmt.Fprintf(&buf, "persistent_keepalive_interval=%d\n", peer.KeepAlive)
+		fmt.Fprintf(&buf, "allowed_ip=%s\n", joinPrefixes(peer.AllowedIPs))
+		for _, key := range slices.Sorted(maps.Keys(peer.Comments)) {
+			fmt.Fprintf(&buf, "comment[%q]=%q\n", key, peer.Comments[key])
 		}
+	}
+	return buf.Bytes()
+}
+
+// equalPeer reports whether both peers are configured the same way on the device
+func equalPeer(a, b PeerConfig) bool {
+	if (a.Endpoint == nil) != (b.Endpoint == nil) || (a.Endpoint != nil && *a.Endpoint != *b.Endpoint) {
+		return false
+	}
+	if a.hasPresharedKey() != b.hasPresharedKey() || (a.hasPresharedKey() && a.PreSharedKey != b.PreSharedKey) {
+		return false
+	}
+	return a.PublicKey == b.PublicKey &&
+		a.KeepAlive == b.KeepAlive &&
+		slices.Equal(a.AllowedIPs, b.AllowedIPs)
+}
+
+// Clone returns a deep copy of the configuration. A goroutine that changes a configuration
+// in use, such as a reload, should change a Clone and publish it instead of mutating it
+func (conf *DeviceConfig) Clone() *DeviceConfig {
+	if conf == nil {
+		return nil
+	}
 
-		request.WriteString(aSecBuilder.String())
+	n := *conf
+	n.Endpoint = slices.Clone(conf.Endpoint)
+	n.DNS = slices.Clone(conf.DNS)
+	n.DNSSearchDomains = slices.Clone(conf.DNSSearchDomains)
+	n.CheckAlive = slices.Clone(conf.CheckAlive)
+	n.PostUp = slices.Clone(conf.PostUp)
+	n.PostDown = slices.Clone(conf.PostDown)
+	n.ListenPort = clonePtr(conf.ListenPort)
+	n.RouteTable = clonePtr(conf.RouteTable)
+	n.UpstreamSOCKS5Auth = clonePtr(conf.UpstreamSOCKS5Auth)
+	n.ASecConfig = conf.ASecConfig.Clone()
+	n.Comments = cloneComments(conf.Comments)
+	n.Peers = slices.Clone(conf.Peers)
+	for i := range n.Peers {
+		n.Peers[i].Endpoint = clonePtr(conf.Peers[i].Endpoint)
+		n.Peers[i].AllowedIPs = slices.Clone(conf.Peers[i].AllowedIPs)
+		n.Peers[i].Comments = cloneComments(conf.Peers[i].Comments)
+	}
+	return &n
+}
+
+// cloneComments returns a deep copy of the comments of a section
+func cloneComments(comments map[string][]string) map[string][]string {
+	if comments == nil {
+		return nil
+	}
+	n := make(map[string][]string, len(comments))
+	for key, lines := range comments {
+		n[key] = slices.Clone(lines)
+	}
+	return n
+}
+
+// sortedPeers returns a copy of peers ordered by public key
+func sortedPeers(peers []PeerConfig) []PeerConfig {
+	return slices.SortedStableFunc(slices.Values(peers), func(a, b PeerConfig) int {
+		return strings.Compare(a.PublicKey, b.PublicKey)
+	})
+}
+
+// ToWGSetConf serializes the config into the format accepted by `wg setconf`.
+// AWG parameters are not understood by `wg`, so they are emitted as comments
+func (conf *DeviceConfig) ToWGSetConf() string {
+	var buf strings.Builder
+
+	buf.WriteString("[Interface]\n")
+	fmt.Fprintf(&buf, "PrivateKey = %s\n", encodeHexToBase64(conf.SecretKey))
+	if conf.ListenPort != nil {
+		fmt.Fprintf(&buf, "ListenPort = %d\n", *conf.ListenPort)
+	}
+	if conf.ASecConfig != nil {
+		for _, field := range conf.ASecConfig.fields() {
+			fmt.Fprintf(&buf, "# %s = %s\n", field.key, field.value)
+		}
 	}
 
 	for _, peer := range conf.Peers {
-		fmt.Fprintf(&request, heredoc.Doc(`
-				public_key=%s
-				persistent_keepalive_interval=%d
-				preshared_key=%s
-			`),
-			peer.PublicKey, peer.KeepAlive, peer.PreSharedKey,
-		)
+		buf.WriteString("\n[Peer]\n")
+		fmt.Fprintf(&buf, "PublicKey = %s\n", encodeHexToBase64(peer.PublicKey))
+		if peer.hasPresharedKey() {
+			fmt.Fprintf(&buf, "PresharedKey = %s\n", encodeHexToBase64(peer.PreSharedKey))
+		}
 		if peer.Endpoint != nil {
-			fmt.Fprintf(&request, "endpoint=%s\n", *peer.Endpoint)
+			fmt.Fprintf(&buf, "Endpoint = %s\n", *peer.Endpoint)
+		}
+		if peer.KeepAlive > 0 {
+			fmt.Fprintf(&buf, "PersistentKeepalive = %d\n", peer.KeepAlive)
 		}
 
-		if len(peer.AllowedIPs) > 0 {
-			for _, ip := range peer.AllowedIPs {
-				fmt.Fprintf(&request, "allowed_ip=%s\n", ip.String())
-			}
-		} else {
-			request.WriteString(heredoc.Doc(`
-				allowed_ip=0.0.0.0/0
-				allowed_ip=::0/0
-			`))
+		allowedIPs := make([]string, 0, len(peer.AllowedIPs))
+		for _, prefix := range peer.AllowedIPs {
+			allowedIPs = append(allowedIPs, prefix.String())
+		}
+		if len(allowedIPs) == 0 {
+			allowedIPs = []string{"0.0.0.0/0", "::/0"}
 		}
+		fmt.Fprintf(&buf, "AllowedIPs = %s\n", strings.Join(allowedIPs, ", "))
 	}
 
-	setting := &DeviceSetting{IpcRequest: request.String(), DNS: conf.DNS, DeviceAddr: conf.Endpoint, MTU: conf.MTU}
-	return setting, nil
+	return buf.String()
 }
 
-// StartWireguard creates a tun interface on netstack given a configuration
-func StartWireguard(conf *DeviceConfig, logLevel int) (*VirtualTun, error) {
-	setting, err := CreateIPCRequest(conf)
+// StartWireguard creates a tun interface on netstack given a configuration.
+// The device is brought down and closed when ctx is cancelled, see VirtualTun.Wait
+func StartWireguard(ctx context.Context, conf *DeviceConfig, logLevel int) (*VirtualTun, error) {
+	resolved, err := resolvePeerEndpoints(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	setting, err := CreateIPCRequest(resolved)
 	if err != nil {
 		return nil, err
 	}
 
+	var detectedMTU int
+	if setting.MTU == 0 {
+		// through an upstream proxy, the direct path to the peers is not the one the packets take
+		if conf.UpstreamSOCKS5 != "" {
+			detectedMTU = defaultMTU
+		} else {
+			detectedMTU = detectTunnelMTU(resolved.Peers)
+		}
+		setting.MTU = detectedMTU
+	}
+
+	if conf.DynamicAddress {
+		setting.DeviceAddr = dynamicDeviceAddr(conf)
+	}
+
 	tun, tnet, err := netstack.CreateNetTUN(setting.DeviceAddr, setting.DNS, setting.MTU)
 	if err != nil {
 		return nil, err
 	}
-	dev := device.NewDevice(tun, conn.NewDefaultBind(), device.NewLogger(logLevel, ""))
+	bind := conn.NewDefaultBind()
+	if conf.UpstreamSOCKS5 != "" {
+		bind = newSOCKS5UpstreamBind(conf.UpstreamSOCKS5, conf.UpstreamSOCKS5Auth)
+	}
+	dev := device.NewDevice(tun, bind, device.NewLogger(logLevel, ""))
 	err = dev.IpcSet(setting.IpcRequest)
 	if err != nil {
+		dev.Close()
 		return nil, err
 	}
 
 	err = dev.Up()
 	if err != nil {
+		dev.Close()
 		return nil, err
 	}
 
-	return &VirtualTun{
-		Tnet:           tnet,
-		Dev:            dev,
-		Conf:           conf,
-		SystemDNS:      len(setting.DNS) == 0,
-		PingRecord:     make(map[string]uint64),
-		PingRecordLock: new(sync.Mutex),
-	}, nil
+	postDown := conf.PostDown
+	interfaceName := conf.InterfaceName
+	if interfaceName == "" {
+		interfaceName = defaultInterfaceName
+	}
+	if conf.EnableHooks {
+		if err := RunHooks(conf.PostUp, interfaceName); err != nil {
+			dev.Close()
+			return nil, err
+		}
+	} else if len(conf.PostUp) > 0 || len(conf.PostDown) > 0 {
+		errorLogger.Printf("Warning: PostUp and PostDown are ignored, hooks are not enabled\n")
+		postDown = nil
+	}
+
+	vt := &VirtualTun{
+		Tnet:              tnet,
+		Dev:               dev,
+		Conf:              conf,
+		ConfLock:          new(sync.RWMutex),
+		SystemDNS:         len(setting.DNS) == 0,
+		PingRecord:        make(map[string]pingRecordEntry),
+		PingRecordLock:    new(sync.Mutex),
+		PingRecordExpiry:  defaultPingRecordExpiry,
+		LatencyRecord:     make(map[string]time.Duration),
+		LatencyRecordLock: new(sync.Mutex),
+		PeerIndex:         buildPeerIndex(conf.Peers),
+		HandshakeMaxAge:   defaultHandshakeMaxAge,
+		DetectedMTU:       detectedMTU,
+		DialDNSTTL:        dnsCacheTTL,
+		DialDNSMaxEntries: dnsCacheMaxSize,
+		dns:               &tunnelDNS{searchDomains: setting.SearchDomains},
+		dialDNS:           &dialDNS{},
+		shutdown:          &tunnelShutdown{done: make(chan struct{})},
+	}
+	vt.StartPingRecordExpiry()
+
+	go func() {
+		defer close(vt.shutdown.done)
+		select {
+		case <-ctx.Done():
+			vt.shutdown.err = errors.Join(dev.Down(), RunHooks(postDown, interfaceName))
+			dev.Close()
+		case <-dev.Wait():
+		}
+	}()
+
+	return vt, nil
+}
+
+// tunnelShutdown reports the end of the goroutine closing the device of a VirtualTun
+type tunnelShutdown struct {
+	done chan struct{}
+	err  error // written before done is closed
+}
+
+// Wait blocks until the device is closed, either because the context given to
+// StartWireguard was cancelled or because it was closed directly, and returns
+// the error of bringing the device down
+func (d VirtualTun) Wait() error {
+	if d.shutdown == nil {
+		return errors.New("tunnel was not started by StartWireguard")
+	}
+	<-d.shutdown.done
+	return d.shutdown.err
 }
@@ -0,0 +1,646 @@
+package wireproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amnezia-vpn/amneziawg-go/device"
+)
+
+// freeUDPPort returns a local UDP port that was free at the time of the call
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// newTestTunnelPair starts two tunnels peered with each other over loopback
+func newTestTunnelPair(t *testing.T) (*DeviceConfig, *VirtualTun, *VirtualTun) {
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	endpointA, endpointB := "127.0.0.1:"+strconv.Itoa(portA), "127.0.0.1:"+strconv.Itoa(portB)
+	const zeroKey = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	confA := &DeviceConfig{
+		SecretKey:  "280af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b7d",
+		Endpoint:   []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		MTU:        1420,
+		ListenPort: &portA,
+		Peers: []PeerConfig{{
+			PublicKey:    "29b5eff4426f4a6ea5913c43e5b325bad76d1fb149c833bf14ad4eb2e17e3e42",
+			PreSharedKey: zeroKey,
+			Endpoint:     &endpointB,
+			AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")},
+		}},
+	}
+	confB := &DeviceConfig{
+		SecretKey:  "78c2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c",
+		Endpoint:   []netip.Addr{netip.MustParseAddr("10.0.0.2")},
+		MTU:        1420,
+		ListenPort: &portB,
+		Peers: []PeerConfig{{
+			PublicKey:    "4d8825e9043bded9462a2695e7357bd355ea23e33a286a14248f640be9f8b949",
+			PreSharedKey: zeroKey,
+			Endpoint:     &endpointA,
+			AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+		}},
+	}
+
+	vtA, err := StartWireguard(context.Background(), confA, device.LogLevelSilent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(vtA.Dev.Close)
+	vtB, err := StartWireguard(context.Background(), confB, device.LogLevelSilent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(vtB.Dev.Close)
+
+	return confA, vtA, vtB
+}
+
+func TestVirtualTunReloadKeepsConnections(t *testing.T) {
+	confA, vtA, vtB := newTestTunnelPair(t)
+
+	listener, err := vtB.ListenTCP("10.0.0.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := vtA.Tnet.Dial("tcp", "10.0.0.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	echo := func(message string) {
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, len(message))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != message {
+			t.Fatalf("unexpected echo %q", reply)
+		}
+	}
+
+	echo("before reload")
+
+	reloaded := *confA
+	reloaded.Peers = append([]PeerConfig(nil), confA.Peers...)
+	if err := vtA.Reload(&reloaded); err != nil {
+		t.Fatal(err)
+	}
+
+	echo("after reload")
+}
+
+func TestVirtualTunReloadRejectsAddressChange(t *testing.T) {
+	confA, vtA, _ := newTestTunnelPair(t)
+
+	changed := *confA
+	changed.Endpoint = []netip.Addr{netip.MustParseAddr("10.0.0.3")}
+	if err := vtA.Reload(&changed); err == nil {
+		t.Fatal("changing the address should require a restart")
+	}
+}
+
+func TestVirtualTunReloadRemovesAWGParameters(t *testing.T) {
+	confA, vtA, _ := newTestTunnelPair(t)
+
+	withAWG := func(section string) *DeviceConfig {
+		t.Helper()
+		iniData, err := loadIniConfig("[Interface]\n" + section)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aSecConfig, err := ParseASecConfig(iniData.Section("Interface"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		changed := confA.Clone()
+		changed.ASecConfig = aSecConfig
+		return changed
+	}
+	deviceState := func() string {
+		t.Helper()
+		state, err := vtA.Dev.IpcGet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state
+	}
+
+	if err := vtA.Reload(withAWG("S3 = 20\nS4 = 30\nH1 = 100-101\n")); err != nil {
+		t.Fatal(err)
+	}
+	if state := deviceState(); !strings.Contains(state, "s3=20\n") || !strings.Contains(state, "h1=100-101\n") {
+		t.Fatalf("AWG parameters should be applied, got:\n%s", state)
+	}
+
+	if err := vtA.Reload(withAWG("S4 = 30\n")); err != nil {
+		t.Fatal(err)
+	}
+	state := deviceState()
+	if strings.Contains(state, "s3=") || !strings.Contains(state, "s4=30\n") || !strings.Contains(state, "h1=1\n") {
+		t.Fatalf("removed AWG parameters should be reset to the device defaults, got:\n%s", state)
+	}
+
+	if err := vtA.Reload(withAWG("Jc = 5\nS4 = 30\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := vtA.Reload(withAWG("S4 = 30\n")); err == nil {
+		t.Fatal("removing Jc should require a restart")
+	}
+	if !strings.Contains(deviceState(), "jc=5\n") || !confA.ASecConfig.hasJunkPacketCount {
+		t.Fatal("rejected reload should keep the device and the configuration unchanged")
+	}
+}
+
+// fakeIPCDevice records IPC requests and answers IpcGet with a fixed state
+type fakeIPCDevice struct {
+	requests []string
+	state    string
+}
+
+func (f *fakeIPCDevice) IpcSet(request string) error {
+	f.requests = append(f.requests, request)
+	return nil
+}
+
+func (f *fakeIPCDevice) IpcGet() (string, error) {
+	return f.state, nil
+}
+
+func TestPeerAllowedIPsIPC(t *testing.T) {
+	const keyA = "7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c"
+	const keyB = "4879e1e02d9a0d7869d608c8a9c786849ae138b49e35872a58b29c627ce3d345"
+
+	dev := &fakeIPCDevice{}
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("fd00::/64")}
+	if err := setPeerAllowedIPs(dev, keyB, prefixes); err != nil {
+		t.Fatal(err)
+	}
+	want := "public_key=" + keyB + "\nupdate_only=true\nreplace_allowed_ips=true\nallowed_ip=10.0.0.0/24\nallowed_ip=fd00::/64\n"
+	if len(dev.requests) != 1 || dev.requests[0] != want {
+		t.Fatalf("unexpected IPC request %q", dev.requests)
+	}
+
+	dev.state = "private_key=" + keyA + "\nlisten_port=51820\n" +
+		"public_key=" + keyA + "\nallowed_ip=0.0.0.0/0\n" +
+		"public_key=" + keyB + "\nendpoint=127.0.0.1:51820\nallowed_ip=10.0.0.0/24\nallowed_ip=fd00::/64\nprotocol_version=1\n"
+	allowedIPs, found, err := getPeerAllowedIPs(dev, keyB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !reflect.DeepEqual(allowedIPs, prefixes) {
+		t.Fatalf("unexpected allowed IPs %v", allowedIPs)
+	}
+
+	dev.state = "public_key=" + keyB + "\nprotocol_version=1\n"
+	if allowedIPs, found, err := getPeerAllowedIPs(dev, keyB); err != nil || !found || len(allowedIPs) != 0 {
+		t.Fatalf("peer without allowed IPs expected, got %v, %v, %v", allowedIPs, found, err)
+	}
+	if _, found, err := getPeerAllowedIPs(dev, keyA); err != nil || found {
+		t.Fatal("unknown peer should not be found")
+	}
+}
+
+func TestVirtualTunUpdatePeerAllowedIPs(t *testing.T) {
+	confA, vtA, _ := newTestTunnelPair(t)
+	const peerKey = "KbXv9EJvSm6lkTxD5bMlutdtH7FJyDO/FK1OsuF+PkI="
+
+	before, err := vtA.GetPeer(peerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// readers of the configuration run while the allowed IPs change
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if peer, err := vtA.GetPeer(peerKey); err != nil || len(peer.AllowedIPs) == 0 {
+				t.Errorf("unexpected peer %+v, %v", peer, err)
+				return
+			}
+		}
+	}()
+	prefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32"), netip.MustParsePrefix("192.168.1.0/24")}
+	for i := 0; i < 10; i++ {
+		if err := vtA.UpdatePeerAllowedIPs(peerKey, prefixes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+	if len(before.AllowedIPs) != 1 {
+		t.Fatalf("peer returned before the update should not change, got %v", before.AllowedIPs)
+	}
+
+	allowedIPs, err := vtA.GetPeerAllowedIPs(peerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(allowedIPs, prefixes) {
+		t.Fatalf("unexpected allowed IPs %v", allowedIPs)
+	}
+	if !reflect.DeepEqual(confA.Peers[0].AllowedIPs, prefixes) {
+		t.Fatalf("configuration should be updated, got %v", confA.Peers[0].AllowedIPs)
+	}
+
+	if err := vtA.UpdatePeerAllowedIPs("SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=", prefixes); err == nil {
+		t.Fatal("unknown peer should be rejected")
+	}
+	if _, err := vtA.GetPeerAllowedIPs("SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U="); err == nil {
+		t.Fatal("unknown peer should be rejected")
+	}
+}
+
+func TestCreateIPCRequestPeerOrderingStability(t *testing.T) {
+	endpoint := "94.140.11.15:51820"
+	peerA := PeerConfig{
+		PublicKey:    "7bc2ca01cf9ff71133abd02befe31f291aecfa067fe32cefa5124b449fd5275c",
+		PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
+		Endpoint:     &endpoint,
+		KeepAlive:    25,
+		AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")},
+	}
+	peerB := PeerConfig{
+		PublicKey:    "4879e1e02d9a0d7869d608c8a9c786849ae138b49e35872a58b29c627ce3d345",
+		PreSharedKey: "0000000000000000000000000000000000000000000000000000000000000000",
+		AllowedIPs:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+	newConf := func(peers ...PeerConfig) *DeviceConfig {
+		return &DeviceConfig{
+			SecretKey: "2c0af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b3d",
+			Endpoint:  []netip.Addr{netip.MustParseAddr("10.5.0.2")},
+			MTU:       1420,
+			Peers:     peers,
+		}
+	}
+	forward, reverse := newConf(peerA, peerB), newConf(peerB, peerA)
+
+	forwardRequest, err := CreateIPCRequest(forward)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverseRequest, err := CreateIPCRequest(reverse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forwardRequest.IpcRequest != reverseRequest.IpcRequest {
+		t.Fatalf("IPC requests should not depend on peer order:\n%s\n%s", forwardRequest.IpcRequest, reverseRequest.IpcRequest)
+	}
+	if !forward.Equal(reverse) || forward.Hash() != reverse.Hash() {
+		t.Fatal("configurations with reordered peers should be equal")
+	}
+	if forward.Peers[0].PublicKey != peerA.PublicKey {
+		t.Fatal("CreateIPCRequest should not reorder the peers of the configuration")
+	}
+}
+
+func TestCreateIPCRequestFields(t *testing.T) {
+	iniData, err := loadIniConfig(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+ListenPort = 51820
+Jc = 5
+Jmin = 10
+Jmax = 50
+H1 = 100-200
+
+[Peer]
+PublicKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+PresharedKey = SHnh4C2aDXhp1gjIqceGhJrhOLSeNYcqWLKcYnzj00U=
+AllowedIPs = 10.0.0.0/8
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+PersistentKeepalive = 25`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := parseDeviceConfig(iniData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setting, err := CreateIPCRequest(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := setting.IPC
+	if fields.PrivateKey != conf.SecretKey || fields.ListenPort == nil || *fields.ListenPort != 51820 {
+		t.Fatalf("unexpected interface fields %+v", fields)
+	}
+	if fields.AWG == nil || *fields.AWG.Jc != 5 || *fields.AWG.Jmax != 50 || *fields.AWG.H1 != "100-200" || fields.AWG.S1 != nil {
+		t.Fatalf("unexpected AWG fields %+v", fields.AWG)
+	}
+	if len(fields.Peers) != 2 {
+		t.Fatalf("expected 2 peers, got %d", len(fields.Peers))
+	}
+	first, second := fields.Peers[0], fields.Peers[1]
+	if first.PublicKey != "4879e1e02d9a0d7869d608c8a9c786849ae138b49e35872a58b29c627ce3d345" || first.PresharedKey != first.PublicKey {
+		t.Fatalf("peers should be ordered by public key with their preshared key, got %+v", first)
+	}
+	if !reflect.DeepEqual(first.AllowedIPs, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}) || first.Endpoint != nil {
+		t.Fatalf("unexpected first peer %+v", first)
+	}
+	if second.Endpoint == nil || *second.Endpoint != "94.140.11.15:51820" || second.PersistentKeepalive != 25 || second.PresharedKey != "" {
+		t.Fatalf("unexpected second peer %+v", second)
+	}
+	if len(second.AllowedIPs) != 2 || second.AllowedIPs[1] != netip.MustParsePrefix("::/0") {
+		t.Fatalf("missing AllowedIPs should default to all addresses, got %v", second.AllowedIPs)
+	}
+	if second.ReplaceAllowedIPs {
+		t.Fatal("allowed IPs should only be replaced on reload")
+	}
+
+	if setting.IpcRequest != fields.Serialize() {
+		t.Fatal("IpcRequest should be the serialized fields")
+	}
+	second.PersistentKeepalive = 0
+	fields.Peers = []PeerIPC{second}
+	fields.AWG = nil
+	want := "private_key=" + conf.SecretKey + "\nlisten_port=51820\n" +
+		"public_key=" + second.PublicKey + "\npersistent_keepalive_interval=0\nendpoint=94.140.11.15:51820\n" +
+		"allowed_ip=0.0.0.0/0\nallowed_ip=::/0\n"
+	if got := fields.Serialize(); got != want {
+		t.Fatalf("modified fields serialized as %q, want %q", got, want)
+	}
+}
+
+func TestDeviceConfigClone(t *testing.T) {
+	conf, err := ParseTemplate(`
+[Interface]
+PrivateKey = LAr1aNSNF9d0MjwUgAVC4020T0N/E5NUtqVv5EnsSz0=
+Address = 10.5.0.2
+# resolver
+DNS = 1.1.1.1
+ListenPort = 51820
+CheckAlive = 1.1.1.1
+Jc = 5
+H1 = 100-200
+I1 = <b 0xA1B2C3D4E5F6><c>
+Mode = 1
+
+[Peer]
+PublicKey = e8LKAc+f9xEzq9Ar7+MfKRrs+gZ/4yzvpRJLRJ/VJ1w=
+Endpoint = 94.140.11.15:51820
+AllowedIPs = 0.0.0.0/0
+`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := conf.Clone()
+	if !reflect.DeepEqual(conf, clone) {
+		t.Fatal("clone should be equal to the original")
+	}
+
+	*clone.ListenPort = 1
+	clone.DNS[0] = netip.MustParseAddr("9.9.9.9")
+	*clone.ASecConfig.i1 = "<c>"
+	*clone.ASecConfig.mode = 2
+	clone.ASecConfig.junkPacketCount = 6
+	*clone.Peers[0].Endpoint = "127.0.0.1:1"
+	clone.Peers[0].AllowedIPs[0] = netip.MustParsePrefix("10.0.0.0/8")
+	clone.Comments["interface.dns"][0] = "# changed"
+
+	if *conf.ListenPort != 51820 || conf.DNS[0] != netip.MustParseAddr("1.1.1.1") ||
+		*conf.ASecConfig.i1 != "<b 0xA1B2C3D4E5F6><c>" || *conf.ASecConfig.mode != 1 ||
+		conf.ASecConfig.junkPacketCount != 5 || *conf.Peers[0].Endpoint != "94.140.11.15:51820" ||
+		conf.Peers[0].AllowedIPs[0] != netip.MustParsePrefix("0.0.0.0/0") ||
+		conf.Comments["interface.dns"][0] != "# resolver" {
+		t.Fatal("changing the clone should not change the original")
+	}
+	if (*DeviceConfig)(nil).Clone() != nil || (*ASecConfigType)(nil).Clone() != nil {
+		t.Fatal("clone of nil should be nil")
+	}
+}
+
+func TestCreateIPCRequestConcurrentWithReload(t *testing.T) {
+	confA, vtA, _ := newTestTunnelPair(t)
+	publicKey := encodeHexToBase64(confA.Peers[0].PublicKey)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if _, err := CreateIPCRequest(vtA.Config()); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := vtA.GetPeer(publicKey); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 200; j++ {
+			next := vtA.Config()
+			next.Peers[0].AllowedIPs = []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")}
+			if j%2 == 1 {
+				next.Peers[0].AllowedIPs = append(next.Peers[0].AllowedIPs, netip.MustParsePrefix("10.0.0.3/32"))
+			}
+			if err := vtA.Reload(next); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+
+	if peer, err := vtA.GetPeer(publicKey); err != nil || len(peer.AllowedIPs) != 2 {
+		t.Fatalf("last reload should be applied, got %+v, %v", peer, err)
+	}
+}
+
+func TestDialWithLatency(t *testing.T) {
+	_, vtA, vtB := newTestTunnelPair(t)
+
+	listener, err := vtB.ListenTCP("10.0.0.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = conn.Write([]byte("hello"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, dialTime, err := vtA.DialWithLatency(ctx, "tcp", "10.0.0.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if dialTime <= 0 {
+		t.Fatal("dial time should be measured")
+	}
+
+	vtA.LatencyRecordLock.Lock()
+	_, recorded := vtA.LatencyRecord["10.0.0.2:8080"]
+	vtA.LatencyRecordLock.Unlock()
+	if recorded {
+		t.Fatal("latency should only be recorded once the first byte is read")
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	vtA.LatencyRecordLock.Lock()
+	latency := vtA.LatencyRecord["10.0.0.2:8080"]
+	vtA.LatencyRecordLock.Unlock()
+	if latency < dialTime {
+		t.Fatalf("time to first byte %s should include the dial time %s", latency, dialTime)
+	}
+}
+
+func TestStartWireguardShutdownOnCancel(t *testing.T) {
+	port := freeUDPPort(t)
+	conf := &DeviceConfig{
+		SecretKey:  "280af568d48d17d774323c14800542e34db44f437f139354b6a56fe449ec4b7d",
+		Endpoint:   []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+		MTU:        1420,
+		ListenPort: &port,
+		Peers: []PeerConfig{{
+			PublicKey:  "29b5eff4426f4a6ea5913c43e5b325bad76d1fb149c833bf14ad4eb2e17e3e42",
+			AllowedIPs: []netip.Prefix{netip.MustParsePrefix("10.0.0.2/32")},
+		}},
+	}
+
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	vt, err := StartWireguard(ctx, conf, device.LogLevelSilent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := vt.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-vt.Dev.Wait():
+	default:
+		t.Fatal("device should be closed once Wait returns")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, %d before the start", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVirtualTunDialResolvesOnce(t *testing.T) {
+	_, vtA, vtB := newTestTunnelPair(t)
+
+	listener, err := vtB.ListenTCP("10.0.0.2:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}
+	}()
+
+	var lookups atomic.Int32
+	vtA.dialDNS.cache = newDNSCacheWithOptions(dnsCacheOptions{
+		TTL: time.Minute,
+		Lookup: func(host string) ([]net.IP, error) {
+			lookups.Add(1)
+			if host != "peer.internal" {
+				return nil, errors.New("unknown host " + host)
+			}
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		},
+	})
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := vtA.Dial(ctx, "tcp", "peer.internal:8080")
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reply, err := io.ReadAll(conn)
+		_ = conn.Close()
+		if err != nil || string(reply) != "ok" {
+			t.Fatalf("unexpected reply %q: %v", reply, err)
+		}
+	}
+	if n := lookups.Load(); n != 1 {
+		t.Fatalf("resolved address should be cached, got %d lookups", n)
+	}
+
+	// New DNS servers invalidate the cached addresses
+	if err := vtA.SetDNS([]netip.Addr{netip.MustParseAddr("10.0.0.2")}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := vtA.Dial(context.Background(), "tcp", "peer.internal:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if n := lookups.Load(); n != 2 {
+		t.Fatalf("SetDNS should flush the Dial cache, got %d lookups", n)
+	}
+
+	if _, err := vtA.Dial(context.Background(), "tcp", "other.internal:8080"); err == nil {
+		t.Fatal("unresolvable host should fail")
+	}
+}